@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the appendfsync policies: fsync after every write, once a second, or whenever the OS decides
+const (
+	aofFsyncAlways   = "always"
+	aofFsyncEverysec = "everysec"
+	aofFsyncNo       = "no"
+)
+
+// the append-only file is made of parts, kept in a directory of their own: a base file holding
+// the dataset as of the last rewrite, and incremental files logging the commands run since.
+// A manifest lists the parts to load, in order, each with a sequence number and type
+const (
+	aofBaseType = "b"
+	aofIncrType = "i"
+	// history files have been replaced by a rewrite, and are only listed until they're deleted
+	aofHistoryType = "h"
+)
+
+var errInvalidManifest = errors.New("invalid AOF manifest file format")
+
+// replicationOnlyCommands are sent to replicas without being logged, as they don't change
+// the dataset
+var replicationOnlyCommands = map[string]bool{"publish": true, "spublish": true, "replconf": true}
+
+type aofFileInfo struct {
+	name string
+	seq  int64
+	kind string
+}
+
+type aofManifest struct {
+	base  *aofFileInfo
+	incrs []*aofFileInfo
+}
+
+// files lists the parts in the order they're loaded
+func (m *aofManifest) files() []*aofFileInfo {
+	if m.base == nil {
+		return m.incrs
+	}
+	return append([]*aofFileInfo{m.base}, m.incrs...)
+}
+
+func (m *aofManifest) encode() []byte {
+	var buf []byte
+	for _, info := range m.files() {
+		buf = fmt.Appendf(buf, "file %s seq %d type %s\n", info.name, info.seq, info.kind)
+	}
+	return buf
+}
+
+// parseAOFManifest reads a manifest, one part per line as pairs of keys and values. Unknown
+// keys are ignored, as later versions may add some
+func parseAOFManifest(data []byte) (*aofManifest, error) {
+	m := &aofManifest{}
+	for line := range strings.SplitSeq(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, errInvalidManifest
+		}
+		info := &aofFileInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, errInvalidManifest
+				}
+				info.seq = seq
+			case "type":
+				info.kind = fields[i+1]
+			}
+		}
+		if info.name == "" || info.seq <= 0 || filepath.Base(info.name) != info.name {
+			return nil, errInvalidManifest
+		}
+
+		switch info.kind {
+		case aofBaseType:
+			if m.base != nil {
+				return nil, errors.New("found duplicate base file information in the AOF manifest")
+			}
+			m.base = info
+		case aofIncrType:
+			if len(m.incrs) > 0 && info.seq <= m.incrs[len(m.incrs)-1].seq {
+				return nil, errors.New("found a non-monotonic sequence number in the AOF manifest")
+			}
+			m.incrs = append(m.incrs, info)
+		case aofHistoryType:
+		default:
+			return nil, errInvalidManifest
+		}
+	}
+
+	if m.base == nil && len(m.incrs) == 0 {
+		return nil, errors.New("found an empty AOF manifest")
+	}
+	return m, nil
+}
+
+// appendOnlyState is the append-only file, which logs every write command so that the
+// dataset can be rebuilt by replaying them
+type appendOnlyState struct {
+	mu sync.Mutex
+	// fsync mirrors the appendfsync parameter, and growthPercentage and minRewriteSize the
+	// auto-aof-rewrite ones
+	fsync            string
+	growthPercentage int64
+	minRewriteSize   int64
+	// ready is set once the file has been loaded at startup; before that, enabling it only
+	// records that it should be loaded
+	ready bool
+
+	manifest         *aofManifest
+	baseSeq, incrSeq int64
+	// file is the incremental file being logged to, nil while disabled, and size its size
+	file *os.File
+	size int64
+	// selectedDB is the database the file last selected, or -1 to select one before the
+	// next command, as each file is replayed starting from database 0
+	selectedDB int
+	// currentSize is the size of every part, and rewriteBaseSize what it was after the last
+	// rewrite, for working out how much the file has grown
+	currentSize     int64
+	rewriteBaseSize int64
+
+	// pending holds the commands not yet written; after a failed write they're kept, to be
+	// retried, and writes are refused until they succeed
+	pending      []byte
+	lastWriteErr error
+
+	// enabling is set while the file is being turned on, until a background rewrite has written
+	// a base for enablingIncr, the incremental file logged to meanwhile, to follow on from
+	enabling     bool
+	enablingIncr *aofFileInfo
+
+	// rewriteGen is bumped whenever the parts are replaced wholesale, so that a background
+	// rewrite started before knows its snapshot is stale
+	rewriteGen          int
+	rewriting           bool
+	rewriteStart        time.Time
+	lastRewriteTry      time.Time
+	lastRewriteOK       bool
+	lastRewriteDuration time.Duration
+	rewrites            int
+}
+
+var aof = &appendOnlyState{fsync: aofFsyncEverysec, lastRewriteOK: true, lastRewriteDuration: -1}
+
+func appendOnlyDir() string {
+	return filepath.Join(filepath.Dir(configRDB["name"]), configRDB["appenddirname"])
+}
+
+func appendOnlyPath(name string) string {
+	return filepath.Join(appendOnlyDir(), name)
+}
+
+func manifestPath() string {
+	return appendOnlyPath(configRDB["appendfilename"] + ".manifest")
+}
+
+func writeManifest(m *aofManifest) error {
+	return replaceFile(manifestPath(), m.encode())
+}
+
+// nextBase names a new base file, in RDB format or as commands
+func (a *appendOnlyState) nextBase(rdbFormat bool) *aofFileInfo {
+	a.baseSeq++
+	format := "aof"
+	if rdbFormat {
+		format = "rdb"
+	}
+	name := fmt.Sprintf("%s.%d.base.%s", configRDB["appendfilename"], a.baseSeq, format)
+	return &aofFileInfo{name: name, seq: a.baseSeq, kind: aofBaseType}
+}
+
+// openNextIncr creates a new incremental file to log to
+func (a *appendOnlyState) openNextIncr() (*aofFileInfo, *os.File, error) {
+	a.incrSeq++
+	info := &aofFileInfo{
+		name: fmt.Sprintf("%s.%d.incr.aof", configRDB["appendfilename"], a.incrSeq),
+		seq:  a.incrSeq,
+		kind: aofIncrType,
+	}
+	file, err := os.OpenFile(appendOnlyPath(info.name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
+	return info, file, err
+}
+
+// adoptManifest picks up the manifest left on disk when the file wasn't loaded at startup,
+// while mu is held, so that new parts are numbered after its own and replace them
+func (a *appendOnlyState) adoptManifest() {
+	if a.manifest != nil {
+		return
+	}
+	data, err := os.ReadFile(manifestPath())
+	if err != nil {
+		return
+	}
+	m, err := parseAOFManifest(data)
+	if err != nil {
+		return
+	}
+
+	a.manifest = m
+	if m.base != nil {
+		a.baseSeq = max(a.baseSeq, m.base.seq)
+	}
+	if len(m.incrs) > 0 {
+		a.incrSeq = max(a.incrSeq, m.incrs[len(m.incrs)-1].seq)
+	}
+}
+
+// manifestSize adds up the size of every part a manifest lists
+func manifestSize(m *aofManifest) int64 {
+	size := int64(0)
+	for _, info := range m.files() {
+		if stat, err := os.Stat(appendOnlyPath(info.name)); err == nil {
+			size += stat.Size()
+		}
+	}
+	return size
+}
+
+func removeAppendOnlyFiles(files []*aofFileInfo) {
+	for _, info := range files {
+		if err := os.Remove(appendOnlyPath(info.name)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Warning: failed to remove the AOF file %s\n", info.name)
+		}
+	}
+}
+
+// feedAppendOnlyFile logs a command that changed a database, if the file is enabled
+func feedAppendOnlyFile(db int, array []string) {
+	if replicationOnlyCommands[strings.ToLower(array[0])] {
+		return
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.file == nil {
+		return
+	}
+	if db != aof.selectedDB {
+		aof.pending = append(aof.pending, encodeBulkArray([]string{"SELECT", strconv.Itoa(db)})...)
+		aof.selectedDB = db
+	}
+	aof.pending = append(aof.pending, encodeBulkArray(array)...)
+	if err := aof.write(); err != nil {
+		if aof.fsync == aofFsyncAlways {
+			// the command has been applied, but can no longer be made durable before replying
+			fmt.Println("Problem: can't recover from AOF write error when the AOF fsync policy is 'always', exiting")
+			os.Exit(1)
+		}
+		return
+	}
+	if aof.fsync == aofFsyncAlways {
+		if err := aof.file.Sync(); err != nil {
+			fmt.Println("Problem: can't persist AOF for fsync error when the AOF fsync policy is 'always', exiting")
+			os.Exit(1)
+		}
+	}
+}
+
+// write appends the pending commands to the file, while mu is held. A partial write is
+// truncated away, so the file never ends in half a command
+func (a *appendOnlyState) write() error {
+	if len(a.pending) == 0 {
+		return nil
+	}
+
+	n, err := a.file.Write(a.pending)
+	if err != nil && n > 0 {
+		if truncateErr := a.file.Truncate(a.size); truncateErr != nil {
+			// the partial command stays, so the rest of it is all that's left to write
+			a.size += int64(n)
+			a.currentSize += int64(n)
+			a.pending = a.pending[n:]
+		}
+	}
+	if err != nil {
+		if a.lastWriteErr == nil {
+			fmt.Printf("Problem: error writing to the AOF file: %v\n", err)
+		}
+		a.lastWriteErr = err
+		return err
+	}
+
+	if a.lastWriteErr != nil {
+		fmt.Println("Warning: AOF write error looks solved, Redis can write again")
+	}
+	a.size += int64(n)
+	a.currentSize += int64(n)
+	a.pending = nil
+	a.lastWriteErr = nil
+	return nil
+}
+
+// syncAppendOnlyFile runs in the background, retrying failed writes and, under the everysec
+// policy, flushing the file to disk once a second, so that at most a second of writes is lost
+func syncAppendOnlyFile() {
+	for range time.Tick(time.Second) {
+		aof.mu.Lock()
+		if aof.file != nil && aof.write() == nil && aof.fsync == aofFsyncEverysec {
+			if err := aof.file.Sync(); err != nil {
+				fmt.Println("Problem: failed to fsync the AOF file")
+			}
+		}
+		aof.mu.Unlock()
+	}
+}
+
+// flushAppendOnlyFile writes out and fsyncs whatever's been logged, e.g. before shutting down
+func flushAppendOnlyFile() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.file == nil {
+		return nil
+	}
+	if err := aof.write(); err != nil {
+		return err
+	}
+	return aof.file.Sync()
+}
+
+// rewriteAppendOnlyFile replaces every part with a new base file holding a snapshot of the
+// dataset, and a new incremental file to log to after it, while executionLock is held. It's
+// used where the current parts can't be carried on from: when the file is created at startup,
+// and after the dataset is replaced wholesale
+func rewriteAppendOnlyFile() error {
+	snapshot := takeSnapshot()
+	defer snapshot.release()
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.rewriteGen++
+	aof.adoptManifest()
+	if err := os.MkdirAll(appendOnlyDir(), 0755); err != nil {
+		return err
+	}
+	base := aof.nextBase(configRDB["aof-use-rdb-preamble"] == "yes")
+	content, err := encodeAppendOnlyBase(snapshot, configRDB["aof-use-rdb-preamble"] == "yes")
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(appendOnlyPath(base.name), content); err != nil {
+		return err
+	}
+	incr, file, err := aof.openNextIncr()
+	if err != nil {
+		removeAppendOnlyFiles([]*aofFileInfo{base})
+		return err
+	}
+	m := &aofManifest{base: base, incrs: []*aofFileInfo{incr}}
+	if err := writeManifest(m); err != nil {
+		file.Close()
+		removeAppendOnlyFiles(m.files())
+		return err
+	}
+
+	if aof.file != nil {
+		aof.file.Close()
+	}
+	if aof.manifest != nil {
+		removeAppendOnlyFiles(aof.manifest.files())
+	}
+	// a rewrite turning the file on is overtaken, and no longer needs its incremental file
+	if aof.enablingIncr != nil {
+		removeAppendOnlyFiles([]*aofFileInfo{aof.enablingIncr})
+	}
+	aof.enabling, aof.enablingIncr = false, nil
+	aof.manifest = m
+	aof.file, aof.size, aof.selectedDB = file, 0, -1
+	aof.currentSize = int64(len(content))
+	aof.rewriteBaseSize = aof.currentSize
+	aof.pending, aof.lastWriteErr = nil, nil
+	return nil
+}
+
+// startAppendOnlyFile turns the file on without blocking other commands, while executionLock is
+// held. Writes are logged to a new incremental file straight away, and a background rewrite
+// writes the base it follows on from; only once that's done does the manifest list them both.
+// If another rewrite is running, this one starts when it finishes
+func startAppendOnlyFile() error {
+	aof.mu.Lock()
+	aof.enabling = true
+	aof.mu.Unlock()
+
+	err := startBackgroundRewrite()
+	if err != nil && !errors.Is(err, errRewriteInProgress) {
+		aof.mu.Lock()
+		aof.enabling = false
+		aof.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// restartAppendOnlyFile recreates the file after the dataset was replaced wholesale, as
+// by a full resynchronisation with the master, while executionLock is held
+func restartAppendOnlyFile() error {
+	aof.mu.Lock()
+	enabled := aof.file != nil
+	aof.mu.Unlock()
+
+	if !enabled {
+		return nil
+	}
+	return rewriteAppendOnlyFile()
+}
+
+// stopAppendOnlyFile stops logging, flushing what's been logged so far
+func stopAppendOnlyFile() {
+	if err := flushAppendOnlyFile(); err != nil {
+		fmt.Println("Problem: failed to flush the AOF file")
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.file != nil {
+		aof.file.Close()
+	}
+	aof.file = nil
+	aof.pending = nil
+	aof.lastWriteErr = nil
+
+	// a rewrite still turning the file on just leaves a base behind
+	if aof.enablingIncr != nil {
+		removeAppendOnlyFiles([]*aofFileInfo{aof.enablingIncr})
+	}
+	aof.enabling, aof.enablingIncr = false, nil
+}
+
+// loadDataFromDisk loads the dataset at startup, before any connection is accepted. With the
+// append-only file enabled, it's rebuilt from that, as it's the more up to date, and logging
+// to it starts; if there isn't one yet, it's created from the RDB file
+func loadDataFromDisk() error {
+	defer func() {
+		aof.mu.Lock()
+		aof.ready = true
+		aof.mu.Unlock()
+	}()
+
+	if configRDB["appendonly"] != "yes" {
+		return loadRDBFile()
+	}
+	if err := upgradeAppendOnlyFile(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(manifestPath())
+	if os.IsNotExist(err) {
+		if err := loadRDBFile(); err != nil {
+			return err
+		}
+		executionLock.Lock()
+		defer executionLock.Unlock()
+		return rewriteAppendOnlyFile()
+	}
+	if err != nil {
+		return err
+	}
+	m, err := parseAOFManifest(data)
+	if err != nil {
+		return err
+	}
+
+	return loadAppendOnlyFiles(m)
+}
+
+// upgradeAppendOnlyFile moves an append-only file written as a single file, alongside the
+// RDB file, into the directory as the base of a new manifest
+func upgradeAppendOnlyFile() error {
+	name := filepath.Join(filepath.Dir(configRDB["name"]), configRDB["appendfilename"])
+	if stat, err := os.Stat(name); err != nil || !stat.Mode().IsRegular() {
+		return nil
+	}
+	if _, err := os.Stat(manifestPath()); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(appendOnlyDir(), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(name, appendOnlyPath(configRDB["appendfilename"])); err != nil {
+		return err
+	}
+	m := &aofManifest{base: &aofFileInfo{name: configRDB["appendfilename"], seq: 1, kind: aofBaseType}}
+	if err := writeManifest(m); err != nil {
+		return err
+	}
+
+	fmt.Printf("Warning: moved the AOF file %s into %s as its base\n", configRDB["appendfilename"], appendOnlyDir())
+	return nil
+}
+
+// loadAppendOnlyFiles replays each part a manifest lists, then carries on logging to the last
+// incremental file. Only the last part can have been cut short by a crash
+func loadAppendOnlyFiles(m *aofManifest) error {
+	files := m.files()
+	for i, info := range files {
+		name := appendOnlyPath(info.name)
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		valid, err := replayAppendOnlyFile(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", info.name, err)
+		}
+		if valid == len(data) {
+			continue
+		}
+		if i < len(files)-1 {
+			return fmt.Errorf("unexpected end of file reading %s, which isn't the last AOF file", info.name)
+		}
+		if configRDB["aof-load-truncated"] != "yes" {
+			return fmt.Errorf("unexpected end of file reading %s; "+
+				"set aof-load-truncated to yes to load the commands before it", info.name)
+		}
+		fmt.Printf("Warning: AOF loaded anyway because aof-load-truncated is enabled, truncating %s to %d bytes\n", info.name, valid)
+		if err := os.Truncate(name, int64(valid)); err != nil {
+			return err
+		}
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if m.base != nil {
+		aof.baseSeq = m.base.seq
+	}
+	var file *os.File
+	var err error
+	if len(m.incrs) > 0 {
+		last := m.incrs[len(m.incrs)-1]
+		aof.incrSeq = last.seq
+		file, err = os.OpenFile(appendOnlyPath(last.name), os.O_WRONLY|os.O_APPEND, 0644)
+	} else {
+		var incr *aofFileInfo
+		if incr, file, err = aof.openNextIncr(); err == nil {
+			m.incrs = append(m.incrs, incr)
+			err = writeManifest(m)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	aof.manifest = m
+	aof.file, aof.size, aof.selectedDB = file, stat.Size(), -1
+	aof.currentSize = manifestSize(m)
+	aof.rewriteBaseSize = aof.currentSize
+	return nil
+}
+
+// replayAppendOnlyFile applies the snapshot and commands held in a part of the append-only
+// file, returning how much of it was valid. A part that ends in an incomplete command, or in
+// a transaction that was never executed, was cut short by a crash, and only what precedes
+// them is applied
+func replayAppendOnlyFile(data []byte) (int, error) {
+	start := 0
+	if bytes.HasPrefix(data, []byte("REDIS")) {
+		snapshot, length, err := decodeRDBPrefix(data)
+		if err != nil {
+			return 0, fmt.Errorf("bad RDB preamble in the append only file: %w", err)
+		}
+		if err := loadRDBSnapshot(snapshot); err != nil {
+			return 0, err
+		}
+		start = length
+	}
+
+	// commands are applied as if they came from a master, so nothing refuses them
+	c := &client{protocol: resp2, isMaster: true}
+	reader := newRESPReader(bytes.NewReader(data[start:]))
+	valid := start
+	for {
+		array, err := reader.readCommand()
+		if err != nil {
+			var protocolErr *protocolError
+			if errors.As(err, &protocolErr) {
+				return 0, fmt.Errorf("bad file format reading the append only file: %w", err)
+			}
+			// anything else is the end of the data, possibly in the middle of a command
+			return valid, nil
+		}
+		if len(array) == 0 {
+			continue
+		}
+
+		if _, err := resolveCommand(array); err != nil {
+			return 0, fmt.Errorf("unknown command '%s' reading the append only file", array[0])
+		}
+		dispatchCommand(c, array)
+		if !c.inMulti {
+			valid = start + reader.bytesRead
+		}
+	}
+}
+
+// appendOnlyWriteError refuses writes while logging them fails
+func appendOnlyWriteError() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.lastWriteErr != nil {
+		return newCommandError("MISCONF", "Errors writing to the AOF file: %s", aof.lastWriteErr)
+	}
+	return nil
+}
+
+// appendOnlyInfo generates the AOF fields of the persistence section of INFO
+func appendOnlyInfo() []string {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	boolInt := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	status := func(ok bool) string {
+		if ok {
+			return "ok"
+		}
+		return "err"
+	}
+	current := int64(-1)
+	if aof.rewriting {
+		current = int64(time.Since(aof.rewriteStart).Seconds())
+	}
+	last := int64(-1)
+	if aof.lastRewriteDuration >= 0 {
+		last = int64(aof.lastRewriteDuration.Seconds())
+	}
+
+	lines := []string{
+		fmt.Sprintf("aof_enabled:%d", boolInt(aof.file != nil)),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", boolInt(aof.rewriting)),
+		fmt.Sprintf("aof_rewrite_scheduled:%d", boolInt(aof.enabling && !aof.rewriting)),
+		fmt.Sprintf("aof_last_rewrite_time_sec:%d", last),
+		fmt.Sprintf("aof_current_rewrite_time_sec:%d", current),
+		fmt.Sprintf("aof_last_bgrewrite_status:%s", status(aof.lastRewriteOK)),
+		fmt.Sprintf("aof_rewrites:%d", aof.rewrites),
+		fmt.Sprintf("aof_last_write_status:%s", status(aof.lastWriteErr == nil)),
+	}
+	if aof.file != nil {
+		lines = append(lines,
+			fmt.Sprintf("aof_current_size:%d", aof.currentSize),
+			fmt.Sprintf("aof_base_size:%d", aof.rewriteBaseSize),
+			fmt.Sprintf("aof_buffer_length:%d", len(aof.pending)),
+		)
+	}
+	return lines
+}
+
+func init() {
+	configParams["appendonly"] = newBoolConfigParam(configRDB, "appendonly", func(enabled bool) {
+		aof.mu.Lock()
+		ready, running := aof.ready, aof.file != nil || aof.enabling
+		aof.mu.Unlock()
+
+		switch {
+		case !ready || enabled == running:
+		case enabled:
+			// CONFIG SET runs under executionLock, which the snapshot needs
+			if err := startAppendOnlyFile(); err != nil {
+				fmt.Printf("Problem: failed to create the AOF file: %v\n", err)
+				configRDB["appendonly"] = "no"
+			}
+		default:
+			stopAppendOnlyFile()
+		}
+	})
+	configParams["appendfsync"] = &configParam{
+		validate: func(value string) error {
+			switch strings.ToLower(value) {
+			case aofFsyncAlways, aofFsyncEverysec, aofFsyncNo:
+				return nil
+			}
+			return errors.New("argument(s) must be one of the following: always, everysec, no")
+		},
+		apply: func(value string) {
+			configRDB["appendfsync"] = strings.ToLower(value)
+			aof.mu.Lock()
+			aof.fsync = configRDB["appendfsync"]
+			aof.mu.Unlock()
+		},
+	}
+	configParams["aof-load-truncated"] = newBoolConfigParam(configRDB, "aof-load-truncated", nil)
+}
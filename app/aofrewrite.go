@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var errRewriteInProgress = newCommandError("ERR", "Background append only file rewriting already in progress")
+
+// aofRewriteItemsPerCommand caps how many elements each command of a rewritten collection adds
+const aofRewriteItemsPerCommand = 64
+
+// aofRewriteRetryDelay is how long to wait before retrying a failed automatic rewrite
+const aofRewriteRetryDelay = time.Minute
+
+// encodeAppendOnlyBase serialises a snapshot as a base file: in RDB format, which is faster
+// to load, or as the commands that rebuild it
+func encodeAppendOnlyBase(snapshot *rdbSnapshot, rdbFormat bool) ([]byte, error) {
+	now := time.Now()
+	if rdbFormat {
+		snapshot.aofBase = true
+		return encodeSnapshot(snapshot)
+	}
+
+	var buf []byte
+	for _, code := range snapshot.functions {
+		buf = append(buf, encodeBulkArray([]string{"FUNCTION", "LOAD", code})...)
+	}
+	for _, db := range slices.Sorted(maps.Keys(snapshot.databases)) {
+		buf = append(buf, encodeBulkArray([]string{"SELECT", strconv.Itoa(db)})...)
+		for key, e := range snapshot.databases[db] {
+			if e.isExpired(now) {
+				continue
+			}
+			commands, err := rewriteEntry(key, e, now)
+			if err != nil {
+				return nil, err
+			}
+			for _, command := range commands {
+				buf = append(buf, encodeBulkArray(command)...)
+			}
+		}
+	}
+	return buf, nil
+}
+
+// rewriteEntry returns the commands that recreate a key, with its expiry and those of its fields
+func rewriteEntry(key string, e *entry, now time.Time) ([][]string, error) {
+	commands := [][]string{}
+	// batch adds items, each of one or more arguments, with as few commands as allowed
+	batch := func(name string, items [][]string) {
+		for start := 0; start < len(items); start += aofRewriteItemsPerCommand {
+			command := []string{name, key}
+			for _, item := range items[start:min(start+aofRewriteItemsPerCommand, len(items))] {
+				command = append(command, item...)
+			}
+			commands = append(commands, command)
+		}
+	}
+
+	switch value := e.Value.(type) {
+	case []byte:
+		commands = append(commands, []string{"SET", key, string(value)})
+
+	case *listValue:
+		items := make([][]string, 0, value.len())
+		for i := 0; i < value.len(); i++ {
+			items = append(items, []string{string(value.at(i))})
+		}
+		batch("RPUSH", items)
+
+	case *setValue:
+		items := make([][]string, 0, value.len())
+		value.each(func(member string) {
+			items = append(items, []string{member})
+		})
+		batch("SADD", items)
+
+	case *zsetValue:
+		items := make([][]string, 0, value.len())
+		for _, item := range value.items() {
+			items = append(items, []string{formatDouble(item.score), item.member})
+		}
+		batch("ZADD", items)
+
+	case *hashValue:
+		items := make([][]string, 0, value.len())
+		value.each(func(field string, v []byte) {
+			if f := value.fields[field]; f.expiryPtr == nil || now.Before(f.expiryPtr.Timestamp) {
+				items = append(items, []string{field, string(v)})
+			}
+		})
+		batch("HSET", items)
+		commands = append(commands, rewriteFieldExpiries(key, value, now)...)
+
+	case *streamValue:
+		commands = append(commands, rewriteStream(key, value)...)
+
+	default:
+		return nil, fmt.Errorf("can't rewrite the %s value of key '%s'", e.Type, key)
+	}
+
+	if len(commands) > 0 && e.ExpiryPtr != nil {
+		commands = append(commands, []string{"PEXPIREAT", key, strconv.FormatInt(e.ExpiryPtr.Timestamp.UnixMilli(), 10)})
+	}
+	return commands, nil
+}
+
+// rewriteFieldExpiries returns the commands that restore the expiries of a hash's fields
+func rewriteFieldExpiries(key string, h *hashValue, now time.Time) [][]string {
+	commands := [][]string{}
+	h.each(func(field string, v []byte) {
+		if f := h.fields[field]; f.expiryPtr != nil && now.Before(f.expiryPtr.Timestamp) {
+			commands = append(commands, []string{
+				"HPEXPIREAT", key, strconv.FormatInt(f.expiryPtr.Timestamp.UnixMilli(), 10), "FIELDS", "1", field,
+			})
+		}
+	})
+	return commands
+}
+
+// rewriteStream returns the commands that recreate a stream: its entries, the metadata XSETID
+// restores, and each consumer group with its consumers and pending entries
+func rewriteStream(key string, s *streamValue) [][]string {
+	commands := [][]string{}
+	entries := s.between(streamID{}, maxStreamID, false, 0)
+	for _, entry := range entries {
+		commands = append(commands, append([]string{"XADD", key, entry.id.String()}, entry.fields...))
+	}
+	if len(entries) == 0 {
+		// an empty stream is created by adding an entry that's trimmed straight away
+		id := s.lastID
+		if id.isZero() {
+			id = streamID{0, 1}
+		}
+		commands = append(commands, []string{"XADD", key, "MAXLEN", "0", id.String(), "x", "y"})
+	}
+	commands = append(commands, []string{
+		"XSETID", key, s.lastID.String(),
+		"ENTRIESADDED", strconv.FormatUint(s.entriesAdded, 10), "MAXDELETEDID", s.maxDeletedID.String(),
+	})
+
+	groupNames := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		groupNames = append(groupNames, name)
+	}
+	slices.Sort(groupNames)
+	for _, name := range groupNames {
+		g := s.groups[name]
+		commands = append(commands, []string{
+			"XGROUP", "CREATE", key, name, g.lastID.String(), "ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10),
+		})
+
+		consumerNames := make([]string, 0, len(g.consumers))
+		for consumerName := range g.consumers {
+			consumerNames = append(consumerNames, consumerName)
+		}
+		slices.Sort(consumerNames)
+		for _, consumerName := range consumerNames {
+			commands = append(commands, []string{"XGROUP", "CREATECONSUMER", key, name, consumerName})
+		}
+
+		g.pending.ascend(streamID{}, maxStreamID, func(id streamID) bool {
+			pending := g.pendingEntries[id]
+			commands = append(commands, []string{
+				"XCLAIM", key, name, pending.consumer.name, "0", id.String(),
+				"TIME", strconv.FormatInt(pending.deliveryTime, 10),
+				"RETRYCOUNT", strconv.FormatUint(pending.deliveryCount, 10),
+				"JUSTID", "FORCE",
+			})
+			return true
+		})
+	}
+
+	return commands
+}
+
+// startBackgroundRewrite compacts the append-only file without blocking other commands, while
+// executionLock is held. New writes go to a fresh incremental file straight away, and a snapshot
+// taken at that same moment is written out as the new base; once it's done, the manifest swaps
+// the older parts for it. While the file is disabled, only a new base is written, unless it's
+// being turned on
+func startBackgroundRewrite() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.rewriting {
+		return errRewriteInProgress
+	}
+	aof.adoptManifest()
+	if err := os.MkdirAll(appendOnlyDir(), 0755); err != nil {
+		return err
+	}
+
+	m := aof.manifest
+	if m == nil {
+		m = &aofManifest{}
+	}
+	// the incremental files up to here are covered by the snapshot, so the new base replaces them
+	replaced := len(m.incrs)
+	if aof.file != nil {
+		if err := aof.write(); err != nil {
+			return err
+		}
+		if err := aof.file.Sync(); err != nil {
+			return err
+		}
+		incr, file, err := aof.openNextIncr()
+		if err != nil {
+			return err
+		}
+		// the new incremental file is listed straight away, so nothing is lost if the rewrite isn't finished
+		next := &aofManifest{base: m.base, incrs: append(slices.Clone(m.incrs), incr)}
+		if err := writeManifest(next); err != nil {
+			file.Close()
+			removeAppendOnlyFiles([]*aofFileInfo{incr})
+			return err
+		}
+		aof.file.Close()
+		aof.file, aof.size, aof.selectedDB = file, 0, -1
+		aof.manifest = next
+	} else if aof.enabling {
+		// listed in the manifest along with the base, once that's written
+		incr, file, err := aof.openNextIncr()
+		if err != nil {
+			return err
+		}
+		aof.file, aof.size, aof.selectedDB = file, 0, -1
+		aof.enablingIncr = incr
+	}
+
+	rdbFormat := configRDB["aof-use-rdb-preamble"] == "yes"
+	base := aof.nextBase(rdbFormat)
+	snapshot, gen, start := takeSnapshot(), aof.rewriteGen, time.Now()
+	aof.rewriting, aof.rewriteStart, aof.lastRewriteTry = true, start, start
+
+	go func() {
+		content, err := encodeAppendOnlyBase(snapshot, rdbFormat)
+		snapshot.release()
+		if err == nil {
+			err = replaceFile(appendOnlyPath(base.name), content)
+		}
+		finishBackgroundRewrite(base, replaced, gen, start, err)
+	}()
+	return nil
+}
+
+// finishBackgroundRewrite installs the base a background rewrite wrote, unless the parts were
+// replaced wholesale in the meantime
+func finishBackgroundRewrite(base *aofFileInfo, replaced, gen int, start time.Time, err error) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.rewriting = false
+	aof.lastRewriteDuration = time.Since(start)
+	if err == nil && gen != aof.rewriteGen {
+		err = errors.New("the dataset was replaced during the rewrite")
+	}
+
+	if err == nil {
+		m := aof.manifest
+		if m == nil {
+			m = &aofManifest{}
+		}
+		next := &aofManifest{base: base, incrs: slices.Clone(m.incrs[replaced:])}
+		enabled := aof.enablingIncr != nil
+		if enabled {
+			next.incrs = append(next.incrs, aof.enablingIncr)
+		}
+		if err = writeManifest(next); err == nil {
+			history := m.incrs[:replaced]
+			if m.base != nil {
+				history = append([]*aofFileInfo{m.base}, history...)
+			}
+			removeAppendOnlyFiles(history)
+
+			aof.manifest = next
+			aof.currentSize = manifestSize(next)
+			aof.rewriteBaseSize = aof.currentSize
+			aof.rewrites++
+			// the file is on from here
+			if enabled {
+				aof.enabling, aof.enablingIncr = false, nil
+			}
+		}
+	}
+
+	aof.lastRewriteOK = err == nil
+	if err != nil {
+		fmt.Printf("Problem: background AOF rewrite failed: %v\n", err)
+		removeAppendOnlyFiles([]*aofFileInfo{base})
+
+		// turning the file on is retried from scratch, with a new snapshot
+		if aof.enablingIncr != nil {
+			aof.file.Close()
+			aof.file, aof.pending, aof.lastWriteErr = nil, nil, nil
+			removeAppendOnlyFiles([]*aofFileInfo{aof.enablingIncr})
+			aof.enablingIncr = nil
+		}
+	}
+}
+
+// rewriteOnGrowth runs in the background, starting a rewrite whenever the append-only file has
+// grown by auto-aof-rewrite-percentage since the last one, and is at least
+// auto-aof-rewrite-min-size. After a failed rewrite, it waits a while before trying again
+func rewriteOnGrowth() {
+	for range time.Tick(100 * time.Millisecond) {
+		executionLock.Lock()
+		if rewriteDue() {
+			if err := startBackgroundRewrite(); err != nil {
+				fmt.Printf("Problem: failed to start an AOF rewrite: %v\n", err)
+			}
+		}
+		executionLock.Unlock()
+	}
+}
+
+func rewriteDue() bool {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.rewriting || !aof.lastRewriteOK && time.Since(aof.lastRewriteTry) < aofRewriteRetryDelay {
+		return false
+	}
+	// turning the file on waits for a rewrite, after any that was already running
+	if aof.enabling && aof.file == nil {
+		return true
+	}
+	if aof.file == nil || aof.growthPercentage == 0 || aof.currentSize < aof.minRewriteSize {
+		return false
+	}
+
+	base := max(aof.rewriteBaseSize, 1)
+	return (aof.currentSize-base)*100/base >= aof.growthPercentage
+}
+
+func handleBgrewriteaof(c *client, array []string) ([]byte, error) {
+	if err := startBackgroundRewrite(); err != nil {
+		var commandErr *commandError
+		if errors.As(err, &commandErr) {
+			return nil, err
+		}
+		return nil, newCommandError("ERR", "Can't execute an AOF background rewriting: %s", err)
+	}
+	return encodeSimpleString("Background append only file rewriting started"), nil
+}
+
+func init() {
+	configParams["aof-use-rdb-preamble"] = newBoolConfigParam(configRDB, "aof-use-rdb-preamble", nil)
+	configParams["auto-aof-rewrite-percentage"] = &configParam{
+		validate: func(value string) error {
+			n, ok := parseInteger(value)
+			if !ok {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			if n < 0 || n > 2147483647 {
+				return errors.New("argument must be between 0 and 2147483647 inclusive")
+			}
+			return nil
+		},
+		apply: func(value string) {
+			n, _ := parseInteger(value)
+			configRDB["auto-aof-rewrite-percentage"] = strconv.FormatInt(n, 10)
+			aof.mu.Lock()
+			aof.growthPercentage = n
+			aof.mu.Unlock()
+		},
+	}
+	configParams["auto-aof-rewrite-min-size"] = &configParam{
+		validate: func(value string) error {
+			_, err := parseMemorySize(value)
+			return err
+		},
+		apply: func(value string) {
+			n, _ := parseMemorySize(value)
+			configRDB["auto-aof-rewrite-min-size"] = strconv.FormatInt(n, 10)
+			aof.mu.Lock()
+			aof.minRewriteSize = n
+			aof.mu.Unlock()
+		},
+	}
+
+	registerCommands(&commandSpec{
+		Name: "bgrewriteaof", Arity: 1, Flags: []string{"admin", "noscript", "no_async_loading"},
+		Group: "server", Summary: "Asynchronously rewrites the append-only file to disk.", Since: "1.0.0",
+		Handler: handleBgrewriteaof,
+	})
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// bits within a string are numbered from the most significant bit of its first byte,
+// so bit 0 is 0x80 of byte 0 and bit 8 is 0x80 of byte 1
+var (
+	errBitOffset = newCommandError("ERR", "bit offset is not an integer or out of range")
+	errBitValue  = newCommandError("ERR", "bit is not an integer or out of range")
+)
+
+// parseBitOffset parses a bit offset, which must address a bit within the largest allowed string
+func parseBitOffset(arg string) (int64, error) {
+	offset, ok := parseInteger(arg)
+	if !ok || offset < 0 || offset>>3 >= maxStringLength {
+		return 0, errBitOffset
+	}
+	return offset, nil
+}
+
+func getBit(value []byte, offset int64) int {
+	if offset>>3 >= int64(len(value)) {
+		return 0
+	}
+	return int(value[offset>>3]>>(7-offset&7)) & 1
+}
+
+func setBit(value []byte, offset int64, bit int) {
+	mask := byte(1) << (7 - offset&7)
+	if bit == 1 {
+		value[offset>>3] |= mask
+	} else {
+		value[offset>>3] &^= mask
+	}
+}
+
+// growString returns the string held at key (creating it if needed) padded with zero bytes to at
+// least size bytes, and records the change
+func growString(key string, e *entry, size int64) []byte {
+	var value []byte
+	if e != nil {
+		value = stringValue(e)
+	}
+	if int64(len(value)) < size {
+		value = append(value, make([]byte, size-int64(len(value)))...)
+	}
+
+	if e == nil {
+		store.set(key, newStringEntry(value, nil))
+	} else {
+		e.Value = value
+		store.modified(key)
+	}
+
+	return value
+}
+
+func handleSetBit(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	offset, err := parseBitOffset(array[2])
+	if err != nil {
+		return nil, err
+	}
+	bit, ok := parseInteger(array[3])
+	if !ok || (bit != 0 && bit != 1) {
+		return nil, errBitValue
+	}
+
+	e, err := store.getTyped(key, stringType)
+	if err != nil {
+		return nil, err
+	}
+
+	value := growString(key, e, offset>>3+1)
+	previous := getBit(value, offset)
+	setBit(value, offset, int(bit))
+
+	return encodeInteger(previous), nil
+}
+
+func handleGetBit(c *client, array []string) ([]byte, error) {
+	offset, err := parseBitOffset(array[2])
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := store.getTyped(array[1], stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return encodeInteger(0), nil
+	}
+
+	return encodeInteger(getBit(stringValue(e), offset)), nil
+}
+
+// bitRange is an inclusive range of bits, given as start and end arguments counting either bytes or bits
+type bitRange struct {
+	start, end int64
+	inBits     bool
+}
+
+// parseBitRange parses "start end [BYTE|BIT]" from args
+func parseBitRange(args []string) (bitRange, error) {
+	var r bitRange
+	var ok bool
+
+	if r.start, ok = parseInteger(args[0]); !ok {
+		return r, errNotInteger
+	}
+	if r.end, ok = parseInteger(args[1]); !ok {
+		return r, errNotInteger
+	}
+	if len(args) == 3 {
+		switch strings.ToUpper(args[2]) {
+		case "BYTE":
+		case "BIT":
+			r.inBits = true
+		default:
+			return r, errSyntax
+		}
+	}
+
+	return r, nil
+}
+
+// resolve turns the range into bit positions within a string of length bytes, like GETRANGE does
+// for its indices. ok is false when the range is empty
+func (r bitRange) resolve(length int) (int64, int64, bool) {
+	total := int64(length)
+	if r.inBits {
+		total *= 8
+	}
+
+	start, end := r.start, r.end
+	if start < 0 && end < 0 && start > end {
+		return 0, 0, false
+	}
+	if start < 0 {
+		start = max(total+start, 0)
+	}
+	if end < 0 {
+		end = max(total+end, 0)
+	}
+	end = min(end, total-1)
+	if start > end {
+		return 0, 0, false
+	}
+
+	if r.inBits {
+		return start, end, true
+	}
+	return start * 8, end*8 + 7, true
+}
+
+// countBits counts the set bits from bit start to bit end inclusive
+func countBits(value []byte, start, end int64) int {
+	first, last := start>>3, end>>3
+
+	count := 0
+	data := value[first : last+1]
+	for len(data) >= 8 {
+		count += bits.OnesCount64(binary.BigEndian.Uint64(data))
+		data = data[8:]
+	}
+	for _, b := range data {
+		count += bits.OnesCount8(b)
+	}
+
+	// take off the bits outside the range in the first and last bytes
+	if skip := start & 7; skip > 0 {
+		count -= bits.OnesCount8(value[first] >> (8 - skip))
+	}
+	if skip := 7 - end&7; skip > 0 {
+		count -= bits.OnesCount8(value[last] & (1<<skip - 1))
+	}
+
+	return count
+}
+
+func handleBitCount(c *client, array []string) ([]byte, error) {
+	var r bitRange
+	switch len(array) {
+	case 2:
+		r = bitRange{start: 0, end: -1}
+	case 4, 5:
+		var err error
+		if r, err = parseBitRange(array[2:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errSyntax
+	}
+
+	e, err := store.getTyped(array[1], stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return encodeInteger(0), nil
+	}
+
+	value := stringValue(e)
+	start, end, ok := r.resolve(len(value))
+	if !ok {
+		return encodeInteger(0), nil
+	}
+
+	return encodeInteger(countBits(value, start, end)), nil
+}
+
+// findBit returns the position of the first bit set to bit between start and end inclusive, or -1
+func findBit(value []byte, bit int, start, end int64) int64 {
+	// whole bytes made up only of the other bit can be skipped
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xFF
+	}
+
+	for i := start; i <= end; {
+		if i&7 == 0 && i+7 <= end && value[i>>3] == skip {
+			i += 8
+			continue
+		}
+		if getBit(value, i) == bit {
+			return i
+		}
+		i++
+	}
+
+	return -1
+}
+
+func handleBitPos(c *client, array []string) ([]byte, error) {
+	bit, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+	if bit != 0 && bit != 1 {
+		return nil, newCommandError("ERR", "The bit argument must be 1 or 0.")
+	}
+
+	r := bitRange{start: 0, end: -1}
+	endGiven := false
+	switch len(array) {
+	case 3:
+	case 4:
+		if r.start, ok = parseInteger(array[3]); !ok {
+			return nil, errNotInteger
+		}
+	case 5, 6:
+		var err error
+		if r, err = parseBitRange(array[3:]); err != nil {
+			return nil, err
+		}
+		endGiven = true
+	default:
+		return nil, errSyntax
+	}
+
+	e, err := store.getTyped(array[1], stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		// a missing key is an empty string, which has no set bits but infinitely many clear ones
+		if bit == 1 {
+			return encodeInteger(-1), nil
+		}
+		return encodeInteger(0), nil
+	}
+
+	value := stringValue(e)
+	start, end, ok := r.resolve(len(value))
+	if !ok {
+		return encodeInteger(-1), nil
+	}
+
+	position := findBit(value, int(bit), start, end)
+	// with no explicit end, the string is treated as padded with clear bits on the right
+	if position == -1 && bit == 0 && !endGiven {
+		position = end + 1
+	}
+
+	return encodeInteger(int(position)), nil
+}
+
+func handleBitOp(c *client, array []string) ([]byte, error) {
+	operation, destination, keys := strings.ToUpper(array[1]), array[2], array[3:]
+
+	switch operation {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(keys) != 1 {
+			return nil, newCommandError("ERR", "BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return nil, errSyntax
+	}
+
+	sources := make([][]byte, len(keys))
+	length := 0
+	for i, key := range keys {
+		e, err := store.getTyped(key, stringType)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			sources[i] = stringValue(e)
+		}
+		length = max(length, len(sources[i]))
+	}
+
+	if length == 0 {
+		store.delete(destination)
+		return encodeInteger(0), nil
+	}
+
+	// shorter strings are treated as padded with zero bytes
+	result := make([]byte, length)
+	copy(result, sources[0])
+	if operation == "NOT" {
+		for i := range result {
+			result[i] = ^result[i]
+		}
+	}
+	for _, source := range sources[1:] {
+		for i := range result {
+			var b byte
+			if i < len(source) {
+				b = source[i]
+			}
+			switch operation {
+			case "AND":
+				result[i] &= b
+			case "OR":
+				result[i] |= b
+			case "XOR":
+				result[i] ^= b
+			}
+		}
+	}
+
+	store.set(destination, newStringEntry(result, nil))
+
+	return encodeInteger(length), nil
+}
+
+// a bitfield is an integer of up to 64 bits stored at an arbitrary bit offset within a string
+type bitfieldType struct {
+	signed bool
+	width  int
+}
+
+var errBitfieldType = newCommandError("ERR", "Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+
+func parseBitfieldType(arg string) (bitfieldType, error) {
+	if len(arg) < 2 {
+		return bitfieldType{}, errBitfieldType
+	}
+
+	var t bitfieldType
+	switch arg[0] {
+	case 'i', 'I':
+		t.signed = true
+	case 'u', 'U':
+	default:
+		return t, errBitfieldType
+	}
+
+	width, err := strconv.Atoi(arg[1:])
+	if err != nil || width < 1 || (t.signed && width > 64) || (!t.signed && width > 63) {
+		return t, errBitfieldType
+	}
+	t.width = width
+
+	return t, nil
+}
+
+// parseBitfieldOffset parses an offset in bits, or with a # prefix, in multiples of the field's width
+func parseBitfieldOffset(arg string, t bitfieldType) (int64, error) {
+	multiplier := int64(1)
+	if strings.HasPrefix(arg, "#") {
+		arg, multiplier = arg[1:], int64(t.width)
+	}
+
+	offset, ok := parseInteger(arg)
+	if !ok || offset < 0 || offset > math.MaxInt64/multiplier {
+		return 0, errBitOffset
+	}
+	offset *= multiplier
+	if offset>>3 >= maxStringLength {
+		return 0, errBitOffset
+	}
+
+	return offset, nil
+}
+
+func (t bitfieldType) get(value []byte, offset int64) int64 {
+	var u uint64
+	for i := range int64(t.width) {
+		u = u<<1 | uint64(getBit(value, offset+i))
+	}
+
+	// sign-extend negative values
+	if t.signed && t.width < 64 && u&(1<<(t.width-1)) != 0 {
+		u |= math.MaxUint64 << t.width
+	}
+
+	return int64(u)
+}
+
+func (t bitfieldType) set(value []byte, offset int64, n int64) {
+	u := uint64(n)
+	for i := range int64(t.width) {
+		setBit(value, offset+i, int(u>>(int64(t.width)-1-i))&1)
+	}
+}
+
+type bitfieldOverflow int
+
+const (
+	overflowWrap bitfieldOverflow = iota
+	overflowSat
+	overflowFail
+)
+
+// add returns value+increment as stored in a field of this type, and whether it overflowed
+func (t bitfieldType) add(value, increment int64, overflow bitfieldOverflow) (int64, bool) {
+	wrap := func() int64 {
+		sum := uint64(value) + uint64(increment)
+		if t.width < 64 {
+			sum &^= math.MaxUint64 << t.width
+			if t.signed && sum&(1<<(t.width-1)) != 0 {
+				sum |= math.MaxUint64 << t.width
+			}
+		}
+		return int64(sum)
+	}
+
+	if !t.signed {
+		limit := uint64(1)<<t.width - 1
+		u := uint64(value)
+		switch {
+		case u > limit || (increment > 0 && uint64(increment) > limit-u):
+			if overflow == overflowSat {
+				return int64(limit), true
+			}
+		case increment < 0 && uint64(-increment) > u:
+			if overflow == overflowSat {
+				return 0, true
+			}
+		default:
+			return value + increment, false
+		}
+		return wrap(), true
+	}
+
+	limit := int64(math.MaxInt64)
+	if t.width < 64 {
+		limit = 1<<(t.width-1) - 1
+	}
+	lowest := -limit - 1
+	switch {
+	case value > limit || (increment > 0 && value > limit-increment):
+		if overflow == overflowSat {
+			return limit, true
+		}
+	case value < lowest || (increment < 0 && value < lowest-increment):
+		if overflow == overflowSat {
+			return lowest, true
+		}
+	default:
+		return value + increment, false
+	}
+	return wrap(), true
+}
+
+type bitfieldOperation struct {
+	name     string
+	field    bitfieldType
+	offset   int64
+	value    int64
+	overflow bitfieldOverflow
+}
+
+func parseBitfieldOperations(args []string, readOnly bool) ([]bitfieldOperation, error) {
+	operations := []bitfieldOperation{}
+	overflow := overflowWrap
+
+	for i := 0; i < len(args); {
+		name := strings.ToUpper(args[i])
+
+		if name == "OVERFLOW" && i+1 < len(args) {
+			switch strings.ToUpper(args[i+1]) {
+			case "WRAP":
+				overflow = overflowWrap
+			case "SAT":
+				overflow = overflowSat
+			case "FAIL":
+				overflow = overflowFail
+			default:
+				return nil, newCommandError("ERR", "Invalid OVERFLOW type specified")
+			}
+			i += 2
+			continue
+		}
+
+		need := 3
+		switch name {
+		case "GET":
+		case "SET", "INCRBY":
+			need = 4
+		default:
+			return nil, errSyntax
+		}
+		if i+need > len(args) {
+			return nil, errSyntax
+		}
+
+		operation := bitfieldOperation{name: name, overflow: overflow}
+		var err error
+		if operation.field, err = parseBitfieldType(args[i+1]); err != nil {
+			return nil, err
+		}
+		if operation.offset, err = parseBitfieldOffset(args[i+2], operation.field); err != nil {
+			return nil, err
+		}
+		if need == 4 {
+			var ok bool
+			if operation.value, ok = parseInteger(args[i+3]); !ok {
+				return nil, errNotInteger
+			}
+		}
+
+		if readOnly && name != "GET" {
+			return nil, newCommandError("ERR", "BITFIELD_RO only supports the GET subcommand")
+		}
+
+		operations = append(operations, operation)
+		i += need
+	}
+
+	return operations, nil
+}
+
+func handleBitField(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	operations, err := parseBitfieldOperations(array[2:], strings.ToLower(array[0]) == "bitfield_ro")
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := store.getTyped(key, stringType)
+	if err != nil {
+		return nil, err
+	}
+
+	// the string is grown up front to hold every field that may be written
+	size := int64(0)
+	for _, operation := range operations {
+		if operation.name != "GET" {
+			size = max(size, (operation.offset+int64(operation.field.width)-1)>>3+1)
+		}
+	}
+
+	var value []byte
+	switch {
+	case size > 0:
+		value = growString(key, e, size)
+	case e != nil:
+		value = stringValue(e)
+	}
+
+	replies := make([][]byte, 0, len(operations))
+	for _, operation := range operations {
+		field := operation.field
+		current := field.get(value, operation.offset)
+
+		var updated, reply int64
+		var overflowed bool
+		switch operation.name {
+		case "GET":
+			replies = append(replies, encodeInteger(int(current)))
+			continue
+		case "SET":
+			updated, overflowed = field.add(operation.value, 0, operation.overflow)
+			reply = current
+		case "INCRBY":
+			updated, overflowed = field.add(current, operation.value, operation.overflow)
+			reply = updated
+		}
+
+		if overflowed && operation.overflow == overflowFail {
+			replies = append(replies, encodeNull(c.protocol))
+			continue
+		}
+		field.set(value, operation.offset, updated)
+		replies = append(replies, encodeInteger(int(reply)))
+	}
+
+	return encodeArray(replies), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "setbit", Arity: 4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "bitmap", Summary: "Sets or clears the bit at offset of the string value. Creates the key if it doesn't exist.",
+			Since: "2.2.0", Handler: handleSetBit,
+		},
+		&commandSpec{
+			Name: "getbit", Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "bitmap", Summary: "Returns a bit value by offset.", Since: "2.2.0",
+			Handler: handleGetBit,
+		},
+		&commandSpec{
+			Name: "bitcount", Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "bitmap", Summary: "Counts the number of set bits (population counting) in a string.", Since: "2.6.0",
+			Handler: handleBitCount,
+		},
+		&commandSpec{
+			Name: "bitpos", Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "bitmap", Summary: "Finds the first set (1) or clear (0) bit in a string.", Since: "2.8.7",
+			Handler: handleBitPos,
+		},
+		&commandSpec{
+			Name: "bitop", Arity: -4, Flags: []string{"write", "denyoom"}, FirstKey: 2, LastKey: -1, KeyStep: 1,
+			Group: "bitmap", Summary: "Performs bitwise operations on multiple strings, and stores the result.",
+			Since: "2.6.0", Handler: handleBitOp,
+		},
+		&commandSpec{
+			Name: "bitfield", Arity: -2, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "bitmap", Summary: "Performs arbitrary bitfield integer operations on strings.", Since: "3.2.0",
+			Handler: handleBitField,
+		},
+		&commandSpec{
+			Name: "bitfield_ro", Arity: -2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "bitmap", Summary: "Performs arbitrary read-only bitfield integer operations on strings.",
+			Since: "6.0.0", Handler: handleBitField,
+		},
+	)
+}
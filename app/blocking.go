@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// blockedClient is a client waiting in a blocking command (e.g. BLPOP) for one of its keys
+// to change. attempt tries to run the command; it's called under executionLock, and
+// reports whether the command could be served
+type blockedClient struct {
+	c *client
+	// db is the database the keys are in
+	db      int
+	keys    []string
+	attempt func() ([]byte, bool, error)
+	// reply receives the reply once another client's write has served this one
+	reply  chan []byte
+	served bool
+}
+
+// databaseKey identifies a key along with the database it's in
+type databaseKey struct {
+	db  int
+	key string
+}
+
+// blockedOnKey holds, for each key, the clients blocked on it in the order they blocked,
+// so that they're served first come, first served. Like readyKeys, it's guarded by executionLock
+var blockedOnKey = map[databaseKey][]*blockedClient{}
+
+// readyKeys holds the keys written to since blocked clients were last served
+var readyKeys = []databaseKey{}
+
+// signalKeyReady records that a key was written, if any client is blocked on it
+func signalKeyReady(db int, key string) {
+	ready := databaseKey{db, key}
+	if _, blocked := blockedOnKey[ready]; blocked && !slices.Contains(readyKeys, ready) {
+		readyKeys = append(readyKeys, ready)
+	}
+}
+
+// parseTimeout parses the timeout argument of a blocking command, in seconds; zero blocks forever
+func parseTimeout(arg string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds > math.MaxInt64/float64(time.Second) {
+		return 0, newCommandError("ERR", "timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, newCommandError("ERR", "timeout is negative")
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// blockOn runs attempt atomically and, if it can't be served yet, blocks until a write to
+// one of keys lets it run or the timeout (zero meaning none) expires, in which case
+// timeoutReply is returned. Whatever attempt modifies is replicated via c.propagateAs.
+// Within a transaction or script, which already holds executionLock, it never blocks. A
+// client that disconnects while blocked is unblocked, so no write is served to it
+func blockOn(c *client, keys []string, timeout time.Duration, timeoutReply []byte, attempt func() ([]byte, bool, error)) ([]byte, error) {
+	if !c.denyBlocking {
+		executionLock.Lock()
+	}
+
+	selectDatabase(c)
+	c.propagateAs = nil
+	output, served, err := attempt()
+	if err == nil {
+		// even an attempt that has to block may have changed something, e.g. created a consumer
+		for _, command := range c.propagateAs {
+			propagateToReplicas(command)
+		}
+	}
+	if c.denyBlocking {
+		if err == nil && !served {
+			return timeoutReply, nil
+		}
+		return output, err
+	}
+	if err != nil || served {
+		if served {
+			serveBlockedClients()
+		}
+		executionLock.Unlock()
+		return output, err
+	}
+
+	blocked := &blockedClient{c: c, db: c.db, keys: keys, attempt: attempt, reply: make(chan []byte, 1)}
+	for _, key := range keys {
+		blockedKey := databaseKey{c.db, key}
+		blockedOnKey[blockedKey] = append(blockedOnKey[blockedKey], blocked)
+	}
+
+	executionLock.Unlock()
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	disconnected, stopWatching := c.watchDisconnect()
+	defer stopWatching()
+
+	select {
+	case output := <-blocked.reply:
+		return output, nil
+	case <-timer:
+	case <-disconnected:
+	}
+
+	executionLock.Lock()
+	defer executionLock.Unlock()
+
+	// the client may have been served just as the timeout expired
+	if blocked.served {
+		return <-blocked.reply, nil
+	}
+	unblockClient(blocked)
+
+	return timeoutReply, nil
+}
+
+func unblockClient(blocked *blockedClient) {
+	for _, key := range blocked.keys {
+		blockedKey := databaseKey{blocked.db, key}
+		waiting := slices.DeleteFunc(blockedOnKey[blockedKey], func(other *blockedClient) bool {
+			return other == blocked
+		})
+		if len(waiting) == 0 {
+			delete(blockedOnKey, blockedKey)
+		} else {
+			blockedOnKey[blockedKey] = waiting
+		}
+	}
+}
+
+// serveBlockedClients retries the clients blocked on keys written to by the command that
+// just ran, in the order they blocked. It runs under executionLock after the command has
+// been replicated, so the writes it makes are replicated after the ones that enabled them
+func serveBlockedClients() {
+	// each client is served in the database it blocked in
+	selected := store
+	defer func() { store = selected }()
+
+	for len(readyKeys) > 0 {
+		key := readyKeys[0]
+		readyKeys = readyKeys[1:]
+
+		for _, blocked := range slices.Clone(blockedOnKey[key]) {
+			if blocked.served {
+				continue
+			}
+
+			store = databases[blocked.db]
+			blocked.c.propagateAs = nil
+			output, served, err := blocked.attempt()
+			if err != nil || !served {
+				continue
+			}
+
+			for _, command := range blocked.c.propagateAs {
+				propagateToReplicas(command)
+			}
+
+			blocked.served = true
+			unblockClient(blocked)
+			blocked.reply <- output
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// client holds the per-connection state of anyone talking to this instance
+type client struct {
+	id     int64
+	conn   net.Conn
+	reader *respReader
+
+	// protocol is the RESP version replies are encoded with, negotiated via HELLO
+	protocol int
+	name     string
+	// db is the index of the database selected with SELECT
+	db int
+
+	// propagateAs optionally replaces the command being executed with the commands
+	// to send to replicas in its place
+	propagateAs [][]string
+
+	// isMaster marks the connection this replica receives its replication stream on;
+	// commands arriving on it are applied without replying
+	isMaster bool
+
+	// transaction state: the commands queued since MULTI, whether queuing one of them failed,
+	// and the keys watched for changes, mapped to whether each had already expired when watched
+	inMulti      bool
+	queued       [][]string
+	multiAborted bool
+	watched      map[databaseKey]bool
+	watchDirty   bool
+	// denyBlocking is set while commands run on behalf of EXEC or a script, which already
+	// hold executionLock, so none of them may block
+	denyBlocking bool
+
+	// the channels, patterns and shard channels subscribed to
+	channels      map[string]struct{}
+	patterns      map[string]struct{}
+	shardChannels map[string]struct{}
+
+	// closing is set by QUIT, so the connection is closed once its reply is sent
+	closing bool
+
+	// output waiting to be sent by the client's writer goroutine, so that nobody ever blocks
+	// on a slow connection while holding executionLock. outReady is signalled whenever output
+	// is added or sent, and outErr is set once the connection has failed or been closed
+	outMu         sync.Mutex
+	outReady      *sync.Cond
+	pending       []byte
+	writing       int
+	outErr        error
+	overSoftLimit time.Time
+}
+
+// outputLimit bounds the output queued for a client: it's disconnected as soon as the
+// output exceeds the hard limit, or once it has exceeded the soft limit for softDuration
+type outputLimit struct {
+	hard, soft   int
+	softDuration time.Duration
+}
+
+// the limits Redis applies by default to pub/sub clients and replicas
+var (
+	pubsubOutputLimit  = &outputLimit{hard: 32 << 20, soft: 8 << 20, softDuration: 60 * time.Second}
+	replicaOutputLimit = &outputLimit{hard: 256 << 20, soft: 64 << 20, softDuration: 60 * time.Second}
+)
+
+var nextClientID atomic.Int64
+
+func newClient(conn net.Conn) *client {
+	c := &client{
+		id:       nextClientID.Add(1),
+		protocol: resp2,
+		conn:     conn,
+	}
+	c.outReady = sync.NewCond(&c.outMu)
+	c.reader = newRESPReader(flushingReader{c})
+	go c.writeOutput()
+
+	return c
+}
+
+// flushingReader sends any queued replies before blocking on the connection for more input,
+// so replies to pipelined commands are batched without ever being held back
+type flushingReader struct {
+	c *client
+}
+
+func (r flushingReader) Read(p []byte) (int, error) {
+	if err := r.c.flush(); err != nil {
+		return 0, err
+	}
+	return r.c.conn.Read(p)
+}
+
+// queue hands output to the writer goroutine without waiting for it to be sent
+func (c *client) queue(output []byte) error {
+	return c.send(output, nil)
+}
+
+// send queues output like queue, disconnecting the client instead if that takes its
+// queued output over limit (if given)
+func (c *client) send(output []byte, limit *outputLimit) error {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	if c.outErr != nil {
+		return c.outErr
+	}
+	c.pending = append(c.pending, output...)
+	if limit != nil && c.exceedsOutputLimit(limit) {
+		fmt.Printf("Warning: client id=%d closed for overcoming of output buffer limits\n", c.id)
+		c.failOutput(errOutputLimit)
+		return c.outErr
+	}
+
+	c.outReady.Broadcast()
+	return nil
+}
+
+var errOutputLimit = errors.New("output buffer limit exceeded")
+
+// exceedsOutputLimit checks the output queued against a limit, while outMu is held
+func (c *client) exceedsOutputLimit(limit *outputLimit) bool {
+	size := len(c.pending) + c.writing
+	if size > limit.hard {
+		return true
+	}
+	if size <= limit.soft {
+		c.overSoftLimit = time.Time{}
+		return false
+	}
+	if c.overSoftLimit.IsZero() {
+		c.overSoftLimit = time.Now()
+	}
+	return time.Since(c.overSoftLimit) > limit.softDuration
+}
+
+// failOutput discards any queued output and closes the connection, while outMu is held
+func (c *client) failOutput(err error) {
+	c.outErr = err
+	c.pending = nil
+	c.conn.Close()
+	c.outReady.Broadcast()
+}
+
+// writeOutput runs for the lifetime of the connection, sending whatever output is queued
+func (c *client) writeOutput() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	for {
+		for len(c.pending) == 0 && c.outErr == nil {
+			c.outReady.Wait()
+		}
+		if c.outErr != nil {
+			return
+		}
+
+		output := c.pending
+		c.pending, c.writing = nil, len(output)
+		c.outMu.Unlock()
+		_, err := c.conn.Write(output)
+		c.outMu.Lock()
+
+		c.writing = 0
+		if err != nil && c.outErr == nil {
+			c.failOutput(err)
+		}
+		c.outReady.Broadcast()
+	}
+}
+
+// flush waits until all the output queued so far has been sent
+func (c *client) flush() error {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	for (len(c.pending) > 0 || c.writing > 0) && c.outErr == nil {
+		c.outReady.Wait()
+	}
+	return c.outErr
+}
+
+func (c *client) write(output []byte) error {
+	if err := c.queue(output); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// close closes the connection and stops its writer goroutine, discarding any unsent output
+func (c *client) close() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	if c.outErr == nil {
+		c.failOutput(net.ErrClosed)
+	}
+}
+
+// watchDisconnect watches the connection of a client that isn't reading commands (e.g. while
+// it's blocked), returning a channel closed if the peer disconnects. Any input arriving
+// meanwhile stays buffered for the client to read, once stop has ended the watch
+func (c *client) watchDisconnect() (disconnected <-chan struct{}, stop func()) {
+	if c.conn == nil {
+		return nil, func() {}
+	}
+
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// peeking waits for input without consuming it, so the watch keeps going until
+		// the buffer fills up, the connection fails, or stop interrupts it with a deadline
+		for n := 1; n <= c.reader.reader.Size(); n++ {
+			_, err := c.reader.reader.Peek(n)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+			if err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	return closed, func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -1,128 +1,333 @@
 package main
 
 import (
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"os"
+	"maps"
+	"math"
+	"slices"
 	"strconv"
-	"time"
+	"strings"
 )
 
-func handleEcho(array []string) []byte {
-	if len(array) != 2 {
-		fmt.Println("Problem: more than 1 argument passed for ECHO")
-		os.Exit(1)
+func handlePing(c *client, array []string) ([]byte, error) {
+	if len(array) > 2 {
+		return nil, wrongArityError("ping")
 	}
 
-	return encodeBulkString(array[1])
-}
+	// a subscribed RESP2 connection can only be sent arrays, like the messages it receives
+	if c.protocol == resp2 && c.subscriptionCount() > 0 {
+		message := ""
+		if len(array) == 2 {
+			message = array[1]
+		}
+		return encodeBulkArray([]string{"pong", message}), nil
+	}
 
-func handleSet(array []string) []byte {
-	if len(array) != 3 && len(array) != 5 {
-		fmt.Println("Problem: too many arguments passed for SET")
-		os.Exit(1)
+	if len(array) == 2 {
+		return encodeBulkString(array[1]), nil
 	}
 
-	rdbContents, err := readRDBFile()
-	if err != nil {
-		fmt.Println("Problem: error thrown when reading RDB file")
-	} else {
-		// handle expiry delay
-		var expiryPtr *expiry
-		if len(array) == 5 && array[3] == "px" {
-			delay, err := strconv.Atoi(array[4])
-			if err != nil {
-				fmt.Println("Problem: error thrown in SET (1)")
-				os.Exit(1)
-			}
-			expiryPtr = &expiry{time.UnixMilli(time.Now().UnixMilli() + int64(delay))}
-		}
+	return encodeSimpleString("PONG"), nil
+}
+
+func handleQuit(c *client, array []string) ([]byte, error) {
+	c.closing = true
+	return encodeSimpleString("OK"), nil
+}
+
+// handleReset returns the connection to the state it started in: out of any transaction,
+// subscription or watch, speaking RESP2, unnamed, and in database 0
+func handleReset(c *client, array []string) ([]byte, error) {
+	discardTransaction(c)
+	unsubscribeAll(c)
+	c.protocol = resp2
+	c.name = ""
+	c.db = 0
 
-		// store key-value pair into RDB file
-		rdbContentsBytes, decodingErr := hex.DecodeString(*rdbContents)
-		if decodingErr != nil {
-			fmt.Println("Problem: error thrown when converting from hex to byte array")
+	return encodeSimpleString("RESET"), nil
+}
+
+func handleHello(c *client, array []string) ([]byte, error) {
+	protocol := c.protocol
+	if len(array) >= 2 {
+		version, err := strconv.Atoi(array[1])
+		if err != nil {
+			return nil, newCommandError("ERR", "Protocol version is not an integer or out of range")
 		}
-		if storeInMap(rdbContentsBytes, array[1], array[2], expiryPtr) {
-			return encodeSimpleString("OK")
+		if version != resp2 && version != resp3 {
+			return nil, newCommandError("NOPROTO", "unsupported protocol version")
 		}
+		protocol = version
 	}
 
-	return nullBulkString()
-}
+	name := c.name
+	for i := 2; i < len(array); i++ {
+		remaining := len(array) - i - 1
+		switch {
+		case strings.EqualFold(array[i], "AUTH") && remaining >= 2:
+			// there are no ACL users besides the passwordless default user
+			if array[i+1] != "default" {
+				return nil, newCommandError("WRONGPASS", "invalid username-password pair or user is disabled.")
+			}
+			i += 2
+		case strings.EqualFold(array[i], "SETNAME") && remaining >= 1:
+			if strings.ContainsAny(array[i+1], " \n") {
+				return nil, newCommandError("ERR", "Client names cannot contain spaces, newlines or special characters.")
+			}
+			name = array[i+1]
+			i++
+		default:
+			return nil, newCommandError("ERR", "Syntax error in HELLO option '%s'", array[i])
+		}
+	}
 
-func handleGet(array []string) []byte {
-	if len(array) != 2 {
-		fmt.Println("Problem: more than 1 argument passed for GET")
-		os.Exit(1)
+	c.protocol = protocol
+	c.name = name
+
+	role := configRepl["role"]
+	if role == "slave" {
+		role = "replica"
 	}
 
-	rdbContents, err := readRDBFile()
+	return encodeMap(c.protocol, [][]byte{
+		encodeBulkString("server"), encodeBulkString("redis"),
+		encodeBulkString("version"), encodeBulkString(serverVersion),
+		encodeBulkString("proto"), encodeInteger(c.protocol),
+		encodeBulkString("id"), encodeInteger(int(c.id)),
+		encodeBulkString("mode"), encodeBulkString("standalone"),
+		encodeBulkString("role"), encodeBulkString(role),
+		encodeBulkString("modules"), encodeArray(nil),
+	}), nil
+}
 
+func handleSelect(c *client, array []string) ([]byte, error) {
+	db, err := parseDatabaseIndex(array[1])
 	if err != nil {
-		fmt.Println("Warning: error thrown when reading RDB file")
-	} else {
-		val, _ := getFromMap(*rdbContents, array[1])
-		return val
+		return nil, err
 	}
 
-	return nullBulkString()
+	c.db = db
+	selectDatabase(c)
+	return encodeSimpleString("OK"), nil
 }
 
-func handleConfigGet(array []string) []byte {
-	if len(array) != 3 {
-		fmt.Println("Problem: more than 1 argument passed for CONFIG GET")
-		os.Exit(1)
+func handleEcho(c *client, array []string) ([]byte, error) {
+	return encodeBulkString(array[1]), nil
+}
+
+// configParam is a parameter CONFIG SET can change. Every value given is validated before
+// any is applied, so that setting several either changes them all or none
+type configParam struct {
+	validate func(value string) error
+	apply    func(value string)
+}
+
+// configParams holds the parameters CONFIG SET can change, registered by the features they configure
+var configParams = map[string]*configParam{}
+
+// readOnlyConfigParams are the parameters CONFIG GET reports but only the command line can set
+var readOnlyConfigParams = []string{"dir", "dbfilename", "appendfilename", "appenddirname", "databases"}
+
+// newBoolConfigParam creates a yes/no parameter stored in config, calling onChange (if given)
+// with each new value
+func newBoolConfigParam(config map[string]string, name string, onChange func(enabled bool)) *configParam {
+	return &configParam{
+		validate: func(value string) error {
+			if !strings.EqualFold(value, "yes") && !strings.EqualFold(value, "no") {
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+		apply: func(value string) {
+			config[name] = strings.ToLower(value)
+			if onChange != nil {
+				onChange(config[name] == "yes")
+			}
+		},
 	}
+}
 
-	key := array[2]
-	val, exists := configRDB[key]
+// parseMemorySize parses a size in bytes, which can have a unit: k, m and g are powers of
+// 1000, while kb, mb and gb are powers of 1024
+func parseMemorySize(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+
+	lower := strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(lower, unit.suffix); ok {
+			lower, multiplier = number, unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * multiplier, nil
+}
+
+// setConfig validates and applies a parameter, e.g. as given on the command line
+func setConfig(name, value string) error {
+	param, exists := configParams[name]
 	if !exists {
-		return nullBulkString()
+		return fmt.Errorf("unknown parameter '%s'", name)
+	}
+	if err := param.validate(value); err != nil {
+		return err
+	}
+
+	param.apply(value)
+	return nil
+}
+
+// handleConfigGet matches each argument as a case-insensitive glob against the parameter
+// names, reporting every parameter matched at most once
+func handleConfigGet(c *client, array []string) ([]byte, error) {
+	names := slices.Concat(slices.Collect(maps.Keys(configParams)), readOnlyConfigParams)
+	slices.Sort(names)
+
+	result := []string{}
+	matched := map[string]bool{}
+	for _, pattern := range array[2:] {
+		pattern = strings.ToLower(pattern)
+		for _, name := range names {
+			if !matched[name] && globMatch(pattern, name) {
+				matched[name] = true
+				result = append(result, name, configRDB[name])
+			}
+		}
 	}
 
-	return encodeBulkArray([]string{key, val})
+	return encodeBulkMap(c.protocol, result), nil
 }
 
-func handleKeys(array []string) []byte {
-	// assuming array[1] is always "*"
+func handleConfigSet(c *client, array []string) ([]byte, error) {
+	if len(array)%2 != 0 {
+		return nil, newCommandError("ERR", "wrong number of arguments for 'config|set' command")
+	}
+
+	seen := map[string]bool{}
+	for i := 2; i < len(array); i += 2 {
+		name := strings.ToLower(array[i])
+		param, exists := configParams[name]
+		if !exists {
+			return nil, newCommandError("ERR", "Unknown option or number of arguments for CONFIG SET - '%s'", array[i])
+		}
+		if seen[name] {
+			return nil, newCommandError("ERR", "CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", array[i])
+		}
+		seen[name] = true
 
-	if len(array) != 2 {
-		fmt.Println("Problem: more than 1 argument passed for KEYS")
-		os.Exit(1)
+		if err := param.validate(array[i+1]); err != nil {
+			return nil, newCommandError("ERR", "CONFIG SET failed (possibly related to argument '%s') - %s", array[i], err)
+		}
 	}
 
-	rdbContents, err := readRDBFile()
-	if err != nil {
-		fmt.Println("Problem: error thrown when reading RDB file")
-		os.Exit(1)
+	for i := 2; i < len(array); i += 2 {
+		configParams[strings.ToLower(array[i])].apply(array[i+1])
 	}
 
-	hashmap, _ := extractMap(*rdbContents)
-	keys := make([]string, len(hashmap))
-	i := 0
+	return encodeSimpleString("OK"), nil
+}
+
+func handleKeys(c *client, array []string) ([]byte, error) {
+	pattern := array[1]
+
+	keys := []string{}
+	for _, key := range store.keys() {
+		if pattern == "*" || globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return encodeBulkArray(keys), nil
+}
+
+// infoSections generate each section of INFO, in the order it reports them
+var infoSections = []struct {
+	name     string
+	generate func() string
+}{
+	{"persistence", persistenceInfo},
+	{"replication", sendReplInfo},
+	{"keyspace", keyspaceInfo},
+}
+
+func handleInfo(c *client, array []string) ([]byte, error) {
+	all := len(array) == 1
+	requested := map[string]bool{}
+	for _, section := range array[1:] {
+		section = strings.ToLower(section)
+		if section == "all" || section == "default" || section == "everything" {
+			all = true
+		}
+		requested[section] = true
+	}
 
-	for key := range hashmap {
-		keys[i] = key
-		i++
+	sections := []string{}
+	for _, section := range infoSections {
+		if all || requested[section.name] {
+			sections = append(sections, section.generate())
+		}
 	}
 
-	return encodeBulkArray(keys)
+	return encodeVerbatimString(c.protocol, "txt", strings.Join(sections, "\n\n")), nil
 }
 
-func handleInfo(array []string) []byte {
-	switch array[1] {
-	case "replication":
-		return sendReplInfo()
-	default:
-		return nullBulkString()
+func handleCommand(c *client, array []string) ([]byte, error) {
+	infos := [][]byte{}
+	for _, name := range sortedCommandNames() {
+		infos = append(infos, encodeCommandInfo(commandTable[name]))
 	}
+
+	return encodeArray(infos), nil
 }
 
-func handleWait(array []string, numReplicas int) []byte {
-	return encodeInteger(numReplicas)
+func handleCommandCount(c *client, array []string) ([]byte, error) {
+	return encodeInteger(len(commandTable)), nil
 }
 
-func getAckBytes() []byte {
-	return encodeBulkArray([]string{"REPLCONF", "GETACK", "*"})
+func handleCommandInfo(c *client, array []string) ([]byte, error) {
+	if len(array) == 2 {
+		return handleCommand(c, array)
+	}
+
+	infos := [][]byte{}
+	for _, name := range array[2:] {
+		spec, exists := lookupCommandByFullName(name)
+		if !exists {
+			infos = append(infos, encodeNull(c.protocol))
+			continue
+		}
+		infos = append(infos, encodeCommandInfo(spec))
+	}
+
+	return encodeArray(infos), nil
+}
+
+func handleCommandDocs(c *client, array []string) ([]byte, error) {
+	names := array[2:]
+	if len(names) == 0 {
+		names = sortedCommandNames()
+	}
+
+	docs := [][]byte{}
+	for _, name := range names {
+		spec, exists := lookupCommandByFullName(name)
+		if !exists {
+			continue
+		}
+		docs = append(docs, encodeBulkString(spec.Name), encodeCommandDocs(c.protocol, spec))
+	}
+
+	return encodeMap(c.protocol, docs), nil
 }
@@ -0,0 +1,1148 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamGroup is a consumer group: a cursor into a stream shared by its consumers, and the
+// entries delivered to them that haven't been acknowledged yet (the pending entries list)
+type streamGroup struct {
+	name   string
+	lastID streamID
+	// entriesRead counts the entries the group has read, or is -1 when that's unknown
+	entriesRead int64
+
+	pending        *streamIDIndex
+	pendingEntries map[streamID]*pendingEntry
+	consumers      map[string]*streamConsumer
+}
+
+type pendingEntry struct {
+	consumer      *streamConsumer
+	deliveryTime  int64
+	deliveryCount uint64
+}
+
+type streamConsumer struct {
+	name string
+	// seenTime is when the consumer last tried to read or claim, and activeTime when it
+	// last succeeded (-1 if it never has)
+	seenTime   int64
+	activeTime int64
+	pending    *streamIDIndex
+}
+
+func newStreamGroup(name string, lastID streamID, entriesRead int64) *streamGroup {
+	return &streamGroup{
+		name:           name,
+		lastID:         lastID,
+		entriesRead:    entriesRead,
+		pending:        newStreamIDIndex(),
+		pendingEntries: map[streamID]*pendingEntry{},
+		consumers:      map[string]*streamConsumer{},
+	}
+}
+
+func (g *streamGroup) addConsumer(name string, now int64) *streamConsumer {
+	consumer := &streamConsumer{name: name, seenTime: now, activeTime: -1, pending: newStreamIDIndex()}
+	g.consumers[name] = consumer
+
+	return consumer
+}
+
+// deliver records that an entry was delivered to consumer, taking it from whichever
+// consumer it was pending for before
+func (g *streamGroup) deliver(id streamID, consumer *streamConsumer, deliveryTime int64, deliveryCount uint64) {
+	pending, exists := g.pendingEntries[id]
+	if !exists {
+		pending = &pendingEntry{}
+		g.pendingEntries[id] = pending
+		g.pending.add(id)
+	}
+
+	if pending.consumer != consumer {
+		if pending.consumer != nil {
+			pending.consumer.pending.remove(id)
+		}
+		consumer.pending.add(id)
+		pending.consumer = consumer
+	}
+	pending.deliveryTime, pending.deliveryCount = deliveryTime, deliveryCount
+}
+
+// acknowledge removes an entry from the pending entries list, reporting whether it was there
+func (g *streamGroup) acknowledge(id streamID) bool {
+	pending, exists := g.pendingEntries[id]
+	if !exists {
+		return false
+	}
+
+	pending.consumer.pending.remove(id)
+	g.pending.remove(id)
+	delete(g.pendingEntries, id)
+	return true
+}
+
+func (g *streamGroup) deleteConsumer(name string) int {
+	consumer, exists := g.consumers[name]
+	if !exists {
+		return 0
+	}
+
+	count := consumer.pending.len()
+	consumer.pending.ascend(streamID{}, maxStreamID, func(id streamID) bool {
+		g.acknowledge(id)
+		return true
+	})
+	delete(g.consumers, name)
+
+	return count
+}
+
+func (g *streamGroup) sortedConsumers() []*streamConsumer {
+	consumers := []*streamConsumer{}
+	for _, name := range slices.Sorted(maps.Keys(g.consumers)) {
+		consumers = append(consumers, g.consumers[name])
+	}
+
+	return consumers
+}
+
+func (g *streamGroup) clone() *streamGroup {
+	copied := newStreamGroup(g.name, g.lastID, g.entriesRead)
+	for name, consumer := range g.consumers {
+		copied.consumers[name] = &streamConsumer{
+			name: name, seenTime: consumer.seenTime, activeTime: consumer.activeTime, pending: consumer.pending.clone(),
+		}
+	}
+
+	copied.pending = g.pending.clone()
+	for id, pending := range g.pendingEntries {
+		copied.pendingEntries[id] = &pendingEntry{
+			consumer:      copied.consumers[pending.consumer.name],
+			deliveryTime:  pending.deliveryTime,
+			deliveryCount: pending.deliveryCount,
+		}
+	}
+
+	return copied
+}
+
+// lag returns how many entries the group has yet to read, if it can be worked out
+func (s *streamValue) lag(g *streamGroup) (int64, bool) {
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+	if g.entriesRead >= 0 && !s.hasTombstones(g.lastID) {
+		return int64(s.entriesAdded) - g.entriesRead, true
+	}
+
+	if entriesRead := s.entriesReadUpTo(g.lastID); entriesRead >= 0 {
+		return int64(s.entriesAdded) - entriesRead, true
+	}
+	return 0, false
+}
+
+// advanceGroup moves a group's cursor forward to an entry just delivered from the stream
+func (s *streamValue) advanceGroup(g *streamGroup, id streamID) {
+	if id.compare(g.lastID) <= 0 {
+		return
+	}
+
+	if g.entriesRead >= 0 && !s.hasTombstones(id) {
+		g.entriesRead++
+	} else if s.entriesAdded > 0 {
+		g.entriesRead = s.entriesReadUpTo(id)
+	}
+	g.lastID = id
+}
+
+func noGroupError(key, group string) *commandError {
+	return newCommandError("NOGROUP", "No such key '%s' or consumer group '%s'", key, group)
+}
+
+// getGroup looks up a consumer group, failing with NOGROUP if it or its stream is missing
+func getGroup(key, name string) (*streamValue, *streamGroup, error) {
+	s, err := getStream(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s == nil || s.groups[name] == nil {
+		return nil, nil, noGroupError(key, name)
+	}
+
+	return s, s.groups[name], nil
+}
+
+// getConsumer looks up a consumer, creating it if it doesn't exist yet
+func getConsumer(c *client, key string, g *streamGroup, name string, now int64) *streamConsumer {
+	consumer, exists := g.consumers[name]
+	if !exists {
+		consumer = g.addConsumer(name, now)
+		store.modified(key)
+		c.propagateAs = append(c.propagateAs, []string{"XGROUP", "CREATECONSUMER", key, g.name, name})
+	}
+
+	return consumer
+}
+
+// propagateClaim replicates the delivery of an entry to a consumer as an XCLAIM that
+// forces the exact same state onto the replica
+func propagateClaim(c *client, key string, g *streamGroup, consumer *streamConsumer, id streamID) {
+	pending := g.pendingEntries[id]
+	c.propagateAs = append(c.propagateAs, []string{
+		"XCLAIM", key, g.name, consumer.name, "0", id.String(),
+		"TIME", strconv.FormatInt(pending.deliveryTime, 10),
+		"RETRYCOUNT", strconv.FormatUint(pending.deliveryCount, 10),
+		"FORCE", "JUSTID", "LASTID", g.lastID.String(),
+	})
+}
+
+func propagateGroupCursor(c *client, key string, g *streamGroup) {
+	c.propagateAs = append(c.propagateAs, []string{
+		"XGROUP", "SETID", key, g.name, g.lastID.String(), "ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10),
+	})
+}
+
+func handleXReadGroup(c *client, array []string) ([]byte, error) {
+	options, err := parseXReadOptions(array)
+	if err != nil {
+		return nil, err
+	}
+
+	// ">" reads entries never delivered to the group; any other ID reads the consumer's
+	// own history of pending entries after it
+	history := make([]*streamID, len(options.keys))
+	for i, arg := range options.ids {
+		switch arg {
+		case ">":
+		case "$":
+			return nil, newCommandError("ERR", "The $ ID is meaningless in the context of XREADGROUP: you want to read "+
+				"the history of this consumer by specifying a proper ID, or use the > ID to get new messages. "+
+				"The $ ID would just return an empty result set.")
+		default:
+			id, err := parseStreamID(arg, 0)
+			if err != nil {
+				return nil, err
+			}
+			history[i] = &id
+		}
+	}
+
+	attempt := func() ([]byte, bool, error) {
+		now := time.Now().UnixMilli()
+
+		streams := make([]*streamValue, len(options.keys))
+		groups := make([]*streamGroup, len(options.keys))
+		for i, key := range options.keys {
+			s, g, err := getGroup(key, options.group)
+			if err == errWrongType {
+				return nil, false, err
+			}
+			if err != nil {
+				return nil, false, newCommandError("NOGROUP",
+					"No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, options.group)
+			}
+			streams[i], groups[i] = s, g
+		}
+
+		keys, results := []string{}, [][]byte{}
+		for i, key := range options.keys {
+			s, g := streams[i], groups[i]
+			consumer := getConsumer(c, key, g, options.consumer, now)
+			consumer.seenTime = now
+
+			if history[i] != nil {
+				keys = append(keys, key)
+				results = append(results, s.readHistory(c, key, g, consumer, *history[i], options.count, now))
+				continue
+			}
+
+			start, _ := g.lastID.next()
+			entries := s.between(start, maxStreamID, false, options.count)
+			if len(entries) == 0 {
+				continue
+			}
+
+			for _, entry := range entries {
+				s.advanceGroup(g, entry.id)
+				if !options.noAck {
+					g.deliver(entry.id, consumer, now, 1)
+					propagateClaim(c, key, g, consumer, entry.id)
+				}
+			}
+			consumer.activeTime = now
+			propagateGroupCursor(c, key, g)
+			store.modified(key)
+
+			keys = append(keys, key)
+			results = append(results, encodeStreamEntries(entries))
+		}
+
+		if len(keys) == 0 {
+			return encodeNullArray(c.protocol), !options.block, nil
+		}
+		return encodeXReadReply(c.protocol, keys, results), true, nil
+	}
+
+	return blockOn(c, options.keys, options.timeout, encodeNullArray(c.protocol), attempt)
+}
+
+// readHistory redelivers a consumer's pending entries after a given ID, with entries
+// since deleted from the stream given as nil
+func (s *streamValue) readHistory(c *client, key string, g *streamGroup, consumer *streamConsumer, after streamID, count int, now int64) []byte {
+	start, ok := after.next()
+	if !ok {
+		return encodeArray(nil)
+	}
+
+	ids := []streamID{}
+	consumer.pending.ascend(start, maxStreamID, func(id streamID) bool {
+		ids = append(ids, id)
+		return count == 0 || len(ids) < count
+	})
+
+	results := make([][]byte, len(ids))
+	for i, id := range ids {
+		if fields, exists := s.entries[id]; exists {
+			results[i] = encodeStreamEntry(streamEntry{id, fields})
+		} else {
+			results[i] = encodeArray([][]byte{encodeBulkString(id.String()), encodeNullArray(c.protocol)})
+		}
+
+		pending := g.pendingEntries[id]
+		g.deliver(id, consumer, now, pending.deliveryCount+1)
+		propagateClaim(c, key, g, consumer, id)
+	}
+	if len(ids) > 0 {
+		store.modified(key)
+	}
+
+	return encodeArray(results)
+}
+
+// parseIDs parses a list of stream IDs, as given to XACK or XDEL
+func parseIDs(args []string) ([]streamID, error) {
+	ids := make([]streamID, len(args))
+	for i, arg := range args {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+
+	return ids, nil
+}
+
+func handleXAck(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	ids, err := parseIDs(array[3:])
+	if err != nil {
+		return nil, err
+	}
+
+	_, g, err := getGroup(key, array[2])
+	if err == errWrongType {
+		return nil, err
+	}
+	if err != nil {
+		return encodeInteger(0), nil
+	}
+
+	acknowledged := 0
+	for _, id := range ids {
+		if g.acknowledge(id) {
+			acknowledged++
+		}
+	}
+	if acknowledged > 0 {
+		store.modified(key)
+	}
+
+	return encodeInteger(acknowledged), nil
+}
+
+func handleXPending(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	args := array[3:]
+	extended := len(args) > 0
+	minIdle := int64(0)
+	var start, end streamID
+	count := int64(0)
+	consumerName := ""
+
+	if extended {
+		if strings.EqualFold(args[0], "IDLE") && len(args) > 1 {
+			var ok bool
+			if minIdle, ok = parseInteger(args[1]); !ok {
+				return nil, errNotInteger
+			}
+			args = args[2:]
+		}
+		if len(args) < 3 || len(args) > 4 {
+			return nil, errSyntax
+		}
+
+		var err error
+		if start, err = parseIntervalID(args[0], true); err != nil {
+			return nil, err
+		}
+		if end, err = parseIntervalID(args[1], false); err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		if count, ok = parseInteger(args[2]); !ok {
+			return nil, errNotInteger
+		}
+		count = max(count, 0)
+
+		if len(args) == 4 {
+			consumerName = args[3]
+		}
+	}
+
+	_, g, err := getGroup(key, array[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if !extended {
+		if g.pending.len() == 0 {
+			return encodeArray([][]byte{
+				encodeInteger(0), encodeNull(c.protocol), encodeNull(c.protocol), encodeNullArray(c.protocol),
+			}), nil
+		}
+
+		first, _ := g.pending.first()
+		last, _ := g.pending.last()
+		consumers := [][]byte{}
+		for _, consumer := range g.sortedConsumers() {
+			if consumer.pending.len() > 0 {
+				consumers = append(consumers, encodeBulkArray([]string{consumer.name, strconv.Itoa(consumer.pending.len())}))
+			}
+		}
+
+		return encodeArray([][]byte{
+			encodeInteger(g.pending.len()),
+			encodeBulkString(first.String()),
+			encodeBulkString(last.String()),
+			encodeArray(consumers),
+		}), nil
+	}
+
+	pendingIDs := g.pending
+	if consumerName != "" {
+		consumer, exists := g.consumers[consumerName]
+		if !exists {
+			return encodeArray(nil), nil
+		}
+		pendingIDs = consumer.pending
+	}
+
+	now := time.Now().UnixMilli()
+	results := [][]byte{}
+	pendingIDs.ascend(start, end, func(id streamID) bool {
+		if int64(len(results)) >= count {
+			return false
+		}
+
+		pending := g.pendingEntries[id]
+		idle := max(now-pending.deliveryTime, 0)
+		if idle >= minIdle {
+			results = append(results, encodeArray([][]byte{
+				encodeBulkString(id.String()),
+				encodeBulkString(pending.consumer.name),
+				encodeInteger(int(idle)),
+				encodeInteger(int(pending.deliveryCount)),
+			}))
+		}
+		return true
+	})
+
+	return encodeArray(results), nil
+}
+
+// forgetDeletedEntry drops an entry that's since been deleted from the stream from the
+// pending entries list, as claiming it finds
+func forgetDeletedEntry(c *client, key string, g *streamGroup, id streamID) {
+	g.acknowledge(id)
+	c.propagateAs = append(c.propagateAs, []string{"XACK", key, g.name, id.String()})
+}
+
+func handleXClaim(c *client, array []string) ([]byte, error) {
+	key, groupName, consumerName := array[1], array[2], array[3]
+
+	minIdle, ok := parseInteger(array[4])
+	if !ok {
+		return nil, newCommandError("ERR", "Invalid min-idle-time argument for XCLAIM")
+	}
+	minIdle = max(minIdle, 0)
+
+	i := 5
+	ids := []streamID{}
+	for ; i < len(array); i++ {
+		id, err := parseStreamID(array[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := time.Now().UnixMilli()
+	deliveryTime, retryCount := int64(-1), int64(-1)
+	force, justID := false, false
+	var lastID *streamID
+
+	for ; i < len(array); i++ {
+		option := strings.ToUpper(array[i])
+		hasValue := i+1 < len(array)
+
+		switch {
+		case option == "FORCE":
+			force = true
+		case option == "JUSTID":
+			justID = true
+		case option == "IDLE" && hasValue:
+			idle, ok := parseInteger(array[i+1])
+			if !ok {
+				return nil, newCommandError("ERR", "Invalid IDLE option argument for XCLAIM")
+			}
+			deliveryTime = now - idle
+			i++
+		case option == "TIME" && hasValue:
+			var ok bool
+			if deliveryTime, ok = parseInteger(array[i+1]); !ok {
+				return nil, newCommandError("ERR", "Invalid TIME option argument for XCLAIM")
+			}
+			i++
+		case option == "RETRYCOUNT" && hasValue:
+			var ok bool
+			if retryCount, ok = parseInteger(array[i+1]); !ok {
+				return nil, newCommandError("ERR", "Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+			i++
+		case option == "LASTID" && hasValue:
+			id, err := parseStreamID(array[i+1], 0)
+			if err != nil {
+				return nil, err
+			}
+			lastID = &id
+			i++
+		default:
+			return nil, newCommandError("ERR", "Unrecognized XCLAIM option '%s'", array[i])
+		}
+	}
+
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	s, g, err := getGroup(key, groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastID != nil && lastID.compare(g.lastID) > 0 {
+		g.lastID = *lastID
+		store.modified(key)
+	}
+
+	consumer := getConsumer(c, key, g, consumerName, now)
+	consumer.seenTime = now
+
+	results := [][]byte{}
+	claimedAny := false
+	for _, id := range ids {
+		pending, exists := g.pendingEntries[id]
+		fields, inStream := s.entries[id]
+
+		if !exists {
+			if !force || !inStream {
+				continue
+			}
+			pending = &pendingEntry{}
+		} else if !inStream {
+			forgetDeletedEntry(c, key, g, id)
+			store.modified(key)
+			continue
+		}
+
+		if exists && minIdle > 0 && now-pending.deliveryTime < minIdle {
+			continue
+		}
+
+		deliveryCount := pending.deliveryCount
+		switch {
+		case retryCount >= 0:
+			deliveryCount = uint64(retryCount)
+		case !justID:
+			deliveryCount++
+		}
+		g.deliver(id, consumer, deliveryTime, deliveryCount)
+		consumer.activeTime = now
+		propagateClaim(c, key, g, consumer, id)
+		store.modified(key)
+		claimedAny = true
+
+		if justID {
+			results = append(results, encodeBulkString(id.String()))
+		} else {
+			results = append(results, encodeStreamEntry(streamEntry{id, fields}))
+		}
+	}
+
+	// a cursor moved by LASTID alone still needs replicating
+	if lastID != nil && !claimedAny {
+		propagateGroupCursor(c, key, g)
+	}
+
+	return encodeArray(results), nil
+}
+
+func handleXAutoClaim(c *client, array []string) ([]byte, error) {
+	key, groupName, consumerName := array[1], array[2], array[3]
+
+	minIdle, ok := parseInteger(array[4])
+	if !ok {
+		return nil, newCommandError("ERR", "Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	minIdle = max(minIdle, 0)
+
+	start, err := parseIntervalID(array[5], true)
+	if err != nil {
+		return nil, err
+	}
+
+	count, justID := int64(100), false
+	for i := 6; i < len(array); i++ {
+		switch option := strings.ToUpper(array[i]); {
+		case option == "COUNT" && i+1 < len(array):
+			var ok bool
+			count, ok = parseInteger(array[i+1])
+			if !ok || count < 1 || count > math.MaxInt64/10 {
+				return nil, newCommandError("ERR", "COUNT must be > 0")
+			}
+			i++
+		case option == "JUSTID":
+			justID = true
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	s, g, err := getGroup(key, groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	consumer := getConsumer(c, key, g, consumerName, now)
+	consumer.seenTime = now
+
+	// looking at too many pending entries in one call would block the server
+	attempts := count * 10
+	next := streamID{}
+	claimed, deleted := [][]byte{}, [][]byte{}
+
+	g.pending.ascend(start, maxStreamID, func(id streamID) bool {
+		if attempts == 0 || count == 0 {
+			next = id
+			return false
+		}
+		attempts--
+
+		pending := g.pendingEntries[id]
+		fields, inStream := s.entries[id]
+		switch {
+		case !inStream:
+			forgetDeletedEntry(c, key, g, id)
+			deleted = append(deleted, encodeBulkString(id.String()))
+		case now-pending.deliveryTime >= minIdle:
+			deliveryCount := pending.deliveryCount
+			if !justID {
+				deliveryCount++
+			}
+			g.deliver(id, consumer, now, deliveryCount)
+			consumer.activeTime = now
+			propagateClaim(c, key, g, consumer, id)
+
+			if justID {
+				claimed = append(claimed, encodeBulkString(id.String()))
+			} else {
+				claimed = append(claimed, encodeStreamEntry(streamEntry{id, fields}))
+			}
+			count--
+		}
+		return true
+	})
+
+	if len(claimed) > 0 || len(deleted) > 0 {
+		store.modified(key)
+	}
+
+	return encodeArray([][]byte{encodeBulkString(next.String()), encodeArray(claimed), encodeArray(deleted)}), nil
+}
+
+// parseGroupID parses the ID a group's cursor is set to, which can be "$" for the last
+// ID of the stream, along with an ENTRIESREAD option at args[0] if given
+func parseGroupID(s *streamValue, arg string, args []string) (streamID, int64, []string, error) {
+	id := s.lastID
+	if arg != "$" {
+		var err error
+		if id, err = parseStreamID(arg, 0); err != nil {
+			return id, 0, nil, err
+		}
+	}
+
+	entriesRead := int64(-1)
+	remaining := []string{}
+	for i := 0; i < len(args); i++ {
+		if strings.EqualFold(args[i], "ENTRIESREAD") && i+1 < len(args) {
+			var ok bool
+			if entriesRead, ok = parseInteger(args[i+1]); !ok {
+				return id, 0, nil, errNotInteger
+			}
+			if entriesRead < -1 {
+				return id, 0, nil, newCommandError("ERR", "value for ENTRIESREAD must be positive or -1")
+			}
+			i++
+			continue
+		}
+		remaining = append(remaining, args[i])
+	}
+
+	return id, entriesRead, remaining, nil
+}
+
+var errGroupKeyMissing = newCommandError("ERR", "The XGROUP subcommand requires the key to exist. "+
+	"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+
+func handleXGroupCreate(c *client, array []string) ([]byte, error) {
+	key, name := array[2], array[3]
+
+	mkStream := false
+	args := []string{}
+	for _, arg := range array[5:] {
+		if strings.EqualFold(arg, "MKSTREAM") {
+			mkStream = true
+		} else {
+			args = append(args, arg)
+		}
+	}
+
+	s, err := getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	created := s == nil
+	if created {
+		if !mkStream {
+			return nil, errGroupKeyMissing
+		}
+		s = newStreamValue()
+	}
+
+	id, entriesRead, remaining, err := parseGroupID(s, array[4], args)
+	if err != nil {
+		return nil, err
+	}
+	if len(remaining) > 0 {
+		return nil, errSyntax
+	}
+
+	if _, exists := s.groups[name]; exists {
+		return nil, newCommandError("BUSYGROUP", "Consumer Group name already exists")
+	}
+
+	s.groups[name] = newStreamGroup(name, id, entriesRead)
+	if created {
+		store.set(key, &entry{Type: streamType, Value: s})
+	} else {
+		store.modified(key)
+	}
+
+	c.propagateAs = [][]string{{"XGROUP", "CREATE", key, name, id.String(), "MKSTREAM", "ENTRIESREAD", strconv.FormatInt(entriesRead, 10)}}
+	return encodeSimpleString("OK"), nil
+}
+
+func handleXGroupSetID(c *client, array []string) ([]byte, error) {
+	key, name := array[2], array[3]
+
+	s, err := getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errGroupKeyMissing
+	}
+
+	id, entriesRead, remaining, err := parseGroupID(s, array[4], array[5:])
+	if err != nil {
+		return nil, err
+	}
+	if len(remaining) > 0 {
+		return nil, errSyntax
+	}
+
+	g, exists := s.groups[name]
+	if !exists {
+		return nil, newCommandError("NOGROUP", "No such consumer group '%s' for key name '%s'", name, key)
+	}
+
+	g.lastID, g.entriesRead = id, entriesRead
+	store.modified(key)
+
+	c.propagateAs = [][]string{{"XGROUP", "SETID", key, name, id.String(), "ENTRIESREAD", strconv.FormatInt(entriesRead, 10)}}
+	return encodeSimpleString("OK"), nil
+}
+
+func handleXGroupDestroy(c *client, array []string) ([]byte, error) {
+	key, name := array[2], array[3]
+
+	s, err := getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errGroupKeyMissing
+	}
+
+	if _, exists := s.groups[name]; !exists {
+		return encodeInteger(0), nil
+	}
+
+	delete(s.groups, name)
+	store.modified(key)
+
+	return encodeInteger(1), nil
+}
+
+// handleXGroupConsumer implements XGROUP CREATECONSUMER and XGROUP DELCONSUMER
+func handleXGroupConsumer(c *client, array []string) ([]byte, error) {
+	key, name, consumerName := array[2], array[3], array[4]
+
+	s, err := getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errGroupKeyMissing
+	}
+
+	g, exists := s.groups[name]
+	if !exists {
+		return nil, newCommandError("NOGROUP", "No such consumer group '%s' for key name '%s'", name, key)
+	}
+
+	if strings.EqualFold(array[1], "createconsumer") {
+		if _, exists := g.consumers[consumerName]; exists {
+			return encodeInteger(0), nil
+		}
+
+		g.addConsumer(consumerName, time.Now().UnixMilli())
+		store.modified(key)
+		return encodeInteger(1), nil
+	}
+
+	if _, exists := g.consumers[consumerName]; !exists {
+		return encodeInteger(0), nil
+	}
+
+	pending := g.deleteConsumer(consumerName)
+	store.modified(key)
+	return encodeInteger(pending), nil
+}
+
+func encodeStreamIDOrNull(protocol int, id streamID, valid bool) []byte {
+	if !valid {
+		return encodeNull(protocol)
+	}
+	return encodeBulkString(id.String())
+}
+
+func encodeEntriesRead(protocol int, entriesRead int64) []byte {
+	if entriesRead < 0 {
+		return encodeNull(protocol)
+	}
+	return encodeInteger(int(entriesRead))
+}
+
+func encodeLag(protocol int, s *streamValue, g *streamGroup) []byte {
+	lag, valid := s.lag(g)
+	if !valid {
+		return encodeNull(protocol)
+	}
+	return encodeInteger(int(lag))
+}
+
+// radixTreeStats approximates the "radix-tree-keys" and "radix-tree-nodes" XINFO reports
+// for the way Redis stores streams, with each key a node of entries
+func radixTreeStats(s *streamValue) (int, int) {
+	keys := (s.len() + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	return keys, keys + 1
+}
+
+func handleXInfoStream(c *client, array []string) ([]byte, error) {
+	full, count := false, int64(10)
+	switch {
+	case len(array) == 3:
+	case strings.EqualFold(array[3], "FULL") && len(array) == 4:
+		full = true
+	case strings.EqualFold(array[3], "FULL") && len(array) == 6 && strings.EqualFold(array[4], "COUNT"):
+		var ok bool
+		if count, ok = parseInteger(array[5]); !ok {
+			return nil, errNotInteger
+		}
+		full, count = true, max(count, 0)
+	default:
+		return nil, errSyntax
+	}
+
+	s, err := getStream(array[2])
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errNoSuchKey
+	}
+
+	keys, nodes := radixTreeStats(s)
+	info := [][]byte{
+		encodeBulkString("length"), encodeInteger(s.len()),
+		encodeBulkString("radix-tree-keys"), encodeInteger(keys),
+		encodeBulkString("radix-tree-nodes"), encodeInteger(nodes),
+		encodeBulkString("last-generated-id"), encodeBulkString(s.lastID.String()),
+		encodeBulkString("max-deleted-entry-id"), encodeBulkString(s.maxDeletedID.String()),
+		encodeBulkString("entries-added"), encodeInteger(int(s.entriesAdded)),
+		encodeBulkString("recorded-first-entry-id"), encodeBulkString(s.firstID().String()),
+	}
+
+	if !full {
+		first, hasFirst := s.ids.first()
+		last, _ := s.lastEntry()
+		firstEntry, lastEntry := encodeNull(c.protocol), encodeNull(c.protocol)
+		if hasFirst {
+			firstEntry = encodeStreamEntry(streamEntry{first, s.entries[first]})
+			lastEntry = encodeStreamEntry(last)
+		}
+
+		info = append(info,
+			encodeBulkString("groups"), encodeInteger(len(s.groups)),
+			encodeBulkString("first-entry"), firstEntry,
+			encodeBulkString("last-entry"), lastEntry,
+		)
+		return encodeMap(c.protocol, info), nil
+	}
+
+	groups := [][]byte{}
+	for _, name := range slices.Sorted(maps.Keys(s.groups)) {
+		g := s.groups[name]
+
+		pending := [][]byte{}
+		g.pending.ascend(streamID{}, maxStreamID, func(id streamID) bool {
+			if count > 0 && int64(len(pending)) >= count {
+				return false
+			}
+			entry := g.pendingEntries[id]
+			pending = append(pending, encodeArray([][]byte{
+				encodeBulkString(id.String()), encodeBulkString(entry.consumer.name),
+				encodeInteger(int(entry.deliveryTime)), encodeInteger(int(entry.deliveryCount)),
+			}))
+			return true
+		})
+
+		consumers := [][]byte{}
+		for _, consumer := range g.sortedConsumers() {
+			consumerPending := [][]byte{}
+			consumer.pending.ascend(streamID{}, maxStreamID, func(id streamID) bool {
+				if count > 0 && int64(len(consumerPending)) >= count {
+					return false
+				}
+				entry := g.pendingEntries[id]
+				consumerPending = append(consumerPending, encodeArray([][]byte{
+					encodeBulkString(id.String()), encodeInteger(int(entry.deliveryTime)), encodeInteger(int(entry.deliveryCount)),
+				}))
+				return true
+			})
+
+			consumers = append(consumers, encodeMap(c.protocol, [][]byte{
+				encodeBulkString("name"), encodeBulkString(consumer.name),
+				encodeBulkString("seen-time"), encodeInteger(int(consumer.seenTime)),
+				encodeBulkString("active-time"), encodeInteger(int(consumer.activeTime)),
+				encodeBulkString("pel-count"), encodeInteger(consumer.pending.len()),
+				encodeBulkString("pending"), encodeArray(consumerPending),
+			}))
+		}
+
+		groups = append(groups, encodeMap(c.protocol, [][]byte{
+			encodeBulkString("name"), encodeBulkString(name),
+			encodeBulkString("last-delivered-id"), encodeBulkString(g.lastID.String()),
+			encodeBulkString("entries-read"), encodeEntriesRead(c.protocol, g.entriesRead),
+			encodeBulkString("lag"), encodeLag(c.protocol, s, g),
+			encodeBulkString("pel-count"), encodeInteger(g.pending.len()),
+			encodeBulkString("pending"), encodeArray(pending),
+			encodeBulkString("consumers"), encodeArray(consumers),
+		}))
+	}
+
+	info = append(info,
+		encodeBulkString("entries"), encodeStreamEntries(s.between(streamID{}, maxStreamID, false, int(min(count, math.MaxInt32)))),
+		encodeBulkString("groups"), encodeArray(groups),
+	)
+	return encodeMap(c.protocol, info), nil
+}
+
+func handleXInfoGroups(c *client, array []string) ([]byte, error) {
+	s, err := getStream(array[2])
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errNoSuchKey
+	}
+
+	groups := [][]byte{}
+	for _, name := range slices.Sorted(maps.Keys(s.groups)) {
+		g := s.groups[name]
+		groups = append(groups, encodeMap(c.protocol, [][]byte{
+			encodeBulkString("name"), encodeBulkString(name),
+			encodeBulkString("consumers"), encodeInteger(len(g.consumers)),
+			encodeBulkString("pending"), encodeInteger(g.pending.len()),
+			encodeBulkString("last-delivered-id"), encodeBulkString(g.lastID.String()),
+			encodeBulkString("entries-read"), encodeEntriesRead(c.protocol, g.entriesRead),
+			encodeBulkString("lag"), encodeLag(c.protocol, s, g),
+		}))
+	}
+
+	return encodeArray(groups), nil
+}
+
+func handleXInfoConsumers(c *client, array []string) ([]byte, error) {
+	key, name := array[2], array[3]
+
+	s, err := getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errNoSuchKey
+	}
+	g, exists := s.groups[name]
+	if !exists {
+		return nil, newCommandError("NOGROUP", "No such consumer group '%s' for key name '%s'", name, key)
+	}
+
+	now := time.Now().UnixMilli()
+	consumers := [][]byte{}
+	for _, consumer := range g.sortedConsumers() {
+		inactive := int64(-1)
+		if consumer.activeTime >= 0 {
+			inactive = max(now-consumer.activeTime, 0)
+		}
+
+		consumers = append(consumers, encodeMap(c.protocol, [][]byte{
+			encodeBulkString("name"), encodeBulkString(consumer.name),
+			encodeBulkString("pending"), encodeInteger(consumer.pending.len()),
+			encodeBulkString("idle"), encodeInteger(int(max(now-consumer.seenTime, 0))),
+			encodeBulkString("inactive"), encodeInteger(int(inactive)),
+		}))
+	}
+
+	return encodeArray(consumers), nil
+}
+
+func init() {
+	groupContainer := &commandSpec{
+		Name: "xgroup", Arity: -2, Group: "stream",
+		Summary: "A container for consumer groups commands.", Since: "5.0.0",
+	}
+	infoContainer := &commandSpec{
+		Name: "xinfo", Arity: -2, Group: "stream",
+		Summary: "A container for stream introspection commands.", Since: "5.0.0",
+	}
+
+	registerCommands(
+		&commandSpec{
+			Name: "xreadgroup", Arity: -7, Flags: []string{"write", "blocking"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "stream", Summary: "Returns new or historical messages from a stream for a consumer in a group. Blocks until a message is available otherwise.",
+			Since: "5.0.0", Handler: handleXReadGroup,
+		},
+		&commandSpec{
+			Name: "xack", Arity: -4, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Returns the number of messages that were successfully acknowledged by the consumer group member of a stream.",
+			Since: "5.0.0", Handler: handleXAck,
+		},
+		&commandSpec{
+			Name: "xpending", Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Returns the information and entries from a stream consumer group's pending entries list.",
+			Since: "5.0.0", Handler: handleXPending,
+		},
+		&commandSpec{
+			Name: "xclaim", Arity: -6, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Changes, or acquires, ownership of a message in a consumer group, as if the message was delivered a consumer group member.",
+			Since: "5.0.0", Handler: handleXClaim,
+		},
+		&commandSpec{
+			Name: "xautoclaim", Arity: -6, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Changes, or acquires, ownership of messages in a consumer group, as if the messages were delivered to as consumer group member.",
+			Since: "6.2.0", Handler: handleXAutoClaim,
+		},
+		groupContainer,
+		infoContainer,
+	)
+
+	registerSubcommands(groupContainer,
+		&commandSpec{
+			Name: "xgroup|create", Arity: -5, Flags: []string{"write", "denyoom"}, FirstKey: 2, LastKey: 2, KeyStep: 1,
+			Group: "stream", Summary: "Creates a consumer group.", Since: "5.0.0",
+			Handler: handleXGroupCreate,
+		},
+		&commandSpec{
+			Name: "xgroup|setid", Arity: -5, Flags: []string{"write"}, FirstKey: 2, LastKey: 2, KeyStep: 1,
+			Group: "stream", Summary: "Sets the last-delivered ID of a consumer group.", Since: "5.0.0",
+			Handler: handleXGroupSetID,
+		},
+		&commandSpec{
+			Name: "xgroup|destroy", Arity: 4, Flags: []string{"write"}, FirstKey: 2, LastKey: 2, KeyStep: 1,
+			Group: "stream", Summary: "Destroys a consumer group.", Since: "5.0.0",
+			Handler: handleXGroupDestroy,
+		},
+		&commandSpec{
+			Name: "xgroup|createconsumer", Arity: 5, Flags: []string{"write", "denyoom"}, FirstKey: 2, LastKey: 2, KeyStep: 1,
+			Group: "stream", Summary: "Creates a consumer in a consumer group.", Since: "6.2.0",
+			Handler: handleXGroupConsumer,
+		},
+		&commandSpec{
+			Name: "xgroup|delconsumer", Arity: 5, Flags: []string{"write"}, FirstKey: 2, LastKey: 2, KeyStep: 1,
+			Group: "stream", Summary: "Deletes a consumer from a consumer group.", Since: "5.0.0",
+			Handler: handleXGroupConsumer,
+		},
+	)
+
+	registerSubcommands(infoContainer,
+		&commandSpec{
+			Name: "xinfo|stream", Arity: -3, Flags: []string{"readonly"}, FirstKey: 2, LastKey: 2, KeyStep: 1,
+			Group: "stream", Summary: "Returns information about a stream.", Since: "5.0.0",
+			Handler: handleXInfoStream,
+		},
+		&commandSpec{
+			Name: "xinfo|groups", Arity: 3, Flags: []string{"readonly"}, FirstKey: 2, LastKey: 2, KeyStep: 1,
+			Group: "stream", Summary: "Returns a list of the consumer groups of a stream.", Since: "5.0.0",
+			Handler: handleXInfoGroups,
+		},
+		&commandSpec{
+			Name: "xinfo|consumers", Arity: 4, Flags: []string{"readonly"}, FirstKey: 2, LastKey: 2, KeyStep: 1,
+			Group: "stream", Summary: "Returns a list of the consumers in a consumer group.", Since: "5.0.0",
+			Handler: handleXInfoConsumers,
+		},
+	)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// commandError is an error reply returned by a command handler; Code is the leading
+// word clients match on, e.g. "ERR" or "WRONGTYPE"
+type commandError struct {
+	Code    string
+	Message string
+}
+
+func (e *commandError) Error() string {
+	return e.Code + " " + e.Message
+}
+
+func newCommandError(code, format string, args ...any) *commandError {
+	return &commandError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errWrongType   = newCommandError("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+	errSyntax      = newCommandError("ERR", "syntax error")
+	errNotInteger  = newCommandError("ERR", "value is not an integer or out of range")
+	errNotFloat    = newCommandError("ERR", "value is not a valid float")
+	errNoSuchKey   = newCommandError("ERR", "no such key")
+	errOutOfRange  = newCommandError("ERR", "index out of range")
+	errNotPositive = newCommandError("ERR", "value is out of range, must be positive")
+	errReadOnly    = newCommandError("READONLY", "You can't write against a read only replica.")
+)
+
+func wrongArityError(name string) *commandError {
+	return newCommandError("ERR", "wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+func invalidExpireError(name string) *commandError {
+	return newCommandError("ERR", "invalid expire time in '%s' command", strings.ToLower(name))
+}
+
+// encodeCommandError turns any error returned by a handler into an error reply
+func encodeCommandError(err error) []byte {
+	var replyErr *commandError
+	if errors.As(err, &replyErr) {
+		return encodeError(replyErr.Error())
+	}
+
+	return encodeError("ERR " + err.Error())
+}
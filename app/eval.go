@@ -0,0 +1,233 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var errNoScript = newCommandError("NOSCRIPT", "No matching script. Please use EVAL.")
+
+// luaScript is a script loaded by EVAL or SCRIPT LOAD, compiled once and cached by its SHA1 digest
+type luaScript struct {
+	sha   string
+	fn    *lua.LFunction
+	flags scriptFlags
+}
+
+// the scripts run by EVAL share an interpreter, reset along with the cache by SCRIPT FLUSH.
+// Both are guarded by executionLock
+var (
+	evalEngine    *luaEngine
+	scriptsBySHA1 = map[string]*luaScript{}
+)
+
+// parseShebang separates the flags declared in a script's shebang line from its body,
+// blanking the line so that line numbers in errors still match
+func parseShebang(body string) (scriptFlags, string, error) {
+	flags := scriptFlags{}
+	if !strings.HasPrefix(body, "#!") {
+		return flags, body, nil
+	}
+
+	line, rest, _ := strings.Cut(body, "\n")
+	parts := strings.Fields(line)
+	if parts[0] != "#!lua" {
+		return flags, "", newCommandError("ERR", "Unexpected engine in script shebang: %s", parts[0])
+	}
+
+	flags.declared = true
+	for _, part := range parts[1:] {
+		list, ok := strings.CutPrefix(part, "flags=")
+		if !ok {
+			return flags, "", newCommandError("ERR", "Unknown lua shebang option: %s", part)
+		}
+		for flag := range strings.SplitSeq(list, ",") {
+			if flag != "" && !flags.add(flag) {
+				return flags, "", newCommandError("ERR", "Unexpected flag in script shebang: %s", flag)
+			}
+		}
+	}
+
+	return flags, "\n" + rest, nil
+}
+
+// loadScript compiles a script into the cache, unless it's there already
+func loadScript(body string) (*luaScript, error) {
+	sha := sha1Hex(body)
+	if script, exists := scriptsBySHA1[sha]; exists {
+		return script, nil
+	}
+
+	flags, body, err := parseShebang(body)
+	if err != nil {
+		return nil, err
+	}
+	if evalEngine == nil {
+		evalEngine = newLuaEngine()
+	}
+	fn, err := evalEngine.compile(body, "user_script")
+	if err != nil {
+		// syntax errors span several lines, which an error reply can't
+		message := strings.Join(strings.Fields(err.Error()), " ")
+		return nil, newCommandError("ERR", "Error compiling script (new function): %s", message)
+	}
+
+	script := &luaScript{sha: sha, fn: fn, flags: flags}
+	scriptsBySHA1[sha] = script
+	return script, nil
+}
+
+// parseScriptArgs splits the arguments following a script into KEYS and ARGV
+func parseScriptArgs(args []string) ([]string, []string, error) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, nil, errNotInteger
+	}
+	if numKeys < 0 {
+		return nil, nil, newCommandError("ERR", "Number of keys can't be negative")
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, newCommandError("ERR", "Number of keys can't be greater than number of args")
+	}
+
+	return args[1 : 1+numKeys], args[1+numKeys:], nil
+}
+
+func runScript(c *client, script *luaScript, array []string) ([]byte, error) {
+	keys, args, err := parseScriptArgs(array[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	readOnly := strings.HasSuffix(strings.ToLower(array[0]), "_ro")
+	if err := script.flags.checkCallable(c, readOnly); err != nil {
+		return nil, err
+	}
+
+	L := evalEngine.state
+	L.G.Global.RawSetString("KEYS", luaStringArray(L, keys))
+	L.G.Global.RawSetString("ARGV", luaStringArray(L, args))
+
+	return evalEngine.run(newScriptRun(c, script.sha, readOnly || script.flags.noWrites), script.fn)
+}
+
+// handleEval implements both EVAL and EVAL_RO, which refuses to run write commands
+func handleEval(c *client, array []string) ([]byte, error) {
+	script, err := loadScript(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return runScript(c, script, array)
+}
+
+func handleEvalSHA(c *client, array []string) ([]byte, error) {
+	script, exists := scriptsBySHA1[strings.ToLower(array[1])]
+	if !exists {
+		return nil, errNoScript
+	}
+
+	return runScript(c, script, array)
+}
+
+func handleScriptLoad(c *client, array []string) ([]byte, error) {
+	script, err := loadScript(array[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeBulkString(script.sha), nil
+}
+
+func handleScriptExists(c *client, array []string) ([]byte, error) {
+	results := make([][]byte, 0, len(array)-2)
+	for _, sha := range array[2:] {
+		_, exists := scriptsBySHA1[strings.ToLower(sha)]
+		results = append(results, encodeBoolean(resp2, exists))
+	}
+
+	return encodeArray(results), nil
+}
+
+// handleScriptFlush empties the script cache; ASYNC and SYNC are accepted, but the
+// cache is always emptied straight away
+func handleScriptFlush(c *client, array []string) ([]byte, error) {
+	if len(array) > 3 {
+		return nil, newCommandError("ERR", "SCRIPT FLUSH only support SYNC|ASYNC option")
+	}
+	if len(array) == 3 && !strings.EqualFold(array[2], "sync") && !strings.EqualFold(array[2], "async") {
+		return nil, newCommandError("ERR", "SCRIPT FLUSH only support SYNC|ASYNC option")
+	}
+
+	scriptsBySHA1 = map[string]*luaScript{}
+	if evalEngine != nil {
+		evalEngine.close()
+		evalEngine = nil
+	}
+
+	return encodeSimpleString("OK"), nil
+}
+
+func handleScriptKill(c *client, array []string) ([]byte, error) {
+	if err := killRunningScript(false); err != nil {
+		return nil, err
+	}
+
+	return encodeSimpleString("OK"), nil
+}
+
+func init() {
+	scriptContainer := &commandSpec{
+		Name: "script", Arity: -2, Group: "scripting",
+		Summary: "A container for Lua scripts management commands.", Since: "2.6.0",
+	}
+
+	registerCommands(
+		&commandSpec{
+			Name: "eval", Arity: -3, Flags: []string{"noscript", "stale", "skip_monitor", "may-replicate", "no_mandatory_keys"},
+			Group: "scripting", Summary: "Executes a server-side Lua script.", Since: "2.6.0",
+			Handler: handleEval,
+		},
+		&commandSpec{
+			Name: "eval_ro", Arity: -3, Flags: []string{"readonly", "noscript", "stale", "skip_monitor", "no_mandatory_keys"},
+			Group: "scripting", Summary: "Executes a read-only server-side Lua script.", Since: "7.0.0",
+			Handler: handleEval,
+		},
+		&commandSpec{
+			Name: "evalsha", Arity: -3, Flags: []string{"noscript", "stale", "skip_monitor", "may-replicate", "no_mandatory_keys"},
+			Group: "scripting", Summary: "Executes a server-side Lua script by SHA1 digest.", Since: "2.6.0",
+			Handler: handleEvalSHA,
+		},
+		&commandSpec{
+			Name: "evalsha_ro", Arity: -3, Flags: []string{"readonly", "noscript", "stale", "skip_monitor", "no_mandatory_keys"},
+			Group: "scripting", Summary: "Executes a read-only server-side Lua script by SHA1 digest.", Since: "7.0.0",
+			Handler: handleEvalSHA,
+		},
+		scriptContainer,
+	)
+
+	registerSubcommands(scriptContainer,
+		&commandSpec{
+			Name: "script|load", Arity: 3, Flags: []string{"noscript", "stale"}, Group: "scripting",
+			Summary: "Loads a server-side Lua script to the script cache.", Since: "2.6.0",
+			Handler: handleScriptLoad,
+		},
+		&commandSpec{
+			Name: "script|exists", Arity: -3, Flags: []string{"noscript"}, Group: "scripting",
+			Summary: "Determines whether server-side Lua scripts exist in the script cache.", Since: "2.6.0",
+			Handler: handleScriptExists,
+		},
+		&commandSpec{
+			Name: "script|flush", Arity: -2, Flags: []string{"noscript"}, Group: "scripting",
+			Summary: "Removes all server-side Lua scripts from the script cache.", Since: "2.6.0",
+			Handler: handleScriptFlush,
+		},
+		&commandSpec{
+			Name: "script|kill", Arity: 2, Flags: []string{"noscript", "allow_busy"}, Group: "scripting",
+			Summary: "Terminates a server-side Lua script during execution.", Since: "2.6.0",
+			Handler: handleScriptKill, Unlocked: true,
+		},
+	)
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var (
+	errFunctionNotFound = newCommandError("ERR", "Function not found")
+	errLibraryNotFound  = newCommandError("ERR", "Library not found")
+	errBadFunctionDump  = newCommandError("ERR", "payload version or checksum are wrong")
+)
+
+// functionLoadTimeout bounds how long a library's code can run while registering its functions
+const functionLoadTimeout = 500 * time.Millisecond
+
+// the RDB version FUNCTION DUMP payloads are tagged with
+const functionDumpVersion = 11
+
+var validFunctionName = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// functionLibrary is a library loaded by FUNCTION LOAD: Lua code that registers functions,
+// which FCALL then calls by name
+type functionLibrary struct {
+	name      string
+	code      string
+	functions map[string]*luaFunction
+}
+
+type luaFunction struct {
+	name        string
+	description string
+	flags       scriptFlags
+	callback    *lua.LFunction
+	library     *functionLibrary
+}
+
+// functionRegistry holds the loaded libraries, and their functions by name, which are
+// unique across libraries
+type functionRegistry struct {
+	libraries map[string]*functionLibrary
+	functions map[string]*luaFunction
+}
+
+// the libraries share an interpreter of their own, apart from the one EVAL scripts run in.
+// Both it and the registry are guarded by executionLock
+var (
+	functionEngine *luaEngine
+	functions      = newFunctionRegistry()
+)
+
+func newFunctionRegistry() *functionRegistry {
+	return &functionRegistry{libraries: map[string]*functionLibrary{}, functions: map[string]*luaFunction{}}
+}
+
+func (registry *functionRegistry) clone() *functionRegistry {
+	return &functionRegistry{libraries: maps.Clone(registry.libraries), functions: maps.Clone(registry.functions)}
+}
+
+// add installs a library, replacing the one of the same name if asked to
+func (registry *functionRegistry) add(lib *functionLibrary, replace bool) error {
+	if _, exists := registry.libraries[lib.name]; exists && !replace {
+		return newCommandError("ERR", "Library '%s' already exists", lib.name)
+	}
+	for name := range lib.functions {
+		if existing, exists := registry.functions[name]; exists && existing.library.name != lib.name {
+			return newCommandError("ERR", "Function %s already exists", name)
+		}
+	}
+
+	registry.remove(lib.name)
+	registry.libraries[lib.name] = lib
+	for name, fn := range lib.functions {
+		registry.functions[name] = fn
+	}
+	return nil
+}
+
+func (registry *functionRegistry) remove(name string) bool {
+	lib, exists := registry.libraries[name]
+	if !exists {
+		return false
+	}
+
+	delete(registry.libraries, name)
+	for name := range lib.functions {
+		delete(registry.functions, name)
+	}
+	return true
+}
+
+func (registry *functionRegistry) sortedLibraries() []*functionLibrary {
+	names := slices.Sorted(maps.Keys(registry.libraries))
+	libraries := make([]*functionLibrary, len(names))
+	for i, name := range names {
+		libraries[i] = registry.libraries[name]
+	}
+	return libraries
+}
+
+// parseLibraryShebang reads the library name from the first line of its code, e.g.
+// "#!lua name=mylib", blanking the line so that line numbers in errors still match
+func parseLibraryShebang(code string) (string, string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", newCommandError("ERR", "Missing library metadata")
+	}
+
+	line, rest, _ := strings.Cut(code, "\n")
+	parts := strings.Fields(line)
+	if engine := strings.TrimPrefix(parts[0], "#!"); !strings.EqualFold(engine, "lua") {
+		return "", "", newCommandError("ERR", "Engine '%s' not found", engine)
+	}
+
+	name := ""
+	for _, part := range parts[1:] {
+		value, ok := strings.CutPrefix(part, "name=")
+		if !ok {
+			return "", "", newCommandError("ERR", "Invalid metadata value given: %s", part)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", "", newCommandError("ERR", "Library name was not given")
+	}
+	if !validFunctionName.MatchString(name) {
+		return "", "", newCommandError(
+			"ERR", "Library names can only contain letters, numbers, or underscores(_) and must be at least one character long",
+		)
+	}
+
+	return name, "\n" + rest, nil
+}
+
+// compileLibrary runs a library's code to collect the functions it registers
+func compileLibrary(code string) (*functionLibrary, error) {
+	name, body, err := parseLibraryShebang(code)
+	if err != nil {
+		return nil, err
+	}
+
+	if functionEngine == nil {
+		functionEngine = newLuaEngine()
+	}
+	engine := functionEngine
+	L := engine.state
+
+	fn, err := engine.compile(body, "user_function")
+	if err != nil {
+		message := strings.Join(strings.Fields(err.Error()), " ")
+		return nil, newCommandError("ERR", "Error compiling function: %s", message)
+	}
+
+	lib := &functionLibrary{name: name, code: code, functions: map[string]*luaFunction{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	defer L.SetTop(0)
+
+	engine.loading = lib
+	L.Push(fn)
+	err = L.PCall(0, 0, nil)
+	engine.loading = nil
+
+	if ctx.Err() != nil {
+		return nil, newCommandError("ERR", "FUNCTION LOAD timeout")
+	}
+	if err != nil {
+		var apiErr *lua.ApiError
+		message := err.Error()
+		if errors.As(err, &apiErr) {
+			message = apiErr.Object.String()
+		}
+		return nil, newCommandError("ERR", "Error registering functions: %s", message)
+	}
+	if len(lib.functions) == 0 {
+		return nil, newCommandError("ERR", "No functions registered")
+	}
+
+	return lib, nil
+}
+
+// registerFunction implements redis.register_function(), called either with a name and a
+// callback or with a table that may also hold a description and flags
+func (engine *luaEngine) registerFunction(L *lua.LState) int {
+	fn := &luaFunction{library: engine.loading, flags: scriptFlags{declared: true}}
+
+	switch L.GetTop() {
+	case 1:
+		args := L.CheckTable(1)
+		args.ForEach(func(key, value lua.LValue) {
+			switch key.String() {
+			case "function_name":
+				name, ok := value.(lua.LString)
+				if !ok {
+					L.RaiseError("function_name argument given to redis.register_function must be a string")
+				}
+				fn.name = string(name)
+			case "callback":
+				callback, ok := value.(*lua.LFunction)
+				if !ok {
+					L.RaiseError("callback argument given to redis.register_function must be a function")
+				}
+				fn.callback = callback
+			case "description":
+				description, ok := value.(lua.LString)
+				if !ok {
+					L.RaiseError("description argument given to redis.register_function must be a string")
+				}
+				fn.description = string(description)
+			case "flags":
+				flags, ok := value.(*lua.LTable)
+				if !ok {
+					L.RaiseError("flags argument to redis.register_function must be a table representing function flags")
+				}
+				flags.ForEach(func(_, flag lua.LValue) {
+					if !fn.flags.add(flag.String()) {
+						L.RaiseError("unknown flag given")
+					}
+				})
+			default:
+				L.RaiseError("unknown argument given to redis.register_function")
+			}
+		})
+		if fn.name == "" {
+			L.RaiseError("redis.register_function must get a function name argument")
+		}
+		if fn.callback == nil {
+			L.RaiseError("redis.register_function must get a callback argument")
+		}
+	case 2:
+		fn.name = L.CheckString(1)
+		fn.callback = L.CheckFunction(2)
+	default:
+		L.RaiseError("wrong number of arguments to redis.register_function")
+	}
+
+	if !validFunctionName.MatchString(fn.name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if _, exists := fn.library.functions[fn.name]; exists {
+		L.RaiseError("Function already exists in the library")
+	}
+	fn.library.functions[fn.name] = fn
+
+	return 0
+}
+
+// replaceFunctionLibraries swaps in the libraries saved in an RDB file
+func replaceFunctionLibraries(codes []string) error {
+	registry := newFunctionRegistry()
+	for _, code := range codes {
+		lib, err := compileLibrary(code)
+		if err != nil {
+			return err
+		}
+		if err := registry.add(lib, false); err != nil {
+			return err
+		}
+	}
+
+	functions = registry
+	return nil
+}
+
+// functionLibraryCodes returns the code of every library, for saving to an RDB file
+func functionLibraryCodes() []string {
+	codes := []string{}
+	for _, lib := range functions.sortedLibraries() {
+		codes = append(codes, lib.code)
+	}
+	return codes
+}
+
+func handleFunctionLoad(c *client, array []string) ([]byte, error) {
+	replace := false
+	for _, arg := range array[2 : len(array)-1] {
+		if !strings.EqualFold(arg, "replace") {
+			return nil, newCommandError("ERR", "Unknown option given: %s", arg)
+		}
+		replace = true
+	}
+
+	lib, err := compileLibrary(array[len(array)-1])
+	if err != nil {
+		return nil, err
+	}
+	if err := functions.add(lib, replace); err != nil {
+		return nil, err
+	}
+	markDirty()
+
+	return encodeBulkString(lib.name), nil
+}
+
+// handleFCall implements both FCALL and FCALL_RO, which refuses to run write commands
+func handleFCall(c *client, array []string) ([]byte, error) {
+	fn, exists := functions.functions[array[1]]
+	if !exists {
+		return nil, errFunctionNotFound
+	}
+	keys, args, err := parseScriptArgs(array[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	readOnly := strings.HasSuffix(strings.ToLower(array[0]), "_ro")
+	if err := fn.flags.checkCallable(c, readOnly); err != nil {
+		return nil, err
+	}
+
+	run := newScriptRun(c, fn.name, readOnly || fn.flags.noWrites)
+	run.function = true
+
+	L := functionEngine.state
+	return functionEngine.run(run, fn.callback, luaStringArray(L, keys), luaStringArray(L, args))
+}
+
+func handleFunctionList(c *client, array []string) ([]byte, error) {
+	withCode, pattern := false, ""
+	for i := 2; i < len(array); i++ {
+		switch {
+		case strings.EqualFold(array[i], "withcode") && !withCode:
+			withCode = true
+		case strings.EqualFold(array[i], "libraryname") && pattern == "":
+			if i+1 >= len(array) {
+				return nil, newCommandError("ERR", "library name argument was not given")
+			}
+			pattern = array[i+1]
+			i++
+		default:
+			return nil, newCommandError("ERR", "Unknown argument %s", array[i])
+		}
+	}
+
+	libraries := [][]byte{}
+	for _, lib := range functions.sortedLibraries() {
+		if pattern != "" && !globMatch(pattern, lib.name) {
+			continue
+		}
+
+		libFunctions := [][]byte{}
+		for _, name := range slices.Sorted(maps.Keys(lib.functions)) {
+			fn := lib.functions[name]
+			description := encodeNull(c.protocol)
+			if fn.description != "" {
+				description = encodeBulkString(fn.description)
+			}
+			libFunctions = append(libFunctions, encodeMap(c.protocol, [][]byte{
+				encodeBulkString("name"), encodeBulkString(fn.name),
+				encodeBulkString("description"), description,
+				encodeBulkString("flags"), encodeBulkSet(c.protocol, fn.flags.names),
+			}))
+		}
+
+		fields := [][]byte{
+			encodeBulkString("library_name"), encodeBulkString(lib.name),
+			encodeBulkString("engine"), encodeBulkString("LUA"),
+			encodeBulkString("functions"), encodeArray(libFunctions),
+		}
+		if withCode {
+			fields = append(fields, encodeBulkString("library_code"), encodeBulkString(lib.code))
+		}
+		libraries = append(libraries, encodeMap(c.protocol, fields))
+	}
+
+	return encodeArray(libraries), nil
+}
+
+func handleFunctionDelete(c *client, array []string) ([]byte, error) {
+	if !functions.remove(array[2]) {
+		return nil, errLibraryNotFound
+	}
+	markDirty()
+
+	return encodeSimpleString("OK"), nil
+}
+
+// handleFunctionFlush deletes every library; ASYNC and SYNC are accepted, but the
+// libraries are always deleted straight away
+func handleFunctionFlush(c *client, array []string) ([]byte, error) {
+	if len(array) > 3 || (len(array) == 3 && !strings.EqualFold(array[2], "sync") && !strings.EqualFold(array[2], "async")) {
+		return nil, newCommandError("ERR", "FUNCTION FLUSH only supports SYNC|ASYNC option")
+	}
+
+	functions = newFunctionRegistry()
+	if functionEngine != nil {
+		functionEngine.close()
+		functionEngine = nil
+	}
+	markDirty()
+
+	return encodeSimpleString("OK"), nil
+}
+
+// handleFunctionDump serialises every library the way they're saved to RDB files, followed
+// by the RDB version and a checksum, like DUMP payloads
+func handleFunctionDump(c *client, array []string) ([]byte, error) {
+	payload := []byte{}
+	for _, code := range functionLibraryCodes() {
+		payload = appendRDBString(append(payload, rdbOpcodeFunction), code)
+	}
+	payload = binary.LittleEndian.AppendUint16(payload, functionDumpVersion)
+	payload = append(payload, getChecksum(payload)...)
+
+	return encodeBulkString(string(payload)), nil
+}
+
+// handleFunctionRestore loads the libraries of a FUNCTION DUMP payload. By default (APPEND)
+// a library that already exists is an error; REPLACE replaces it instead, and FLUSH deletes
+// every library first. Either all of the libraries are restored or none are
+func handleFunctionRestore(c *client, array []string) ([]byte, error) {
+	policy := "append"
+	if len(array) > 4 {
+		return nil, errSyntax
+	}
+	if len(array) == 4 {
+		policy = strings.ToLower(array[3])
+		if policy != "append" && policy != "replace" && policy != "flush" {
+			return nil, newCommandError(
+				"ERR", "Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.",
+			)
+		}
+	}
+
+	payload := []byte(array[2])
+	if len(payload) < 10 {
+		return nil, errBadFunctionDump
+	}
+	body, footer := payload[:len(payload)-10], payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > functionDumpVersion ||
+		!bytes.Equal(getChecksum(payload[:len(payload)-8]), footer[2:]) {
+		return nil, errBadFunctionDump
+	}
+
+	registry := functions.clone()
+	if policy == "flush" {
+		registry = newFunctionRegistry()
+	}
+
+	r := &rdbReader{data: body}
+	for r.pos < len(body) {
+		opcode, err := r.readByte()
+		if err != nil || opcode != rdbOpcodeFunction {
+			return nil, newCommandError("ERR", "given type is not a function")
+		}
+		code, err := r.readString()
+		if err != nil {
+			return nil, newCommandError("ERR", "failed loading the given functions payload")
+		}
+
+		lib, err := compileLibrary(code)
+		if err != nil {
+			return nil, err
+		}
+		if err := registry.add(lib, policy == "replace"); err != nil {
+			return nil, err
+		}
+	}
+
+	functions = registry
+	markDirty()
+
+	return encodeSimpleString("OK"), nil
+}
+
+func handleFunctionKill(c *client, array []string) ([]byte, error) {
+	if err := killRunningScript(true); err != nil {
+		return nil, err
+	}
+
+	return encodeSimpleString("OK"), nil
+}
+
+func init() {
+	functionContainer := &commandSpec{
+		Name: "function", Arity: -2, Group: "scripting",
+		Summary: "A container for function commands.", Since: "7.0.0",
+	}
+
+	registerCommands(
+		&commandSpec{
+			Name: "fcall", Arity: -3, Flags: []string{"noscript", "stale", "skip_monitor", "may-replicate", "no_mandatory_keys"},
+			Group: "scripting", Summary: "Invokes a function.", Since: "7.0.0",
+			Handler: handleFCall,
+		},
+		&commandSpec{
+			Name: "fcall_ro", Arity: -3, Flags: []string{"readonly", "noscript", "stale", "skip_monitor", "no_mandatory_keys"},
+			Group: "scripting", Summary: "Invokes a read-only function.", Since: "7.0.0",
+			Handler: handleFCall,
+		},
+		functionContainer,
+	)
+
+	registerSubcommands(functionContainer,
+		&commandSpec{
+			Name: "function|load", Arity: -3, Flags: []string{"write", "denyoom", "noscript"}, Group: "scripting",
+			Summary: "Creates a library.", Since: "7.0.0",
+			Handler: handleFunctionLoad,
+		},
+		&commandSpec{
+			Name: "function|list", Arity: -2, Flags: []string{"noscript"}, Group: "scripting",
+			Summary: "Returns information about all libraries.", Since: "7.0.0",
+			Handler: handleFunctionList,
+		},
+		&commandSpec{
+			Name: "function|delete", Arity: 3, Flags: []string{"write", "noscript"}, Group: "scripting",
+			Summary: "Deletes a library and its functions.", Since: "7.0.0",
+			Handler: handleFunctionDelete,
+		},
+		&commandSpec{
+			Name: "function|flush", Arity: -2, Flags: []string{"write", "noscript"}, Group: "scripting",
+			Summary: "Deletes all libraries and functions.", Since: "7.0.0",
+			Handler: handleFunctionFlush,
+		},
+		&commandSpec{
+			Name: "function|dump", Arity: 2, Flags: []string{"noscript"}, Group: "scripting",
+			Summary: "Dumps all libraries into a serialized binary payload.", Since: "7.0.0",
+			Handler: handleFunctionDump,
+		},
+		&commandSpec{
+			Name: "function|restore", Arity: -3, Flags: []string{"write", "denyoom", "noscript"}, Group: "scripting",
+			Summary: "Restores all libraries from a payload.", Since: "7.0.0",
+			Handler: handleFunctionRestore,
+		},
+		&commandSpec{
+			Name: "function|kill", Arity: 2, Flags: []string{"noscript", "allow_busy"}, Group: "scripting",
+			Summary: "Terminates a function during execution.", Since: "7.0.0",
+			Handler: handleFunctionKill, Unlocked: true,
+		},
+	)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func handleDel(c *client, array []string) ([]byte, error) {
+	deleted := 0
+	for _, key := range array[1:] {
+		if store.delete(key) {
+			deleted++
+		}
+	}
+
+	return encodeInteger(deleted), nil
+}
+
+func handleExists(c *client, array []string) ([]byte, error) {
+	// keys are counted as many times as they're mentioned, like Redis does
+	count := 0
+	for _, key := range array[1:] {
+		if _, exists := store.get(key); exists {
+			count++
+		}
+	}
+
+	return encodeInteger(count), nil
+}
+
+func handleType(c *client, array []string) ([]byte, error) {
+	e, exists := store.get(array[1])
+	if !exists {
+		return encodeSimpleString("none"), nil
+	}
+
+	return encodeSimpleString(e.Type.String()), nil
+}
+
+func handleRename(c *client, array []string) ([]byte, error) {
+	source, destination := array[1], array[2]
+	onlyIfMissing := strings.EqualFold(array[0], "renamenx")
+
+	e, exists := store.get(source)
+	if !exists {
+		return nil, errNoSuchKey
+	}
+
+	if source == destination {
+		if onlyIfMissing {
+			return encodeInteger(0), nil
+		}
+		return encodeSimpleString("OK"), nil
+	}
+
+	if onlyIfMissing {
+		if _, exists := store.get(destination); exists {
+			return encodeInteger(0), nil
+		}
+	}
+
+	store.delete(source)
+	store.set(destination, e)
+
+	if onlyIfMissing {
+		return encodeInteger(1), nil
+	}
+	return encodeSimpleString("OK"), nil
+}
+
+func handleCopy(c *client, array []string) ([]byte, error) {
+	source, destination := array[1], array[2]
+
+	replace, target := false, store
+	for i := 3; i < len(array); i++ {
+		option := strings.ToUpper(array[i])
+		switch {
+		case option == "REPLACE":
+			replace = true
+		case option == "DB" && i+1 < len(array):
+			db, err := parseDatabaseIndex(array[i+1])
+			if err != nil {
+				return nil, err
+			}
+			target = databases[db]
+			i++
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	if source == destination && target == store {
+		return nil, newCommandError("ERR", "source and destination objects are the same")
+	}
+
+	e, exists := store.get(source)
+	if !exists {
+		return encodeInteger(0), nil
+	}
+	if _, exists := target.get(destination); exists && !replace {
+		return encodeInteger(0), nil
+	}
+
+	target.set(destination, e.clone())
+	return encodeInteger(1), nil
+}
+
+func handleTouch(c *client, array []string) ([]byte, error) {
+	touched := 0
+	for _, key := range array[1:] {
+		if _, exists := store.get(key); exists {
+			touched++
+		}
+	}
+
+	return encodeInteger(touched), nil
+}
+
+// handleExpire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT, which differ only
+// in the unit of their argument and whether it's relative to now
+func handleExpire(c *client, array []string) ([]byte, error) {
+	command := strings.ToLower(array[0])
+	key := array[1]
+
+	when, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+
+	nx, xx, gt, lt := false, false, false, false
+	for _, arg := range array[3:] {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return nil, newCommandError("ERR", "Unsupported option %s", arg)
+		}
+	}
+	if (nx && (xx || gt || lt)) || (gt && lt) {
+		return nil, newCommandError("ERR", "NX and XX, GT or LT options at the same time are not compatible")
+	}
+
+	// work out the absolute expiry in milliseconds, guarding against overflow
+	if command == "expire" || command == "expireat" {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			return nil, invalidExpireError(command)
+		}
+		when *= 1000
+	}
+	if command == "expire" || command == "pexpire" {
+		now := time.Now().UnixMilli()
+		if when > math.MaxInt64-now {
+			return nil, invalidExpireError(command)
+		}
+		when += now
+	}
+
+	e, exists := store.get(key)
+	if !exists {
+		return encodeInteger(0), nil
+	}
+
+	// a key without an expiry counts as having an infinite TTL
+	switch {
+	case nx && e.ExpiryPtr != nil,
+		xx && e.ExpiryPtr == nil,
+		gt && (e.ExpiryPtr == nil || when <= e.ExpiryPtr.Timestamp.UnixMilli()),
+		lt && e.ExpiryPtr != nil && when >= e.ExpiryPtr.Timestamp.UnixMilli():
+		return encodeInteger(0), nil
+	}
+
+	if when <= time.Now().UnixMilli() {
+		store.delete(key)
+		c.propagateAs = append(c.propagateAs, []string{"DEL", key})
+		return encodeInteger(1), nil
+	}
+
+	store.setExpiry(key, &expiry{time.UnixMilli(when)})
+	c.propagateAs = append(c.propagateAs, []string{"PEXPIREAT", key, strconv.FormatInt(when, 10)})
+
+	return encodeInteger(1), nil
+}
+
+// handleExpireTime implements EXPIRETIME and PEXPIRETIME
+func handleExpireTime(c *client, array []string) ([]byte, error) {
+	e, exists := store.get(array[1])
+	if !exists {
+		return encodeInteger(-2), nil
+	}
+	if e.ExpiryPtr == nil {
+		return encodeInteger(-1), nil
+	}
+
+	if strings.EqualFold(array[0], "pexpiretime") {
+		return encodeInteger(int(e.ExpiryPtr.Timestamp.UnixMilli())), nil
+	}
+	return encodeInteger(int(e.ExpiryPtr.Timestamp.Unix())), nil
+}
+
+// handleTTL implements TTL and PTTL
+func handleTTL(c *client, array []string) ([]byte, error) {
+	e, exists := store.get(array[1])
+	if !exists {
+		return encodeInteger(-2), nil
+	}
+	if e.ExpiryPtr == nil {
+		return encodeInteger(-1), nil
+	}
+
+	remaining := max(e.ExpiryPtr.Timestamp.UnixMilli()-time.Now().UnixMilli(), 0)
+	if strings.EqualFold(array[0], "pttl") {
+		return encodeInteger(int(remaining)), nil
+	}
+	return encodeInteger(int((remaining + 500) / 1000)), nil
+}
+
+func handlePersist(c *client, array []string) ([]byte, error) {
+	e, exists := store.get(array[1])
+	if !exists || e.ExpiryPtr == nil {
+		return encodeInteger(0), nil
+	}
+
+	store.setExpiry(array[1], nil)
+	return encodeInteger(1), nil
+}
+
+func handleRandomKey(c *client, array []string) ([]byte, error) {
+	key, exists := store.randomKey()
+	if !exists {
+		return encodeNull(c.protocol), nil
+	}
+
+	return encodeBulkString(key), nil
+}
+
+func handleDBSize(c *client, array []string) ([]byte, error) {
+	return encodeInteger(store.size()), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "del", Arity: -2, Flags: []string{"write"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "generic", Summary: "Deletes one or more keys.", Since: "1.0.0",
+			Handler: handleDel,
+		},
+		&commandSpec{
+			Name: "unlink", Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "generic", Summary: "Asynchronously deletes one or more keys.", Since: "4.0.0",
+			Handler: handleDel,
+		},
+		&commandSpec{
+			Name: "exists", Arity: -2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "generic", Summary: "Determines whether one or more keys exist.", Since: "1.0.0",
+			Handler: handleExists,
+		},
+		&commandSpec{
+			Name: "type", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Determines the type of value stored at a key.", Since: "1.0.0",
+			Handler: handleType,
+		},
+		&commandSpec{
+			Name: "rename", Arity: 3, Flags: []string{"write"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "generic", Summary: "Renames a key and overwrites the destination.", Since: "1.0.0",
+			Handler: handleRename,
+		},
+		&commandSpec{
+			Name: "renamenx", Arity: 3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "generic", Summary: "Renames a key only when the target key name doesn't exist.", Since: "1.0.0",
+			Handler: handleRename,
+		},
+		&commandSpec{
+			Name: "copy", Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "generic", Summary: "Copies the value of a key to a new key.", Since: "6.2.0",
+			Handler: handleCopy,
+		},
+		&commandSpec{
+			Name: "touch", Arity: -2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "generic", Summary: "Returns the number of existing keys out of those specified after updating the time they were last accessed.",
+			Since: "3.2.1", Handler: handleTouch,
+		},
+		&commandSpec{
+			Name: "expire", Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Sets the expiration time of a key in seconds.", Since: "1.0.0",
+			Handler: handleExpire,
+		},
+		&commandSpec{
+			Name: "pexpire", Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Sets the expiration time of a key in milliseconds.", Since: "2.6.0",
+			Handler: handleExpire,
+		},
+		&commandSpec{
+			Name: "expireat", Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Sets the expiration time of a key to a Unix timestamp.", Since: "1.2.0",
+			Handler: handleExpire,
+		},
+		&commandSpec{
+			Name: "pexpireat", Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Sets the expiration time of a key to a Unix milliseconds timestamp.", Since: "2.6.0",
+			Handler: handleExpire,
+		},
+		&commandSpec{
+			Name: "expiretime", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Returns the expiration time of a key as a Unix timestamp.", Since: "7.0.0",
+			Handler: handleExpireTime,
+		},
+		&commandSpec{
+			Name: "pexpiretime", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Returns the expiration time of a key as a Unix milliseconds timestamp.", Since: "7.0.0",
+			Handler: handleExpireTime,
+		},
+		&commandSpec{
+			Name: "ttl", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Returns the expiration time in seconds of a key.", Since: "1.0.0",
+			Handler: handleTTL,
+		},
+		&commandSpec{
+			Name: "pttl", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Returns the expiration time in milliseconds of a key.", Since: "2.6.0",
+			Handler: handleTTL,
+		},
+		&commandSpec{
+			Name: "persist", Arity: 2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Removes the expiration time of a key.", Since: "2.2.0",
+			Handler: handlePersist,
+		},
+		&commandSpec{
+			Name: "randomkey", Arity: 1, Flags: []string{"readonly"}, Group: "generic",
+			Summary: "Returns a random key name from the database.", Since: "1.0.0",
+			Handler: handleRandomKey,
+		},
+		&commandSpec{
+			Name: "dbsize", Arity: 1, Flags: []string{"readonly", "fast"}, Group: "server",
+			Summary: "Returns the number of keys in the database.", Since: "1.0.0",
+			Handler: handleDBSize,
+		},
+	)
+}
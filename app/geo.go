@@ -0,0 +1,616 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// geo commands keep points in a sorted set, scored by the 52-bit geohash of each point
+
+// parseLongLat parses a longitude and latitude, which must be within what a geohash can hold
+func parseLongLat(lonArg, latArg string) (float64, float64, error) {
+	longitude, err := parseDouble(lonArg)
+	if err != nil || math.IsNaN(longitude) {
+		return 0, 0, errNotFloat
+	}
+	latitude, err := parseDouble(latArg)
+	if err != nil || math.IsNaN(latitude) {
+		return 0, 0, errNotFloat
+	}
+
+	if longitude < geoLongMin || longitude > geoLongMax || latitude < geoLatMin || latitude > geoLatMax {
+		return 0, 0, newCommandError("ERR", "invalid longitude,latitude pair %f,%f", longitude, latitude)
+	}
+
+	return longitude, latitude, nil
+}
+
+// parseGeoUnit returns the number of meters in a unit of distance
+func parseGeoUnit(arg string) (float64, error) {
+	switch strings.ToLower(arg) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	default:
+		return 0, newCommandError("ERR", "unsupported unit provided. please use M, KM, FT, MI")
+	}
+}
+
+// formatGeoDistance formats a distance the way Redis replies with one, to four decimal places
+func formatGeoDistance(distance float64) string {
+	return strconv.FormatFloat(distance, 'f', 4, 64)
+}
+
+// encodeCoordinate encodes a longitude or latitude with all the precision of the stored geohash
+func encodeCoordinate(protocol int, coordinate float64) []byte {
+	formatted := strconv.FormatFloat(coordinate, 'f', 17, 64)
+	formatted = strings.TrimRight(strings.TrimRight(formatted, "0"), ".")
+	if formatted == "-0" {
+		formatted = "0"
+	}
+
+	if protocol != resp3 {
+		return encodeBulkString(formatted)
+	}
+	return fmt.Appendf(nil, ",%s\r\n", formatted)
+}
+
+func handleGeoAdd(c *client, array []string) ([]byte, error) {
+	key := array[1]
+	nx, xx := false, false
+
+	// GEOADD is ZADD with the coordinates turned into scores
+	zadd := []string{"zadd", key}
+	i := 2
+options:
+	for ; i < len(array); i++ {
+		switch strings.ToUpper(array[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+		default:
+			break options
+		}
+		zadd = append(zadd, array[i])
+	}
+
+	triples := array[i:]
+	if len(triples) == 0 || len(triples)%3 != 0 || (nx && xx) {
+		return nil, errSyntax
+	}
+
+	for j := 0; j < len(triples); j += 3 {
+		longitude, latitude, err := parseLongLat(triples[j], triples[j+1])
+		if err != nil {
+			return nil, err
+		}
+		score, _ := geoScore(longitude, latitude)
+		zadd = append(zadd, strconv.FormatFloat(score, 'f', -1, 64), triples[j+2])
+	}
+
+	return handleZAdd(c, zadd)
+}
+
+func handleGeoDist(c *client, array []string) ([]byte, error) {
+	conversion := 1.0
+	switch len(array) {
+	case 4:
+	case 5:
+		var err error
+		if conversion, err = parseGeoUnit(array[4]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errSyntax
+	}
+
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return encodeNull(c.protocol), nil
+	}
+
+	score1, exists1 := z.score(array[2])
+	score2, exists2 := z.score(array[3])
+	if !exists1 || !exists2 {
+		return encodeNull(c.protocol), nil
+	}
+
+	lon1, lat1 := geoDecodeScore(score1)
+	lon2, lat2 := geoDecodeScore(score2)
+
+	return encodeBulkString(formatGeoDistance(geoDistance(lon1, lat1, lon2, lat2) / conversion)), nil
+}
+
+// the alphabet of standard geohash strings, which skips a, i, l and o
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+func handleGeoHash(c *client, array []string) ([]byte, error) {
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([][]byte, 0, len(array)-2)
+	for _, member := range array[2:] {
+		var score float64
+		exists := false
+		if z != nil {
+			score, exists = z.score(member)
+		}
+		if !exists {
+			hashes = append(hashes, encodeNull(c.protocol))
+			continue
+		}
+
+		// standard geohashes cover latitudes from -90 to 90 rather than just the Mercator ones,
+		// so the point is hashed again
+		longitude, latitude := geoDecodeScore(score)
+		h, _ := geohashEncode(wgs84Longitude, geoRange{-90, 90}, longitude, latitude, geoStepMax)
+
+		var hash [11]byte
+		for i := range hash {
+			index := 0
+			// 52 bits make ten characters; the eleventh is padding
+			if i < 10 {
+				index = int(h.bits>>(52-(i+1)*5)) & 0x1F
+			}
+			hash[i] = geohashAlphabet[index]
+		}
+		hashes = append(hashes, encodeBulkString(string(hash[:])))
+	}
+
+	return encodeArray(hashes), nil
+}
+
+func handleGeoPos(c *client, array []string) ([]byte, error) {
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make([][]byte, 0, len(array)-2)
+	for _, member := range array[2:] {
+		var score float64
+		exists := false
+		if z != nil {
+			score, exists = z.score(member)
+		}
+		if !exists {
+			positions = append(positions, encodeNullArray(c.protocol))
+			continue
+		}
+
+		longitude, latitude := geoDecodeScore(score)
+		positions = append(positions, encodeArray([][]byte{
+			encodeCoordinate(c.protocol, longitude), encodeCoordinate(c.protocol, latitude),
+		}))
+	}
+
+	return encodeArray(positions), nil
+}
+
+// geoShape is the area searched by GEOSEARCH: a circle or a box centred on a point, measured
+// in some unit
+type geoShape struct {
+	longitude, latitude float64
+	box                 bool
+	radius              float64
+	width, height       float64
+	// conversion is the number of meters in the unit
+	conversion float64
+}
+
+// boundingBox returns the longitudes and latitudes enclosing the shape
+func (shape *geoShape) boundingBox() (geoRange, geoRange) {
+	height, width := shape.radius, shape.radius
+	if shape.box {
+		height, width = shape.height/2, shape.width/2
+	}
+	height *= shape.conversion
+	width *= shape.conversion
+
+	latDelta := radiansToDegrees(height / earthRadiusMeters)
+	longDeltaTop := radiansToDegrees(width / earthRadiusMeters / math.Cos(degreesToRadians(shape.latitude+latDelta)))
+	longDeltaBottom := radiansToDegrees(width / earthRadiusMeters / math.Cos(degreesToRadians(shape.latitude-latDelta)))
+
+	// the box is widest on the side nearest the equator
+	longDelta := longDeltaTop
+	if shape.latitude < 0 {
+		longDelta = longDeltaBottom
+	}
+
+	return geoRange{shape.longitude - longDelta, shape.longitude + longDelta},
+		geoRange{shape.latitude - latDelta, shape.latitude + latDelta}
+}
+
+// distance returns how far a point is from the centre of the shape in meters, if it's within the shape
+func (shape *geoShape) distance(longitude, latitude float64) (float64, bool) {
+	if !shape.box {
+		distance := geoDistance(shape.longitude, shape.latitude, longitude, latitude)
+		return distance, distance <= shape.radius*shape.conversion
+	}
+
+	// the latitude is cheaper to check, so it goes first
+	if geoLatitudeDistance(latitude, shape.latitude) > shape.height*shape.conversion/2 {
+		return 0, false
+	}
+	if geoDistance(longitude, latitude, shape.longitude, latitude) > shape.width*shape.conversion/2 {
+		return 0, false
+	}
+
+	return geoDistance(shape.longitude, shape.latitude, longitude, latitude), true
+}
+
+// searchAreas returns the geohash cells to look in: the one holding the centre of the shape, at a
+// precision where its neighbours cover the whole shape, and those neighbours that overlap it
+func (shape *geoShape) searchAreas() []geoHash {
+	longitudes, latitudes := shape.boundingBox()
+
+	radius := shape.radius
+	if shape.box {
+		// the distance from the centre to a corner
+		radius = math.Sqrt(shape.width*shape.width/4 + shape.height*shape.height/4)
+	}
+	steps := geoStepsForRadius(radius*shape.conversion, shape.latitude)
+
+	h, _ := geohashEncode(wgs84Longitude, wgs84Latitude, shape.longitude, shape.latitude, steps)
+	neighbors := h.neighbors()
+
+	// near the edge of the centre cell a neighbour may not reach far enough, in which case
+	// bigger cells are used
+	decode := func(h geoHash) geoArea {
+		return geohashDecode(wgs84Longitude, wgs84Latitude, h)
+	}
+	if steps > 1 && (decode(neighbors.north).latitude.max < latitudes.max ||
+		decode(neighbors.south).latitude.min > latitudes.min ||
+		decode(neighbors.east).longitude.max < longitudes.max ||
+		decode(neighbors.west).longitude.min > longitudes.min) {
+		steps--
+		h, _ = geohashEncode(wgs84Longitude, wgs84Latitude, shape.longitude, shape.latitude, steps)
+		neighbors = h.neighbors()
+	}
+
+	// leave out neighbours on sides the shape doesn't reach
+	if area := decode(h); steps >= 2 {
+		if area.latitude.min < latitudes.min {
+			neighbors.south, neighbors.southWest, neighbors.southEast = geoHash{}, geoHash{}, geoHash{}
+		}
+		if area.latitude.max > latitudes.max {
+			neighbors.north, neighbors.northEast, neighbors.northWest = geoHash{}, geoHash{}, geoHash{}
+		}
+		if area.longitude.min < longitudes.min {
+			neighbors.west, neighbors.southWest, neighbors.northWest = geoHash{}, geoHash{}, geoHash{}
+		}
+		if area.longitude.max > longitudes.max {
+			neighbors.east, neighbors.southEast, neighbors.northEast = geoHash{}, geoHash{}, geoHash{}
+		}
+	}
+
+	areas := []geoHash{}
+	for _, area := range []geoHash{
+		h, neighbors.north, neighbors.south, neighbors.east, neighbors.west,
+		neighbors.northEast, neighbors.northWest, neighbors.southEast, neighbors.southWest,
+	} {
+		// with huge radiuses, neighbours can wrap around onto each other
+		if !area.isZero() && !slices.Contains(areas, area) {
+			areas = append(areas, area)
+		}
+	}
+
+	return areas
+}
+
+type geoPoint struct {
+	member              string
+	score               float64
+	longitude, latitude float64
+	// distance is in meters
+	distance float64
+}
+
+// search returns the members of z within the shape, stopping after limit of them unless it's 0
+func (shape *geoShape) search(z *zsetValue, limit int) []geoPoint {
+	points := []geoPoint{}
+	for _, area := range shape.searchAreas() {
+		lowest, highest := area.scoreRange()
+		r := &scoreRange{min: lowest, max: highest, maxExclusive: true}
+
+		for x := z.zsl.firstInScoreRange(r); x != nil && r.belowMax(x.score); x = x.level[0].forward {
+			longitude, latitude := geoDecodeScore(x.score)
+			distance, ok := shape.distance(longitude, latitude)
+			if !ok {
+				continue
+			}
+
+			points = append(points, geoPoint{x.member, x.score, longitude, latitude, distance})
+			if limit > 0 && len(points) >= limit {
+				return points
+			}
+		}
+	}
+
+	return points
+}
+
+type geoSearchRequest struct {
+	shape                         geoShape
+	fromMember                    string
+	hasFrom, hasBy, fromLongLat   bool
+	descending, sorted            bool
+	count                         int
+	any                           bool
+	withCoord, withDist, withHash bool
+	storeDist                     bool
+}
+
+// parseGeoSearch parses the options of GEOSEARCH and GEOSEARCHSTORE, which start at args
+func parseGeoSearch(args []string, store bool) (*geoSearchRequest, error) {
+	request := &geoSearchRequest{}
+	shape := &request.shape
+
+	for i := 0; i < len(args); i++ {
+		remaining := len(args) - i - 1
+		switch option := strings.ToUpper(args[i]); {
+		case option == "FROMMEMBER" && remaining >= 1:
+			if request.hasFrom {
+				return nil, errSyntax
+			}
+			request.hasFrom, request.fromMember = true, args[i+1]
+			i++
+		case option == "FROMLONLAT" && remaining >= 2:
+			if request.hasFrom {
+				return nil, errSyntax
+			}
+			var err error
+			if shape.longitude, shape.latitude, err = parseLongLat(args[i+1], args[i+2]); err != nil {
+				return nil, err
+			}
+			request.hasFrom, request.fromLongLat = true, true
+			i += 2
+		case option == "BYRADIUS" && remaining >= 2:
+			if request.hasBy {
+				return nil, errSyntax
+			}
+			radius, err := parseDouble(args[i+1])
+			if err != nil || math.IsNaN(radius) {
+				return nil, newCommandError("ERR", "need numeric radius")
+			}
+			if radius < 0 {
+				return nil, newCommandError("ERR", "radius cannot be negative")
+			}
+			if shape.conversion, err = parseGeoUnit(args[i+2]); err != nil {
+				return nil, err
+			}
+			shape.radius = radius
+			request.hasBy = true
+			i += 2
+		case option == "BYBOX" && remaining >= 3:
+			if request.hasBy {
+				return nil, errSyntax
+			}
+			width, err := parseDouble(args[i+1])
+			if err != nil || math.IsNaN(width) {
+				return nil, newCommandError("ERR", "need numeric width")
+			}
+			height, err := parseDouble(args[i+2])
+			if err != nil || math.IsNaN(height) {
+				return nil, newCommandError("ERR", "need numeric height")
+			}
+			if width < 0 || height < 0 {
+				return nil, newCommandError("ERR", "height or width cannot be negative")
+			}
+			if shape.conversion, err = parseGeoUnit(args[i+3]); err != nil {
+				return nil, err
+			}
+			shape.box, shape.width, shape.height = true, width, height
+			request.hasBy = true
+			i += 3
+		case option == "ASC":
+			request.sorted, request.descending = true, false
+		case option == "DESC":
+			request.sorted, request.descending = true, true
+		case option == "COUNT" && remaining >= 1:
+			count, ok := parseInteger(args[i+1])
+			if !ok {
+				return nil, errNotInteger
+			}
+			if count <= 0 {
+				return nil, newCommandError("ERR", "COUNT must be > 0")
+			}
+			request.count = int(count)
+			i++
+		case option == "ANY":
+			request.any = true
+		case option == "WITHCOORD" && !store:
+			request.withCoord = true
+		case option == "WITHDIST" && !store:
+			request.withDist = true
+		case option == "WITHHASH" && !store:
+			request.withHash = true
+		case option == "STOREDIST" && store:
+			request.storeDist = true
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	command := "GEOSEARCH"
+	if store {
+		command = "GEOSEARCHSTORE"
+	}
+	if !request.hasFrom {
+		return nil, newCommandError("ERR", "exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", strings.ToLower(command))
+	}
+	if !request.hasBy {
+		return nil, newCommandError("ERR", "exactly one of BYRADIUS and BYBOX can be specified for %s", strings.ToLower(command))
+	}
+	if request.any && request.count == 0 {
+		return nil, newCommandError("ERR", "the ANY argument requires COUNT argument")
+	}
+
+	return request, nil
+}
+
+// run finds the points the request asks for in z, which may be nil
+func (request *geoSearchRequest) run(z *zsetValue) ([]geoPoint, error) {
+	shape := &request.shape
+	if !request.fromLongLat {
+		score, exists := 0.0, false
+		if z != nil {
+			score, exists = z.score(request.fromMember)
+		}
+		if !exists {
+			return nil, newCommandError("ERR", "could not decode requested zset member")
+		}
+		shape.longitude, shape.latitude = geoDecodeScore(score)
+	}
+	if z == nil {
+		return nil, nil
+	}
+
+	// with ANY the search stops at the first matches found, otherwise the nearest are kept
+	limit := 0
+	if request.any {
+		limit = request.count
+	}
+	points := shape.search(z, limit)
+
+	if request.sorted || request.count > 0 && !request.any {
+		slices.SortStableFunc(points, func(a, b geoPoint) int {
+			if request.descending {
+				a, b = b, a
+			}
+			switch {
+			case a.distance < b.distance:
+				return -1
+			case a.distance > b.distance:
+				return 1
+			default:
+				return 0
+			}
+		})
+	}
+	if request.count > 0 && len(points) > request.count {
+		points = points[:request.count]
+	}
+
+	return points, nil
+}
+
+func handleGeoSearch(c *client, array []string) ([]byte, error) {
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := parseGeoSearch(array[2:], false)
+	if err != nil {
+		return nil, err
+	}
+	points, err := request.run(z)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([][]byte, 0, len(points))
+	for _, point := range points {
+		if !request.withDist && !request.withHash && !request.withCoord {
+			results = append(results, encodeBulkString(point.member))
+			continue
+		}
+
+		result := [][]byte{encodeBulkString(point.member)}
+		if request.withDist {
+			result = append(result, encodeBulkString(formatGeoDistance(point.distance/request.shape.conversion)))
+		}
+		if request.withHash {
+			result = append(result, encodeInteger(int(point.score)))
+		}
+		if request.withCoord {
+			result = append(result, encodeArray([][]byte{
+				encodeCoordinate(c.protocol, point.longitude), encodeCoordinate(c.protocol, point.latitude),
+			}))
+		}
+		results = append(results, encodeArray(result))
+	}
+
+	return encodeArray(results), nil
+}
+
+func handleGeoSearchStore(c *client, array []string) ([]byte, error) {
+	destination := array[1]
+
+	z, err := getZset(array[2])
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := parseGeoSearch(array[3:], true)
+	if err != nil {
+		return nil, err
+	}
+	points, err := request.run(z)
+	if err != nil {
+		return nil, err
+	}
+
+	result := newZsetValue()
+	for _, point := range points {
+		score := point.score
+		if request.storeDist {
+			score = point.distance / request.shape.conversion
+		}
+		result.set(point.member, score)
+	}
+	storeZset(destination, result)
+
+	return encodeInteger(result.len()), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "geoadd", Arity: -5, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "geo", Summary: "Adds one or more members to a geospatial index. The key is created if it doesn't exist.",
+			Since: "3.2.0", Handler: handleGeoAdd,
+		},
+		&commandSpec{
+			Name: "geodist", Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "geo", Summary: "Returns the distance between two members of a geospatial index.", Since: "3.2.0",
+			Handler: handleGeoDist,
+		},
+		&commandSpec{
+			Name: "geohash", Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "geo", Summary: "Returns members from a geospatial index as geohash strings.", Since: "3.2.0",
+			Handler: handleGeoHash,
+		},
+		&commandSpec{
+			Name: "geopos", Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "geo", Summary: "Returns the longitude and latitude of members from a geospatial index.",
+			Since: "3.2.0", Handler: handleGeoPos,
+		},
+		&commandSpec{
+			Name: "geosearch", Arity: -7, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "geo", Summary: "Queries a geospatial index for members inside an area of a box or a circle.",
+			Since: "6.2.0", Handler: handleGeoSearch,
+		},
+		&commandSpec{
+			Name: "geosearchstore", Arity: -8, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "geo", Summary: "Queries a geospatial index for members inside an area of a box or a circle, optionally stores the result.",
+			Since: "6.2.0", Handler: handleGeoSearchStore,
+		},
+	)
+}
@@ -0,0 +1,230 @@
+package main
+
+import "math"
+
+// a geohash interleaves the bits of a longitude and a latitude, each scaled to the unit
+// interval and cut into 2^step slices, so nearby points tend to share a prefix. Redis stores
+// 52-bit (step 26) geohashes of points as sorted set scores, where a prefix is a score range
+const (
+	geoStepMax = 26
+
+	geoLongMin = -180.0
+	geoLongMax = 180.0
+	// the latitudes Web Mercator can represent, beyond which the scheme breaks down
+	geoLatMin = -85.05112878
+	geoLatMax = 85.05112878
+
+	earthRadiusMeters = 6372797.560856
+	mercatorMax       = 20037726.37
+)
+
+type geoRange struct {
+	min, max float64
+}
+
+type geoHash struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHash) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+// scoreRange returns the scores of the 52-bit geohashes starting with h, from min inclusive to max exclusive
+func (h geoHash) scoreRange() (float64, float64) {
+	shift := 52 - 2*h.step
+	return float64(h.bits << shift), float64((h.bits + 1) << shift)
+}
+
+// geoArea is the box of coordinates covered by a geohash
+type geoArea struct {
+	longitude, latitude geoRange
+}
+
+var (
+	wgs84Longitude = geoRange{geoLongMin, geoLongMax}
+	wgs84Latitude  = geoRange{geoLatMin, geoLatMax}
+)
+
+// spreadBits moves the bits of v to the even bit positions
+func spreadBits(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000FFFF0000FFFF
+	x = (x | x<<8) & 0x00FF00FF00FF00FF
+	x = (x | x<<4) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// squashBits is the inverse of spreadBits, gathering the even bits of x
+func squashBits(x uint64) uint32 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x>>4) & 0x00FF00FF00FF00FF
+	x = (x | x>>8) & 0x0000FFFF0000FFFF
+	x = (x | x>>16) & 0x00000000FFFFFFFF
+	return uint32(x)
+}
+
+// geohashEncode hashes a point, with latitude in the even bits and longitude in the odd ones
+func geohashEncode(longitudes, latitudes geoRange, longitude, latitude float64, step uint) (geoHash, bool) {
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHash{}, false
+	}
+	if longitude < longitudes.min || longitude > longitudes.max || latitude < latitudes.min || latitude > latitudes.max {
+		return geoHash{}, false
+	}
+
+	latOffset := (latitude - latitudes.min) / (latitudes.max - latitudes.min) * float64(uint64(1)<<step)
+	longOffset := (longitude - longitudes.min) / (longitudes.max - longitudes.min) * float64(uint64(1)<<step)
+
+	return geoHash{bits: spreadBits(uint32(latOffset)) | spreadBits(uint32(longOffset))<<1, step: step}, true
+}
+
+func geohashDecode(longitudes, latitudes geoRange, h geoHash) geoArea {
+	latCell, longCell := squashBits(h.bits), squashBits(h.bits>>1)
+	cells := float64(uint64(1) << h.step)
+
+	return geoArea{
+		longitude: geoRange{
+			longitudes.min + float64(longCell)/cells*(longitudes.max-longitudes.min),
+			longitudes.min + float64(longCell+1)/cells*(longitudes.max-longitudes.min),
+		},
+		latitude: geoRange{
+			latitudes.min + float64(latCell)/cells*(latitudes.max-latitudes.min),
+			latitudes.min + float64(latCell+1)/cells*(latitudes.max-latitudes.min),
+		},
+	}
+}
+
+// center returns the middle of the area, kept within the coordinates that can be stored
+func (a geoArea) center() (float64, float64) {
+	longitude := min(max((a.longitude.min+a.longitude.max)/2, geoLongMin), geoLongMax)
+	latitude := min(max((a.latitude.min+a.latitude.max)/2, geoLatMin), geoLatMax)
+	return longitude, latitude
+}
+
+// geoScore returns the sorted set score of a point
+func geoScore(longitude, latitude float64) (float64, bool) {
+	h, ok := geohashEncode(wgs84Longitude, wgs84Latitude, longitude, latitude, geoStepMax)
+	return float64(h.bits), ok
+}
+
+// geoDecodeScore returns the point a sorted set score stands for
+func geoDecodeScore(score float64) (float64, float64) {
+	return geohashDecode(wgs84Longitude, wgs84Latitude, geoHash{bits: uint64(score), step: geoStepMax}).center()
+}
+
+// moveX shifts the geohash d cells east (or west, when negative) by adding to its longitude bits
+func (h geoHash) moveX(d int) geoHash {
+	if d == 0 {
+		return h
+	}
+
+	x := h.bits & 0xAAAAAAAAAAAAAAAA
+	y := h.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - h.step*2)
+	if d > 0 {
+		x += zz + 1
+	} else {
+		x = (x | zz) - (zz + 1)
+	}
+	x &= 0xAAAAAAAAAAAAAAAA >> (64 - h.step*2)
+
+	return geoHash{bits: x | y, step: h.step}
+}
+
+// moveY shifts the geohash d cells north (or south, when negative)
+func (h geoHash) moveY(d int) geoHash {
+	if d == 0 {
+		return h
+	}
+
+	x := h.bits & 0xAAAAAAAAAAAAAAAA
+	y := h.bits & 0x5555555555555555
+	zz := uint64(0xAAAAAAAAAAAAAAAA) >> (64 - h.step*2)
+	if d > 0 {
+		y += zz + 1
+	} else {
+		y = (y | zz) - (zz + 1)
+	}
+	y &= 0x5555555555555555 >> (64 - h.step*2)
+
+	return geoHash{bits: x | y, step: h.step}
+}
+
+// geoNeighbors are the eight cells around a geohash, any of which can be zeroed once it's
+// known not to overlap the search
+type geoNeighbors struct {
+	north, south, east, west                   geoHash
+	northEast, northWest, southEast, southWest geoHash
+}
+
+func (h geoHash) neighbors() geoNeighbors {
+	return geoNeighbors{
+		north:     h.moveY(1),
+		south:     h.moveY(-1),
+		east:      h.moveX(1),
+		west:      h.moveX(-1),
+		northEast: h.moveX(1).moveY(1),
+		northWest: h.moveX(-1).moveY(1),
+		southEast: h.moveX(1).moveY(-1),
+		southWest: h.moveX(-1).moveY(-1),
+	}
+}
+
+func degreesToRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func radiansToDegrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+func geoLatitudeDistance(lat1, lat2 float64) float64 {
+	return earthRadiusMeters * math.Abs(degreesToRadians(lat2)-degreesToRadians(lat1))
+}
+
+// geoDistance returns the distance in meters between two points with the haversine formula
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lon1r, lon2r := degreesToRadians(lon1), degreesToRadians(lon2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	// on the same meridian only the latitudes matter
+	if v == 0 {
+		return geoLatitudeDistance(lat1, lat2)
+	}
+
+	lat1r, lat2r := degreesToRadians(lat1), degreesToRadians(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// geoStepsForRadius picks the geohash precision whose cells are about as big as the radius
+func geoStepsForRadius(meters, latitude float64) uint {
+	if meters == 0 {
+		return geoStepMax
+	}
+
+	step := 1
+	for meters < mercatorMax {
+		meters *= 2
+		step++
+	}
+	// make sure the range is included in most of the base cases
+	step -= 2
+
+	// cells get narrower towards the poles
+	if latitude > 66 || latitude < -66 {
+		step--
+		if latitude > 80 || latitude < -80 {
+			step--
+		}
+	}
+
+	return uint(min(max(step, 1), geoStepMax))
+}
@@ -0,0 +1,108 @@
+package main
+
+// globMatch reports whether str matches a Redis glob-style pattern, supporting
+// *, ?, [abc], [^abc], [a-z] and backslash escapes, as KEYS and the SCAN family do
+func globMatch(pattern, str string) bool {
+	skipLongerMatches := false
+	return globMatchImpl(pattern, str, &skipLongerMatches, 0)
+}
+
+// globMatchImpl follows stringmatchlen from Redis. Once a * fails to match the rest of the
+// string from every position, skipLongerMatches stops any enclosing * from retrying with
+// longer prefixes, which keeps patterns like "a*a*a*a*b" from taking exponential time
+func globMatchImpl(pattern, str string, skipLongerMatches *bool, nesting int) bool {
+	// protect against stack overflow with pathological patterns
+	if nesting > 1000 {
+		return false
+	}
+
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for len(str) > 0 {
+				if globMatchImpl(pattern[1:], str, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+				str = str[1:]
+			}
+
+			*skipLongerMatches = true
+			return false
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+
+			matched := false
+			for {
+				if len(pattern) >= 2 && pattern[0] == '\\' {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						matched = true
+					}
+				} else if len(pattern) == 0 {
+					// an unterminated class runs to the end of the pattern
+					break
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[0] >= start && str[0] <= end {
+						matched = true
+					}
+					pattern = pattern[2:]
+				} else if pattern[0] == str[0] {
+					matched = true
+				}
+				pattern = pattern[1:]
+			}
+
+			if not {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+
+		if len(pattern) > 0 {
+			pattern = pattern[1:]
+		}
+		if len(str) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			break
+		}
+	}
+
+	return len(pattern) == 0 && len(str) == 0
+}
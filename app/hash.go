@@ -0,0 +1,856 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type hashField struct {
+	value     []byte
+	expiryPtr *expiry
+}
+
+// hashValue maps field names to values, each of which can have its own expiry
+type hashValue struct {
+	fields map[string]*hashField
+	// index lets HSCAN iterate over the fields, and gives enumerations a stable order
+	index *scanTable
+	// expiring holds the fields that have an expiry, so expired ones are found without a full scan
+	expiring map[string]struct{}
+}
+
+func newHashValue() *hashValue {
+	return &hashValue{fields: map[string]*hashField{}, index: newScanTable(), expiring: map[string]struct{}{}}
+}
+
+func (h *hashValue) len() int {
+	return len(h.fields)
+}
+
+func (h *hashValue) get(field string) ([]byte, bool) {
+	f, exists := h.fields[field]
+	if !exists {
+		return nil, false
+	}
+
+	return f.value, true
+}
+
+// set stores a field's value, clearing any expiry it had, and reports whether the field is new
+func (h *hashValue) set(field string, value []byte) bool {
+	if f, exists := h.fields[field]; exists {
+		f.value = value
+		f.expiryPtr = nil
+		delete(h.expiring, field)
+		return false
+	}
+
+	h.fields[field] = &hashField{value: value}
+	h.index.add(field)
+	return true
+}
+
+func (h *hashValue) remove(field string) bool {
+	if _, exists := h.fields[field]; !exists {
+		return false
+	}
+
+	delete(h.fields, field)
+	delete(h.expiring, field)
+	h.index.remove(field)
+	return true
+}
+
+func (h *hashValue) setFieldExpiry(field string, expiryPtr *expiry) {
+	h.fields[field].expiryPtr = expiryPtr
+	if expiryPtr != nil {
+		h.expiring[field] = struct{}{}
+	} else {
+		delete(h.expiring, field)
+	}
+}
+
+// expiredFields lists the fields whose expiry has passed
+func (h *hashValue) expiredFields(now time.Time) []string {
+	expired := []string{}
+	for field := range h.expiring {
+		if now.Compare(h.fields[field].expiryPtr.Timestamp) >= 0 {
+			expired = append(expired, field)
+		}
+	}
+	return expired
+}
+
+// allFieldsExpired reports whether every field has expired, which makes the whole hash expired
+func (h *hashValue) allFieldsExpired(now time.Time) bool {
+	if h.len() == 0 || len(h.expiring) < h.len() {
+		return false
+	}
+	return len(h.expiredFields(now)) == h.len()
+}
+
+// each visits the fields in a stable order
+func (h *hashValue) each(visit func(field string, value []byte)) {
+	h.index.each(func(field string) {
+		visit(field, h.fields[field].value)
+	})
+}
+
+func (h *hashValue) clone() *hashValue {
+	copied := newHashValue()
+	h.index.each(func(field string) {
+		f := h.fields[field]
+		copied.set(field, bytes.Clone(f.value))
+		if f.expiryPtr != nil {
+			copied.setFieldExpiry(field, f.expiryPtr)
+		}
+	})
+
+	return copied
+}
+
+// getHash looks up a hash for reading or modifying; a missing key (or one whose fields have all
+// expired) gives a nil hash. The lookup has already removed any fields that have expired
+func getHash(key string) (*hashValue, error) {
+	e, err := store.getTyped(key, hashType)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	return e.Value.(*hashValue), nil
+}
+
+// hashChanged records a modification of the hash at key, deleting it once it's empty
+func hashChanged(key string, h *hashValue) {
+	if h.len() == 0 {
+		store.delete(key)
+	} else {
+		store.modified(key)
+	}
+}
+
+// getOrCreateHash looks up a hash to add fields to, creating an empty one if needed
+func getOrCreateHash(key string) (*hashValue, error) {
+	h, err := getHash(key)
+	if err != nil || h != nil {
+		return h, err
+	}
+
+	h = newHashValue()
+	store.set(key, &entry{Type: hashType, Value: h})
+	return h, nil
+}
+
+// handleHSet implements HSET and the older HMSET
+func handleHSet(c *client, array []string) ([]byte, error) {
+	if len(array)%2 != 0 {
+		return nil, wrongArityError(array[0])
+	}
+
+	key := array[1]
+	h, err := getOrCreateHash(key)
+	if err != nil {
+		return nil, err
+	}
+
+	added := 0
+	for i := 2; i < len(array); i += 2 {
+		if h.set(array[i], []byte(array[i+1])) {
+			added++
+		}
+	}
+	store.modified(key)
+
+	if strings.EqualFold(array[0], "hmset") {
+		return encodeSimpleString("OK"), nil
+	}
+	return encodeInteger(added), nil
+}
+
+func handleHSetNX(c *client, array []string) ([]byte, error) {
+	key, field := array[1], array[2]
+
+	h, err := getOrCreateHash(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := h.get(field); exists {
+		return encodeInteger(0), nil
+	}
+
+	h.set(field, []byte(array[3]))
+	store.modified(key)
+
+	return encodeInteger(1), nil
+}
+
+func handleHGet(c *client, array []string) ([]byte, error) {
+	h, err := getHash(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return encodeNull(c.protocol), nil
+	}
+
+	value, exists := h.get(array[2])
+	if !exists {
+		return encodeNull(c.protocol), nil
+	}
+
+	return encodeBulkString(string(value)), nil
+}
+
+func handleHMGet(c *client, array []string) ([]byte, error) {
+	h, err := getHash(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	values := [][]byte{}
+	for _, field := range array[2:] {
+		var value []byte
+		exists := false
+		if h != nil {
+			value, exists = h.get(field)
+		}
+
+		if exists {
+			values = append(values, encodeBulkString(string(value)))
+		} else {
+			values = append(values, encodeNull(c.protocol))
+		}
+	}
+
+	return encodeArray(values), nil
+}
+
+// handleHGetAll implements HGETALL, HKEYS and HVALS
+func handleHGetAll(c *client, array []string) ([]byte, error) {
+	command := strings.ToLower(array[0])
+
+	h, err := getHash(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		if command == "hgetall" {
+			return encodeMap(c.protocol, nil), nil
+		}
+		return encodeArray(nil), nil
+	}
+
+	elements := [][]byte{}
+	h.each(func(field string, value []byte) {
+		if command != "hvals" {
+			elements = append(elements, encodeBulkString(field))
+		}
+		if command != "hkeys" {
+			elements = append(elements, encodeBulkString(string(value)))
+		}
+	})
+
+	if command == "hgetall" {
+		return encodeMap(c.protocol, elements), nil
+	}
+	return encodeArray(elements), nil
+}
+
+func handleHDel(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	h, err := getHash(key)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return encodeInteger(0), nil
+	}
+
+	deleted := 0
+	for _, field := range array[2:] {
+		if h.remove(field) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		hashChanged(key, h)
+	}
+
+	return encodeInteger(deleted), nil
+}
+
+func handleHExists(c *client, array []string) ([]byte, error) {
+	h, err := getHash(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return encodeInteger(0), nil
+	}
+
+	if _, exists := h.get(array[2]); exists {
+		return encodeInteger(1), nil
+	}
+	return encodeInteger(0), nil
+}
+
+func handleHLen(c *client, array []string) ([]byte, error) {
+	h, err := getHash(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return encodeInteger(0), nil
+	}
+
+	return encodeInteger(h.len()), nil
+}
+
+func handleHStrLen(c *client, array []string) ([]byte, error) {
+	h, err := getHash(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return encodeInteger(0), nil
+	}
+
+	value, _ := h.get(array[2])
+	return encodeInteger(len(value)), nil
+}
+
+func handleHIncrBy(c *client, array []string) ([]byte, error) {
+	key, field := array[1], array[2]
+
+	delta, ok := parseInteger(array[3])
+	if !ok {
+		return nil, errNotInteger
+	}
+
+	h, err := getOrCreateHash(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var current int64
+	if value, exists := h.get(field); exists {
+		current, ok = parseInteger(string(value))
+		if !ok {
+			return nil, newCommandError("ERR", "hash value is not an integer")
+		}
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return nil, newCommandError("ERR", "increment or decrement would overflow")
+	}
+
+	result := current + delta
+	setKeepingExpiry(h, field, []byte(strconv.FormatInt(result, 10)))
+	store.modified(key)
+
+	return encodeInteger(int(result)), nil
+}
+
+// setKeepingExpiry updates a field's value without clearing its expiry, as increments do
+func setKeepingExpiry(h *hashValue, field string, value []byte) {
+	if f, exists := h.fields[field]; exists {
+		f.value = value
+		return
+	}
+
+	h.set(field, value)
+}
+
+func handleHIncrByFloat(c *client, array []string) ([]byte, error) {
+	key, field := array[1], array[2]
+
+	delta, ok := parseLongDouble(array[3])
+	if !ok {
+		return nil, errNotFloat
+	}
+	if delta.IsInf() {
+		return nil, newCommandError("ERR", "increment would produce NaN or Infinity")
+	}
+
+	h, err := getOrCreateHash(key)
+	if err != nil {
+		return nil, err
+	}
+
+	current := new(big.Float).SetPrec(64)
+	if value, exists := h.get(field); exists {
+		current, ok = parseLongDouble(string(value))
+		if !ok {
+			return nil, newCommandError("ERR", "hash value is not a float")
+		}
+	}
+
+	if current.IsInf() {
+		return nil, newCommandError("ERR", "increment would produce NaN or Infinity")
+	}
+
+	result := formatLongDouble(new(big.Float).SetPrec(64).Add(current, delta))
+	setKeepingExpiry(h, field, []byte(result))
+	store.modified(key)
+
+	// replicas receive the result, so floating point differences can't make them diverge
+	c.propagateAs = append(c.propagateAs, []string{"HSET", key, field, result})
+	if expiryPtr := h.fields[field].expiryPtr; expiryPtr != nil {
+		c.propagateAs = append(c.propagateAs, []string{
+			"HPEXPIREAT", key, strconv.FormatInt(expiryPtr.Timestamp.UnixMilli(), 10), "FIELDS", "1", field,
+		})
+	}
+
+	return encodeBulkString(result), nil
+}
+
+func handleHRandField(c *client, array []string) ([]byte, error) {
+	if len(array) > 4 || (len(array) == 4 && !strings.EqualFold(array[3], "WITHVALUES")) {
+		return nil, errSyntax
+	}
+
+	hasCount, withValues := len(array) >= 3, len(array) == 4
+
+	var count int64
+	if hasCount {
+		var ok bool
+		count, ok = parseInteger(array[2])
+		if !ok {
+			return nil, errNotInteger
+		}
+		if count < -math.MaxInt64/2 || count > math.MaxInt64/2 {
+			return nil, newCommandError("ERR", "value is out of range")
+		}
+	}
+
+	h, err := getHash(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasCount {
+		if h == nil {
+			return encodeNull(c.protocol), nil
+		}
+		// map iteration order is randomised, so the first field is a random one
+		for field := range h.fields {
+			return encodeBulkString(field), nil
+		}
+	}
+	if h == nil || count == 0 {
+		return encodeArray(nil), nil
+	}
+
+	// a positive count gives distinct fields; a negative one allows repeats
+	fields := []string{}
+	if count > 0 {
+		for field := range h.fields {
+			if int64(len(fields)) == count {
+				break
+			}
+			fields = append(fields, field)
+		}
+	} else {
+		all := make([]string, 0, h.len())
+		for field := range h.fields {
+			all = append(all, field)
+		}
+		for ; count < 0; count++ {
+			fields = append(fields, all[rand.Intn(len(all))])
+		}
+	}
+
+	elements := [][]byte{}
+	for _, field := range fields {
+		if !withValues {
+			elements = append(elements, encodeBulkString(field))
+			continue
+		}
+
+		value, _ := h.get(field)
+		if c.protocol == resp3 {
+			elements = append(elements, encodeBulkArray([]string{field, string(value)}))
+		} else {
+			elements = append(elements, encodeBulkString(field), encodeBulkString(string(value)))
+		}
+	}
+
+	return encodeArray(elements), nil
+}
+
+func handleHScan(c *client, array []string) ([]byte, error) {
+	options, err := parseScanOptions(array[0], array[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := getHash(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return encodeScanReply(0, nil), nil
+	}
+
+	cursor, fields := h.index.scanBatch(options.cursor, options.count)
+
+	results := []string{}
+	for _, field := range fields {
+		if !options.matches(field) {
+			continue
+		}
+		results = append(results, field)
+		if !options.noValues {
+			value, _ := h.get(field)
+			results = append(results, string(value))
+		}
+	}
+
+	return encodeScanReply(cursor, results), nil
+}
+
+// parseFieldsArgument parses the "FIELDS numfields field [field ...]" arguments that end
+// the field expiry commands
+func parseFieldsArgument(args []string) ([]string, error) {
+	if len(args) < 2 || !strings.EqualFold(args[0], "FIELDS") {
+		return nil, newCommandError("ERR", "Mandatory argument FIELDS is missing or not at the right position")
+	}
+
+	numFields, ok := parseInteger(args[1])
+	if !ok || numFields <= 0 {
+		return nil, newCommandError("ERR", "Parameter `numFields` should be greater than 0")
+	}
+	if numFields != int64(len(args)-2) {
+		return nil, newCommandError("ERR", "The `numfields` parameter must match the number of arguments")
+	}
+
+	return args[2:], nil
+}
+
+// results of setting a field's expiry, as HEXPIRE reports them
+const (
+	fieldExpiryNoField   = -2
+	fieldExpiryNotSet    = 0
+	fieldExpirySet       = 1
+	fieldExpiryDeleted   = 2
+	maxFieldExpiryMillis = 1<<48 - 1
+)
+
+// handleHExpire implements HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT
+func handleHExpire(c *client, array []string) ([]byte, error) {
+	command := strings.ToLower(array[0])
+	key := array[1]
+
+	when, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+	if when < 0 {
+		return nil, newCommandError("ERR", "invalid expire time, must be >= 0")
+	}
+
+	condition := ""
+	rest := array[3:]
+	if len(rest) > 0 {
+		switch strings.ToUpper(rest[0]) {
+		case "NX", "XX", "GT", "LT":
+			condition = strings.ToUpper(rest[0])
+			rest = rest[1:]
+		}
+	}
+
+	fields, err := parseFieldsArgument(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	if command == "hexpire" || command == "hexpireat" {
+		if when > maxFieldExpiryMillis/1000 {
+			return nil, invalidExpireError(command)
+		}
+		when *= 1000
+	}
+	if command == "hexpire" || command == "hpexpire" {
+		when += time.Now().UnixMilli()
+	}
+	if when > maxFieldExpiryMillis {
+		return nil, invalidExpireError(command)
+	}
+
+	h, err := getHash(key)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([][]byte, len(fields))
+	updated, deleted := []string{}, []string{}
+	for i, field := range fields {
+		f, exists := (*hashField)(nil), false
+		if h != nil {
+			f, exists = h.fields[field]
+		}
+		if !exists {
+			results[i] = encodeInteger(fieldExpiryNoField)
+			continue
+		}
+
+		// a field without an expiry counts as having an infinite TTL
+		current := f.expiryPtr
+		if condition == "NX" && current != nil ||
+			condition == "XX" && current == nil ||
+			condition == "GT" && (current == nil || when <= current.Timestamp.UnixMilli()) ||
+			condition == "LT" && current != nil && when >= current.Timestamp.UnixMilli() {
+			results[i] = encodeInteger(fieldExpiryNotSet)
+			continue
+		}
+
+		if when <= time.Now().UnixMilli() {
+			h.remove(field)
+			deleted = append(deleted, field)
+			results[i] = encodeInteger(fieldExpiryDeleted)
+			continue
+		}
+
+		h.setFieldExpiry(field, &expiry{time.UnixMilli(when)})
+		updated = append(updated, field)
+		results[i] = encodeInteger(fieldExpirySet)
+	}
+
+	if len(updated) > 0 || len(deleted) > 0 {
+		hashChanged(key, h)
+	}
+
+	// replicas are sent absolute expiries, and explicit deletions for fields already expired
+	c.propagateAs = [][]string{}
+	if len(updated) > 0 {
+		c.propagateAs = append(c.propagateAs, append([]string{
+			"HPEXPIREAT", key, strconv.FormatInt(when, 10), "FIELDS", strconv.Itoa(len(updated)),
+		}, updated...))
+	}
+	if len(deleted) > 0 {
+		c.propagateAs = append(c.propagateAs, append([]string{"HDEL", key}, deleted...))
+	}
+
+	return encodeArray(results), nil
+}
+
+// handleHTTL implements HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME
+func handleHTTL(c *client, array []string) ([]byte, error) {
+	command := strings.ToLower(array[0])
+
+	fields, err := parseFieldsArgument(array[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := getHash(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	results := make([][]byte, len(fields))
+	for i, field := range fields {
+		f, exists := (*hashField)(nil), false
+		if h != nil {
+			f, exists = h.fields[field]
+		}
+
+		switch {
+		case !exists:
+			results[i] = encodeInteger(-2)
+		case f.expiryPtr == nil:
+			results[i] = encodeInteger(-1)
+		default:
+			at := f.expiryPtr.Timestamp.UnixMilli()
+			switch command {
+			case "httl":
+				results[i] = encodeInteger(int((max(at-now, 0) + 500) / 1000))
+			case "hpttl":
+				results[i] = encodeInteger(int(max(at-now, 0)))
+			case "hexpiretime":
+				results[i] = encodeInteger(int(at / 1000))
+			default:
+				results[i] = encodeInteger(int(at))
+			}
+		}
+	}
+
+	return encodeArray(results), nil
+}
+
+func handleHPersist(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	fields, err := parseFieldsArgument(array[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := getHash(key)
+	if err != nil {
+		return nil, err
+	}
+
+	persisted := false
+	results := make([][]byte, len(fields))
+	for i, field := range fields {
+		f, exists := (*hashField)(nil), false
+		if h != nil {
+			f, exists = h.fields[field]
+		}
+
+		switch {
+		case !exists:
+			results[i] = encodeInteger(-2)
+		case f.expiryPtr == nil:
+			results[i] = encodeInteger(-1)
+		default:
+			h.setFieldExpiry(field, nil)
+			persisted = true
+			results[i] = encodeInteger(1)
+		}
+	}
+
+	if persisted {
+		store.modified(key)
+	}
+
+	return encodeArray(results), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "hset", Arity: -4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Creates or modifies the value of a field in a hash.", Since: "2.0.0",
+			Handler: handleHSet,
+		},
+		&commandSpec{
+			Name: "hmset", Arity: -4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Sets the values of multiple fields.", Since: "2.0.0",
+			Handler: handleHSet,
+		},
+		&commandSpec{
+			Name: "hsetnx", Arity: 4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Sets the value of a field in a hash only when the field doesn't exist.", Since: "2.0.0",
+			Handler: handleHSetNX,
+		},
+		&commandSpec{
+			Name: "hget", Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the value of a field in a hash.", Since: "2.0.0",
+			Handler: handleHGet,
+		},
+		&commandSpec{
+			Name: "hmget", Arity: -3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the values of all fields in a hash.", Since: "2.0.0",
+			Handler: handleHMGet,
+		},
+		&commandSpec{
+			Name: "hgetall", Arity: 2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns all fields and values in a hash.", Since: "2.0.0",
+			Handler: handleHGetAll,
+		},
+		&commandSpec{
+			Name: "hkeys", Arity: 2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns all fields in a hash.", Since: "2.0.0",
+			Handler: handleHGetAll,
+		},
+		&commandSpec{
+			Name: "hvals", Arity: 2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns all values in a hash.", Since: "2.0.0",
+			Handler: handleHGetAll,
+		},
+		&commandSpec{
+			Name: "hdel", Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain.",
+			Since: "2.0.0", Handler: handleHDel,
+		},
+		&commandSpec{
+			Name: "hexists", Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Determines whether a field exists in a hash.", Since: "2.0.0",
+			Handler: handleHExists,
+		},
+		&commandSpec{
+			Name: "hlen", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the number of fields in a hash.", Since: "2.0.0",
+			Handler: handleHLen,
+		},
+		&commandSpec{
+			Name: "hstrlen", Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the length of the value of a field.", Since: "3.2.0",
+			Handler: handleHStrLen,
+		},
+		&commandSpec{
+			Name: "hincrby", Arity: 4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Increments the integer value of a field in a hash by a number. Uses 0 as initial value if the field doesn't exist.",
+			Since: "2.0.0", Handler: handleHIncrBy,
+		},
+		&commandSpec{
+			Name: "hincrbyfloat", Arity: 4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Increments the floating point value of a field by a number. Uses 0 as initial value if the field doesn't exist.",
+			Since: "2.6.0", Handler: handleHIncrByFloat,
+		},
+		&commandSpec{
+			Name: "hrandfield", Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns one or more random fields from a hash.", Since: "6.2.0",
+			Handler: handleHRandField,
+		},
+		&commandSpec{
+			Name: "hscan", Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Iterates over fields and values of a hash.", Since: "2.8.0",
+			Handler: handleHScan,
+		},
+		&commandSpec{
+			Name: "hexpire", Arity: -6, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Set expiry for hash field using relative time to expire (seconds)", Since: "7.4.0",
+			Handler: handleHExpire,
+		},
+		&commandSpec{
+			Name: "hpexpire", Arity: -6, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Set expiry for hash field using relative time to expire (milliseconds)", Since: "7.4.0",
+			Handler: handleHExpire,
+		},
+		&commandSpec{
+			Name: "hexpireat", Arity: -6, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Set expiry for hash field using an absolute Unix timestamp (seconds)", Since: "7.4.0",
+			Handler: handleHExpire,
+		},
+		&commandSpec{
+			Name: "hpexpireat", Arity: -6, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Set expiry for hash field using an absolute Unix timestamp (milliseconds)", Since: "7.4.0",
+			Handler: handleHExpire,
+		},
+		&commandSpec{
+			Name: "httl", Arity: -5, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the TTL in seconds of a hash field.", Since: "7.4.0",
+			Handler: handleHTTL,
+		},
+		&commandSpec{
+			Name: "hpttl", Arity: -5, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the TTL in milliseconds of a hash field.", Since: "7.4.0",
+			Handler: handleHTTL,
+		},
+		&commandSpec{
+			Name: "hexpiretime", Arity: -5, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the expiration time of a hash field as a Unix timestamp, in seconds.", Since: "7.4.0",
+			Handler: handleHTTL,
+		},
+		&commandSpec{
+			Name: "hpexpiretime", Arity: -5, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the expiration time of a hash field as a Unix timestamp, in msec.", Since: "7.4.0",
+			Handler: handleHTTL,
+		},
+		&commandSpec{
+			Name: "hpersist", Arity: -5, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Removes the expiration time for each specified field", Since: "7.4.0",
+			Handler: handleHPersist,
+		},
+	)
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// HyperLogLogs are stored as strings laid out exactly as Redis lays them out, so they can be
+// exchanged with it through RDB files and GET/SET. A 16 byte header ("HYLL", the encoding, three
+// unused bytes and a little-endian cached cardinality whose top bit marks it stale) is followed
+// by 16384 registers, either densely packed six bits each or run-length encoded as sparse opcodes
+const (
+	hllP          = 14
+	hllQ          = 64 - hllP
+	hllRegisters  = 1 << hllP
+	hllBits       = 6
+	hllHeaderSize = 16
+	hllDenseSize  = hllHeaderSize + (hllRegisters*hllBits+7)/8
+
+	hllDense  = 0
+	hllSparse = 1
+
+	hllSparseValMaxValue = 32
+	hllSparseValMaxLen   = 4
+	hllSparseZeroMaxLen  = 64
+	hllSparseXZeroMaxLen = 16384
+
+	// hllSparseMaxBytes mirrors Redis's default hll-sparse-max-bytes, past which sparse HLLs become dense
+	hllSparseMaxBytes = 3000
+
+	hllAlphaInf = 0.721347520444481703680
+)
+
+var (
+	errNotHLL     = newCommandError("WRONGTYPE", "Key is not a valid HyperLogLog string value.")
+	errCorruptHLL = newCommandError("INVALIDOBJ", "Corrupted HLL object detected")
+)
+
+// sparse opcodes: ZERO is 00xxxxxx (a run of up to 64 empty registers), XZERO is
+// 01xxxxxx yyyyyyyy (a run of up to 16384) and VAL is 1vvvvvxx (up to 4 registers set to v+1)
+func hllIsZero(op byte) bool  { return op&0xC0 == 0x00 }
+func hllIsXZero(op byte) bool { return op&0xC0 == 0x40 }
+func hllIsVal(op byte) bool   { return op&0x80 != 0 }
+
+func hllZeroLen(op byte) int           { return int(op&0x3F) + 1 }
+func hllXZeroLen(op, next byte) int    { return (int(op&0x3F)<<8 | int(next)) + 1 }
+func hllValValue(op byte) uint8        { return (op>>2)&0x1F + 1 }
+func hllValLen(op byte) int            { return int(op&0x03) + 1 }
+func hllValOp(value uint8, n int) byte { return 0x80 | (value-1)<<2 | byte(n-1) }
+
+// appendHLLZeros appends the shortest opcode for a run of n empty registers
+func appendHLLZeros(ops []byte, n int) []byte {
+	if n > hllSparseZeroMaxLen {
+		return append(ops, 0x40|byte((n-1)>>8), byte(n-1))
+	}
+	return append(ops, byte(n-1))
+}
+
+// newHLL returns an empty sparse HyperLogLog
+func newHLL() []byte {
+	h := make([]byte, hllHeaderSize, hllHeaderSize+2)
+	copy(h, "HYLL")
+	h[4] = hllSparse
+	return appendHLLZeros(h, hllSparseXZeroMaxLen)
+}
+
+func isHLL(h []byte) bool {
+	if len(h) < hllHeaderSize || !bytes.Equal(h[:4], []byte("HYLL")) {
+		return false
+	}
+
+	switch h[4] {
+	case hllDense:
+		return len(h) == hllDenseSize
+	case hllSparse:
+		return true
+	default:
+		return false
+	}
+}
+
+func hllCachedCount(h []byte) (uint64, bool) {
+	if h[15]&0x80 != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(h[8:]), true
+}
+
+func hllInvalidateCache(h []byte) {
+	h[15] |= 0x80
+}
+
+// murmurHash64A is the hash function Redis uses for HyperLogLogs, reading words little-endian
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(data))*m
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
+
+// hllPatternLength returns the register an element hashes to, and the length of the run of
+// zero bits (plus one) that it would set the register to
+func hllPatternLength(element []byte) (int, uint8) {
+	hash := murmurHash64A(element, 0xadc83b19)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	// so the count is at most hllQ+1
+	hash |= 1 << hllQ
+
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+// dense registers are packed least significant bit first, so a register can straddle two bytes
+func hllDenseGet(registers []byte, index int) uint8 {
+	b, shift := index*hllBits/8, uint(index*hllBits&7)
+	value := registers[b] >> shift
+	if b+1 < len(registers) {
+		value |= registers[b+1] << (8 - shift)
+	}
+	return value & 63
+}
+
+func hllDenseSet(registers []byte, index int, count uint8) bool {
+	if count <= hllDenseGet(registers, index) {
+		return false
+	}
+
+	b, shift := index*hllBits/8, uint(index*hllBits&7)
+	registers[b] &^= 63 << shift
+	registers[b] |= count << shift
+	if b+1 < len(registers) {
+		registers[b+1] &^= 63 >> (8 - shift)
+		registers[b+1] |= count >> (8 - shift)
+	}
+
+	return true
+}
+
+// hllSparseToDense converts a sparse HyperLogLog, keeping its header
+func hllSparseToDense(h []byte) ([]byte, error) {
+	dense := make([]byte, hllDenseSize)
+	copy(dense, h[:hllHeaderSize])
+	dense[4] = hllDense
+
+	registers := dense[hllHeaderSize:]
+	index := 0
+	for p := hllHeaderSize; p < len(h); {
+		switch op := h[p]; {
+		case hllIsZero(op):
+			index += hllZeroLen(op)
+			p++
+		case hllIsXZero(op):
+			if p+1 >= len(h) {
+				return nil, errCorruptHLL
+			}
+			index += hllXZeroLen(op, h[p+1])
+			p += 2
+		default:
+			n := hllValLen(op)
+			if index+n > hllRegisters {
+				return nil, errCorruptHLL
+			}
+			for range n {
+				hllDenseSet(registers, index, hllValValue(op))
+				index++
+			}
+			p++
+		}
+	}
+	if index != hllRegisters {
+		return nil, errCorruptHLL
+	}
+
+	return dense, nil
+}
+
+// hllSparseSet raises a register of a sparse HyperLogLog to count, editing the opcodes in place
+// the way Redis does so the bytes match. The HLL is returned, as it may have grown or become dense
+func hllSparseSet(h []byte, index int, count uint8) ([]byte, bool, error) {
+	promote := func() ([]byte, bool, error) {
+		dense, err := hllSparseToDense(h)
+		if err != nil {
+			return nil, false, err
+		}
+		hllDenseSet(dense[hllHeaderSize:], index, count)
+		return dense, true, nil
+	}
+
+	if count > hllSparseValMaxValue {
+		return promote()
+	}
+
+	// find the opcode covering the register, and the one before it
+	p, prev, first, span, oplen := hllHeaderSize, -1, 0, 0, 1
+	for p < len(h) {
+		oplen = 1
+		switch op := h[p]; {
+		case hllIsZero(op):
+			span = hllZeroLen(op)
+		case hllIsVal(op):
+			span = hllValLen(op)
+		default:
+			if p+1 >= len(h) {
+				return nil, false, errCorruptHLL
+			}
+			span = hllXZeroLen(op, h[p+1])
+			oplen = 2
+		}
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += oplen
+		first += span
+	}
+	if span == 0 || p >= len(h) {
+		return nil, false, errCorruptHLL
+	}
+
+	op := h[p]
+	switch {
+	case hllIsVal(op) && hllValValue(op) >= count:
+		return h, false, nil
+	case hllIsVal(op) && span == 1, hllIsZero(op) && span == 1:
+		h[p] = hllValOp(count, 1)
+	default:
+		// split the run into the registers before, ours, and those after
+		last := first + span - 1
+		sequence := make([]byte, 0, 5)
+		if hllIsVal(op) {
+			if index != first {
+				sequence = append(sequence, hllValOp(hllValValue(op), index-first))
+			}
+			sequence = append(sequence, hllValOp(count, 1))
+			if index != last {
+				sequence = append(sequence, hllValOp(hllValValue(op), last-index))
+			}
+		} else {
+			if index != first {
+				sequence = appendHLLZeros(sequence, index-first)
+			}
+			sequence = append(sequence, hllValOp(count, 1))
+			if index != last {
+				sequence = appendHLLZeros(sequence, last-index)
+			}
+		}
+
+		if grow := len(sequence) - oplen; grow > 0 && len(h)+grow > hllSparseMaxBytes {
+			return promote()
+		}
+		h = slices.Replace(h, p, p+oplen, sequence...)
+	}
+
+	// merge neighbouring VAL opcodes holding the same value, scanning a few opcodes from the previous one
+	p = max(prev, hllHeaderSize)
+	for scan := 0; p < len(h) && scan < 5; scan++ {
+		if hllIsXZero(h[p]) {
+			p += 2
+			continue
+		}
+		if hllIsZero(h[p]) {
+			p++
+			continue
+		}
+		if p+1 < len(h) && hllIsVal(h[p+1]) && hllValValue(h[p]) == hllValValue(h[p+1]) {
+			if n := hllValLen(h[p]) + hllValLen(h[p+1]); n <= hllSparseValMaxLen {
+				h[p+1] = hllValOp(hllValValue(h[p]), n)
+				h = slices.Delete(h, p, p+1)
+				// try merging the result with the opcode after it too
+				continue
+			}
+		}
+		p++
+	}
+
+	return h, true, nil
+}
+
+// hllAdd adds an element, returning the (possibly reallocated) HLL and whether a register changed
+func hllAdd(h []byte, element []byte) ([]byte, bool, error) {
+	index, count := hllPatternLength(element)
+	if h[4] == hllDense {
+		return h, hllDenseSet(h[hllHeaderSize:], index, count), nil
+	}
+	return hllSparseSet(h, index, count)
+}
+
+// hllMerge raises each of registers to the matching register of h
+func hllMerge(registers []uint8, h []byte) error {
+	if h[4] == hllDense {
+		for i := range registers {
+			registers[i] = max(registers[i], hllDenseGet(h[hllHeaderSize:], i))
+		}
+		return nil
+	}
+
+	index := 0
+	for p := hllHeaderSize; p < len(h); {
+		switch op := h[p]; {
+		case hllIsZero(op):
+			index += hllZeroLen(op)
+			p++
+		case hllIsXZero(op):
+			if p+1 >= len(h) {
+				return errCorruptHLL
+			}
+			index += hllXZeroLen(op, h[p+1])
+			p += 2
+		default:
+			n := hllValLen(op)
+			if index+n > hllRegisters {
+				return errCorruptHLL
+			}
+			for range n {
+				registers[index] = max(registers[index], hllValValue(op))
+				index++
+			}
+			p++
+		}
+	}
+	if index != hllRegisters {
+		return errCorruptHLL
+	}
+
+	return nil
+}
+
+// hllEstimate estimates the cardinality from a histogram of register values, using the
+// estimator from Otmar Ertl's "New cardinality estimation algorithms for HyperLogLog sketches"
+func hllEstimate(histogram []int) uint64 {
+	m := float64(hllRegisters)
+
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y, z := 1.0, x
+	for {
+		x *= x
+		previous := z
+		z += x * y
+		y += y
+		if previous == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		previous := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if previous == z {
+			return z / 3
+		}
+	}
+}
+
+// hllCount estimates the cardinality of a single HyperLogLog
+func hllCount(h []byte) (uint64, error) {
+	registers := make([]uint8, hllRegisters)
+	if err := hllMerge(registers, h); err != nil {
+		return 0, err
+	}
+	return hllCountRegisters(registers), nil
+}
+
+func hllCountRegisters(registers []uint8) uint64 {
+	histogram := make([]int, 64)
+	for _, register := range registers {
+		histogram[register&63]++
+	}
+	return hllEstimate(histogram)
+}
+
+// getHLL returns the HyperLogLog held at key, or nil if there isn't one
+func getHLL(key string) (*entry, error) {
+	e, err := store.getTyped(key, stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil && !isHLL(stringValue(e)) {
+		return nil, errNotHLL
+	}
+	return e, nil
+}
+
+func handlePFAdd(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	e, err := getHLL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	h, updated := newHLL(), e == nil
+	if e != nil {
+		h = stringValue(e)
+	}
+	for _, element := range array[2:] {
+		var changed bool
+		if h, changed, err = hllAdd(h, []byte(element)); err != nil {
+			return nil, err
+		}
+		updated = updated || changed
+	}
+
+	if !updated {
+		return encodeInteger(0), nil
+	}
+
+	hllInvalidateCache(h)
+	if e == nil {
+		store.set(key, newStringEntry(h, nil))
+	} else {
+		e.Value = h
+		store.modified(key)
+	}
+
+	return encodeInteger(1), nil
+}
+
+func handlePFCount(c *client, array []string) ([]byte, error) {
+	keys := array[1:]
+
+	// several keys are counted as their union, which isn't cached anywhere
+	if len(keys) > 1 {
+		registers := make([]uint8, hllRegisters)
+		for _, key := range keys {
+			e, err := getHLL(key)
+			if err != nil {
+				return nil, err
+			}
+			if e == nil {
+				continue
+			}
+			if err := hllMerge(registers, stringValue(e)); err != nil {
+				return nil, err
+			}
+		}
+		return encodeInteger(int(hllCountRegisters(registers))), nil
+	}
+
+	e, err := getHLL(keys[0])
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return encodeInteger(0), nil
+	}
+
+	h := stringValue(e)
+	if count, ok := hllCachedCount(h); ok {
+		return encodeInteger(int(count)), nil
+	}
+
+	count, err := hllCount(h)
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(h[8:], count)
+	store.modified(keys[0])
+
+	return encodeInteger(int(count)), nil
+}
+
+func handlePFMerge(c *client, array []string) ([]byte, error) {
+	destination := array[1]
+
+	// the destination's own registers are part of the union
+	registers := make([]uint8, hllRegisters)
+	dense := false
+	for _, key := range array[1:] {
+		e, err := getHLL(key)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			continue
+		}
+		if stringValue(e)[4] == hllDense {
+			dense = true
+		}
+		if err := hllMerge(registers, stringValue(e)); err != nil {
+			return nil, err
+		}
+	}
+
+	e, _ := getHLL(destination)
+	h := newHLL()
+	if e != nil {
+		h = stringValue(e)
+	}
+
+	// the result is dense if any input was
+	var err error
+	if dense && h[4] == hllSparse {
+		if h, err = hllSparseToDense(h); err != nil {
+			return nil, err
+		}
+	}
+	for i, count := range registers {
+		if count == 0 {
+			continue
+		}
+		if h[4] == hllDense {
+			hllDenseSet(h[hllHeaderSize:], i, count)
+		} else if h, _, err = hllSparseSet(h, i, count); err != nil {
+			return nil, err
+		}
+	}
+	hllInvalidateCache(h)
+
+	if e == nil {
+		store.set(destination, newStringEntry(h, nil))
+	} else {
+		e.Value = h
+		store.modified(destination)
+	}
+
+	return encodeSimpleString("OK"), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "pfadd", Arity: -2, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hyperloglog", Summary: "Adds elements to a HyperLogLog key. Creates the key if it doesn't exist.",
+			Since: "2.8.9", Handler: handlePFAdd,
+		},
+		&commandSpec{
+			Name: "pfcount", Arity: -2, Flags: []string{"readonly", "may-replicate"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "hyperloglog", Summary: "Returns the approximated cardinality of the set(s) observed by the HyperLogLog key(s).",
+			Since: "2.8.9", Handler: handlePFCount,
+		},
+		&commandSpec{
+			Name: "pfmerge", Arity: -2, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "hyperloglog", Summary: "Merges one or more HyperLogLog values into a single key.",
+			Since: "2.8.9", Handler: handlePFMerge,
+		},
+	)
+}
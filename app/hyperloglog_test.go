@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// The expected values below come from a reference implementation of Redis's hyperloglog.c,
+// independent of the code here, so HLLs written by either can be read by the other
+
+func TestMurmurHash64A(t *testing.T) {
+	hashes := []struct {
+		data string
+		seed uint64
+		want uint64
+	}{
+		{"", 0, 0},
+		{"a", 0, 0x071717d2d36b6b11},
+		{"hello", 0, 0x1e68d17c457bf117},
+		{"12345678", 0, 0x758f67d162b2d202},
+		{"", 0xadc83b19, 0xd8dfea6585bc9732},
+		{"a", 0xadc83b19, 0x53d2470a9b43b1a7},
+		{"foo", 0xadc83b19, 0xe64609b8b0141cb4},
+		{"1234567", 0xadc83b19, 0x85563db163632857},
+		{"12345678", 0xadc83b19, 0x95ebb86389132953},
+		{"123456789", 0xadc83b19, 0x217532cb09f2a44d},
+		{"The quick brown fox", 0xadc83b19, 0xb8cb2a48ba03f3e4},
+	}
+	for _, hash := range hashes {
+		if got := murmurHash64A([]byte(hash.data), hash.seed); got != hash.want {
+			t.Errorf("murmurHash64A(%q, %#x) = %#016x, want %#016x", hash.data, hash.seed, got, hash.want)
+		}
+	}
+}
+
+func TestHLLPatternLength(t *testing.T) {
+	patterns := []struct {
+		element string
+		index   int
+		count   uint8
+	}{
+		{"a", 12711, 2},
+		{"b", 15780, 1},
+		{"g", 8378, 2},
+		{"hello", 9216, 1},
+		{"element:1", 1167, 1},
+	}
+	for _, pattern := range patterns {
+		index, count := hllPatternLength([]byte(pattern.element))
+		if index != pattern.index || count != pattern.count {
+			t.Errorf("hllPatternLength(%q) = %d, %d, want %d, %d", pattern.element, index, count, pattern.index, pattern.count)
+		}
+	}
+}
+
+// pfadd runs PFADD against a fresh database and returns the string it stores
+func pfadd(t *testing.T, elements ...string) []byte {
+	t.Helper()
+
+	databases = newDatabases(16)
+	store = databases[0]
+	t.Cleanup(func() {
+		databases = newDatabases(16)
+		store = databases[0]
+	})
+
+	if _, err := handlePFAdd(&client{}, append([]string{"PFADD", "hll"}, elements...)); err != nil {
+		t.Fatalf("PFADD: %v", err)
+	}
+	e, err := getHLL("hll")
+	if err != nil || e == nil {
+		t.Fatalf("PFADD stored no HLL: %v", err)
+	}
+	return stringValue(e)
+}
+
+func TestHLLSparseEncoding(t *testing.T) {
+	// an HLL as created, with an empty valid cache and every register in one XZERO opcode
+	empty := decodeFixture(t, `
+		48594c4c 01 000000  // "HYLL", sparse
+		0000000000000000    // cached cardinality
+		7fff                // XZERO 16384
+	`)
+	if got := newHLL(); !bytes.Equal(got, empty) {
+		t.Errorf("newHLL() = %x, want %x", got, empty)
+	}
+
+	// PFADD, which marks the cache stale even when it adds nothing
+	empty[15] = 0x80
+	if got := pfadd(t); !bytes.Equal(got, empty) {
+		t.Errorf("PFADD hll = %x, want %x", got, empty)
+	}
+
+	want := decodeFixture(t, `
+		48594c4c 01 000000  // "HYLL", sparse
+		0000000000000080    // stale cached cardinality
+		466d                // XZERO 1646
+		80                  // VAL 1: "f"
+		560c                // XZERO 5645
+		80                  // VAL 1: "d"
+		443c                // XZERO 1085
+		84                  // VAL 2: "g"
+		38                  // ZERO 57
+		80                  // VAL 1: "c"
+		50b1                // XZERO 4274
+		84                  // VAL 2: "a"
+		498c                // XZERO 2445
+		80                  // VAL 1: "e"
+		426d                // XZERO 622
+		80                  // VAL 1: "b"
+		425a                // XZERO 603
+	`)
+	h := pfadd(t, "a", "b", "c", "d", "e", "f", "g")
+	if !bytes.Equal(h, want) {
+		t.Errorf("PFADD hll a b c d e f g = %x, want %x", h, want)
+	}
+
+	// PFCOUNT gives 7, as in its documentation, and caches the count little-endian with the
+	// stale bit clear
+	reply, err := handlePFCount(&client{}, []string{"PFCOUNT", "hll"})
+	if err != nil || string(reply) != ":7\r\n" {
+		t.Errorf("PFCOUNT = %q, %v, want 7", reply, err)
+	}
+	if e, _ := getHLL("hll"); e == nil || !bytes.Equal(stringValue(e)[8:16], []byte{7, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("PFCOUNT didn't cache the count 7")
+	}
+
+	dense, err := hllSparseToDense(want)
+	if err != nil {
+		t.Fatalf("hllSparseToDense: %v", err)
+	}
+	if len(dense) != hllDenseSize || dense[4] != hllDense || !bytes.Equal(dense[8:16], want[8:16]) {
+		t.Errorf("hllSparseToDense gave a %d-byte HLL with header %x", len(dense), dense[:16])
+	}
+	registers := map[int]uint8{1646: 1, 7292: 1, 8378: 2, 8436: 1, 12711: 2, 15157: 1, 15780: 1}
+	for i := range hllRegisters {
+		if got := hllDenseGet(dense[hllHeaderSize:], i); got != registers[i] {
+			t.Errorf("register %d = %d, want %d", i, got, registers[i])
+		}
+	}
+}
+
+func TestHLLDenseRegisters(t *testing.T) {
+	// registers are packed six bits each, least significant bit first
+	registers := make([]byte, hllDenseSize-hllHeaderSize)
+	for i, count := range []uint8{1, 2, 3, 4, 63} {
+		hllDenseSet(registers, i, count)
+	}
+	if want := decodeFixture(t, `813010 3f`); !bytes.Equal(registers[:4], want) {
+		t.Errorf("registers 0 to 4 are packed as %x, want %x", registers[:4], want)
+	}
+
+	// the last register ends on the last byte
+	hllDenseSet(registers, hllRegisters-1, 63)
+	if registers[len(registers)-1] != 0xfc || hllDenseGet(registers, hllRegisters-1) != 63 {
+		t.Errorf("last register packed as %x", registers[len(registers)-1])
+	}
+}
+
+func TestHLLEncodingMatchesRedis(t *testing.T) {
+	// whole HLLs are compared by digest. The first two stay sparse, the second just under
+	// hll-sparse-max-bytes and with runs of registers merged into single opcodes, while the
+	// others outgrow it and become dense
+	cases := []struct {
+		elements int
+		encoding byte
+		sha256   string
+		count    uint64
+	}{
+		{300, hllSparse, "33c3ac2a7327fc6139f6f0c5bb53385271110ce021e3b93442613ac296f674c7", 301},
+		{1650, hllSparse, "894223eaf7a2a7c3a4f342b6fc2367ce78be7f8f3aa01fdfedde282edc18bc46", 1657},
+		{2000, hllDense, "1413d367ae2022e977710ab6beeebb989df83e8058a1c6e9d211d877c2bc24ea", 2004},
+		{20000, hllDense, "fead0d85a6b6d337fb76938a6494bfeb5643adfaf8ae222ea3fe1aa0d0927860", 19986},
+	}
+
+	for _, tc := range cases {
+		elements := make([]string, tc.elements)
+		for i := range elements {
+			elements[i] = fmt.Sprintf("element:%d", i)
+		}
+
+		h := pfadd(t, elements...)
+		if h[4] != tc.encoding {
+			t.Errorf("%d elements: encoding %d, want %d", tc.elements, h[4], tc.encoding)
+		}
+		if sum := sha256.Sum256(h); hex.EncodeToString(sum[:]) != tc.sha256 {
+			t.Errorf("%d elements: %d bytes with SHA-256 %x, want %s", tc.elements, len(h), sum, tc.sha256)
+		}
+		if count, err := hllCount(h); err != nil || count != tc.count {
+			t.Errorf("%d elements: count %d, %v, want %d", tc.elements, count, err, tc.count)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// intset is a sorted array of integers stored in the narrowest width (2, 4 or 8 bytes, little
+// endian) that fits every member, laid out exactly like Redis's intset so that it can be
+// written to and read from RDB files as is. Adding a wider integer upgrades the whole array
+type intset struct {
+	width    int
+	contents []byte
+}
+
+func newIntset() *intset {
+	return &intset{width: 2}
+}
+
+func intsetWidthFor(value int64) int {
+	switch {
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		return 2
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		return 4
+	default:
+		return 8
+	}
+}
+
+func (is *intset) len() int {
+	return len(is.contents) / is.width
+}
+
+func (is *intset) get(i int) int64 {
+	element := is.contents[i*is.width : (i+1)*is.width]
+	switch is.width {
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(element)))
+	case 4:
+		return int64(int32(binary.LittleEndian.Uint32(element)))
+	default:
+		return int64(binary.LittleEndian.Uint64(element))
+	}
+}
+
+func (is *intset) put(i int, value int64) {
+	element := is.contents[i*is.width : (i+1)*is.width]
+	switch is.width {
+	case 2:
+		binary.LittleEndian.PutUint16(element, uint16(value))
+	case 4:
+		binary.LittleEndian.PutUint32(element, uint32(value))
+	default:
+		binary.LittleEndian.PutUint64(element, uint64(value))
+	}
+}
+
+// search returns the position of value, or where it would be inserted if it's missing
+func (is *intset) search(value int64) (int, bool) {
+	low, high := 0, is.len()-1
+	for low <= high {
+		mid := int(uint(low+high) >> 1)
+		current := is.get(mid)
+		switch {
+		case current < value:
+			low = mid + 1
+		case current > value:
+			high = mid - 1
+		default:
+			return mid, true
+		}
+	}
+
+	return low, false
+}
+
+func (is *intset) contains(value int64) bool {
+	if intsetWidthFor(value) > is.width {
+		return false
+	}
+
+	_, found := is.search(value)
+	return found
+}
+
+// upgrade widens every element so that value fits
+func (is *intset) upgrade(width int) {
+	upgraded := &intset{width: width, contents: make([]byte, is.len()*width)}
+	for i := 0; i < is.len(); i++ {
+		upgraded.put(i, is.get(i))
+	}
+
+	*is = *upgraded
+}
+
+func (is *intset) add(value int64) bool {
+	if width := intsetWidthFor(value); width > is.width {
+		is.upgrade(width)
+	}
+
+	pos, found := is.search(value)
+	if found {
+		return false
+	}
+
+	is.contents = append(is.contents, make([]byte, is.width)...)
+	copy(is.contents[(pos+1)*is.width:], is.contents[pos*is.width:])
+	is.put(pos, value)
+
+	return true
+}
+
+func (is *intset) remove(value int64) bool {
+	if intsetWidthFor(value) > is.width {
+		return false
+	}
+
+	pos, found := is.search(value)
+	if !found {
+		return false
+	}
+
+	is.contents = append(is.contents[:pos*is.width], is.contents[(pos+1)*is.width:]...)
+	return true
+}
+
+func (is *intset) clone() *intset {
+	return &intset{width: is.width, contents: append([]byte(nil), is.contents...)}
+}
+
+// bytes serialises an intset the way RDB files hold it: its width and length, as 32-bit
+// little-endian integers, followed by its contents
+func (is *intset) bytes() []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(is.width))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(is.len()))
+	return append(buf, is.contents...)
+}
+
+// decodeIntset returns the members of a serialised intset
+func decodeIntset(data []byte) ([]string, error) {
+	if len(data) < 8 {
+		return nil, errors.New("corrupt intset")
+	}
+	width, length := int(binary.LittleEndian.Uint32(data)), int(binary.LittleEndian.Uint32(data[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(data) != 8+width*length {
+		return nil, errors.New("corrupt intset")
+	}
+
+	is := &intset{width: width, contents: data[8:]}
+	members := make([]string, is.len())
+	for i := range members {
+		members[i] = strconv.FormatInt(is.get(i), 10)
+	}
+	return members, nil
+}
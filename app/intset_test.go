@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestIntsetEncoding(t *testing.T) {
+	// an intset widens every member once one needs it, keeping them sorted
+	steps := []struct {
+		add  int64
+		want string
+	}{
+		{1, `02000000 01000000 0100`},
+		{-2, `02000000 02000000 feff 0100`},
+		{70000, `04000000 03000000 feffffff 01000000 70110100`},
+		{1 << 33, `08000000 04000000 feffffffffffffff 0100000000000000 7011010000000000 0000000002000000`},
+	}
+
+	is := newIntset()
+	for _, step := range steps {
+		is.add(step.add)
+		if got, want := is.bytes(), decodeFixture(t, step.want); !bytes.Equal(got, want) {
+			t.Errorf("after adding %d, intset = %x, want %x", step.add, got, want)
+		}
+	}
+}
+
+func TestDecodeIntset(t *testing.T) {
+	fixtures := []struct {
+		fixture string
+		want    []string
+	}{
+		{`02000000 04000000 0080 fdff 0500 ff7f`, []string{"-32768", "-3", "5", "32767"}},
+		{`04000000 02000000 00000080 70110100`, []string{"-2147483648", "70000"}},
+		{`08000000 02000000 0000000000000080 ffffffffffffff7f`, []string{"-9223372036854775808", "9223372036854775807"}},
+	}
+	for _, fixture := range fixtures {
+		members, err := decodeIntset(decodeFixture(t, fixture.fixture))
+		if err != nil {
+			t.Errorf("decodeIntset(%s): %v", fixture.fixture, err)
+		} else if !slices.Equal(members, fixture.want) {
+			t.Errorf("decodeIntset(%s) = %q, want %q", fixture.fixture, members, fixture.want)
+		}
+	}
+
+	corrupt := []string{
+		`02000000 02000000 0100`,        // fewer members than its length
+		`03000000 01000000 010000`,      // an invalid width
+		`04000000 01000000 01000000 00`, // trailing data
+		`020000`,
+	}
+	for _, fixture := range corrupt {
+		if _, err := decodeIntset(decodeFixture(t, fixture)); err == nil {
+			t.Errorf("decodeIntset accepted %s", fixture)
+		}
+	}
+}
@@ -4,33 +4,42 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
-const EMPTY_RDB_BASE64 = "UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+APsAAP+Z/8ky5l9PGw=="
+const EMPTY_RDB_BASE64 = "UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog=="
 
-func readRDBFile() (*string, error) {
-	byteContent, err := os.ReadFile(configRDB["name"])
-	if err != nil {
-		return nil, err
-	}
+func readRDBFile() ([]byte, error) {
+	return os.ReadFile(configRDB["name"])
+}
 
-	rdbContent := fmt.Sprintf("%x", byteContent)
-	return &rdbContent, nil
+func writeRDBFile(content []byte) error {
+	return replaceFile(configRDB["name"], content)
 }
 
-func writeRDBFile(content []byte) (bool, error) {
-	file, openErr := os.Create(configRDB["name"])
-	if openErr != nil {
-		return false, openErr
+// replaceFile replaces a file atomically: the content is written to a temporary file
+// alongside it, which is then renamed over it, so a failed save never leaves a truncated file
+func replaceFile(name string, content []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(name), "temp-*"+filepath.Ext(name))
+	if err != nil {
+		return err
+	}
+	// once renamed, there's nothing left to remove
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
 	}
-	_, writeErr := file.Write(content)
-	if writeErr != nil {
-		return false, writeErr
+	if err := file.Close(); err != nil {
+		return err
 	}
 
-	// contents, _ := readRDBFile()
-	// fmt.Println(*contents)
-	return true, nil
+	return os.Rename(file.Name(), name)
 }
 
 func getEmptyRDBFile() []byte {
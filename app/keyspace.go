@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type valueType int
+
+const (
+	stringType valueType = iota
+	listType
+	setType
+	zsetType
+	hashType
+	streamType
+)
+
+func (t valueType) String() string {
+	switch t {
+	case stringType:
+		return "string"
+	case listType:
+		return "list"
+	case setType:
+		return "set"
+	case zsetType:
+		return "zset"
+	case hashType:
+		return "hash"
+	case streamType:
+		return "stream"
+	default:
+		return "none"
+	}
+}
+
+// parseValueType maps a type name, as reported by TYPE, back to its valueType
+func parseValueType(name string) (valueType, bool) {
+	for t := stringType; t <= streamType; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t, true
+		}
+	}
+
+	return 0, false
+}
+
+// entry is a single value held in the keyspace, along with its expiry metadata
+type entry struct {
+	Type      valueType
+	Value     any
+	ExpiryPtr *expiry
+	// shared marks an entry a snapshot being written out refers to, which has to be copied
+	// before it's changed (see unshare)
+	shared bool
+}
+
+func newStringEntry(value []byte, expiryPtr *expiry) *entry {
+	return &entry{Type: stringType, Value: value, ExpiryPtr: expiryPtr}
+}
+
+// clone deep-copies an entry, so that the copy can be modified independently
+func (e *entry) clone() *entry {
+	copied := &entry{Type: e.Type, ExpiryPtr: e.ExpiryPtr}
+
+	switch value := e.Value.(type) {
+	case []byte:
+		copied.Value = bytes.Clone(value)
+	case *listValue:
+		copied.Value = value.clone()
+	case *hashValue:
+		copied.Value = value.clone()
+	case *setValue:
+		copied.Value = value.clone()
+	case *zsetValue:
+		copied.Value = value.clone()
+	case *streamValue:
+		copied.Value = value.clone()
+	default:
+		copied.Value = value
+	}
+
+	return copied
+}
+
+// isExpired reports whether the key has expired, which a hash also does once every one of its
+// fields has
+func (e *entry) isExpired(now time.Time) bool {
+	if e.ExpiryPtr != nil && now.Compare(e.ExpiryPtr.Timestamp) >= 0 {
+		return true
+	}
+
+	h, ok := e.Value.(*hashValue)
+	return ok && h.allFieldsExpired(now)
+}
+
+// keyspace holds the keys of one of the databases served by this instance; the RDB file is
+// only read into them at startup and written from them when saving
+type keyspace struct {
+	// id is the database's index, as given to SELECT
+	id      int
+	mu      sync.RWMutex
+	entries map[string]*entry
+	// expires indexes the keys that have an expiry, for the active expiry cycle
+	expires map[string]struct{}
+	// fieldExpires indexes the hashes that have fields with an expiry, for the same cycle
+	fieldExpires map[string]struct{}
+	// index lets SCAN iterate over the keys incrementally
+	index *scanTable
+}
+
+// databases holds every database, as many as the databases parameter asks for
+var databases = newDatabases(16)
+
+// store is the database selected by the client whose command is running. It's only ever
+// switched, and used, under executionLock
+var store = databases[0]
+
+func newKeyspace(id int) *keyspace {
+	return &keyspace{
+		id:           id,
+		entries:      map[string]*entry{},
+		expires:      map[string]struct{}{},
+		fieldExpires: map[string]struct{}{},
+		index:        newScanTable(),
+	}
+}
+
+func newDatabases(count int) []*keyspace {
+	dbs := make([]*keyspace, count)
+	for i := range dbs {
+		dbs[i] = newKeyspace(i)
+	}
+	return dbs
+}
+
+// selectDatabase makes store the database a client has selected, under executionLock
+func selectDatabase(c *client) {
+	store = databases[c.db]
+}
+
+// parseDatabaseIndex parses the index of a database, e.g. as given to SELECT
+func parseDatabaseIndex(arg string) (int, error) {
+	db, ok := parseInteger(arg)
+	if !ok {
+		return 0, errNotInteger
+	}
+	if db < 0 || db >= int64(len(databases)) {
+		return 0, newCommandError("ERR", "DB index is out of range")
+	}
+	return int(db), nil
+}
+
+// dirty counts modifications to every database, so callers can tell whether a command
+// changed anything, and how much has changed since the last save
+var dirty atomic.Int64
+
+// markDirty records a modification, including one outside the keyspace, e.g. to the function
+// libraries, so that the command making it is replicated
+func markDirty() {
+	dirty.Add(1)
+}
+
+func dirtyCount() int64 {
+	return dirty.Load()
+}
+
+func (ks *keyspace) get(key string) (*entry, bool) {
+	ks.mu.RLock()
+	e, exists := ks.entries[key]
+	ks.mu.RUnlock()
+
+	if !exists {
+		return nil, false
+	}
+
+	now := time.Now()
+	if e.isExpired(now) {
+		ks.expire(key, e)
+		return nil, false
+	}
+	if e.shared && !readOnlyLookups {
+		ks.mu.Lock()
+		e = ks.unshare(key, e)
+		ks.mu.Unlock()
+	}
+	if h, ok := e.Value.(*hashValue); ok && len(h.expiring) > 0 {
+		e = ks.expireFields(key, e, now)
+	}
+
+	return e, true
+}
+
+// unshare gives the keyspace its own copy of an entry a snapshot still refers to, so that
+// changing it leaves the snapshot as it was; once no snapshot is left, the entry is the
+// keyspace's again. It's called under executionLock and ks.mu
+func (ks *keyspace) unshare(key string, e *entry) *entry {
+	if !e.shared {
+		return e
+	}
+	if sharedSnapshots.Load() == 0 {
+		e.shared = false
+		return e
+	}
+
+	copied := e.clone()
+	ks.entries[key] = copied
+	return copied
+}
+
+// expire lazily evicts a key found to have expired. Replicas leave the key in place
+// (while reporting it as missing), since their master sends an explicit DEL for it
+func (ks *keyspace) expire(key string, e *entry) {
+	if configRepl["role"] == "slave" {
+		return
+	}
+
+	ks.mu.Lock()
+	current, stillExists := ks.entries[key]
+	if stillExists && current == e {
+		delete(ks.entries, key)
+		delete(ks.expires, key)
+		delete(ks.fieldExpires, key)
+		ks.index.remove(key)
+		markDirty()
+		touchWatchedKey(ks.id, key, true)
+	}
+	ks.mu.Unlock()
+
+	if stillExists && current == e {
+		propagateInDatabase(ks.id, []string{"DEL", key})
+	}
+}
+
+// expireFields lazily removes the fields of a hash that have expired, leaving the rest, and
+// returns the entry now holding the hash. Like expired keys, expired fields are deleted
+// explicitly on replicas
+func (ks *keyspace) expireFields(key string, e *entry, now time.Time) *entry {
+	expired := e.Value.(*hashValue).expiredFields(now)
+	if len(expired) == 0 {
+		return e
+	}
+
+	ks.mu.Lock()
+	e = ks.unshare(key, e)
+	ks.mu.Unlock()
+
+	h := e.Value.(*hashValue)
+	for _, field := range expired {
+		h.remove(field)
+	}
+	ks.modified(key)
+
+	propagateInDatabase(ks.id, append([]string{"HDEL", key}, expired...))
+	return e
+}
+
+// trackFieldExpiries keeps fieldExpires up to date with the entry at key, under ks.mu
+func (ks *keyspace) trackFieldExpiries(key string, e *entry) {
+	if h, ok := e.Value.(*hashValue); ok && len(h.expiring) > 0 {
+		ks.fieldExpires[key] = struct{}{}
+	} else {
+		delete(ks.fieldExpires, key)
+	}
+}
+
+// getTyped looks up a key that must hold the given type; a missing key isn't an error
+func (ks *keyspace) getTyped(key string, t valueType) (*entry, error) {
+	e, exists := ks.get(key)
+	if !exists {
+		return nil, nil
+	}
+	if e.Type != t {
+		return nil, errWrongType
+	}
+
+	return e, nil
+}
+
+func (ks *keyspace) set(key string, e *entry) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if _, exists := ks.entries[key]; !exists {
+		ks.index.add(key)
+	}
+	ks.entries[key] = e
+	if e.ExpiryPtr != nil {
+		ks.expires[key] = struct{}{}
+	} else {
+		delete(ks.expires, key)
+	}
+	ks.trackFieldExpiries(key, e)
+	markDirty()
+	signalKeyReady(ks.id, key)
+	touchWatchedKey(ks.id, key, false)
+}
+
+// setExpiry changes (or with nil, removes) the expiry of an existing key
+func (ks *keyspace) setExpiry(key string, expiryPtr *expiry) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	e, exists := ks.entries[key]
+	if !exists {
+		return
+	}
+
+	e = ks.unshare(key, e)
+	e.ExpiryPtr = expiryPtr
+	if expiryPtr != nil {
+		ks.expires[key] = struct{}{}
+	} else {
+		delete(ks.expires, key)
+	}
+	markDirty()
+	touchWatchedKey(ks.id, key, false)
+}
+
+// modified records an in-place change to the value held at key
+func (ks *keyspace) modified(key string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if e, exists := ks.entries[key]; exists {
+		ks.trackFieldExpiries(key, e)
+	}
+	markDirty()
+	signalKeyReady(ks.id, key)
+	touchWatchedKey(ks.id, key, false)
+}
+
+func (ks *keyspace) delete(key string) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	e, exists := ks.entries[key]
+	if !exists {
+		return false
+	}
+	delete(ks.entries, key)
+	delete(ks.expires, key)
+	delete(ks.fieldExpires, key)
+	ks.index.remove(key)
+	markDirty()
+	touchWatchedKey(ks.id, key, true)
+
+	return !e.isExpired(time.Now())
+}
+
+// expiredButPresent reports whether a key has expired without having been evicted yet
+func (ks *keyspace) expiredButPresent(key string) bool {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	e, exists := ks.entries[key]
+	return exists && e.isExpired(time.Now())
+}
+
+func (ks *keyspace) keys() []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(ks.entries))
+	for key, e := range ks.entries {
+		if !e.isExpired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func (ks *keyspace) size() int {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return len(ks.entries)
+}
+
+// randomKey returns an arbitrary live key, relying on Go's randomised map iteration order
+func (ks *keyspace) randomKey() (string, bool) {
+	for {
+		ks.mu.RLock()
+		key, found := "", false
+		for candidate := range ks.entries {
+			key, found = candidate, true
+			break
+		}
+		ks.mu.RUnlock()
+
+		if !found {
+			return "", false
+		}
+		if _, exists := ks.get(key); exists {
+			return key, true
+		}
+	}
+}
+
+// sharedSnapshots counts the snapshots taken and not yet released, whose entries have to be
+// copied before they're changed
+var sharedSnapshots atomic.Int64
+
+// readOnlyLookups is set, under executionLock, while a read-only command runs, which can look
+// at shared entries without copying them
+var readOnlyLookups bool
+
+// snapshot returns every live key-value pair, which can be written to disk while commands
+// keep modifying the keyspace: rather than being copied up front, the entries are marked
+// shared, so that only those changed before the snapshot is released get copied. It's called
+// under executionLock
+func (ks *keyspace) snapshot() map[string]*entry {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	result := make(map[string]*entry, len(ks.entries))
+	for key, e := range ks.entries {
+		if !e.isExpired(now) {
+			e.shared = true
+			result[key] = e
+		}
+	}
+
+	return result
+}
+
+// replace swaps in an entirely new set of entries (e.g. after loading an RDB file)
+func (ks *keyspace) replace(entries map[string]*entry) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.entries = entries
+	ks.expires = map[string]struct{}{}
+	ks.fieldExpires = map[string]struct{}{}
+	ks.index = newScanTable()
+	for key, e := range entries {
+		if e.ExpiryPtr != nil {
+			ks.expires[key] = struct{}{}
+		}
+		ks.trackFieldExpiries(key, e)
+		ks.index.add(key)
+	}
+	touchAllWatchedKeys(ks.id)
+}
+
+// scan returns a batch of keys from cursor onwards, along with the next cursor. Expired
+// keys are included, so callers must check each key before returning it
+func (ks *keyspace) scan(cursor uint64, count int) (uint64, []string) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.index.scanBatch(cursor, count)
+}
+
+// activeExpireCycle samples keys with an expiry, and hashes with expiring fields, and evicts
+// whatever has expired, so that keys and fields which are never accessed again still get
+// removed; like Redis, it keeps sampling while more than a quarter of each sample turns out to
+// be expired, for up to a quarter of the time between cycles
+func (ks *keyspace) activeExpireCycle() {
+	const sampleSize = 20
+	const timeLimit = 25 * time.Millisecond
+
+	if configRepl["role"] == "slave" {
+		return
+	}
+
+	start := time.Now()
+	for {
+		executionLock.Lock()
+
+		ks.mu.RLock()
+		now := time.Now()
+		sampled, expired := 0, map[string]*entry{}
+		for key := range ks.expires {
+			if sampled == sampleSize {
+				break
+			}
+			sampled++
+			if e := ks.entries[key]; e.isExpired(now) {
+				expired[key] = e
+			}
+		}
+		sampledHashes, expiredFields := 0, map[string]*entry{}
+		for key := range ks.fieldExpires {
+			if sampledHashes == sampleSize {
+				break
+			}
+			sampledHashes++
+			e := ks.entries[key]
+			if e.isExpired(now) {
+				expired[key] = e
+			} else if h := e.Value.(*hashValue); len(h.expiredFields(now)) > 0 {
+				expiredFields[key] = e
+			}
+		}
+		ks.mu.RUnlock()
+
+		for key, e := range expired {
+			ks.expire(key, e)
+		}
+		for key, e := range expiredFields {
+			ks.expireFields(key, e, now)
+		}
+
+		executionLock.Unlock()
+
+		if len(expired)+len(expiredFields) <= (sampled+sampledHashes)/4 || time.Since(start) > timeLimit {
+			return
+		}
+	}
+}
+
+func runActiveExpiry() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for range ticker.C {
+		for _, db := range databases {
+			db.activeExpireCycle()
+		}
+	}
+}
+
+// keyspaceInfo generates the keyspace section of INFO, which lists the databases holding keys
+func keyspaceInfo() string {
+	lines := []string{"# Keyspace"}
+	for _, db := range databases {
+		db.mu.RLock()
+		keys, expires := len(db.entries), len(db.expires)
+		db.mu.RUnlock()
+
+		if keys > 0 {
+			lines = append(lines, fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=0", db.id, keys, expires))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,894 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// listValue is a double-ended queue backed by a ring buffer, so that pushing and popping
+// at either end are O(1) and indexing doesn't need to walk the list
+type listValue struct {
+	items  [][]byte
+	head   int
+	length int
+}
+
+func newListValue() *listValue {
+	return &listValue{items: make([][]byte, 4)}
+}
+
+func (l *listValue) len() int {
+	return l.length
+}
+
+func (l *listValue) index(i int) int {
+	return (l.head + i) % len(l.items)
+}
+
+func (l *listValue) at(i int) []byte {
+	return l.items[l.index(i)]
+}
+
+func (l *listValue) set(i int, value []byte) {
+	l.items[l.index(i)] = value
+}
+
+// resize moves the elements into a buffer of the given capacity, starting at its head
+func (l *listValue) resize(capacity int) {
+	items := make([][]byte, capacity)
+	for i := 0; i < l.length; i++ {
+		items[i] = l.at(i)
+	}
+
+	l.items = items
+	l.head = 0
+}
+
+func (l *listValue) pushFront(value []byte) {
+	if l.length == len(l.items) {
+		l.resize(2 * len(l.items))
+	}
+
+	l.head = (l.head - 1 + len(l.items)) % len(l.items)
+	l.items[l.head] = value
+	l.length++
+}
+
+func (l *listValue) pushBack(value []byte) {
+	if l.length == len(l.items) {
+		l.resize(2 * len(l.items))
+	}
+
+	l.items[l.index(l.length)] = value
+	l.length++
+}
+
+// shrink releases memory once most of the buffer is unused
+func (l *listValue) shrink() {
+	if len(l.items) > 16 && l.length < len(l.items)/4 {
+		l.resize(len(l.items) / 2)
+	}
+}
+
+func (l *listValue) popFront() []byte {
+	value := l.items[l.head]
+	l.items[l.head] = nil
+	l.head = l.index(1)
+	l.length--
+	l.shrink()
+
+	return value
+}
+
+func (l *listValue) popBack() []byte {
+	i := l.index(l.length - 1)
+	value := l.items[i]
+	l.items[i] = nil
+	l.length--
+	l.shrink()
+
+	return value
+}
+
+func (l *listValue) pop(left bool) []byte {
+	if left {
+		return l.popFront()
+	}
+	return l.popBack()
+}
+
+func (l *listValue) push(value []byte, left bool) {
+	if left {
+		l.pushFront(value)
+	} else {
+		l.pushBack(value)
+	}
+}
+
+// elements returns the elements from start to stop inclusive, in order
+func (l *listValue) elements(start, stop int) [][]byte {
+	result := make([][]byte, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		result = append(result, l.at(i))
+	}
+
+	return result
+}
+
+// replace swaps in a new set of elements, e.g. after removing some from the middle
+func (l *listValue) replace(elements [][]byte) {
+	l.items = make([][]byte, max(4, len(elements)))
+	copy(l.items, elements)
+	l.head = 0
+	l.length = len(elements)
+}
+
+// insert places value before the element at index i
+func (l *listValue) insert(i int, value []byte) {
+	elements := l.elements(0, l.length-1)
+	elements = append(elements[:i], append([][]byte{value}, elements[i:]...)...)
+	l.replace(elements)
+}
+
+func (l *listValue) clone() *listValue {
+	copied := newListValue()
+	for i := 0; i < l.length; i++ {
+		copied.pushBack(bytes.Clone(l.at(i)))
+	}
+
+	return copied
+}
+
+// getList looks up a list for reading or modifying; a missing key gives a nil list
+func getList(key string) (*listValue, error) {
+	e, err := store.getTyped(key, listType)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	return e.Value.(*listValue), nil
+}
+
+// listChanged records a modification of the list at key, deleting it once it's empty
+func listChanged(key string, l *listValue) {
+	if l.len() == 0 {
+		store.delete(key)
+	} else {
+		store.modified(key)
+	}
+}
+
+// normaliseRange resolves negative start and stop indexes as LRANGE does, reporting
+// whether the resulting range is empty
+func normaliseRange(start, stop int64, length int) (int, int, bool) {
+	if start < 0 {
+		start += int64(length)
+	}
+	if stop < 0 {
+		stop += int64(length)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= int64(length) {
+		return 0, 0, false
+	}
+	if stop >= int64(length) {
+		stop = int64(length) - 1
+	}
+
+	return int(start), int(stop), true
+}
+
+func parseListDirection(arg string) (bool, error) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	default:
+		return false, errSyntax
+	}
+}
+
+func listDirectionName(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+func encodeListElements(elements [][]byte) []byte {
+	encoded := make([][]byte, len(elements))
+	for i, element := range elements {
+		encoded[i] = encodeBulkString(string(element))
+	}
+
+	return encodeArray(encoded)
+}
+
+// handlePush implements LPUSH, RPUSH, LPUSHX and RPUSHX
+func handlePush(c *client, array []string) ([]byte, error) {
+	command := strings.ToLower(array[0])
+	key := array[1]
+	left := command[0] == 'l'
+
+	l, err := getList(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if l == nil {
+		if strings.HasSuffix(command, "x") {
+			return encodeInteger(0), nil
+		}
+
+		l = newListValue()
+		for _, element := range array[2:] {
+			l.push([]byte(element), left)
+		}
+		store.set(key, &entry{Type: listType, Value: l})
+
+		return encodeInteger(l.len()), nil
+	}
+
+	for _, element := range array[2:] {
+		l.push([]byte(element), left)
+	}
+	store.modified(key)
+
+	return encodeInteger(l.len()), nil
+}
+
+// handlePop implements LPOP and RPOP
+func handlePop(c *client, array []string) ([]byte, error) {
+	if len(array) > 3 {
+		return nil, errSyntax
+	}
+
+	key := array[1]
+	left := strings.EqualFold(array[0], "lpop")
+
+	count, hasCount := int64(1), len(array) == 3
+	if hasCount {
+		var ok bool
+		count, ok = parseInteger(array[2])
+		if !ok || count < 0 {
+			return nil, errNotPositive
+		}
+	}
+
+	l, err := getList(key)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		if hasCount {
+			return encodeNullArray(c.protocol), nil
+		}
+		return encodeNull(c.protocol), nil
+	}
+
+	if !hasCount {
+		element := l.pop(left)
+		listChanged(key, l)
+		return encodeBulkString(string(element)), nil
+	}
+
+	elements := [][]byte{}
+	for ; count > 0 && l.len() > 0; count-- {
+		elements = append(elements, l.pop(left))
+	}
+	if len(elements) > 0 {
+		listChanged(key, l)
+	}
+
+	return encodeListElements(elements), nil
+}
+
+func handleLLen(c *client, array []string) ([]byte, error) {
+	l, err := getList(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return encodeInteger(0), nil
+	}
+
+	return encodeInteger(l.len()), nil
+}
+
+func handleLRange(c *client, array []string) ([]byte, error) {
+	start, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+	stop, ok := parseInteger(array[3])
+	if !ok {
+		return nil, errNotInteger
+	}
+
+	l, err := getList(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return encodeArray(nil), nil
+	}
+
+	first, last, nonEmpty := normaliseRange(start, stop, l.len())
+	if !nonEmpty {
+		return encodeArray(nil), nil
+	}
+
+	return encodeListElements(l.elements(first, last)), nil
+}
+
+func handleLIndex(c *client, array []string) ([]byte, error) {
+	index, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+
+	l, err := getList(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return encodeNull(c.protocol), nil
+	}
+
+	if index < 0 {
+		index += int64(l.len())
+	}
+	if index < 0 || index >= int64(l.len()) {
+		return encodeNull(c.protocol), nil
+	}
+
+	return encodeBulkString(string(l.at(int(index)))), nil
+}
+
+func handleLSet(c *client, array []string) ([]byte, error) {
+	key := array[1]
+	index, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+
+	l, err := getList(key)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, errNoSuchKey
+	}
+
+	if index < 0 {
+		index += int64(l.len())
+	}
+	if index < 0 || index >= int64(l.len()) {
+		return nil, errOutOfRange
+	}
+
+	l.set(int(index), []byte(array[3]))
+	store.modified(key)
+
+	return encodeSimpleString("OK"), nil
+}
+
+func handleLInsert(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	var after bool
+	switch strings.ToUpper(array[2]) {
+	case "BEFORE":
+		after = false
+	case "AFTER":
+		after = true
+	default:
+		return nil, errSyntax
+	}
+
+	l, err := getList(key)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return encodeInteger(0), nil
+	}
+
+	pivot := []byte(array[3])
+	for i := 0; i < l.len(); i++ {
+		if !bytes.Equal(l.at(i), pivot) {
+			continue
+		}
+
+		if after {
+			i++
+		}
+		l.insert(i, []byte(array[4]))
+		store.modified(key)
+
+		return encodeInteger(l.len()), nil
+	}
+
+	return encodeInteger(-1), nil
+}
+
+func handleLRem(c *client, array []string) ([]byte, error) {
+	key := array[1]
+	count, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+
+	l, err := getList(key)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return encodeInteger(0), nil
+	}
+
+	// a negative count removes matches starting from the tail
+	elements := l.elements(0, l.len()-1)
+	target := []byte(array[3])
+	removed := make([]bool, len(elements))
+	numRemoved := int64(0)
+	for n := 0; n < len(elements); n++ {
+		i := n
+		if count < 0 {
+			i = len(elements) - 1 - n
+		}
+		if bytes.Equal(elements[i], target) {
+			removed[i] = true
+			numRemoved++
+			if count != 0 && numRemoved == max(count, -count) {
+				break
+			}
+		}
+	}
+
+	if numRemoved == 0 {
+		return encodeInteger(0), nil
+	}
+
+	kept := make([][]byte, 0, len(elements)-int(numRemoved))
+	for i, element := range elements {
+		if !removed[i] {
+			kept = append(kept, element)
+		}
+	}
+	l.replace(kept)
+	listChanged(key, l)
+
+	return encodeInteger(int(numRemoved)), nil
+}
+
+func handleLTrim(c *client, array []string) ([]byte, error) {
+	key := array[1]
+	start, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+	stop, ok := parseInteger(array[3])
+	if !ok {
+		return nil, errNotInteger
+	}
+
+	l, err := getList(key)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return encodeSimpleString("OK"), nil
+	}
+
+	first, last, nonEmpty := normaliseRange(start, stop, l.len())
+	if !nonEmpty {
+		store.delete(key)
+		return encodeSimpleString("OK"), nil
+	}
+	if first == 0 && last == l.len()-1 {
+		return encodeSimpleString("OK"), nil
+	}
+
+	l.replace(l.elements(first, last))
+	store.modified(key)
+
+	return encodeSimpleString("OK"), nil
+}
+
+func handleLPos(c *client, array []string) ([]byte, error) {
+	rank, count, maxLen := int64(1), int64(-1), int64(0)
+
+	for i := 3; i < len(array); i += 2 {
+		if i+1 >= len(array) {
+			return nil, errSyntax
+		}
+		value, ok := parseInteger(array[i+1])
+		if !ok {
+			return nil, errNotInteger
+		}
+
+		switch strings.ToUpper(array[i]) {
+		case "RANK":
+			if value == 0 || value == -1<<63 {
+				return nil, newCommandError("ERR", "RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = value
+		case "COUNT":
+			if value < 0 {
+				return nil, newCommandError("ERR", "COUNT can't be negative")
+			}
+			count = value
+		case "MAXLEN":
+			if value < 0 {
+				return nil, newCommandError("ERR", "MAXLEN can't be negative")
+			}
+			maxLen = value
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	l, err := getList(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		if count >= 0 {
+			return encodeArray(nil), nil
+		}
+		return encodeNull(c.protocol), nil
+	}
+
+	// a negative rank searches from the tail, skipping the first -rank-1 matches
+	target := []byte(array[2])
+	skip := max(rank, -rank) - 1
+	positions := [][]byte{}
+	for n := 0; n < l.len() && (maxLen == 0 || int64(n) < maxLen); n++ {
+		i := n
+		if rank < 0 {
+			i = l.len() - 1 - n
+		}
+		if !bytes.Equal(l.at(i), target) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		positions = append(positions, encodeInteger(i))
+		if count < 0 || (count > 0 && int64(len(positions)) == count) {
+			break
+		}
+	}
+
+	if count >= 0 {
+		return encodeArray(positions), nil
+	}
+	if len(positions) == 0 {
+		return encodeNull(c.protocol), nil
+	}
+	return positions[0], nil
+}
+
+// moveElement pops an element from one end of source and pushes it onto destination,
+// returning nil if source doesn't exist. Both keys are type-checked before anything moves
+func moveElement(source, destination string, fromLeft, toLeft bool) ([]byte, error) {
+	l, err := getList(source)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	if _, err := getList(destination); err != nil {
+		return nil, err
+	}
+
+	element := l.pop(fromLeft)
+	listChanged(source, l)
+
+	// looked up again, since popping may have deleted the source when it's also the destination
+	target, _ := getList(destination)
+	if target == nil {
+		target = newListValue()
+		target.push(element, toLeft)
+		store.set(destination, &entry{Type: listType, Value: target})
+	} else {
+		target.push(element, toLeft)
+		store.modified(destination)
+	}
+
+	return element, nil
+}
+
+// handleLMove implements LMOVE and the older RPOPLPUSH
+func handleLMove(c *client, array []string) ([]byte, error) {
+	fromLeft, toLeft := false, true
+	if strings.EqualFold(array[0], "lmove") {
+		var err error
+		if fromLeft, err = parseListDirection(array[3]); err != nil {
+			return nil, err
+		}
+		if toLeft, err = parseListDirection(array[4]); err != nil {
+			return nil, err
+		}
+	}
+
+	element, err := moveElement(array[1], array[2], fromLeft, toLeft)
+	if err != nil {
+		return nil, err
+	}
+	if element == nil {
+		return encodeNull(c.protocol), nil
+	}
+
+	return encodeBulkString(string(element)), nil
+}
+
+// parseMultiPopArgs parses the "numkeys key [key ...] <direction> [COUNT count]" arguments
+// shared by LMPOP, BLMPOP, ZMPOP and BZMPOP
+func parseMultiPopArgs(args []string, parseDirection func(string) (bool, error)) ([]string, bool, int, error) {
+	numKeys, ok := parseInteger(args[0])
+	if !ok || numKeys <= 0 {
+		return nil, false, 0, newCommandError("ERR", "numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-2) {
+		return nil, false, 0, errSyntax
+	}
+
+	keys := args[1 : 1+numKeys]
+	direction, err := parseDirection(args[1+numKeys])
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	count, hasCount := int64(1), false
+	for i := 2 + numKeys; i < int64(len(args)); i += 2 {
+		if hasCount || !strings.EqualFold(args[i], "COUNT") || i+1 >= int64(len(args)) {
+			return nil, false, 0, errSyntax
+		}
+		count, ok = parseInteger(args[i+1])
+		if !ok || count <= 0 {
+			return nil, false, 0, newCommandError("ERR", "count should be greater than 0")
+		}
+		hasCount = true
+	}
+
+	return keys, direction, int(count), nil
+}
+
+// popFromFirstList pops up to count elements from the first non-empty list among keys,
+// returning the key popped from, or "" if they're all empty
+func popFromFirstList(keys []string, left bool, count int) (string, [][]byte, error) {
+	for _, key := range keys {
+		l, err := getList(key)
+		if err != nil {
+			return "", nil, err
+		}
+		if l == nil {
+			continue
+		}
+
+		elements := [][]byte{}
+		for ; count > 0 && l.len() > 0; count-- {
+			elements = append(elements, l.pop(left))
+		}
+		listChanged(key, l)
+
+		return key, elements, nil
+	}
+
+	return "", nil, nil
+}
+
+func handleLMPop(c *client, array []string) ([]byte, error) {
+	keys, left, count, err := parseMultiPopArgs(array[1:], parseListDirection)
+	if err != nil {
+		return nil, err
+	}
+
+	key, elements, err := popFromFirstList(keys, left, count)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return encodeNullArray(c.protocol), nil
+	}
+
+	return encodeArray([][]byte{encodeBulkString(key), encodeListElements(elements)}), nil
+}
+
+// handleBlockingPop implements BLPOP and BRPOP
+func handleBlockingPop(c *client, array []string) ([]byte, error) {
+	command := strings.ToUpper(array[0])
+	keys := array[1 : len(array)-1]
+	left := command == "BLPOP"
+
+	timeout, err := parseTimeout(array[len(array)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	return blockOn(c, keys, timeout, encodeNullArray(c.protocol), func() ([]byte, bool, error) {
+		key, elements, err := popFromFirstList(keys, left, 1)
+		if err != nil || key == "" {
+			return nil, false, err
+		}
+
+		c.propagateAs = [][]string{{command[1:], key}}
+		return encodeArray([][]byte{encodeBulkString(key), encodeBulkString(string(elements[0]))}), true, nil
+	})
+}
+
+// handleBlockingMove implements BLMOVE and the older BRPOPLPUSH
+func handleBlockingMove(c *client, array []string) ([]byte, error) {
+	source, destination := array[1], array[2]
+	fromLeft, toLeft := false, true
+	if strings.EqualFold(array[0], "blmove") {
+		var err error
+		if fromLeft, err = parseListDirection(array[3]); err != nil {
+			return nil, err
+		}
+		if toLeft, err = parseListDirection(array[4]); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout, err := parseTimeout(array[len(array)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	return blockOn(c, []string{source}, timeout, encodeNull(c.protocol), func() ([]byte, bool, error) {
+		element, err := moveElement(source, destination, fromLeft, toLeft)
+		if err != nil || element == nil {
+			return nil, false, err
+		}
+
+		c.propagateAs = [][]string{{"LMOVE", source, destination, listDirectionName(fromLeft), listDirectionName(toLeft)}}
+		return encodeBulkString(string(element)), true, nil
+	})
+}
+
+func handleBlockingMPop(c *client, array []string) ([]byte, error) {
+	timeout, err := parseTimeout(array[1])
+	if err != nil {
+		return nil, err
+	}
+	keys, left, count, err := parseMultiPopArgs(array[2:], parseListDirection)
+	if err != nil {
+		return nil, err
+	}
+
+	return blockOn(c, keys, timeout, encodeNullArray(c.protocol), func() ([]byte, bool, error) {
+		key, elements, err := popFromFirstList(keys, left, count)
+		if err != nil || key == "" {
+			return nil, false, err
+		}
+
+		popCommand := "RPOP"
+		if left {
+			popCommand = "LPOP"
+		}
+		c.propagateAs = [][]string{{popCommand, key, strconv.Itoa(len(elements))}}
+		return encodeArray([][]byte{encodeBulkString(key), encodeListElements(elements)}), true, nil
+	})
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "lpush", Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist.", Since: "1.0.0",
+			Handler: handlePush,
+		},
+		&commandSpec{
+			Name: "rpush", Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Appends one or more elements to a list. Creates the key if it doesn't exist.", Since: "1.0.0",
+			Handler: handlePush,
+		},
+		&commandSpec{
+			Name: "lpushx", Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Prepends one or more elements to a list only when the list exists.", Since: "2.2.0",
+			Handler: handlePush,
+		},
+		&commandSpec{
+			Name: "rpushx", Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Appends an element to a list only when the list exists.", Since: "2.2.0",
+			Handler: handlePush,
+		},
+		&commandSpec{
+			Name: "lpop", Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Returns the first elements in a list after removing it. Deletes the list if the last element was popped.",
+			Since: "1.0.0", Handler: handlePop,
+		},
+		&commandSpec{
+			Name: "rpop", Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Returns and removes the last elements of a list. Deletes the list if the last element was popped.",
+			Since: "1.0.0", Handler: handlePop,
+		},
+		&commandSpec{
+			Name: "llen", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Returns the length of a list.", Since: "1.0.0",
+			Handler: handleLLen,
+		},
+		&commandSpec{
+			Name: "lrange", Arity: 4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Returns a range of elements from a list.", Since: "1.0.0",
+			Handler: handleLRange,
+		},
+		&commandSpec{
+			Name: "lindex", Arity: 3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Returns an element from a list by its index.", Since: "1.0.0",
+			Handler: handleLIndex,
+		},
+		&commandSpec{
+			Name: "lset", Arity: 4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Sets the value of an element in a list by its index.", Since: "1.0.0",
+			Handler: handleLSet,
+		},
+		&commandSpec{
+			Name: "linsert", Arity: 5, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Inserts an element before or after another element in a list.", Since: "2.2.0",
+			Handler: handleLInsert,
+		},
+		&commandSpec{
+			Name: "lrem", Arity: 4, Flags: []string{"write"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Removes elements from a list. Deletes the list if the last element was removed.", Since: "1.0.0",
+			Handler: handleLRem,
+		},
+		&commandSpec{
+			Name: "ltrim", Arity: 4, Flags: []string{"write"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Removes elements from both ends a list. Deletes the list if all elements were trimmed.", Since: "1.0.0",
+			Handler: handleLTrim,
+		},
+		&commandSpec{
+			Name: "lpos", Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Returns the index of matching elements in a list.", Since: "6.0.6",
+			Handler: handleLPos,
+		},
+		&commandSpec{
+			Name: "lmove", Arity: 5, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "list", Summary: "Returns an element after popping it from one list and pushing it to another. Deletes the list if the last element was moved.",
+			Since: "6.2.0", Handler: handleLMove,
+		},
+		&commandSpec{
+			Name: "rpoplpush", Arity: 3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "list", Summary: "Returns the last element of a list after removing and pushing it to another list. Deletes the list if the last element was popped.",
+			Since: "1.2.0", Handler: handleLMove,
+		},
+		&commandSpec{
+			Name: "lmpop", Arity: -4, Flags: []string{"write"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "list", Summary: "Returns multiple elements from a list after removing them. Deletes the list if the last element was popped.",
+			Since: "7.0.0", Handler: handleLMPop,
+		},
+		&commandSpec{
+			Name: "blpop", Arity: -3, Flags: []string{"write", "blocking"}, FirstKey: 1, LastKey: -2, KeyStep: 1,
+			Group: "list", Summary: "Removes and returns the first element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped.",
+			Since: "2.0.0", Handler: handleBlockingPop,
+		},
+		&commandSpec{
+			Name: "brpop", Arity: -3, Flags: []string{"write", "blocking"}, FirstKey: 1, LastKey: -2, KeyStep: 1,
+			Group: "list", Summary: "Removes and returns the last element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped.",
+			Since: "2.0.0", Handler: handleBlockingPop,
+		},
+		&commandSpec{
+			Name: "blmove", Arity: 6, Flags: []string{"write", "denyoom", "blocking"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "list", Summary: "Pops an element from a list, pushes it to another list and returns it. Blocks until an element is available otherwise. Deletes the list if the last element was moved.",
+			Since: "6.2.0", Handler: handleBlockingMove,
+		},
+		&commandSpec{
+			Name: "brpoplpush", Arity: 4, Flags: []string{"write", "denyoom", "blocking"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "list", Summary: "Pops an element from a list, pushes it to another list and returns it. Block until an element is available otherwise. Deletes the list if the last element was popped.",
+			Since: "2.2.0", Handler: handleBlockingMove,
+		},
+		&commandSpec{
+			Name: "blmpop", Arity: -5, Flags: []string{"write", "blocking"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "list", Summary: "Pops the first element from one of multiple lists. Blocks until an element is available otherwise. Deletes the list if the last element was popped.",
+			Since: "7.0.0", Handler: handleBlockingMPop,
+		},
+	)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// a listpack is Redis's compact serialisation of a list of strings and integers, which is
+// how stream entries are stored in RDB files. Each element is its encoding and data,
+// followed by their combined length written backwards so the list can be walked either way
+const (
+	listpackHeaderSize = 6
+	listpackEnd        = 0xFF
+)
+
+type listpack struct {
+	buf   []byte
+	count int
+}
+
+func newListpack() *listpack {
+	return &listpack{buf: make([]byte, listpackHeaderSize)}
+}
+
+// appendString adds an element, stored as an integer if it's one in canonical form
+func (lp *listpack) appendString(s string) {
+	if n, ok := parseInteger(s); ok {
+		lp.appendInteger(n)
+		return
+	}
+
+	start := len(lp.buf)
+	switch length := len(s); {
+	case length < 64:
+		lp.buf = append(lp.buf, 0x80|byte(length))
+	case length < 4096:
+		lp.buf = append(lp.buf, 0xE0|byte(length>>8), byte(length))
+	default:
+		lp.buf = append(lp.buf, 0xF0)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(length))
+	}
+	lp.buf = append(lp.buf, s...)
+
+	lp.finishElement(start)
+}
+
+func (lp *listpack) appendInteger(n int64) {
+	start := len(lp.buf)
+	switch {
+	case n >= 0 && n <= 127:
+		lp.buf = append(lp.buf, byte(n))
+	case n >= -4096 && n <= 4095:
+		u := uint16(n) & 0x1FFF
+		lp.buf = append(lp.buf, 0xC0|byte(u>>8), byte(u))
+	case n >= -32768 && n <= 32767:
+		lp.buf = append(lp.buf, 0xF1)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(n))
+	case n >= -8388608 && n <= 8388607:
+		u := uint32(n)
+		lp.buf = append(lp.buf, 0xF2, byte(u), byte(u>>8), byte(u>>16))
+	case n >= -2147483648 && n <= 2147483647:
+		lp.buf = append(lp.buf, 0xF3)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	default:
+		lp.buf = append(lp.buf, 0xF4)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(n))
+	}
+
+	lp.finishElement(start)
+}
+
+// finishElement writes the back length of the element starting at start
+func (lp *listpack) finishElement(start int) {
+	length := len(lp.buf) - start
+	switch {
+	case length <= 127:
+		lp.buf = append(lp.buf, byte(length))
+	case length < 16383:
+		lp.buf = append(lp.buf, byte(length>>7), byte(length&127)|128)
+	case length < 2097151:
+		lp.buf = append(lp.buf, byte(length>>14), byte((length>>7)&127)|128, byte(length&127)|128)
+	case length < 268435455:
+		lp.buf = append(lp.buf, byte(length>>21), byte((length>>14)&127)|128,
+			byte((length>>7)&127)|128, byte(length&127)|128)
+	default:
+		lp.buf = append(lp.buf, byte(length>>28), byte((length>>21)&127)|128, byte((length>>14)&127)|128,
+			byte((length>>7)&127)|128, byte(length&127)|128)
+	}
+	lp.count++
+}
+
+// bytes terminates the listpack and fills in its header
+func (lp *listpack) bytes() []byte {
+	encoded := append(lp.buf, listpackEnd)
+	binary.LittleEndian.PutUint32(encoded, uint32(len(encoded)))
+	// counts that don't fit are left for readers to work out
+	binary.LittleEndian.PutUint16(encoded[4:], uint16(min(lp.count, 65535)))
+
+	return encoded
+}
+
+func backlenSize(length int) int {
+	switch {
+	case length <= 127:
+		return 1
+	case length < 16383:
+		return 2
+	case length < 2097151:
+		return 3
+	case length < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+var errCorruptListpack = errors.New("corrupt listpack")
+
+// decodeListpack returns every element of a listpack, with integers written out in decimal
+func decodeListpack(data []byte) ([]string, error) {
+	if len(data) < listpackHeaderSize+1 || int(binary.LittleEndian.Uint32(data)) != len(data) {
+		return nil, errCorruptListpack
+	}
+
+	elements := []string{}
+	i := listpackHeaderSize
+	for data[i] != listpackEnd {
+		element, size, err := decodeListpackElement(data[i:])
+		if err != nil {
+			return nil, err
+		}
+
+		i += size + backlenSize(size)
+		if i >= len(data) {
+			return nil, errCorruptListpack
+		}
+		elements = append(elements, element)
+	}
+
+	return elements, nil
+}
+
+// decodeListpackElement decodes the element at the start of data, returning its value and
+// the size of its encoding and data
+func decodeListpackElement(data []byte) (string, int, error) {
+	need := func(size int) bool {
+		return len(data) >= size
+	}
+
+	b := data[0]
+	switch {
+	case b&0x80 == 0:
+		return strconv.Itoa(int(b)), 1, nil
+	case b&0xC0 == 0x80:
+		length := int(b & 0x3F)
+		if !need(1 + length) {
+			return "", 0, errCorruptListpack
+		}
+		return string(data[1 : 1+length]), 1 + length, nil
+	case b&0xE0 == 0xC0:
+		if !need(2) {
+			return "", 0, errCorruptListpack
+		}
+		u := int(b&0x1F)<<8 | int(data[1])
+		if u >= 1<<12 {
+			u -= 1 << 13
+		}
+		return strconv.Itoa(u), 2, nil
+	case b&0xF0 == 0xE0:
+		if !need(2) {
+			return "", 0, errCorruptListpack
+		}
+		length := int(b&0x0F)<<8 | int(data[1])
+		if !need(2 + length) {
+			return "", 0, errCorruptListpack
+		}
+		return string(data[2 : 2+length]), 2 + length, nil
+	}
+
+	switch b {
+	case 0xF0:
+		if !need(5) {
+			return "", 0, errCorruptListpack
+		}
+		length := int(binary.LittleEndian.Uint32(data[1:]))
+		if length < 0 || !need(5+length) {
+			return "", 0, errCorruptListpack
+		}
+		return string(data[5 : 5+length]), 5 + length, nil
+	case 0xF1:
+		if !need(3) {
+			return "", 0, errCorruptListpack
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(data[1:])))), 3, nil
+	case 0xF2:
+		if !need(4) {
+			return "", 0, errCorruptListpack
+		}
+		u := int(data[1]) | int(data[2])<<8 | int(data[3])<<16
+		if u >= 1<<23 {
+			u -= 1 << 24
+		}
+		return strconv.Itoa(u), 4, nil
+	case 0xF3:
+		if !need(5) {
+			return "", 0, errCorruptListpack
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(data[1:])))), 5, nil
+	case 0xF4:
+		if !need(9) {
+			return "", 0, errCorruptListpack
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(data[1:])), 10), 9, nil
+	default:
+		return "", 0, errCorruptListpack
+	}
+}
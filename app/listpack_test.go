@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// listpackFixture holds an element in each of a listpack's string and integer encodings,
+// each followed by its length written backwards
+const listpackFixture = `
+	e00000001400                                                      // total bytes, elements
+	816102                                                            // "a"
+	e07e787878787878787878787878787878787878787878787878787878787878  // 126 x's
+	7878787878787878787878787878787878787878787878787878787878787878
+	7878787878787878787878787878787878787878787878787878787878787878
+	7878787878787878787878787878787878787878787878787878787878787878
+	0180                                                              // a two-byte back length
+	0001                                                              // 0
+	7f01                                                              // 127
+	c08002                                                            // 128
+	dfff02                                                            // -1
+	cfff02                                                            // 4095
+	d00002                                                            // -4096
+	f1001003                                                          // 4096
+	f1008003                                                          // -32768
+	f1ff7f03                                                          // 32767
+	f2ffff7f04                                                        // 8388607
+	f200008004                                                        // -8388608
+	f3ffffff7f05                                                      // 2147483647
+	f30000008005                                                      // -2147483648
+	f4000000000001000009                                              // 1099511627776
+	f4000000000000008009                                              // -9223372036854775808
+	8331326104                                                        // "12a"
+	8330303704                                                        // "007"
+	822d3003                                                          // "-0"
+	ff                                                                // end
+`
+
+var listpackFixtureElements = []string{"a", strings.Repeat("x", 126), "0", "127", "128", "-1", "4095", "-4096",
+	"4096", "-32768", "32767", "8388607", "-8388608", "2147483647", "-2147483648", "1099511627776",
+	"-9223372036854775808", "12a", "007", "-0"}
+
+func TestDecodeListpack(t *testing.T) {
+	data := decodeFixture(t, listpackFixture)
+
+	elements, err := decodeListpack(data)
+	if err != nil {
+		t.Fatalf("decodeListpack: %v", err)
+	}
+	if !slices.Equal(elements, listpackFixtureElements) {
+		t.Errorf("decodeListpack = %q, want %q", elements, listpackFixtureElements)
+	}
+
+	for _, corrupt := range [][]byte{data[:len(data)-1], append(slices.Clone(data), 0xff), data[:3]} {
+		if _, err := decodeListpack(corrupt); err == nil {
+			t.Errorf("decodeListpack accepted %d bytes of a %d-byte listpack", len(corrupt), len(data))
+		}
+	}
+	truncated := slices.Clone(data[:len(data)-5])
+	truncated[0] = byte(len(truncated))
+	if _, err := decodeListpack(truncated); err == nil {
+		t.Error("decodeListpack accepted a listpack ending mid-element")
+	}
+}
+
+func TestListpackEncoding(t *testing.T) {
+	// strings holding integers in canonical form are stored as integers, as Redis stores them
+	lp := newListpack()
+	for _, element := range listpackFixtureElements {
+		lp.appendString(element)
+	}
+
+	if got, want := lp.bytes(), decodeFixture(t, listpackFixture); !bytes.Equal(got, want) {
+		t.Errorf("listpack = %x, want %x", got, want)
+	}
+}
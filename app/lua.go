@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var (
+	errBusyScript = newCommandError(
+		"BUSY", "Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.",
+	)
+	errNotBusy    = newCommandError("NOTBUSY", "No scripts in execution right now.")
+	errUnkillable = newCommandError(
+		"UNKILLABLE", "Sorry the script already executed write commands against the dataset. "+
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.",
+	)
+	errScriptKilled = newCommandError("ERR", "Script killed by user with SCRIPT KILL...")
+)
+
+// busyScriptThreshold is how long a script can run before other clients are told the server
+// is busy, instead of waiting for it
+const busyScriptThreshold = 5 * time.Second
+
+// luaEngine is a Lua interpreter scripts run in, one at a time, under executionLock
+type luaEngine struct {
+	state *lua.LState
+	// env is what scripts see as their globals: a read-only view of the interpreter's own
+	env *lua.LTable
+	// loading is the function library whose code is running, if any; meanwhile "redis" is
+	// loadAPI, which can register functions but not yet call commands
+	loading *functionLibrary
+	loadAPI *lua.LTable
+}
+
+func newLuaEngine() *luaEngine {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	engine := &luaEngine{state: L}
+
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// scripts have no business with the filesystem
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+
+	redis := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"call":         luaRedisCall,
+		"pcall":        luaRedisPCall,
+		"error_reply":  luaErrorReply,
+		"status_reply": luaStatusReply,
+		"sha1hex":      luaSHA1Hex,
+		"log":          luaLog,
+		"setresp":      luaSetResp,
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.RawSetString(level, lua.LNumber(i))
+	}
+	L.SetGlobal("redis", redis)
+
+	engine.loadAPI = L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"register_function": engine.registerFunction,
+		"log":               luaLog,
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		engine.loadAPI.RawSetString(level, lua.LNumber(i))
+	}
+
+	// reading a missing global is almost certainly a typo, and writing one would leak state
+	// into later scripts, so both are errors
+	globals := L.G.Global
+	env := L.NewTable()
+	meta := L.NewTable()
+	meta.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		value := globals.RawGetString(name)
+		if name == "redis" && engine.loading != nil {
+			value = engine.loadAPI
+		}
+		if value == lua.LNil {
+			L.RaiseError("Script attempted to access nonexistent global variable '%s'", name)
+		}
+		L.Push(value)
+		return 1
+	}))
+	meta.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Attempt to modify a readonly table")
+		return 0
+	}))
+	meta.RawSetString("__metatable", lua.LFalse)
+	L.SetMetatable(env, meta)
+	globals.RawSetString("_G", env)
+	engine.env = env
+
+	return engine
+}
+
+func (engine *luaEngine) close() {
+	engine.state.Close()
+}
+
+// compile compiles code into a function of the engine, whose errors name it after chunkName
+func (engine *luaEngine) compile(code, chunkName string) (*lua.LFunction, error) {
+	chunk, err := parse.Parse(strings.NewReader(code), chunkName)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, chunkName)
+	if err != nil {
+		return nil, err
+	}
+
+	fn := engine.state.NewFunctionFromProto(proto)
+	fn.Env = engine.env
+	return fn, nil
+}
+
+func sha1Hex(s string) string {
+	digest := sha1.Sum([]byte(s))
+	return hex.EncodeToString(digest[:])
+}
+
+// scriptFlags are what a script declares about itself, in its shebang line
+// (e.g. "#!lua flags=no-writes") or when registering a function
+type scriptFlags struct {
+	// declared is set for scripts that declare their flags, as functions always do; the
+	// rest are held to the looser rules scripts followed before flags existed
+	declared bool
+	names    []string
+	noWrites bool
+}
+
+var knownScriptFlags = []string{"no-writes", "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys"}
+
+// add records a flag, reporting whether it's a known one
+func (flags *scriptFlags) add(flag string) bool {
+	if !slices.Contains(knownScriptFlags, flag) {
+		return false
+	}
+
+	flags.names = append(flags.names, flag)
+	if flag == "no-writes" {
+		flags.noWrites = true
+	}
+	return true
+}
+
+// checkCallable refuses to run a script that may write from a read-only command, or on a
+// replica, rather than failing halfway through
+func (flags scriptFlags) checkCallable(c *client, readOnly bool) error {
+	if !flags.declared || flags.noWrites {
+		return nil
+	}
+	if readOnly {
+		return newCommandError("ERR", "Can not execute a script with write flag using *_ro command.")
+	}
+	if configRepl["role"] == "slave" && !c.isMaster {
+		return errReadOnly
+	}
+	if !c.isMaster {
+		return diskWriteError()
+	}
+
+	return nil
+}
+
+// scriptRun is a script being executed, whose redis.call()s run as a client of their own
+type scriptRun struct {
+	caller *client
+	client *client
+	// name identifies the script (or function) in error messages
+	name     string
+	function bool
+	readOnly bool
+	start    time.Time
+	cancel   context.CancelFunc
+	// wrote and killed are guarded by scriptRunMu, as SCRIPT KILL checks them
+	wrote  bool
+	killed bool
+	// where is the location of the redis.call() whose error is aborting the script
+	where string
+}
+
+// runningScript is the script being executed, if any; it's only ever replaced under
+// executionLock, and also guarded by scriptRunMu for SCRIPT KILL, which can't take that lock
+var (
+	scriptRunMu   sync.Mutex
+	runningScript *scriptRun
+)
+
+// scriptBusyError fails commands sent while a script has run for too long, rather than
+// leaving them waiting for it
+func scriptBusyError() error {
+	scriptRunMu.Lock()
+	defer scriptRunMu.Unlock()
+
+	if runningScript == nil || time.Since(runningScript.start) <= busyScriptThreshold {
+		return nil
+	}
+	if runningScript.function {
+		return newCommandError(
+			"BUSY", "Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSAVE.",
+		)
+	}
+	return errBusyScript
+}
+
+// killRunningScript interrupts the running script (by SCRIPT KILL) or function (by FUNCTION
+// KILL), unless it already wrote something, since the write can't be undone and its
+// atomicity would be broken
+func killRunningScript(function bool) error {
+	scriptRunMu.Lock()
+	defer scriptRunMu.Unlock()
+
+	if runningScript == nil || runningScript.function != function {
+		return errNotBusy
+	}
+	if runningScript.wrote {
+		return errUnkillable
+	}
+
+	runningScript.killed = true
+	runningScript.cancel()
+	return nil
+}
+
+func newScriptRun(c *client, name string, readOnly bool) *scriptRun {
+	return &scriptRun{
+		caller:   c,
+		client:   &client{id: c.id, protocol: resp2, db: c.db, isMaster: c.isMaster, denyBlocking: true},
+		name:     name,
+		readOnly: readOnly,
+	}
+}
+
+// run calls fn with args on behalf of the run's caller, and replies with whatever it
+// returns. The commands it calls are replicated rather than the script itself
+func (engine *luaEngine) run(run *scriptRun, fn *lua.LFunction, args ...lua.LValue) ([]byte, error) {
+	L := engine.state
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	run.start, run.cancel = time.Now(), cancel
+	scriptRunMu.Lock()
+	runningScript = run
+	scriptRunMu.Unlock()
+
+	defer func() {
+		scriptRunMu.Lock()
+		runningScript = nil
+		scriptRunMu.Unlock()
+	}()
+
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	defer L.SetTop(0)
+
+	var output []byte
+	var err error
+	run.caller.propagateAs = [][]string{}
+	propagateAtomically(func() {
+		L.Push(fn)
+		for _, arg := range args {
+			L.Push(arg)
+		}
+		if callErr := L.PCall(len(args), 1, nil); callErr != nil {
+			err = run.failure(callErr)
+			return
+		}
+		output = run.reply(L.Get(-1))
+	})
+
+	return output, err
+}
+
+// failure turns an error raised by a script into the error reply for it
+func (run *scriptRun) failure(err error) error {
+	scriptRunMu.Lock()
+	killed := run.killed
+	scriptRunMu.Unlock()
+	if killed {
+		return errScriptKilled
+	}
+
+	message, where := "ERR "+err.Error(), ""
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		message = "ERR " + apiErr.Object.String()
+		if table, ok := apiErr.Object.(*lua.LTable); ok {
+			// raised by redis.call(), or by error() with a table like the ones it raises,
+			// holding an error reply complete with its code
+			if reply, ok := table.RawGetString("err").(lua.LString); ok {
+				message, where = string(reply), run.where
+			}
+		} else if i := strings.Index(message, ": "); i >= 0 && strings.HasPrefix(message, "ERR user_") {
+			// runtime errors start with where they happened, e.g. "user_script:1: ..."
+			where = message[len("ERR "):i]
+		}
+	}
+
+	code, text, _ := strings.Cut(message, " ")
+	if where != "" {
+		text += fmt.Sprintf(" script: %s, on @%s.", run.name, strings.TrimSuffix(where, ":"))
+	} else {
+		text += fmt.Sprintf(" script: %s", run.name)
+	}
+	return newCommandError(code, "%s", text)
+}
+
+// call runs a command for redis.call() or redis.pcall()
+func (run *scriptRun) call(args []string) ([]byte, error) {
+	if _, exists := lookupCommand(args[0]); !exists {
+		return nil, newCommandError("ERR", "Unknown Redis command called from script")
+	}
+	spec, err := resolveCommand(args)
+	if err != nil {
+		var commandErr *commandError
+		if errors.As(err, &commandErr) && strings.HasPrefix(commandErr.Message, "wrong number of arguments") {
+			return nil, newCommandError("ERR", "Wrong number of args calling Redis command from script")
+		}
+		return nil, err
+	}
+
+	if spec.hasFlag("noscript") {
+		return nil, newCommandError("ERR", "This Redis command is not allowed from script")
+	}
+	if spec.hasFlag("write") {
+		if run.readOnly {
+			return nil, newCommandError("ERR", "Write commands are not allowed from read-only scripts.")
+		}
+		if configRepl["role"] == "slave" && !run.caller.isMaster {
+			return nil, errReadOnly
+		}
+		if !run.caller.isMaster {
+			if err := diskWriteError(); err != nil {
+				return nil, err
+			}
+		}
+
+		scriptRunMu.Lock()
+		run.wrote = true
+		scriptRunMu.Unlock()
+	}
+
+	return runCommand(run.client, spec, args)
+}
+
+func luaStringArray(L *lua.LState, values []string) *lua.LTable {
+	table := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		table.Append(lua.LString(value))
+	}
+	return table
+}
+
+func luaTableWith(L *lua.LState, field string, value lua.LValue) *lua.LTable {
+	table := L.CreateTable(0, 1)
+	table.RawSetString(field, value)
+	return table
+}
+
+// luaCommandArgs collects the arguments of redis.call(), which must be strings or numbers
+func luaCommandArgs(L *lua.LState) ([]string, error) {
+	if L.GetTop() == 0 {
+		return nil, newCommandError("ERR", "Please specify at least one argument for this redis lib call")
+	}
+
+	args := make([]string, L.GetTop())
+	for i := range args {
+		switch value := L.Get(i + 1).(type) {
+		case lua.LString:
+			args[i] = string(value)
+		case lua.LNumber:
+			if float64(value) == float64(int64(value)) {
+				args[i] = strconv.FormatInt(int64(value), 10)
+			} else {
+				args[i] = strconv.FormatFloat(float64(value), 'g', 17, 64)
+			}
+		default:
+			return nil, newCommandError("ERR", "Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	return args, nil
+}
+
+// callCommand implements redis.call(), which raises errors, and redis.pcall(), which returns them
+func callCommand(L *lua.LState, raise bool) int {
+	run := runningScript
+
+	var reply lua.LValue
+	args, err := luaCommandArgs(L)
+	if err == nil {
+		var output []byte
+		if output, err = run.call(args); err == nil {
+			value, readErr := newRESPReader(bytes.NewReader(output)).readValue()
+			if readErr != nil {
+				err = readErr
+			} else if value.Kind == '-' {
+				err = errors.New(value.Str)
+			} else {
+				reply = respToLua(L, value)
+			}
+		}
+	}
+
+	if err != nil {
+		reply = luaTableWith(L, "err", lua.LString(err.Error()))
+		if raise {
+			run.where = L.Where(1)
+			L.Error(reply, 1)
+		}
+	}
+
+	L.Push(reply)
+	return 1
+}
+
+func luaRedisCall(L *lua.LState) int {
+	return callCommand(L, true)
+}
+
+func luaRedisPCall(L *lua.LState) int {
+	return callCommand(L, false)
+}
+
+func luaErrorReply(L *lua.LState) int {
+	L.Push(luaTableWith(L, "err", lua.LString(L.CheckString(1))))
+	return 1
+}
+
+func luaStatusReply(L *lua.LState) int {
+	L.Push(luaTableWith(L, "ok", lua.LString(L.CheckString(1))))
+	return 1
+}
+
+func luaSHA1Hex(L *lua.LState) int {
+	if L.GetTop() != 1 {
+		L.RaiseError("wrong number of arguments")
+	}
+	L.Push(lua.LString(sha1Hex(L.CheckString(1))))
+	return 1
+}
+
+func luaLog(L *lua.LState) int {
+	if L.GetTop() < 2 {
+		L.RaiseError("redis.log() requires two arguments or more.")
+	}
+	level, ok := L.Get(1).(lua.LNumber)
+	if !ok || level < 0 || level > 3 {
+		L.RaiseError("Invalid debug level.")
+	}
+
+	words := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		words = append(words, L.ToStringMeta(L.Get(i)).String())
+	}
+	fmt.Println(strings.Join(words, " "))
+
+	return 0
+}
+
+// luaSetResp picks the RESP version replies to redis.call() are converted from
+func luaSetResp(L *lua.LState) int {
+	if L.GetTop() != 1 {
+		L.RaiseError("redis.setresp() requires one argument.")
+	}
+	protocol := L.CheckInt(1)
+	if protocol != resp2 && protocol != resp3 {
+		L.RaiseError("RESP version must be 2 or 3.")
+	}
+
+	runningScript.client.protocol = protocol
+	return 0
+}
+
+// respToLua converts a command's reply for the script: status and error replies become
+// tables with an "ok" or "err" field, and RESP2 nulls become false
+func respToLua(L *lua.LState, value respValue) lua.LValue {
+	switch value.Kind {
+	case '+':
+		return luaTableWith(L, "ok", lua.LString(value.Str))
+	case '-':
+		return luaTableWith(L, "err", lua.LString(value.Str))
+	case ':':
+		return lua.LNumber(value.Int)
+	case '$', '*':
+		if value.IsNull {
+			return lua.LFalse
+		}
+		if value.Kind == '$' {
+			return lua.LString(value.Str)
+		}
+		table := L.CreateTable(len(value.Elements), 0)
+		for _, element := range value.Elements {
+			table.Append(respToLua(L, element))
+		}
+		return table
+	case '_':
+		return lua.LNil
+	case '#':
+		return lua.LBool(value.Bool)
+	case ',':
+		return luaTableWith(L, "double", lua.LNumber(value.Double))
+	case '(':
+		return luaTableWith(L, "big_number", lua.LString(value.Str))
+	case '=':
+		verbatim := L.CreateTable(0, 2)
+		verbatim.RawSetString("format", lua.LString(value.Format))
+		verbatim.RawSetString("string", lua.LString(value.Str))
+		return luaTableWith(L, "verbatim_string", verbatim)
+	case '%':
+		pairs := L.CreateTable(0, len(value.Elements)/2)
+		for i := 0; i+1 < len(value.Elements); i += 2 {
+			pairs.RawSet(respToLua(L, value.Elements[i]), respToLua(L, value.Elements[i+1]))
+		}
+		return luaTableWith(L, "map", pairs)
+	case '~':
+		members := L.CreateTable(0, len(value.Elements))
+		for _, element := range value.Elements {
+			members.RawSet(respToLua(L, element), lua.LTrue)
+		}
+		return luaTableWith(L, "set", members)
+	default:
+		return lua.LNil
+	}
+}
+
+// reply converts a value returned by the script into the reply to its caller. Numbers are
+// truncated to integers, and arrays end at their first nil
+func (run *scriptRun) reply(value lua.LValue) []byte {
+	protocol := run.caller.protocol
+
+	switch value := value.(type) {
+	case lua.LString:
+		return encodeBulkString(string(value))
+	case lua.LNumber:
+		return encodeInteger(int(value))
+	case lua.LBool:
+		// booleans only survive as such for scripts that opted into RESP3
+		if run.client.protocol == resp3 {
+			return encodeBoolean(protocol, bool(value))
+		}
+		if value {
+			return encodeInteger(1)
+		}
+		return encodeNull(protocol)
+	case *lua.LTable:
+		if message, ok := value.RawGetString("err").(lua.LString); ok {
+			return encodeError(string(message))
+		}
+		if status, ok := value.RawGetString("ok").(lua.LString); ok {
+			return encodeSimpleString(string(status))
+		}
+		if num, ok := value.RawGetString("double").(lua.LNumber); ok {
+			return encodeDouble(protocol, float64(num))
+		}
+		if num, ok := value.RawGetString("big_number").(lua.LString); ok {
+			return encodeBigNumber(protocol, string(num))
+		}
+		if verbatim, ok := value.RawGetString("verbatim_string").(*lua.LTable); ok {
+			return encodeVerbatimString(
+				protocol, verbatim.RawGetString("format").String(), verbatim.RawGetString("string").String(),
+			)
+		}
+		if pairs, ok := value.RawGetString("map").(*lua.LTable); ok {
+			elements := [][]byte{}
+			pairs.ForEach(func(k, v lua.LValue) {
+				elements = append(elements, run.reply(k), run.reply(v))
+			})
+			return encodeMap(protocol, elements)
+		}
+		if members, ok := value.RawGetString("set").(*lua.LTable); ok {
+			elements := [][]byte{}
+			members.ForEach(func(k, _ lua.LValue) {
+				elements = append(elements, run.reply(k))
+			})
+			return encodeSet(protocol, elements)
+		}
+
+		elements := [][]byte{}
+		for i := 1; ; i++ {
+			element := value.RawGetInt(i)
+			if element == lua.LNil {
+				break
+			}
+			elements = append(elements, run.reply(element))
+		}
+		return encodeArray(elements)
+	default:
+		return encodeNull(protocol)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import "errors"
+
+var errCorruptLZF = errors.New("corrupt LZF data")
+
+// lzfDecompress expands LZF-compressed data, which Redis uses for long strings in RDB files.
+// Each chunk starts with a control byte: below 32 it's a run of that many literal bytes (plus
+// one), otherwise a back reference whose length is in its top three bits, extended by another
+// byte when they're all set, and whose offset is in its bottom five bits and the next byte
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			run := ctrl + 1
+			if i+run > len(in) || len(out)+run > length {
+				return nil, errCorruptLZF
+			}
+			out = append(out, in[i:i+run]...)
+			i += run
+			continue
+		}
+
+		run := ctrl >> 5
+		if run == 7 {
+			if i >= len(in) {
+				return nil, errCorruptLZF
+			}
+			run += int(in[i])
+			i++
+		}
+		run += 2
+		if i >= len(in) {
+			return nil, errCorruptLZF
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+run > length {
+			return nil, errCorruptLZF
+		}
+
+		// the reference can overlap the bytes it produces, so they're copied one by one
+		for j := 0; j < run; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != length {
+		return nil, errCorruptLZF
+	}
+	return out, nil
+}
+
+// lzfCompress compresses data in the format lzfDecompress reads, finding repeats through a
+// hash table of the positions where each three-byte sequence was last seen. It gives up,
+// returning nil, once the output grows beyond limit bytes
+func lzfCompress(in []byte, limit int) []byte {
+	const (
+		hashBits  = 14
+		maxOffset = 1 << 13
+		maxLit    = 32
+		maxRef    = 264
+	)
+	var table [1 << hashBits]int
+
+	out := []byte{0}
+	literals, control := 0, 0
+	// ends the current run of literals, and starts another
+	flush := func(next bool) {
+		if literals > 0 {
+			out[control] = byte(literals - 1)
+		} else {
+			out = out[:len(out)-1]
+		}
+		literals = 0
+		if next {
+			control = len(out)
+			out = append(out, 0)
+		}
+	}
+
+	for i := 0; i < len(in); {
+		if i+2 < len(in) {
+			h := (uint32(in[i])<<16 | uint32(in[i+1])<<8 | uint32(in[i+2])) * 2654435761 >> (32 - hashBits)
+			ref := table[h] - 1
+			table[h] = i + 1
+
+			if ref >= 0 && i-ref-1 < maxOffset && in[ref] == in[i] && in[ref+1] == in[i+1] && in[ref+2] == in[i+2] {
+				length := 3
+				for i+length < len(in) && length < maxRef && in[ref+length] == in[i+length] {
+					length++
+				}
+
+				flush(false)
+				offset := i - ref - 1
+				if encoded := length - 2; encoded < 7 {
+					out = append(out, byte(encoded<<5|offset>>8))
+				} else {
+					out = append(out, byte(7<<5|offset>>8), byte(encoded-7))
+				}
+				out = append(out, byte(offset))
+				control = len(out)
+				out = append(out, 0)
+
+				i += length
+				if len(out) > limit {
+					return nil
+				}
+				continue
+			}
+		}
+
+		out = append(out, in[i])
+		literals++
+		i++
+		if literals == maxLit {
+			flush(true)
+		}
+		if len(out) > limit {
+			return nil
+		}
+	}
+
+	flush(false)
+	if len(out) > limit {
+		return nil
+	}
+	return out
+}
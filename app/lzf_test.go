@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// lzfFixture is LZF data in the format of Redis's lzf_c.c, with literal runs, a short back
+// reference, long ones whose length takes an extra byte, and references overlapping the
+// bytes they produce
+const lzfFixture = `
+	02616263      // literal "abc"
+	e00302        // 12 bytes from 3 back
+	0078          // literal "x"
+	e01e00        // 39 bytes from 1 back
+	0668656c6c6f2c20                                                  // literal "hello, "
+	e00306        // 12 bytes from 7 back
+	1f2100010203040506070809 0a0b0c0d0e0f101112131415161718191a1b1c1d1e // literal "!", 0 to 30
+	081f2021222324252627                                              // literal 31 to 39
+`
+
+func lzfFixtureData() []byte {
+	data := []byte(strings.Repeat("abc", 5) + strings.Repeat("x", 40) + "hello, hello, hello!")
+	for b := range 40 {
+		data = append(data, byte(b))
+	}
+	return data
+}
+
+func TestLZFDecompress(t *testing.T) {
+	compressed := decodeFixture(t, lzfFixture)
+	want := lzfFixtureData()
+
+	got, err := lzfDecompress(compressed, len(want))
+	if err != nil {
+		t.Fatalf("lzfDecompress: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("lzfDecompress = %q, want %q", got, want)
+	}
+
+	// the expected length must match exactly, and references must stay within the output
+	if _, err := lzfDecompress(compressed, len(want)-1); err == nil {
+		t.Error("lzfDecompress overran the expected length")
+	}
+	if _, err := lzfDecompress(compressed, len(want)+1); err == nil {
+		t.Error("lzfDecompress fell short of the expected length")
+	}
+	if _, err := lzfDecompress(compressed[:len(compressed)-1], len(want)); err == nil {
+		t.Error("lzfDecompress accepted a truncated literal run")
+	}
+	if _, err := lzfDecompress(decodeFixture(t, `0061 e00005`), 10); err == nil {
+		t.Error("lzfDecompress accepted a reference before the start")
+	}
+}
+
+func TestLZFCompress(t *testing.T) {
+	inputs := [][]byte{
+		lzfFixtureData(),
+		[]byte(strings.Repeat("hello world ", 1000)),
+		bytes.Repeat([]byte{0}, 70000),
+	}
+	for _, input := range inputs {
+		compressed := lzfCompress(input, len(input))
+		if compressed == nil {
+			t.Errorf("lzfCompress couldn't compress %d bytes", len(input))
+			continue
+		}
+		got, err := lzfDecompress(compressed, len(input))
+		if err != nil || !bytes.Equal(got, input) {
+			t.Errorf("lzfDecompress(lzfCompress(%d bytes)) failed: %v", len(input), err)
+		}
+	}
+
+	// data that doesn't compress gives up once it passes the limit
+	if compressed := lzfCompress([]byte("abcdefghijklmnop"), 8); compressed != nil {
+		t.Errorf("lzfCompress returned %d bytes, over the limit of 8", len(compressed))
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errBgsaveInProgress = newCommandError("ERR", "Background save already in progress")
+	errMisconf          = newCommandError(
+		"MISCONF", "Redis is configured to save RDB snapshots, but it's currently unable to persist to disk. "+
+			"Commands that may modify the data set are disabled, because this instance is configured to report "+
+			"errors during writes if RDB snapshotting fails (stop-writes-on-bgsave-error option). "+
+			"Please check the Redis logs for details about the RDB error.",
+	)
+)
+
+// defaultSavePoints is Redis's default save policy: after an hour if anything changed, five
+// minutes if 100 keys did, or a minute if 10000 did
+const defaultSavePoints = "3600 1 300 100 60 10000"
+
+// bgsaveRetryDelay is how long to wait before retrying a failed background save
+const bgsaveRetryDelay = 5 * time.Second
+
+// savePoint triggers a background save once at least changes modifications have been made
+// and seconds have passed since the last save
+type savePoint struct {
+	seconds int
+	changes int64
+}
+
+func parseSavePoints(value string) ([]savePoint, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("Invalid save parameters")
+	}
+
+	points := []savePoint{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 0 {
+			return nil, errors.New("Invalid save parameters")
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, errors.New("Invalid save parameters")
+		}
+		points = append(points, savePoint{seconds, changes})
+	}
+	return points, nil
+}
+
+// saveState tracks the saves of the RDB file, as reported by LASTSAVE and INFO
+type saveState struct {
+	mu sync.Mutex
+	// lastSave is when the last successful save started, and lastSaveDirty the keyspace's
+	// dirty count at that point, so changes since can be counted
+	lastSave      time.Time
+	lastSaveDirty int64
+	saves         int
+	// points and stopWritesOnError mirror the save and stop-writes-on-bgsave-error parameters
+	points            []savePoint
+	stopWritesOnError bool
+
+	bgsaveInProgress   bool
+	bgsaveStart        time.Time
+	lastBgsaveTry      time.Time
+	lastBgsaveOK       bool
+	lastBgsaveDuration time.Duration
+}
+
+var saves = &saveState{lastSave: time.Now(), lastBgsaveOK: true, lastBgsaveDuration: -1}
+
+// saveMu serialises writing the RDB file, so that a background save finishing late can't
+// replace a newer file
+var saveMu sync.Mutex
+
+// takeSnapshot captures the dataset, while executionLock is held, so that it can be written
+// out while commands keep changing it. Its entries are shared with the keyspace until it's
+// released, which has to happen once it's been written
+func takeSnapshot() *rdbSnapshot {
+	sharedSnapshots.Add(1)
+	dbs := map[int]map[string]*entry{}
+	for _, db := range databases {
+		if entries := db.snapshot(); len(entries) > 0 {
+			dbs[db.id] = entries
+		}
+	}
+
+	return &rdbSnapshot{
+		databases:  dbs,
+		functions:  functionLibraryCodes(),
+		replID:     configRepl["replicationID"],
+		replOffset: currentReplOffset(),
+		compress:   configRDB["rdbcompression"] == "yes",
+		checksum:   configRDB["rdbchecksum"] == "yes",
+	}
+}
+
+// release stops the keyspace copying entries on behalf of the snapshot
+func (s *rdbSnapshot) release() {
+	sharedSnapshots.Add(-1)
+}
+
+// writeSnapshot saves a snapshot to the RDB file, given the keyspace's dirty count when
+// it was taken. Whether it succeeds is recorded for both SAVE and BGSAVE, as either way
+// it decides whether writes are refused
+func writeSnapshot(snapshot *rdbSnapshot, dirty int64, start time.Time) error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	content, err := encodeSnapshot(snapshot)
+	snapshot.release()
+	if err == nil {
+		err = writeRDBFile(content)
+	}
+
+	saves.mu.Lock()
+	defer saves.mu.Unlock()
+
+	saves.lastBgsaveOK = err == nil
+	if err != nil {
+		return err
+	}
+	saves.lastSave = start
+	saves.lastSaveDirty = dirty
+	saves.saves++
+	return nil
+}
+
+// saveRDBFile writes the whole dataset to the configured RDB file, while executionLock is held
+func saveRDBFile() error {
+	return writeSnapshot(takeSnapshot(), dirtyCount(), time.Now())
+}
+
+// startBackgroundSave snapshots the dataset, while executionLock is held, and writes it to the
+// RDB file without blocking other commands. It reports false if a save was already running
+func startBackgroundSave() bool {
+	saves.mu.Lock()
+	if saves.bgsaveInProgress {
+		saves.mu.Unlock()
+		return false
+	}
+	start := time.Now()
+	saves.bgsaveInProgress = true
+	saves.bgsaveStart = start
+	saves.lastBgsaveTry = start
+	saves.mu.Unlock()
+
+	snapshot, dirty := takeSnapshot(), dirtyCount()
+	go func() {
+		err := writeSnapshot(snapshot, dirty, start)
+		if err != nil {
+			fmt.Println("Problem: background save failed")
+		}
+
+		saves.mu.Lock()
+		defer saves.mu.Unlock()
+
+		saves.bgsaveInProgress = false
+		saves.lastBgsaveDuration = time.Since(start)
+	}()
+
+	return true
+}
+
+// saveOnSchedule runs in the background, starting a save whenever a save point is reached.
+// After a failed save, it waits a while before trying again
+func saveOnSchedule() {
+	for range time.Tick(100 * time.Millisecond) {
+		executionLock.Lock()
+		if savePointReached() {
+			startBackgroundSave()
+		}
+		executionLock.Unlock()
+	}
+}
+
+func savePointReached() bool {
+	saves.mu.Lock()
+	defer saves.mu.Unlock()
+
+	if saves.bgsaveInProgress || (!saves.lastBgsaveOK && time.Since(saves.lastBgsaveTry) < bgsaveRetryDelay) {
+		return false
+	}
+
+	changes := dirtyCount() - saves.lastSaveDirty
+	for _, point := range saves.points {
+		if changes >= point.changes && time.Since(saves.lastSave) > time.Duration(point.seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// diskWriteError refuses writes while the RDB file can't be saved, if configured to, or the
+// append-only file can't be written, so that clients notice before losing data
+func diskWriteError() error {
+	saves.mu.Lock()
+	failing := saves.stopWritesOnError && len(saves.points) > 0 && !saves.lastBgsaveOK
+	saves.mu.Unlock()
+
+	if failing {
+		return errMisconf
+	}
+	return appendOnlyWriteError()
+}
+
+func bgsaveInProgress() bool {
+	saves.mu.Lock()
+	defer saves.mu.Unlock()
+
+	return saves.bgsaveInProgress
+}
+
+func handleSave(c *client, array []string) ([]byte, error) {
+	if bgsaveInProgress() {
+		return nil, errBgsaveInProgress
+	}
+
+	if err := saveRDBFile(); err != nil {
+		fmt.Println("Problem: failed to save RDB file")
+		return nil, newCommandError("ERR", "%s", err)
+	}
+	return encodeSimpleString("OK"), nil
+}
+
+// handleBgsave starts a background save. SCHEDULE is accepted for compatibility, but as
+// nothing else ever holds up a save, it just starts one straight away
+func handleBgsave(c *client, array []string) ([]byte, error) {
+	if len(array) > 2 || (len(array) == 2 && !strings.EqualFold(array[1], "schedule")) {
+		return nil, errSyntax
+	}
+
+	if !startBackgroundSave() {
+		return nil, errBgsaveInProgress
+	}
+	return encodeSimpleString("Background saving started"), nil
+}
+
+func handleLastsave(c *client, array []string) ([]byte, error) {
+	saves.mu.Lock()
+	defer saves.mu.Unlock()
+
+	return encodeInteger(int(saves.lastSave.Unix())), nil
+}
+
+// handleShutdown saves the dataset (if there are save points, or SAVE is given, and NOSAVE
+// isn't) and exits. Only SHUTDOWN NOSAVE can stop a script that has become busy, since the
+// dataset may hold half of its writes, so it runs without waiting for executionLock
+func handleShutdown(c *client, array []string) ([]byte, error) {
+	save, nosave := false, false
+	for _, option := range array[1:] {
+		switch {
+		case strings.EqualFold(option, "save"):
+			save = true
+		case strings.EqualFold(option, "nosave"):
+			nosave = true
+		default:
+			return nil, errSyntax
+		}
+	}
+	if save && nosave {
+		return nil, errSyntax
+	}
+	if err := scriptBusyError(); err != nil && !nosave {
+		return nil, err
+	}
+
+	if err := shutdownServer(save, nosave); err != nil {
+		return nil, newCommandError("ERR", "Errors trying to SHUTDOWN. Check logs.")
+	}
+	return nil, nil
+}
+
+// shutdownServer flushes the append-only file, saves the RDB file as SHUTDOWN would with
+// the given options, and exits. If a script becomes busy while it waits for executionLock,
+// it exits without saving instead; it returns, leaving the server running, if saving fails
+func shutdownServer(save, nosave bool) error {
+	for !executionLock.TryLock() {
+		if scriptBusyError() != nil {
+			fmt.Println("Warning: a busy script is running, so exiting without saving")
+			if err := flushAppendOnlyFile(); err != nil {
+				fmt.Println("Problem: failed to flush the AOF file on shutdown")
+			}
+			os.Exit(0)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer executionLock.Unlock()
+
+	if err := flushAppendOnlyFile(); err != nil {
+		fmt.Println("Problem: failed to flush the AOF file on shutdown")
+	}
+
+	saves.mu.Lock()
+	save = save || (!nosave && len(saves.points) > 0)
+	saves.mu.Unlock()
+	if save {
+		if err := saveRDBFile(); err != nil {
+			fmt.Printf("Problem: failed to save RDB file on shutdown: %v\n", err)
+			return err
+		}
+	}
+
+	os.Exit(0)
+	return nil
+}
+
+// persistenceInfo generates the persistence section of INFO
+func persistenceInfo() string {
+	saves.mu.Lock()
+	defer saves.mu.Unlock()
+
+	boolInt := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	status := "ok"
+	if !saves.lastBgsaveOK {
+		status = "err"
+	}
+	current := int64(-1)
+	if saves.bgsaveInProgress {
+		current = int64(time.Since(saves.bgsaveStart).Seconds())
+	}
+	last := int64(-1)
+	if saves.lastBgsaveDuration >= 0 {
+		last = int64(saves.lastBgsaveDuration.Seconds())
+	}
+
+	lines := []string{
+		"# Persistence",
+		"loading:0",
+		"async_loading:0",
+		fmt.Sprintf("rdb_changes_since_last_save:%d", dirtyCount()-saves.lastSaveDirty),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", boolInt(saves.bgsaveInProgress)),
+		fmt.Sprintf("rdb_last_save_time:%d", saves.lastSave.Unix()),
+		fmt.Sprintf("rdb_last_bgsave_status:%s", status),
+		fmt.Sprintf("rdb_last_bgsave_time_sec:%d", last),
+		fmt.Sprintf("rdb_current_bgsave_time_sec:%d", current),
+		fmt.Sprintf("rdb_saves:%d", saves.saves),
+	}
+	return strings.Join(append(lines, appendOnlyInfo()...), "\n")
+}
+
+func init() {
+	configParams["save"] = &configParam{
+		validate: func(value string) error {
+			_, err := parseSavePoints(value)
+			return err
+		},
+		apply: func(value string) {
+			points, _ := parseSavePoints(value)
+			saves.mu.Lock()
+			saves.points = points
+			saves.mu.Unlock()
+
+			normalised := []string{}
+			for _, point := range points {
+				normalised = append(normalised, strconv.Itoa(point.seconds), strconv.FormatInt(point.changes, 10))
+			}
+			configRDB["save"] = strings.Join(normalised, " ")
+		},
+	}
+	configParams["stop-writes-on-bgsave-error"] = newBoolConfigParam(configRDB, "stop-writes-on-bgsave-error", func(enabled bool) {
+		saves.mu.Lock()
+		saves.stopWritesOnError = enabled
+		saves.mu.Unlock()
+	})
+	configParams["rdbcompression"] = newBoolConfigParam(configRDB, "rdbcompression", nil)
+	configParams["rdbchecksum"] = newBoolConfigParam(configRDB, "rdbchecksum", nil)
+
+	registerCommands(
+		&commandSpec{
+			Name: "save", Arity: 1, Flags: []string{"admin", "noscript", "no_async_loading", "no_multi"},
+			Group: "server", Summary: "Synchronously saves the database(s) to disk.", Since: "1.0.0",
+			Handler: handleSave,
+		},
+		&commandSpec{
+			Name: "bgsave", Arity: -1, Flags: []string{"admin", "noscript", "no_async_loading"},
+			Group: "server", Summary: "Asynchronously saves the database(s) to disk.", Since: "1.0.0",
+			Handler: handleBgsave,
+		},
+		&commandSpec{
+			Name: "lastsave", Arity: 1, Flags: []string{"loading", "stale", "fast"},
+			Group: "server", Summary: "Returns the Unix timestamp of the last successful save to disk.", Since: "1.0.0",
+			Handler: handleLastsave,
+		},
+		&commandSpec{
+			Name: "shutdown", Arity: -1, Flags: []string{"admin", "noscript", "loading", "stale", "no_multi", "allow_busy"},
+			Group: "server", Summary: "Synchronously saves the database(s) to disk and shuts down the Redis server.", Since: "1.0.0",
+			Handler: handleShutdown, Unlocked: true,
+		},
+	)
+}
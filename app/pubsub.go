@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// subscriptionKind is one of the three independent namespaces clients can subscribe to:
+// channels, patterns matched against channels, and shard channels
+type subscriptionKind struct {
+	subscribeReply, unsubscribeReply string
+	// subscribers maps each channel (or pattern) to its subscribers. Like the rest of the
+	// pub/sub state, it's guarded by executionLock
+	subscribers map[string]map[*client]struct{}
+	// of returns the client's own subscriptions of this kind
+	of func(c *client) *map[string]struct{}
+}
+
+var (
+	channelSubscriptions = &subscriptionKind{
+		subscribeReply: "subscribe", unsubscribeReply: "unsubscribe",
+		subscribers: map[string]map[*client]struct{}{},
+		of:          func(c *client) *map[string]struct{} { return &c.channels },
+	}
+	patternSubscriptions = &subscriptionKind{
+		subscribeReply: "psubscribe", unsubscribeReply: "punsubscribe",
+		subscribers: map[string]map[*client]struct{}{},
+		of:          func(c *client) *map[string]struct{} { return &c.patterns },
+	}
+	shardSubscriptions = &subscriptionKind{
+		subscribeReply: "ssubscribe", unsubscribeReply: "sunsubscribe",
+		subscribers: map[string]map[*client]struct{}{},
+		of:          func(c *client) *map[string]struct{} { return &c.shardChannels },
+	}
+)
+
+// allowedWhileSubscribed are the only commands a RESP2 connection can send once it has
+// subscribed, since replies and messages would otherwise be indistinguishable
+var allowedWhileSubscribed = map[string]bool{
+	"subscribe": true, "ssubscribe": true, "psubscribe": true,
+	"unsubscribe": true, "sunsubscribe": true, "punsubscribe": true,
+	"ping": true, "quit": true, "reset": true,
+}
+
+func (c *client) subscriptionCount() int {
+	return len(c.channels) + len(c.patterns) + len(c.shardChannels)
+}
+
+// subscribedContextError rejects the commands a subscribed RESP2 connection can't send
+func subscribedContextError(c *client, spec *commandSpec) error {
+	if c.protocol != resp2 || c.subscriptionCount() == 0 || allowedWhileSubscribed[spec.Name] {
+		return nil
+	}
+
+	return newCommandError(
+		"ERR", "Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+		spec.Name,
+	)
+}
+
+// count is the number of subscriptions reported in (un)subscribe replies; shard channels
+// are counted apart from the rest
+func (kind *subscriptionKind) count(c *client) int {
+	if kind == shardSubscriptions {
+		return len(c.shardChannels)
+	}
+	return len(c.channels) + len(c.patterns)
+}
+
+func (kind *subscriptionKind) subscribe(c *client, name string) {
+	own := kind.of(c)
+	if _, subscribed := (*own)[name]; subscribed {
+		return
+	}
+
+	if *own == nil {
+		*own = map[string]struct{}{}
+	}
+	(*own)[name] = struct{}{}
+
+	if kind.subscribers[name] == nil {
+		kind.subscribers[name] = map[*client]struct{}{}
+	}
+	kind.subscribers[name][c] = struct{}{}
+}
+
+func (kind *subscriptionKind) unsubscribe(c *client, name string) {
+	own := kind.of(c)
+	if _, subscribed := (*own)[name]; !subscribed {
+		return
+	}
+	delete(*own, name)
+
+	delete(kind.subscribers[name], c)
+	if len(kind.subscribers[name]) == 0 {
+		delete(kind.subscribers, name)
+	}
+}
+
+func (kind *subscriptionKind) reply(c *client, action, name string) []byte {
+	return encodePush(c.protocol, [][]byte{
+		encodeBulkString(action), encodeBulkString(name), encodeInteger(kind.count(c)),
+	})
+}
+
+// handleSubscribe returns a handler subscribing to each of its arguments, confirming each one
+func handleSubscribe(kind *subscriptionKind) func(c *client, array []string) ([]byte, error) {
+	return func(c *client, array []string) ([]byte, error) {
+		output := []byte{}
+		for _, name := range array[1:] {
+			kind.subscribe(c, name)
+			output = append(output, kind.reply(c, kind.subscribeReply, name)...)
+		}
+
+		// the confirmations are queued while still holding executionLock, so that messages
+		// published in the meantime can't overtake them; within EXEC they're part of its reply
+		if c.denyBlocking {
+			return output, nil
+		}
+		return nil, c.queue(output)
+	}
+}
+
+// handleUnsubscribe returns a handler unsubscribing from each of its arguments, or from
+// everything when there are none
+func handleUnsubscribe(kind *subscriptionKind) func(c *client, array []string) ([]byte, error) {
+	return func(c *client, array []string) ([]byte, error) {
+		names := array[1:]
+		if len(names) == 0 {
+			for name := range *kind.of(c) {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+
+			if len(names) == 0 {
+				return encodePush(c.protocol, [][]byte{
+					encodeBulkString(kind.unsubscribeReply), encodeNull(c.protocol), encodeInteger(kind.count(c)),
+				}), nil
+			}
+		}
+
+		output := []byte{}
+		for _, name := range names {
+			kind.unsubscribe(c, name)
+			output = append(output, kind.reply(c, kind.unsubscribeReply, name)...)
+		}
+
+		return output, nil
+	}
+}
+
+// releaseSubscriptions drops the subscriptions of a client whose connection has closed
+func releaseSubscriptions(c *client) {
+	executionLock.Lock()
+	defer executionLock.Unlock()
+
+	unsubscribeAll(c)
+}
+
+// unsubscribeAll drops every subscription of a client, without confirming any, while
+// executionLock is held
+func unsubscribeAll(c *client) {
+	for _, kind := range []*subscriptionKind{channelSubscriptions, patternSubscriptions, shardSubscriptions} {
+		for name := range *kind.of(c) {
+			kind.unsubscribe(c, name)
+		}
+	}
+}
+
+func deliverMessage(subscriber *client, elements ...string) {
+	message := make([][]byte, len(elements))
+	for i, element := range elements {
+		message[i] = encodeBulkString(element)
+	}
+
+	// queued rather than written, since it's sent while executionLock is held; a subscriber
+	// that doesn't keep up is disconnected
+	if err := subscriber.send(encodePush(subscriber.protocol, message), pubsubOutputLimit); err != nil {
+		fmt.Println("Problem: error thrown when writing to subscriber")
+	}
+}
+
+// publish sends a message to the subscribers of a channel and of the patterns matching
+// it, returning how many received it
+func publish(channel, message string) int {
+	receivers := 0
+
+	for subscriber := range channelSubscriptions.subscribers[channel] {
+		deliverMessage(subscriber, "message", channel, message)
+		receivers++
+	}
+	for pattern, subscribers := range patternSubscriptions.subscribers {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for subscriber := range subscribers {
+			deliverMessage(subscriber, "pmessage", pattern, channel, message)
+			receivers++
+		}
+	}
+
+	return receivers
+}
+
+// messages are replicated even though they don't change the dataset, so that subscribers
+// to replicas receive them too
+func handlePublish(c *client, array []string) ([]byte, error) {
+	receivers := publish(array[1], array[2])
+	propagateToReplicas(array)
+
+	return encodeInteger(receivers), nil
+}
+
+func handleSPublish(c *client, array []string) ([]byte, error) {
+	receivers := 0
+	for subscriber := range shardSubscriptions.subscribers[array[1]] {
+		deliverMessage(subscriber, "smessage", array[1], array[2])
+		receivers++
+	}
+	propagateToReplicas(array)
+
+	return encodeInteger(receivers), nil
+}
+
+// activeChannels lists the channels of a kind with subscribers, optionally filtered by a pattern
+func activeChannels(kind *subscriptionKind, array []string) ([]byte, error) {
+	if len(array) > 3 {
+		return nil, newCommandError(
+			"ERR", "unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.", array[1],
+		)
+	}
+
+	channels := []string{}
+	for channel := range kind.subscribers {
+		if len(array) == 2 || globMatch(array[2], channel) {
+			channels = append(channels, channel)
+		}
+	}
+	slices.Sort(channels)
+
+	return encodeBulkArray(channels), nil
+}
+
+// subscriberCounts returns the number of subscribers to each channel given, as a flat array
+// of channels and counts whichever the protocol, as Redis replies
+func subscriberCounts(kind *subscriptionKind, channels []string) []byte {
+	pairs := make([][]byte, 0, 2*len(channels))
+	for _, channel := range channels {
+		pairs = append(pairs, encodeBulkString(channel), encodeInteger(len(kind.subscribers[channel])))
+	}
+
+	return encodeArray(pairs)
+}
+
+func handlePubSubChannels(c *client, array []string) ([]byte, error) {
+	return activeChannels(channelSubscriptions, array)
+}
+
+func handlePubSubShardChannels(c *client, array []string) ([]byte, error) {
+	return activeChannels(shardSubscriptions, array)
+}
+
+func handlePubSubNumSub(c *client, array []string) ([]byte, error) {
+	return subscriberCounts(channelSubscriptions, array[2:]), nil
+}
+
+func handlePubSubShardNumSub(c *client, array []string) ([]byte, error) {
+	return subscriberCounts(shardSubscriptions, array[2:]), nil
+}
+
+func handlePubSubNumPat(c *client, array []string) ([]byte, error) {
+	return encodeInteger(len(patternSubscriptions.subscribers)), nil
+}
+
+func init() {
+	pubsubContainer := &commandSpec{
+		Name: "pubsub", Arity: -2, Group: "pubsub",
+		Summary: "A container for Pub/Sub commands.", Since: "2.8.0",
+	}
+
+	registerCommands(
+		&commandSpec{
+			Name: "subscribe", Arity: -2, Flags: []string{"pubsub", "noscript", "loading", "stale"},
+			Group: "pubsub", Summary: "Listens for messages published to channels.", Since: "2.0.0",
+			Handler: handleSubscribe(channelSubscriptions),
+		},
+		&commandSpec{
+			Name: "unsubscribe", Arity: -1, Flags: []string{"pubsub", "noscript", "loading", "stale"},
+			Group: "pubsub", Summary: "Stops listening to messages posted to channels.", Since: "2.0.0",
+			Handler: handleUnsubscribe(channelSubscriptions),
+		},
+		&commandSpec{
+			Name: "psubscribe", Arity: -2, Flags: []string{"pubsub", "noscript", "loading", "stale"},
+			Group: "pubsub", Summary: "Listens for messages published to channels that match one or more patterns.",
+			Since: "2.0.0", Handler: handleSubscribe(patternSubscriptions),
+		},
+		&commandSpec{
+			Name: "punsubscribe", Arity: -1, Flags: []string{"pubsub", "noscript", "loading", "stale"},
+			Group: "pubsub", Summary: "Stops listening to messages published to channels that match one or more patterns.",
+			Since: "2.0.0", Handler: handleUnsubscribe(patternSubscriptions),
+		},
+		&commandSpec{
+			Name: "ssubscribe", Arity: -2, Flags: []string{"pubsub", "noscript", "loading", "stale"},
+			FirstKey: 1, LastKey: -1, KeyStep: 1, Group: "pubsub",
+			Summary: "Listens for messages published to shard channels.", Since: "7.0.0",
+			Handler: handleSubscribe(shardSubscriptions),
+		},
+		&commandSpec{
+			Name: "sunsubscribe", Arity: -1, Flags: []string{"pubsub", "noscript", "loading", "stale"},
+			FirstKey: 1, LastKey: -1, KeyStep: 1, Group: "pubsub",
+			Summary: "Stops listening to messages posted to shard channels.", Since: "7.0.0",
+			Handler: handleUnsubscribe(shardSubscriptions),
+		},
+		&commandSpec{
+			Name: "publish", Arity: 3, Flags: []string{"pubsub", "loading", "stale", "fast", "may-replicate"},
+			Group: "pubsub", Summary: "Posts a message to a channel.", Since: "2.0.0",
+			Handler: handlePublish,
+		},
+		&commandSpec{
+			Name: "spublish", Arity: 3, Flags: []string{"pubsub", "loading", "stale", "fast", "may-replicate"},
+			FirstKey: 1, LastKey: 1, KeyStep: 1, Group: "pubsub",
+			Summary: "Post a message to a shard channel", Since: "7.0.0",
+			Handler: handleSPublish,
+		},
+		pubsubContainer,
+	)
+
+	registerSubcommands(pubsubContainer,
+		&commandSpec{
+			Name: "pubsub|channels", Arity: -2, Flags: []string{"pubsub", "loading", "stale"}, Group: "pubsub",
+			Summary: "Returns the active channels.", Since: "2.8.0",
+			Handler: handlePubSubChannels,
+		},
+		&commandSpec{
+			Name: "pubsub|numsub", Arity: -2, Flags: []string{"pubsub", "loading", "stale"}, Group: "pubsub",
+			Summary: "Returns a count of subscribers to channels.", Since: "2.8.0",
+			Handler: handlePubSubNumSub,
+		},
+		&commandSpec{
+			Name: "pubsub|numpat", Arity: 2, Flags: []string{"pubsub", "loading", "stale"}, Group: "pubsub",
+			Summary: "Returns a count of unique pattern subscriptions.", Since: "2.8.0",
+			Handler: handlePubSubNumPat,
+		},
+		&commandSpec{
+			Name: "pubsub|shardchannels", Arity: -2, Flags: []string{"pubsub", "loading", "stale"}, Group: "pubsub",
+			Summary: "Returns the active shard channels.", Since: "7.0.0",
+			Handler: handlePubSubShardChannels,
+		},
+		&commandSpec{
+			Name: "pubsub|shardnumsub", Arity: -2, Flags: []string{"pubsub", "loading", "stale"}, Group: "pubsub",
+			Summary: "Returns the count of subscribers of shard channels.", Since: "7.0.0",
+			Handler: handlePubSubShardNumSub,
+		},
+	)
+}
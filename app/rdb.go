@@ -1,549 +1,1424 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash/crc64"
+	"maps"
 	"math"
 	"os"
+	"runtime"
+	"slices"
 	"strconv"
 	"time"
 )
 
-type LengthEncodingType int
+// rdbListNodeSize is how many elements the writer packs into each listpack of a list
+const rdbListNodeSize = 128
+
+// encodeSnapshot serialises a snapshot of the dataset as a complete RDB file. It fails rather
+// than leave out a value it can't encode, so a save never replaces a file with less data
+func encodeSnapshot(snapshot *rdbSnapshot) ([]byte, error) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	buf := fmt.Appendf(nil, "REDIS%04d", snapshotRDBVersion(snapshot))
+	buf = appendRDBAux(buf, "redis-ver", serverVersion)
+	buf = appendRDBAux(buf, "redis-bits", strconv.Itoa(strconv.IntSize))
+	buf = appendRDBAux(buf, "ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	buf = appendRDBAux(buf, "used-mem", strconv.FormatUint(memStats.Alloc, 10))
+	buf = appendRDBAux(buf, "repl-stream-db", "0")
+	buf = appendRDBAux(buf, "repl-id", snapshot.replID)
+	buf = appendRDBAux(buf, "repl-offset", strconv.Itoa(snapshot.replOffset))
+	aofBase := "0"
+	if snapshot.aofBase {
+		aofBase = "1"
+	}
+	buf = appendRDBAux(buf, "aof-base", aofBase)
 
-const (
-	remaining6Bits LengthEncodingType = iota
-	remaining14Bits
-	remaining4CompleteBytes
-	specialCase
-)
+	for _, code := range snapshot.functions {
+		buf = appendRDBString(append(buf, rdbOpcodeFunction), code)
+	}
 
-func encodeValue(value string) (string, error) {
-	length := len([]byte(value))
+	for _, db := range slices.Sorted(maps.Keys(snapshot.databases)) {
+		entries := snapshot.databases[db]
+		if len(entries) == 0 {
+			continue
+		}
 
-	encodedLength, err := encodeLength(length)
-	encodedValue := fmt.Sprintf("%x", []byte(value))
+		expiring := 0
+		for _, e := range entries {
+			if e.ExpiryPtr != nil {
+				expiring++
+			}
+		}
+		buf = appendRDBLength(append(buf, rdbOpcodeSelectDB), uint64(db))
+		buf = appendRDBLength(append(buf, rdbOpcodeResizeDB), uint64(len(entries)))
+		buf = appendRDBLength(buf, uint64(expiring))
+
+		for key, e := range entries {
+			if e.ExpiryPtr != nil {
+				buf = appendRDBMilliseconds(append(buf, rdbOpcodeExpireTimeMs), e.ExpiryPtr.Timestamp.UnixMilli())
+			}
+			var err error
+			if buf, err = appendRDBValue(buf, key, e, snapshot.compress); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-	return encodedLength + encodedValue, err
+	buf = append(buf, rdbOpcodeEOF)
+	if !snapshot.checksum {
+		// a zero checksum tells readers not to verify it
+		return binary.LittleEndian.AppendUint64(buf, 0), nil
+	}
+	return append(buf, getChecksum(buf)...), nil
 }
 
-func getLengthEncodingType(firstByte byte) LengthEncodingType {
-	prefix := int(firstByte >> 6)
-	switch prefix {
-	case 0:
-		return remaining6Bits
-	case 1:
-		return remaining14Bits
-	case 2:
-		return remaining4CompleteBytes
-	case 3:
-		return specialCase
-	default:
-		return -1
-	}
-}
-
-func decodeValue(encoding []byte) (value string, bytesRead int, err error) {
-	lengthEncodingType := getLengthEncodingType(encoding[0])
-
-	switch lengthEncodingType {
-	case remaining6Bits:
-		length := int(encoding[0] & 0x3F)
-		return string(encoding[1 : 1+length]), 1 + length, nil
-	case remaining14Bits:
-		length := int(int(int(encoding[0]&0x3F)<<8) | int(encoding[1]))
-		return string(encoding[2 : 2+length]), 2 + length, nil
-	case remaining4CompleteBytes:
-		length := int(binary.BigEndian.Uint32(encoding[1:5]))
-		return string(encoding[5 : 5+length]), 5 + length, nil
-	case specialCase:
-		specialCaseType := int(encoding[0] & 0x3F)
-		valueBytes := encoding[1 : 1+int(math.Pow(2, float64(specialCaseType)))]
-		for i, j := 0, len(valueBytes)-1; i < j; i, j = i+1, j-1 {
-			valueBytes[i], valueBytes[j] = valueBytes[j], valueBytes[i]
-		}
-		var valueInt int32
-		for _, b := range valueBytes {
-			valueInt = (valueInt << 8) | int32(b)
-		}
-		return string(valueInt), 1 + int(math.Pow(2, float64(specialCaseType))), nil
+// snapshotRDBVersion picks the RDB version to write: that of Redis 7.2, unless a hash field
+// has an expiry, which only Redis 7.4's can hold
+func snapshotRDBVersion(snapshot *rdbSnapshot) int {
+	now := time.Now()
+	for _, entries := range snapshot.databases {
+		for _, e := range entries {
+			if h, ok := e.Value.(*hashValue); ok && liveFieldExpiry(h, now) != nil {
+				return rdbVersionFieldExpiry
+			}
+		}
+	}
+	return rdbVersion
+}
+
+// liveFieldExpiry returns the earliest expiry among the fields of a hash that haven't yet
+// expired, if any has one
+func liveFieldExpiry(h *hashValue, now time.Time) *expiry {
+	var earliest *expiry
+	for field := range h.expiring {
+		expiryPtr := h.fields[field].expiryPtr
+		if now.Before(expiryPtr.Timestamp) && (earliest == nil || expiryPtr.Timestamp.Before(earliest.Timestamp)) {
+			earliest = expiryPtr
+		}
+	}
+	return earliest
+}
+
+func appendRDBAux(buf []byte, key, value string) []byte {
+	buf = appendRDBString(append(buf, rdbOpcodeAux), key)
+	return appendRDBString(buf, value)
+}
+
+// appendRDBValue appends a key and its value, preceded by the value's RDB type
+func appendRDBValue(buf []byte, key string, e *entry, compress bool) ([]byte, error) {
+	str := func(buf []byte, s string) []byte {
+		return appendRDBEncodedString(buf, s, compress)
+	}
+
+	switch value := e.Value.(type) {
+	case *listValue:
+		buf = str(append(buf, rdbTypeListQuicklist2), key)
+		buf = appendRDBLength(buf, uint64((value.len()+rdbListNodeSize-1)/rdbListNodeSize))
+		for start := 0; start < value.len(); start += rdbListNodeSize {
+			lp := newListpack()
+			for i := start; i < min(start+rdbListNodeSize, value.len()); i++ {
+				lp.appendString(string(value.at(i)))
+			}
+			buf = appendRDBLength(buf, rdbQuicklistPacked)
+			buf = str(buf, string(lp.bytes()))
+		}
+
+	case *setValue:
+		if value.ints != nil {
+			buf = str(append(buf, rdbTypeSetIntset), key)
+			return str(buf, string(value.ints.bytes())), nil
+		}
+		buf = str(append(buf, rdbTypeSet), key)
+		buf = appendRDBLength(buf, uint64(value.len()))
+		value.each(func(member string) {
+			buf = str(buf, member)
+		})
+
+	case *zsetValue:
+		buf = str(append(buf, rdbTypeZset2), key)
+		buf = appendRDBLength(buf, uint64(value.len()))
+		for _, item := range value.items() {
+			buf = str(buf, item.member)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(item.score))
+		}
+
+	case *hashValue:
+		// fields that have already expired are left out
+		now := time.Now()
+		fields := []*hashField{}
+		names := []string{}
+		value.each(func(name string, v []byte) {
+			if f := value.fields[name]; f.expiryPtr == nil || now.Before(f.expiryPtr.Timestamp) {
+				fields, names = append(fields, f), append(names, name)
+			}
+		})
+
+		// a hash with field expiries is saved like Redis 7.4 does: each field's expiry is
+		// stored relative to the earliest, plus one, with zero meaning it has none
+		minExpiry := liveFieldExpiry(value, now)
+		if minExpiry == nil {
+			buf = str(append(buf, rdbTypeHash), key)
+		} else {
+			buf = str(append(buf, rdbTypeHashMetadata), key)
+			buf = appendRDBMilliseconds(buf, minExpiry.Timestamp.UnixMilli())
+		}
+		buf = appendRDBLength(buf, uint64(len(fields)))
+		for i, f := range fields {
+			if minExpiry != nil {
+				ttl := uint64(0)
+				if f.expiryPtr != nil {
+					ttl = uint64(f.expiryPtr.Timestamp.UnixMilli()-minExpiry.Timestamp.UnixMilli()) + 1
+				}
+				buf = appendRDBLength(buf, ttl)
+			}
+			buf = str(str(buf, names[i]), string(f.value))
+		}
+
+	case *streamValue:
+		buf = str(append(buf, rdbTypeStream), key)
+		buf = append(buf, encodeStreamValue(value)...)
+
+	case []byte:
+		buf = str(append(buf, rdbTypeString), key)
+		buf = str(buf, string(value))
+
 	default:
-		return "", 0, errors.New("could not determine length encoding type")
+		return nil, fmt.Errorf("can't encode the %s value of key '%s'", e.Type, key)
 	}
+
+	return buf, nil
 }
 
-func encodeLength(length int) (string, error) {
-	if length < (1 << 6) {
-		return fmt.Sprintf("%02x", length), nil
-	} else if length < (1 << 14) {
-		binaryLength := fmt.Sprintf("%014b", length)
-		decimalLength, err := strconv.ParseInt("01"+binaryLength, 2, 64)
-		if err != nil {
-			return "", errors.New("could not convert binary length encoding into decimal (1)")
+// appendRDBEncodedString appends a string in the most compact form available: as an
+// integer when it's one, or compressed with LZF if enabled and that saves enough space
+func appendRDBEncodedString(buf []byte, s string, compress bool) []byte {
+	if n, ok := parseInteger(s); ok {
+		switch {
+		case n >= math.MinInt8 && n <= math.MaxInt8:
+			return append(buf, 0xC0, byte(n))
+		case n >= math.MinInt16 && n <= math.MaxInt16:
+			return binary.LittleEndian.AppendUint16(append(buf, 0xC1), uint16(n))
+		case n >= math.MinInt32 && n <= math.MaxInt32:
+			return binary.LittleEndian.AppendUint32(append(buf, 0xC2), uint32(n))
 		}
-		return fmt.Sprintf("%04x", decimalLength), nil
-	} else if uint64(length) < (1 << 32) {
-		binaryLength, binaryErr := toggleEndianBinary(fmt.Sprintf("%032b", length))
-		if binaryErr != nil {
-			return "", errors.New("could not convert from big-endian to little-endian")
+	}
+
+	// like Redis, short strings aren't worth compressing
+	if compress && len(s) > 20 {
+		if compressed := lzfCompress([]byte(s), len(s)-4); compressed != nil {
+			buf = appendRDBLength(append(buf, 0xC3), uint64(len(compressed)))
+			buf = appendRDBLength(buf, uint64(len(s)))
+			return append(buf, compressed...)
 		}
-		decimalLength, err := strconv.ParseInt("10000000"+binaryLength, 2, 64)
-		if err != nil {
-			return "", errors.New("could not convert binary length encoding into decimal (2)")
+	}
+
+	return appendRDBString(buf, s)
+}
+
+// loadRDBFile reads the configured RDB file into the keyspace, once at startup
+func loadRDBFile() error {
+	data, err := readRDBFile()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
-		return fmt.Sprintf("%010x", decimalLength), nil
+		return err
 	}
 
-	return "", errors.New("value length is too large")
+	return loadRDBContents(data)
 }
 
-func decodeLength(encoding []byte) (int, error) {
-	lengthEncodingType := getLengthEncodingType(encoding[0])
+// loadRDBContents replaces every database and the function libraries with those held in an
+// RDB file. A file holding more databases than are configured is refused
+func loadRDBContents(data []byte) error {
+	snapshot, err := decodeRDB(data)
+	if err != nil {
+		return err
+	}
+	return loadRDBSnapshot(snapshot)
+}
 
-	switch lengthEncodingType {
-	case remaining6Bits:
-		return int(encoding[0] & 0x3F), nil
-	case remaining14Bits:
-		return int(int(int(encoding[0]&0x3F)<<8) | int(encoding[1])), nil
-	case remaining4CompleteBytes:
-		return int(binary.BigEndian.Uint32(encoding[1:5])), nil
-	case specialCase:
-		specialCaseType := int(encoding[0] & 0x3F)
-		valueBytes := encoding[1 : 1+int(math.Pow(2, float64(specialCaseType)))]
-		for i, j := 0, len(valueBytes)-1; i < j; i, j = i+1, j-1 {
-			valueBytes[i], valueBytes[j] = valueBytes[j], valueBytes[i]
+func loadRDBSnapshot(snapshot *rdbSnapshot) error {
+	for db := range snapshot.databases {
+		if db >= len(databases) {
+			return fmt.Errorf("the data holds database %d, but only %d databases are configured", db, len(databases))
 		}
-		var valueInt int32
-		for _, b := range valueBytes {
-			valueInt = (valueInt << 8) | int32(b)
+	}
+	if err := replaceFunctionLibraries(snapshot.functions); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, db := range databases {
+		entries := map[string]*entry{}
+		for key, e := range snapshot.databases[db.id] {
+			if e.isExpired(now) {
+				continue
+			}
+			entries[key] = e
 		}
-		return len(string(valueInt)), nil
-	default:
-		return 0, errors.New("could not determine length encoding type")
+		db.replace(entries)
 	}
+	return nil
 }
 
-// func parseRDBFile(fileBinary []byte) []byte {
-// 	fmt.Println("received an RDB file")
-// 	i := 0
-// 	j := i + 1
+// crc64Jones is the CRC-64 variant that Redis checksums RDB files and DUMP payloads with
+var crc64Jones = crc64.MakeTable(0x95AC9329AC4BC9B5)
 
-// 	for j < len(fileBinary) && unicode.IsDigit(rune(fileBinary[j])) {
-// 		j++
-// 	}
+func rdbChecksum(payload []byte) uint64 {
+	// unlike the standard library's, Redis's CRC isn't inverted before or after
+	return ^crc64.Update(^uint64(0), crc64Jones, payload)
+}
 
-// 	lengthStr := string(fileBinary[i+1 : j])
-// 	length, err := strconv.Atoi(lengthStr)
-// 	if err != nil {
-// 		fmt.Println("Problem: error thrown when parsing Redis array (1)")
-// 	}
-// 	i += 3 + len(lengthStr)
-// 	return fileBinary[i : i+length]
-// }
+func getChecksum(payload []byte) []byte {
+	return binary.LittleEndian.AppendUint64(nil, rdbChecksum(payload))
+}
 
-func readRDBHeader(encoding []byte) (string, int, error) {
-	i := 0
-	for fmt.Sprintf("%02x", encoding[i]) != "fa" {
-		i++
+// rdbSnapshot is the content of an RDB file: the keys of each database, and the code of
+// each function library
+type rdbSnapshot struct {
+	databases map[int]map[string]*entry
+	functions []string
+	// the replication ID and offset the snapshot was taken at, and how to save it
+	replID     string
+	replOffset int
+	compress   bool
+	checksum   bool
+	// aofBase marks a snapshot written at the start of an append-only file
+	aofBase bool
+}
+
+// decodeRDB parses a complete RDB file, of any version up to the one written here
+func decodeRDB(data []byte) (*rdbSnapshot, error) {
+	snapshot, _, err := decodeRDBPrefix(data)
+	return snapshot, err
+}
+
+// decodeRDBPrefix parses an RDB file at the start of data, also returning its length, as an
+// append-only file can begin with one
+func decodeRDBPrefix(data []byte) (*rdbSnapshot, int, error) {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return nil, 0, errors.New("wrong signature trying to load RDB file")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > rdbVersionFieldExpiry {
+		return nil, 0, fmt.Errorf("can't handle RDB format version %q", data[5:9])
 	}
 
-	return string(encoding[:i]), i, nil
+	snapshot := &rdbSnapshot{databases: map[int]map[string]*entry{}, functions: []string{}}
+	r := &rdbReader{data: data, pos: 9}
+	db := 0
+	// an expiry, like the LRU and LFU metadata, precedes the key it applies to
+	var expiryPtr *expiry
+
+	for {
+		opcode, err := r.readByte()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch opcode {
+		case rdbOpcodeEOF:
+			if err := r.verifyChecksum(version); err != nil {
+				return nil, 0, err
+			}
+			return snapshot, r.pos, nil
+		case rdbOpcodeSelectDB:
+			n, err := r.readLength()
+			if err != nil {
+				return nil, 0, err
+			}
+			db = int(n)
+		case rdbOpcodeResizeDB:
+			// the key and expiry counts are only sizing hints
+			if _, err := r.readLength(); err != nil {
+				return nil, 0, err
+			}
+			if _, err := r.readLength(); err != nil {
+				return nil, 0, err
+			}
+		case rdbOpcodeAux:
+			// auxiliary fields, such as the Redis version and creation time, are informational
+			if _, err := r.readString(); err != nil {
+				return nil, 0, err
+			}
+			if _, err := r.readString(); err != nil {
+				return nil, 0, err
+			}
+		case rdbOpcodeFunction:
+			code, err := r.readString()
+			if err != nil {
+				return nil, 0, err
+			}
+			snapshot.functions = append(snapshot.functions, code)
+		case rdbOpcodeFunctionPreGA:
+			return nil, 0, errors.New("pre-GA function format not supported")
+		case rdbOpcodeModuleAux:
+			if err := r.skipModuleAux(); err != nil {
+				return nil, 0, err
+			}
+		case rdbOpcodeExpireTimeMs:
+			ms, err := r.readMilliseconds()
+			if err != nil {
+				return nil, 0, err
+			}
+			expiryPtr = &expiry{time.UnixMilli(ms)}
+		case rdbOpcodeExpireTime:
+			b, err := r.readBytes(4)
+			if err != nil {
+				return nil, 0, err
+			}
+			expiryPtr = &expiry{time.Unix(int64(int32(binary.LittleEndian.Uint32(b))), 0)}
+		case rdbOpcodeIdle:
+			if _, err := r.readLength(); err != nil {
+				return nil, 0, err
+			}
+		case rdbOpcodeFreq:
+			if _, err := r.readByte(); err != nil {
+				return nil, 0, err
+			}
+		default:
+			key, err := r.readString()
+			if err != nil {
+				return nil, 0, err
+			}
+			e, err := decodeRDBValue(r, opcode)
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not decode value of '%s': %w", key, err)
+			}
+
+			// module values and empty collections are skipped
+			if e != nil {
+				if snapshot.databases[db] == nil {
+					snapshot.databases[db] = map[string]*entry{}
+				}
+				e.ExpiryPtr = expiryPtr
+				snapshot.databases[db][key] = e
+			}
+			expiryPtr = nil
+		}
+	}
 }
 
-func readMetadata(encoding []byte) (map[string]string, int, error) {
-	mapping := make(map[string]string)
-	i := 0
-	for fmt.Sprintf("%02x", encoding[i]) != "fe" && fmt.Sprintf("%02x", encoding[i]) != "ff" {
-		if fmt.Sprintf("%02x", encoding[i]) != "fa" {
-			return nil, 0, errors.New("expected 'fa' indicator, but found something else")
+// verifyChecksum checks the CRC64 that follows the end of the file, which is missing before
+// version 5 and zero when Redis was configured not to compute it
+func (r *rdbReader) verifyChecksum(version int) error {
+	if version < 5 {
+		return nil
+	}
+
+	end := r.pos
+	b, err := r.readBytes(8)
+	if err != nil {
+		return err
+	}
+	if expected := binary.LittleEndian.Uint64(b); expected != 0 && expected != rdbChecksum(r.data[:end]) {
+		return errors.New("wrong RDB checksum")
+	}
+
+	return nil
+}
+
+// decodeRDBValue reads a value of the given RDB type, in any of the encodings Redis has
+// written it in. Values that can't be held here, such as those of modules, are skipped
+func decodeRDBValue(r *rdbReader, rdbType byte) (*entry, error) {
+	switch rdbType {
+	case rdbTypeString:
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
 		}
+		return newStringEntry([]byte(s), nil), nil
 
-		i += 1
+	case rdbTypeList:
+		elements, err := r.readStringList(1)
+		if err != nil {
+			return nil, err
+		}
+		return listEntryOf(elements), nil
+	case rdbTypeListZiplist:
+		elements, err := r.readEncoded(decodeZiplist)
+		if err != nil {
+			return nil, err
+		}
+		return listEntryOf(elements), nil
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		elements, err := r.readQuicklist(rdbType)
+		if err != nil {
+			return nil, err
+		}
+		return listEntryOf(elements), nil
 
-		// get metadata key
-		key, n, keyErr := decodeValue(encoding[i:])
-		if keyErr != nil {
-			return nil, 0, keyErr
+	case rdbTypeSet:
+		members, err := r.readStringList(1)
+		if err != nil {
+			return nil, err
+		}
+		return setEntryOf(members), nil
+	case rdbTypeSetIntset:
+		members, err := r.readEncoded(decodeIntset)
+		if err != nil {
+			return nil, err
+		}
+		return setEntryOf(members), nil
+	case rdbTypeSetListpack:
+		members, err := r.readEncoded(decodeListpack)
+		if err != nil {
+			return nil, err
+		}
+		return setEntryOf(members), nil
+
+	case rdbTypeZset, rdbTypeZset2:
+		return r.readZset(rdbType)
+	case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		decode := decodeListpack
+		if rdbType == rdbTypeZsetZiplist {
+			decode = decodeZiplist
+		}
+		pairs, err := r.readEncoded(decode)
+		if err != nil {
+			return nil, err
+		}
+		return zsetEntryOf(pairs)
+
+	case rdbTypeHash:
+		pairs, err := r.readStringList(2)
+		if err != nil {
+			return nil, err
+		}
+		return hashEntryOf(pairs)
+	case rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack:
+		decode := decodeListpack
+		switch rdbType {
+		case rdbTypeHashZipmap:
+			decode = decodeZipmap
+		case rdbTypeHashZiplist:
+			decode = decodeZiplist
+		}
+		pairs, err := r.readEncoded(decode)
+		if err != nil {
+			return nil, err
+		}
+		return hashEntryOf(pairs)
+
+	case rdbTypeHashMetadata, rdbTypeHashMetadataPreGA:
+		return r.readHashMetadata(rdbType)
+	case rdbTypeHashListpackEx, rdbTypeHashListpackExPreGA:
+		// only the GA layout starts with the earliest expiry, which isn't needed here
+		if rdbType == rdbTypeHashListpackEx {
+			if _, err := r.readMilliseconds(); err != nil {
+				return nil, err
+			}
+		}
+		triplets, err := r.readEncoded(decodeListpack)
+		if err != nil {
+			return nil, err
+		}
+		if len(triplets)%3 != 0 {
+			return nil, errors.New("hash listpack has a field without a value or expiry")
 		}
 
-		i += n
+		fields := []hashFieldRecord{}
+		for i := 0; i < len(triplets); i += 3 {
+			expireAt, err := strconv.ParseInt(triplets[i+2], 10, 64)
+			if err != nil {
+				return nil, errors.New("hash listpack has an invalid field expiry")
+			}
+			fields = append(fields, hashFieldRecord{triplets[i], triplets[i+1], expireAt})
+		}
+		return hashEntryWithExpiries(fields), nil
 
-		value, m, valueErr := decodeValue(encoding[i:])
-		if valueErr != nil {
-			return nil, 0, valueErr
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStream:
+		s, err := decodeStreamValue(r, rdbType)
+		if err != nil {
+			return nil, err
 		}
+		return &entry{Type: streamType, Value: s}, nil
 
-		i += m
-		mapping[key] = value
+	case rdbTypeModule2:
+		if _, err := r.readLength(); err != nil {
+			return nil, err
+		}
+		return nil, r.skipModuleValue()
+	case rdbTypeModulePreGA:
+		return nil, errors.New("pre-GA module values not supported")
 	}
 
-	return mapping, i, nil
+	return nil, fmt.Errorf("unknown RDB value type %d", rdbType)
 }
 
-func storeInMap(fileEncoding []byte, key, val string, expiryPtr *expiry) bool {
-	// assumes key doesn't already exist in hashmap
-	toBeInserted := ""
+func listEntryOf(elements []string) *entry {
+	if len(elements) == 0 {
+		return nil
+	}
 
-	filePointer := 0
+	l := newListValue()
+	for _, element := range elements {
+		l.pushBack([]byte(element))
+	}
+	return &entry{Type: listType, Value: l}
+}
 
-	_, n, headerErr := readRDBHeader(fileEncoding[filePointer:])
-	if headerErr != nil {
-		fmt.Println("Problem: error thrown when reading RDB header")
+func setEntryOf(members []string) *entry {
+	if len(members) == 0 {
+		return nil
 	}
-	filePointer += n
 
-	_, n, metadataErr := readMetadata(fileEncoding[filePointer:])
-	if metadataErr != nil {
-		fmt.Println("Problem: error thrown when reading RDB metadata")
+	s := newSetValue()
+	for _, member := range members {
+		s.add(member)
 	}
-	filePointer += n
+	return &entry{Type: setType, Value: s}
+}
 
-	if fmt.Sprintf("%02x", fileEncoding[filePointer]) != "fe" {
-		// TODO: address when database is empty (add a database section)
-		toBeInserted += "fe00fb01"
+// zsetEntryOf builds a sorted set from members alternating with their scores
+func zsetEntryOf(pairs []string) (*entry, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("sorted set has a member without a score")
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
 
-		if expiryPtr == nil {
-			toBeInserted += "00"
-		} else {
-			timestampHex, err := toggleEndianHex(fmt.Sprintf("%016x", (*expiryPtr).Timestamp.UnixMilli()))
-			if err != nil {
-				fmt.Println("Problem: error thrown when converting expiry timestamp to little-endian")
-			}
-			toBeInserted += "01fc" + timestampHex
+	z := newZsetValue()
+	for i := 0; i < len(pairs); i += 2 {
+		score, err := strconv.ParseFloat(pairs[i+1], 64)
+		if err != nil || math.IsNaN(score) {
+			return nil, fmt.Errorf("invalid score '%s'", pairs[i+1])
 		}
+		z.set(pairs[i], score)
+	}
+	return &entry{Type: zsetType, Value: z}, nil
+}
+
+// hashEntryOf builds a hash from fields alternating with their values
+func hashEntryOf(pairs []string) (*entry, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("hash has a field without a value")
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	h := newHashValue()
+	for i := 0; i < len(pairs); i += 2 {
+		h.set(pairs[i], []byte(pairs[i+1]))
+	}
+	return &entry{Type: hashType, Value: h}, nil
+}
+
+// hashFieldRecord is a hash field as stored with its expiry, in Unix milliseconds or zero
+// when it has none
+type hashFieldRecord struct {
+	name, value string
+	expireAt    int64
+}
 
-		encodedKey, keyErr := encodeValue(key)
-		if keyErr != nil {
-			fmt.Println("Problem: error thrown when encoding key")
-			return false
+// hashEntryWithExpiries builds a hash from fields that may have expiries, leaving out those
+// that have already expired
+func hashEntryWithExpiries(fields []hashFieldRecord) *entry {
+	now := time.Now()
+	h := newHashValue()
+	for _, f := range fields {
+		if f.expireAt != 0 && !now.Before(time.UnixMilli(f.expireAt)) {
+			continue
 		}
-		encodedValue, valueErr := encodeValue(val)
-		if valueErr != nil {
-			fmt.Println("Problem: error thrown when encoding value")
-			return false
+		h.set(f.name, []byte(f.value))
+		if f.expireAt != 0 {
+			h.setFieldExpiry(f.name, &expiry{time.UnixMilli(f.expireAt)})
 		}
+	}
+	if h.len() == 0 {
+		return nil
+	}
+	return &entry{Type: hashType, Value: h}
+}
 
-		toBeInserted += "00" + encodedKey + encodedValue
+// readHashMetadata reads a hash stored field by field with expiries. The GA layout stores
+// each relative to the earliest, plus one, while its predecessor stores them as they are
+func (r *rdbReader) readHashMetadata(rdbType byte) (*entry, error) {
+	var minExpiry int64
+	if rdbType == rdbTypeHashMetadata {
+		var err error
+		if minExpiry, err = r.readMilliseconds(); err != nil {
+			return nil, err
+		}
+	}
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
 
-	} else {
-		originalFilePointer := filePointer
-		if _, exists := getFromMap(fmt.Sprintf("%x", fileEncoding), key); exists {
-			// TODO: address when key already exists (including expiry)
+	fields := []hashFieldRecord{}
+	for range length {
+		ttl, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		f := hashFieldRecord{expireAt: int64(ttl)}
+		if rdbType == rdbTypeHashMetadata && ttl != 0 {
+			f.expireAt = minExpiry + int64(ttl) - 1
+		}
+		if f.name, err = r.readString(); err != nil {
+			return nil, err
+		}
+		if f.value, err = r.readString(); err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return hashEntryWithExpiries(fields), nil
+}
 
-		} else {
-			// fe section
-			filePointer += 2
-			toBeInserted += "fe00"
+// the RDB format version written here, that of Redis 7.0 to 7.2, and the version of Redis
+// 7.4, which is only written when needed for hash field expiries
+const (
+	rdbVersion            = 11
+	rdbVersionFieldExpiry = 12
+)
 
-			// fb section
-			filePointer += 1
-			toBeInserted += "fb"
+// RDB value types, each naming a type and how its value is encoded
+const (
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZset             = 3
+	rdbTypeHash             = 4
+	rdbTypeZset2            = 5
+	rdbTypeModulePreGA      = 6
+	rdbTypeModule2          = 7
+	rdbTypeHashZipmap       = 9
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZsetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZsetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	// streams in the layout Redis 7.2 writes (RDB_TYPE_STREAM_LISTPACKS_3)
+	rdbTypeStream = 21
+	// hashes with field expiries, as written by Redis 7.4 and its release candidates
+	rdbTypeHashMetadataPreGA   = 22
+	rdbTypeHashListpackExPreGA = 23
+	rdbTypeHashMetadata        = 24
+	rdbTypeHashListpackEx      = 25
+)
 
-			databaseSize, decodeDatabaseLengthErr := decodeLength(fileEncoding[filePointer:])
-			if decodeDatabaseLengthErr != nil {
-				fmt.Println("Problem: error thrown when decoding length of entire database")
-				return false
-			}
-			databaseSize += 1
-			filePointer += 1
+// RDB opcodes, which share a byte with the value types preceding each key
+const (
+	rdbOpcodeFunction      = 0xf5
+	rdbOpcodeFunctionPreGA = 0xf6
+	rdbOpcodeModuleAux     = 0xf7
+	rdbOpcodeIdle          = 0xf8
+	rdbOpcodeFreq          = 0xf9
+	rdbOpcodeAux           = 0xfa
+	rdbOpcodeResizeDB      = 0xfb
+	rdbOpcodeExpireTimeMs  = 0xfc
+	rdbOpcodeExpireTime    = 0xfd
+	rdbOpcodeSelectDB      = 0xfe
+	rdbOpcodeEOF           = 0xff
+)
 
-			expirySize, decodeExpiryLengthErr := decodeLength(fileEncoding[filePointer:])
-			if decodeExpiryLengthErr != nil {
-				fmt.Println("Problem: error thrown when decoding length of expiry database")
-				return false
-			}
-			if expiryPtr != nil {
-				expirySize += 1
-			}
-			filePointer += 1
+// quicklist nodes hold either a single element or a listpack (a ziplist before version 10)
+const (
+	rdbQuicklistPlain  = 1
+	rdbQuicklistPacked = 2
+)
 
-			encodedDatabaseLength, encodeDatabaseLengthErr := encodeLength(databaseSize)
-			if encodeDatabaseLengthErr != nil {
-				fmt.Println("Problem: error thrown when encoding length of entire database")
-			}
-			encodedExpiryLength, encodeExpiryLengthErr := encodeLength(expirySize)
-			if encodeExpiryLengthErr != nil {
-				fmt.Println("Problem: error thrown when encoding length of expiry database")
-			}
-			toBeInserted += encodedDatabaseLength + encodedExpiryLength
+// module values are serialised as a sequence of these opcodes, each followed by its data
+const (
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSInt   = 1
+	rdbModuleOpcodeUInt   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+)
 
-			if expiryPtr != nil {
-				timestampHex, err := toggleEndianHex(fmt.Sprintf("%016x", (*expiryPtr).Timestamp.UnixMilli()))
-				if err != nil {
-					fmt.Println("Problem: error thrown when converting expiry timestamp to little-endian")
-				}
-				toBeInserted += "fc" + timestampHex
-			}
+// stream entry flags within a listpack node
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
 
-			encodedKey, keyErr := encodeValue(key)
-			if keyErr != nil {
-				fmt.Println("Problem: error thrown when encoding key")
-				return false
-			}
-			encodedValue, valueErr := encodeValue(val)
-			if valueErr != nil {
-				fmt.Println("Problem: error thrown when encoding value")
-				return false
-			}
+// appendRDBLength appends a length in RDB's variable-size encoding
+func appendRDBLength(buf []byte, length uint64) []byte {
+	switch {
+	case length < 1<<6:
+		return append(buf, byte(length))
+	case length < 1<<14:
+		return append(buf, 0x40|byte(length>>8), byte(length))
+	case length <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0x80), uint32(length))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0x81), length)
+	}
+}
 
-			toBeInserted += "00" + encodedKey + encodedValue
-		}
+func appendRDBString(buf []byte, s string) []byte {
+	return append(appendRDBLength(buf, uint64(len(s))), s...)
+}
 
-		for fmt.Sprintf("%02x", fileEncoding[filePointer]) != "ff" {
-			if fmt.Sprintf("%02x", fileEncoding[filePointer]) == "00" {
-				filePointer += 1
-				toBeInserted += "00"
-				_, n, err := decodeValue(fileEncoding[filePointer:])
-				if err != nil {
-					fmt.Println("Problem: error thrown when decoding the value of a key")
-					return false
-				}
-				toBeInserted += fmt.Sprintf("%*x", n, fileEncoding[filePointer:filePointer+n])
-				filePointer += n
+func appendRDBMilliseconds(buf []byte, ms int64) []byte {
+	return binary.LittleEndian.AppendUint64(buf, uint64(ms))
+}
 
-				_, m, err := decodeValue(fileEncoding[filePointer:])
-				if err != nil {
-					fmt.Println("Problem: error thrown when decoding the value of a value")
-					return false
-				}
-				toBeInserted += fmt.Sprintf("%*x", m, fileEncoding[filePointer:filePointer+n])
-				filePointer += n
-			} else if fmt.Sprintf("%02x", fileEncoding[filePointer]) == "fc" {
-				filePointer += 1
-				toBeInserted += "fc" + fmt.Sprintf("%x", fileEncoding[filePointer:filePointer+8])
-				filePointer += 8
-
-				toBeInserted += "00"
-				_, n, err := decodeValue(fileEncoding[filePointer:])
-				if err != nil {
-					fmt.Println("Problem: error thrown when decoding the value of a key")
-					return false
-				}
-				toBeInserted += fmt.Sprintf("%*x", n, fileEncoding[filePointer:filePointer+n])
-				filePointer += n
+// encodeStreamNode packs consecutive entries into a listpack the way Redis lays out a node
+// of a stream: a master entry holding the node's entry count and the first entry's field
+// names, then each entry as flags, its ID relative to the node's, and its fields and values
+// (just the values when its fields match the master entry's)
+func encodeStreamNode(entries []streamEntry) []byte {
+	master := entries[0]
+	masterFields := []string{}
+	for i := 0; i < len(master.fields); i += 2 {
+		masterFields = append(masterFields, master.fields[i])
+	}
 
-				_, m, err := decodeValue(fileEncoding[filePointer:])
-				if err != nil {
-					fmt.Println("Problem: error thrown when decoding the value of a value")
-					return false
-				}
-				toBeInserted += fmt.Sprintf("%*x", m, fileEncoding[filePointer:filePointer+n])
-				filePointer += n
-			} else if fmt.Sprintf("%02x", fileEncoding[filePointer]) == "fd" {
-				filePointer += 1
-				toBeInserted += "fd" + fmt.Sprintf("%x", fileEncoding[filePointer:filePointer+4])
-				filePointer += 4
-
-				toBeInserted += "00"
-				_, n, err := decodeValue(fileEncoding[filePointer:])
-				if err != nil {
-					fmt.Println("Problem: error thrown when decoding the value of a key")
-					return false
-				}
-				toBeInserted += fmt.Sprintf("%*x", n, fileEncoding[filePointer:filePointer+n])
-				filePointer += n
+	lp := newListpack()
+	lp.appendInteger(int64(len(entries)))
+	lp.appendInteger(0)
+	lp.appendInteger(int64(len(masterFields)))
+	for _, field := range masterFields {
+		lp.appendString(field)
+	}
+	lp.appendInteger(0)
 
-				_, m, err := decodeValue(fileEncoding[filePointer:])
-				if err != nil {
-					fmt.Println("Problem: error thrown when decoding the value of a value")
-					return false
-				}
-				toBeInserted += fmt.Sprintf("%*x", m, fileEncoding[filePointer:filePointer+n])
-				filePointer += n
-			} else {
-				fmt.Println("Problem: unexpected first byte for a database entry")
-				return false
+	for _, entry := range entries {
+		sameFields := len(entry.fields) == 2*len(masterFields)
+		for i := 0; sameFields && i < len(masterFields); i++ {
+			sameFields = entry.fields[2*i] == masterFields[i]
+		}
+
+		flags := int64(0)
+		if sameFields {
+			flags = streamItemSameFields
+		}
+		lp.appendInteger(flags)
+		lp.appendInteger(int64(entry.id.ms - master.id.ms))
+		lp.appendInteger(int64(entry.id.seq - master.id.seq))
+
+		if sameFields {
+			for i := 1; i < len(entry.fields); i += 2 {
+				lp.appendString(entry.fields[i])
 			}
+			lp.appendInteger(int64(len(masterFields) + 3))
+		} else {
+			lp.appendInteger(int64(len(entry.fields) / 2))
+			for _, field := range entry.fields {
+				lp.appendString(field)
+			}
+			lp.appendInteger(int64(len(entry.fields) + 4))
 		}
+	}
+
+	return lp.bytes()
+}
+
+func appendStreamID(buf []byte, id streamID) []byte {
+	return appendRDBLength(appendRDBLength(buf, id.ms), id.seq)
+}
+
+// encodeStreamValue serialises a stream, including its consumer groups and the IDs that
+// keep new entries' IDs increasing after it's loaded again
+func encodeStreamValue(s *streamValue) []byte {
+	entries := s.between(streamID{}, maxStreamID, false, 0)
 
-		filePointer = originalFilePointer
+	buf := appendRDBLength(nil, uint64((len(entries)+streamNodeMaxEntries-1)/streamNodeMaxEntries))
+	for start := 0; start < len(entries); start += streamNodeMaxEntries {
+		node := entries[start:min(start+streamNodeMaxEntries, len(entries))]
+		buf = appendRDBString(buf, node[0].id.key())
+		buf = appendRDBString(buf, string(encodeStreamNode(node)))
 	}
 
-	databaseBytes, decodeHexErr := hex.DecodeString(toBeInserted)
-	if decodeHexErr != nil {
-		fmt.Println("Problem: error thrown when decoding database hex encoding")
-		return false
+	buf = appendRDBLength(buf, uint64(s.len()))
+	buf = appendStreamID(buf, s.lastID)
+	buf = appendStreamID(buf, s.firstID())
+	buf = appendStreamID(buf, s.maxDeletedID)
+	buf = appendRDBLength(buf, s.entriesAdded)
+
+	buf = appendRDBLength(buf, uint64(len(s.groups)))
+	for _, name := range slices.Sorted(maps.Keys(s.groups)) {
+		g := s.groups[name]
+		buf = appendRDBString(buf, name)
+		buf = appendStreamID(buf, g.lastID)
+		buf = appendRDBLength(buf, uint64(g.entriesRead))
+
+		buf = appendRDBLength(buf, uint64(g.pending.len()))
+		g.pending.ascend(streamID{}, maxStreamID, func(id streamID) bool {
+			pending := g.pendingEntries[id]
+			buf = append(buf, id.key()...)
+			buf = appendRDBMilliseconds(buf, pending.deliveryTime)
+			buf = appendRDBLength(buf, pending.deliveryCount)
+			return true
+		})
+
+		consumers := g.sortedConsumers()
+		buf = appendRDBLength(buf, uint64(len(consumers)))
+		for _, consumer := range consumers {
+			buf = appendRDBString(buf, consumer.name)
+			buf = appendRDBMilliseconds(buf, consumer.seenTime)
+			buf = appendRDBMilliseconds(buf, consumer.activeTime)
+
+			buf = appendRDBLength(buf, uint64(consumer.pending.len()))
+			consumer.pending.ascend(streamID{}, maxStreamID, func(id streamID) bool {
+				buf = append(buf, id.key()...)
+				return true
+			})
+		}
 	}
-	payload := append(fileEncoding[:filePointer], databaseBytes...)
 
-	// compute new end-of-file checksum
-	checksum := getChecksum(payload)
+	return buf
+}
+
+var errTruncatedRDB = errors.New("unexpected end of RDB file")
 
-	newFileEncoding := append(append(payload, 0xFF), checksum...)
+// rdbReader decodes binary RDB data
+type rdbReader struct {
+	data []byte
+	pos  int
+}
 
-	success, _ := writeRDBFile(newFileEncoding)
-	if !success {
-		fmt.Println("Problem: RDB file could not be written")
-		return false
+func (r *rdbReader) readBytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errTruncatedRDB
 	}
 
-	return true
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
 }
 
-func getChecksum(payload []byte) []byte {
-	table := crc64.MakeTable(crc64.ECMA)
-	checksum := crc64.Checksum(payload, table)
+func (r *rdbReader) readByte() (byte, error) {
+	b, err := r.readBytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
 
-	var buffer bytes.Buffer
+// readLength reads a length, or reports the format of a specially encoded string
+func (r *rdbReader) readLengthOrEncoding() (uint64, bool, error) {
+	first, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3F), false, nil
+	case 1:
+		second, err := r.readByte()
+		return uint64(first&0x3F)<<8 | uint64(second), false, err
+	case 2:
+		switch first {
+		case 0x80:
+			b, err := r.readBytes(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(b)), false, nil
+		case 0x81:
+			b, err := r.readBytes(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(b), false, nil
+		}
+		return 0, false, fmt.Errorf("unknown length encoding %02x", first)
+	default:
+		return uint64(first & 0x3F), true, nil
+	}
+}
 
-	binary.Write(&buffer, binary.LittleEndian, checksum)
-	newChecksumBytes := buffer.Bytes()
-	return newChecksumBytes
+func (r *rdbReader) readLength() (uint64, error) {
+	length, encoded, err := r.readLengthOrEncoding()
+	if err == nil && encoded {
+		err = errors.New("expected a length but found an encoded string")
+	}
+	return length, err
 }
 
-func getFromMap(fileEncoding, key string) ([]byte, bool) {
-	hashmap, expiries := extractMap(fileEncoding)
-	// fmt.Printf("After getting the RDB file hashmap, the result was: %v\n", hashmap)
+func (r *rdbReader) readString() (string, error) {
+	length, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return "", err
+	}
 
-	value, valueExists := hashmap[key]
-	if !valueExists {
-		return nullBulkString(), false
+	if !encoded {
+		b, err := r.readBytes(int(min(length, math.MaxInt32)))
+		return string(b), err
 	}
 
-	expiryPtr, expiryPtrExists := expiries[key]
-	if expiryPtrExists && expiryPtr != nil && time.Now().Compare((*expiryPtr).Timestamp) > 0 {
-		return nullBulkString(), false
+	switch length {
+	case 0:
+		b, err := r.readBytes(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case 1:
+		b, err := r.readBytes(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case 2:
+		b, err := r.readBytes(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case 3:
+		compressedLength, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		length, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := r.readBytes(int(min(compressedLength, math.MaxInt32)))
+		if err != nil {
+			return "", err
+		}
+		b, err := lzfDecompress(compressed, int(min(length, math.MaxInt32)))
+		return string(b), err
+	default:
+		return "", fmt.Errorf("unsupported string encoding %d", length)
 	}
+}
 
-	return encodeSimpleString(value), true
+// readStringList reads a length followed by that many groups of strings, e.g. a hash's
+// fields and values in groups of two
+func (r *rdbReader) readStringList(group int) ([]string, error) {
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	elements := []string{}
+	for i := uint64(0); i < length*uint64(group); i++ {
+		element, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
 }
 
-type keyValuePair struct {
-	Key       string
-	Value     string
-	ExpiryPtr *expiry
+// readEncoded reads a string holding a compact encoding of a value's elements
+func (r *rdbReader) readEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	encoded, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	return decode([]byte(encoded))
 }
 
-func extractMap(fileEncoding string) (map[string]string, map[string]*expiry) {
-	dataLength := len(fileEncoding)
-	var intermediateResults []keyValuePair
-	for i := 0; i < dataLength; i += 2 {
-		if fileEncoding[i:i+2] != "fe" {
-			continue
+func (r *rdbReader) readQuicklist(rdbType byte) ([]string, error) {
+	nodes, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	elements := []string{}
+	for ; nodes > 0; nodes-- {
+		container := uint64(rdbQuicklistPacked)
+		if rdbType == rdbTypeListQuicklist2 {
+			if container, err = r.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		node, err := r.readString()
+		if err != nil {
+			return nil, err
 		}
 
-		if i+4 > dataLength || fileEncoding[i+2:i+4] != "00" {
-			fmt.Println("Warning: expected database index to be 0, terminating early")
-			break
+		switch container {
+		case rdbQuicklistPlain:
+			elements = append(elements, node)
+		case rdbQuicklistPacked:
+			decode := decodeListpack
+			if rdbType == rdbTypeListQuicklist {
+				decode = decodeZiplist
+			}
+			nodeElements, err := decode([]byte(node))
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, nodeElements...)
+		default:
+			return nil, fmt.Errorf("unknown quicklist node container %d", container)
 		}
-		i += 4
+	}
+
+	return elements, nil
+}
+
+// readZset reads a sorted set whose scores are binary doubles, or before version 8 text
+func (r *rdbReader) readZset(rdbType byte) (*entry, error) {
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, nil
+	}
 
-		if i+2 > dataLength || fileEncoding[i:i+2] != "fb" {
-			fmt.Printf("Problem: could not find the `fb` flag (at index %d)", i)
-			os.Exit(1)
+	z := newZsetValue()
+	for ; length > 0; length-- {
+		member, err := r.readString()
+		if err != nil {
+			return nil, err
 		}
-		if i+6 > dataLength {
-			fmt.Println("Problem: could not find hashmap metadata")
-			os.Exit(1)
+
+		var score float64
+		if rdbType == rdbTypeZset2 {
+			score, err = r.readDouble()
+		} else {
+			score, err = r.readTextDouble()
 		}
-		i += 6
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(score) {
+			return nil, errors.New("sorted set has a NaN score")
+		}
+		z.set(member, score)
+	}
 
-		// remove end of file
-		pairs := fileEncoding[i : dataLength-18]
+	return &entry{Type: zsetType, Value: z}, nil
+}
 
-		intermediateResults = getPairs(pairs)
+func (r *rdbReader) readDouble() (float64, error) {
+	b, err := r.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+}
 
-		break
+// readTextDouble reads a double written as text after a length byte, where the lengths
+// 253 to 255 stand for NaN, infinity and negative infinity
+func (r *rdbReader) readTextDouble() (float64, error) {
+	length, err := r.readByte()
+	if err != nil {
+		return 0, err
 	}
 
-	results := map[string]string{}
-	expiryResults := map[string]*expiry{}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
 
-	for _, r := range intermediateResults {
-		results[r.Key] = r.Value
-		if r.ExpiryPtr != nil {
-			expiryResults[r.Key] = r.ExpiryPtr
+	b, err := r.readBytes(int(length))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+// skipModuleAux reads past the data a module saves alongside the keyspace, which is of no
+// use without the module
+func (r *rdbReader) skipModuleAux() error {
+	// the module ID, then when the data was saved, relative to the keyspace
+	if _, err := r.readLength(); err != nil {
+		return err
+	}
+	if opcode, err := r.readLength(); err != nil || opcode != rdbModuleOpcodeUInt {
+		return errors.New("invalid module auxiliary data")
+	}
+	if _, err := r.readLength(); err != nil {
+		return err
+	}
+
+	return r.skipModuleValue()
+}
+
+// skipModuleValue reads past data serialised by a module, up to its EOF opcode
+func (r *rdbReader) skipModuleValue() error {
+	for {
+		opcode, err := r.readLength()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case rdbModuleOpcodeEOF:
+			return nil
+		case rdbModuleOpcodeSInt, rdbModuleOpcodeUInt:
+			_, err = r.readLength()
+		case rdbModuleOpcodeFloat:
+			_, err = r.readBytes(4)
+		case rdbModuleOpcodeDouble:
+			_, err = r.readBytes(8)
+		case rdbModuleOpcodeString:
+			_, err = r.readString()
+		default:
+			return fmt.Errorf("unknown module opcode %d", opcode)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	return results, expiryResults
 }
 
-func getPairs(pairs string) []keyValuePair {
-	dataLength := len(pairs)
-	entities := []string{"key", "value"}
-	results := []keyValuePair{}
+func (r *rdbReader) readMilliseconds() (int64, error) {
+	b, err := r.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
 
-	i := 0
-	for i < dataLength {
-		if i+2 > dataLength {
-			fmt.Println("Problem: could not find start of key-value pair")
-			os.Exit(1)
+func (r *rdbReader) readStreamID() (streamID, error) {
+	ms, err := r.readLength()
+	if err != nil {
+		return streamID{}, err
+	}
+	seq, err := r.readLength()
+	return streamID{ms, seq}, err
+}
+
+func (r *rdbReader) readRawStreamID() (streamID, error) {
+	b, err := r.readBytes(16)
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamIDFromKey(string(b)), nil
+}
+
+var errCorruptStream = errors.New("corrupt stream node")
+
+// decodeStreamNode adds the live entries of a listpack node to a stream
+func decodeStreamNode(s *streamValue, master streamID, elements []string) error {
+	integer := func(i int) (int64, error) {
+		if i >= len(elements) {
+			return 0, errCorruptStream
+		}
+		n, err := strconv.ParseInt(elements[i], 10, 64)
+		if err != nil {
+			return 0, errCorruptStream
 		}
-		var pair keyValuePair
+		return n, nil
+	}
 
-		switch pairs[i : i+2] {
-		case "fc":
-			// timestamp in milliseconds
-			i += 2
-			if i+16 > dataLength {
-				fmt.Println("Problem: could not find expiry timestamp")
-				os.Exit(1)
-			}
+	numFields, err := integer(2)
+	if err != nil || numFields < 0 || 4+int(numFields) > len(elements) {
+		return errCorruptStream
+	}
+	masterFields := elements[3 : 3+numFields]
+
+	i := 4 + int(numFields)
+	for i < len(elements) {
+		flags, err := integer(i)
+		if err != nil {
+			return err
+		}
+		msDiff, err := integer(i + 1)
+		if err != nil {
+			return err
+		}
+		seqDiff, err := integer(i + 2)
+		if err != nil {
+			return err
+		}
+		i += 3
 
-			// switch from little-endian hex to big-endian hex
-			timestampHex, convertErr := toggleEndianHex(pairs[i : i+16])
-			if convertErr != nil {
-				fmt.Printf("Problem: error thrown while converting timestamp from little endian")
-				os.Exit(1)
+		fields := []string{}
+		if flags&streamItemSameFields != 0 {
+			if i+len(masterFields) > len(elements) {
+				return errCorruptStream
 			}
-			timestampUnixMilli, err := strconv.ParseInt(timestampHex, 16, 64)
-			if err != nil {
-				fmt.Printf("Problem: error thrown while parsing expiry timestamp")
-				os.Exit(1)
+			for j, field := range masterFields {
+				fields = append(fields, field, elements[i+j])
 			}
+			i += len(masterFields)
+		} else {
+			count, err := integer(i)
+			if err != nil || count < 0 || i+1+2*int(count) > len(elements) {
+				return errCorruptStream
+			}
+			fields = append(fields, elements[i+1:i+1+2*int(count)]...)
+			i += 1 + 2*int(count)
+		}
+		// skip the element count that lets Redis walk the listpack backwards
+		i++
 
-			timestamp := time.UnixMilli(timestampUnixMilli)
-			pair.ExpiryPtr = &expiry{timestamp}
-			i += 16
+		if flags&streamItemDeleted == 0 {
+			id := streamID{master.ms + uint64(msDiff), master.seq + uint64(seqDiff)}
+			if _, exists := s.entries[id]; exists {
+				return errCorruptStream
+			}
+			s.ids.add(id)
+			s.entries[id] = fields
 		}
-		if i+2 > dataLength || pairs[i:i+2] != "00" {
-			fmt.Println("Problem: expected value type to be string")
-			os.Exit(1)
+	}
+
+	return nil
+}
+
+// decodeStreamValue reads a stream in any of its RDB layouts, which have gained metadata
+// over time: the first, maximum deleted and added entries, and how many entries each group
+// has read, in version 10, and consumers' active times in version 11
+func decodeStreamValue(r *rdbReader, rdbType byte) (*streamValue, error) {
+	s := newStreamValue()
+
+	nodes, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for ; nodes > 0; nodes-- {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, errCorruptStream
+		}
+		encoded, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		elements, err := decodeListpack([]byte(encoded))
+		if err != nil {
+			return nil, err
 		}
+		if err := decodeStreamNode(s, streamIDFromKey(key), elements); err != nil {
+			return nil, err
+		}
+	}
 
-		i += 2
+	// the length is implied by the entries, and the first ID by the first of them
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if s.lastID, err = r.readStreamID(); err != nil {
+		return nil, err
+	}
+	s.entriesAdded = length
+	if rdbType >= rdbTypeStreamListpacks2 {
+		if _, err := r.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.maxDeletedID, err = r.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.entriesAdded, err = r.readLength(); err != nil {
+			return nil, err
+		}
+	}
 
-		for _, entity := range entities {
-			if i+2 > dataLength {
-				fmt.Printf("Problem: could not find %s length", entity)
-				os.Exit(1)
+	groups, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for ; groups > 0; groups-- {
+		name, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		lastID, err := r.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+		// older layouts leave how many entries the group has read unknown
+		entriesRead := int64(-1)
+		if rdbType >= rdbTypeStreamListpacks2 {
+			n, err := r.readLength()
+			if err != nil {
+				return nil, err
 			}
+			entriesRead = int64(n)
+		}
+		g := newStreamGroup(name, lastID, entriesRead)
+		s.groups[name] = g
 
-			entityLengthInt64, err := strconv.ParseInt(pairs[i:i+2], 16, 64)
+		pendingCount, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for ; pendingCount > 0; pendingCount-- {
+			id, err := r.readRawStreamID()
+			if err != nil {
+				return nil, err
+			}
+			deliveryTime, err := r.readMilliseconds()
+			if err != nil {
+				return nil, err
+			}
+			deliveryCount, err := r.readLength()
 			if err != nil {
-				fmt.Printf("Problem: error thrown while parsing %s length", entity)
-				os.Exit(1)
+				return nil, err
 			}
 
-			entityLength := int(entityLengthInt64)
-			// fmt.Println(entityLength)
-			i += 2
+			g.pending.add(id)
+			g.pendingEntries[id] = &pendingEntry{deliveryTime: deliveryTime, deliveryCount: deliveryCount}
+		}
 
-			if i+(2*entityLength) > dataLength {
-				fmt.Printf("Problem: could not find %s data", entity)
-				os.Exit(1)
+		consumers, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for ; consumers > 0; consumers-- {
+			name, err := r.readString()
+			if err != nil {
+				return nil, err
 			}
-
-			entityBytes, err := hex.DecodeString(pairs[i : i+(2*entityLength)])
+			seenTime, err := r.readMilliseconds()
 			if err != nil {
-				fmt.Printf("Problem: error thrown while parsing %s", entity)
-				os.Exit(1)
+				return nil, err
+			}
+			activeTime := seenTime
+			if rdbType >= rdbTypeStream {
+				if activeTime, err = r.readMilliseconds(); err != nil {
+					return nil, err
+				}
 			}
 
-			if entity == "key" {
-				pair.Key = string(entityBytes)
-			} else {
-				pair.Value = string(entityBytes)
+			consumer := g.addConsumer(name, seenTime)
+			consumer.activeTime = activeTime
+
+			consumerPending, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+			for ; consumerPending > 0; consumerPending-- {
+				id, err := r.readRawStreamID()
+				if err != nil {
+					return nil, err
+				}
+				pending, exists := g.pendingEntries[id]
+				if !exists || pending.consumer != nil {
+					return nil, errCorruptStream
+				}
+				pending.consumer = consumer
+				consumer.pending.add(id)
 			}
-			i += 2 * entityLength
 		}
 
-		results = append(results, pair)
+		// every pending entry must belong to a consumer
+		for _, pending := range g.pendingEntries {
+			if pending.consumer == nil {
+				return nil, errCorruptStream
+			}
+		}
 	}
 
-	return results
+	return s, nil
 }
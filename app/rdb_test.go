@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/hex"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures below are RDB files laid out byte for byte as Redis writes them, in hex. They
+// were built from the formats in Redis's rdb.c, ziplist.c, listpack.c, intset.c and
+// t_stream.c rather than by the encoders here, so they check compatibility, not round trips
+
+// farFuture is 2100-01-01, in Unix milliseconds, for expiries that never pass in a test
+const farFuture = 4102444800000
+
+// decodeFixture decodes a fixture written in hex, ignoring spaces and // comments
+func decodeFixture(t *testing.T, fixture string) []byte {
+	t.Helper()
+
+	var digits strings.Builder
+	for line := range strings.Lines(fixture) {
+		line, _, _ = strings.Cut(line, "//")
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	data, err := hex.DecodeString(digits.String())
+	if err != nil {
+		t.Fatalf("invalid fixture: %v", err)
+	}
+	return data
+}
+
+func decodeFixtureRDB(t *testing.T, fixture string) *rdbSnapshot {
+	t.Helper()
+
+	snapshot, err := decodeRDB(decodeFixture(t, fixture))
+	if err != nil {
+		t.Fatalf("decodeRDB: %v", err)
+	}
+	return snapshot
+}
+
+func lookupEntry(t *testing.T, entries map[string]*entry, key string, want valueType) *entry {
+	t.Helper()
+
+	e, ok := entries[key]
+	if !ok {
+		t.Fatalf("key %q is missing", key)
+	}
+	if e.Type != want {
+		t.Fatalf("key %q has type %v, want %v", key, e.Type, want)
+	}
+	return e
+}
+
+func stringOf(t *testing.T, entries map[string]*entry, key string) string {
+	t.Helper()
+	return string(lookupEntry(t, entries, key, stringType).Value.([]byte))
+}
+
+func listOf(t *testing.T, entries map[string]*entry, key string) []string {
+	t.Helper()
+
+	l := lookupEntry(t, entries, key, listType).Value.(*listValue)
+	elements := []string{}
+	for i := 0; i < l.len(); i++ {
+		elements = append(elements, string(l.at(i)))
+	}
+	return elements
+}
+
+func setOf(t *testing.T, entries map[string]*entry, key string) []string {
+	t.Helper()
+
+	members := lookupEntry(t, entries, key, setType).Value.(*setValue).slice()
+	slices.Sort(members)
+	return members
+}
+
+func zsetOf(t *testing.T, entries map[string]*entry, key string) map[string]float64 {
+	t.Helper()
+	return lookupEntry(t, entries, key, zsetType).Value.(*zsetValue).dict
+}
+
+func hashOf(t *testing.T, entries map[string]*entry, key string) map[string]string {
+	t.Helper()
+
+	fields := map[string]string{}
+	lookupEntry(t, entries, key, hashType).Value.(*hashValue).each(func(field string, value []byte) {
+		fields[field] = string(value)
+	})
+	return fields
+}
+
+func TestDecodeRDBEncodings(t *testing.T) {
+	snapshot := decodeFixtureRDB(t, encodingsRDB)
+	if len(snapshot.databases) != 1 {
+		t.Fatalf("got %d databases, want 1", len(snapshot.databases))
+	}
+	entries := snapshot.databases[0]
+
+	strs := map[string]string{
+		"str":   "hello",
+		"int8":  "-5",
+		"int16": "1000",
+		"int32": "100000",
+		"lzf":   strings.Repeat("hello world ", 20),
+		"meta":  "lru",
+	}
+	for key, want := range strs {
+		if got := stringOf(t, entries, key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+
+	if e := lookupEntry(t, entries, "expiring", stringType); e.ExpiryPtr == nil || e.ExpiryPtr.Timestamp.UnixMilli() != farFuture {
+		t.Errorf("expiring has expiry %v, want %d ms", e.ExpiryPtr, int64(farFuture))
+	}
+	if e := lookupEntry(t, entries, "expired", stringType); e.ExpiryPtr == nil || !e.ExpiryPtr.Timestamp.Equal(time.Unix(1000000000, 0)) {
+		t.Errorf("expired has expiry %v, want 1000000000 s", e.ExpiryPtr)
+	}
+	if e := lookupEntry(t, entries, "str", stringType); e.ExpiryPtr != nil {
+		t.Errorf("str has expiry %v, want none", e.ExpiryPtr)
+	}
+
+	lists := map[string][]string{
+		"list": {"x", "12"},
+		"ziplist": {"a", strings.Repeat("x", 300), "7", "-100", "1000", "100000", "10000000",
+			"1099511627776", "-1099511627776", "tail"},
+		"quicklist":  {"a", "b", "1", "c"},
+		"quicklist2": {"a", "1", "plain", "z"},
+	}
+	for key, want := range lists {
+		if got := listOf(t, entries, key); !slices.Equal(got, want) {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+
+	sets := map[string][]string{
+		"set":         {"m1", "m2"},
+		"intset16":    {"-3", "300", "5"},
+		"intset32":    {"-1", "70000"},
+		"intset64":    {"1099511627776", "2"},
+		"setlistpack": {"7", "a", "b"},
+	}
+	for key, want := range sets {
+		if got := setOf(t, entries, key); !slices.Equal(got, want) {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+
+	zsets := map[string]map[string]float64{
+		"zsetziplist":  {"a": 1, "b": 2.5},
+		"zsetlistpack": {"a": -2, "b": 3.25},
+		"zset2":        {"a": 1.5, "b": -2},
+		"zset":         {"a": 0.5},
+	}
+	for key, want := range zsets {
+		if got := zsetOf(t, entries, key); !maps.Equal(got, want) {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+
+	hashes := map[string]map[string]string{
+		"hash":         {"f": "v"},
+		"zipmap":       {"f1": "v1", "f2": "v2"},
+		"hashziplist":  {"f": "v", "n": "5"},
+		"hashlistpack": {"f": "v", "n": "-7"},
+	}
+	for key, want := range hashes {
+		if got := hashOf(t, entries, key); !maps.Equal(got, want) {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+
+	// besides the two expiring strings
+	if len(entries) != len(strs)+2+len(lists)+len(sets)+len(zsets)+len(hashes) {
+		t.Errorf("got %d keys: %v", len(entries), slices.Sorted(maps.Keys(entries)))
+	}
+}
+
+func TestDecodeRDBStreams(t *testing.T) {
+	fixtures := []struct {
+		name    string
+		fixture string
+		// the metadata each layout adds
+		hasMetadata   bool
+		hasActiveTime bool
+	}{
+		{"listpacks", stream15RDB, false, false},
+		{"listpacks 2", stream19RDB, true, false},
+		{"listpacks 3", stream21RDB, true, true},
+	}
+
+	for _, tc := range fixtures {
+		t.Run(tc.name, func(t *testing.T) {
+			snapshot := decodeFixtureRDB(t, tc.fixture)
+			s := lookupEntry(t, snapshot.databases[0], "s", streamType).Value.(*streamValue)
+
+			// the entry flagged as deleted is skipped, and the one sharing the master entry's
+			// fields gets them back
+			want := map[streamID][]string{
+				{1000, 0}: {"name", "a", "temp", "20"},
+				{1001, 0}: {"other", "x"},
+				{2000, 5}: {"k", "v"},
+			}
+			if len(s.entries) != len(want) || s.ids.len() != len(want) {
+				t.Fatalf("got %d entries (%d IDs), want %d", len(s.entries), s.ids.len(), len(want))
+			}
+			for id, fields := range want {
+				if !slices.Equal(s.entries[id], fields) {
+					t.Errorf("entry %v = %q, want %q", id, s.entries[id], fields)
+				}
+			}
+			if s.lastID != (streamID{2000, 5}) {
+				t.Errorf("last ID = %v, want 2000-5", s.lastID)
+			}
+			if tc.hasMetadata && (s.maxDeletedID != streamID{1000, 1} || s.entriesAdded != 4) {
+				t.Errorf("max deleted ID = %v and entries added = %d, want 1000-1 and 4", s.maxDeletedID, s.entriesAdded)
+			}
+
+			g, ok := s.groups["g"]
+			if !ok {
+				t.Fatal("group g is missing")
+			}
+			if g.lastID != (streamID{1001, 0}) {
+				t.Errorf("group last ID = %v, want 1001-0", g.lastID)
+			}
+			if tc.hasMetadata && g.entriesRead != 2 {
+				t.Errorf("group entries read = %d, want 2", g.entriesRead)
+			}
+
+			pending, ok := g.pendingEntries[streamID{1000, 0}]
+			if !ok || len(g.pendingEntries) != 1 {
+				t.Fatalf("got pending entries %v, want just 1000-0", g.pendingEntries)
+			}
+			if pending.consumer == nil || pending.consumer.name != "alice" || pending.deliveryTime != 1700000000000 || pending.deliveryCount != 3 {
+				t.Errorf("pending entry = %+v, want one delivered to alice at 1700000000000, 3 times", pending)
+			}
+
+			alice, bob := g.consumers["alice"], g.consumers["bob"]
+			if alice == nil || bob == nil || len(g.consumers) != 2 {
+				t.Fatalf("got consumers %v, want alice and bob", slices.Sorted(maps.Keys(g.consumers)))
+			}
+			if alice.seenTime != 1700000001000 || alice.pending.len() != 1 || bob.pending.len() != 0 {
+				t.Errorf("alice seen at %d with %d pending, bob with %d, want 1700000001000, 1 and 0",
+					alice.seenTime, alice.pending.len(), bob.pending.len())
+			}
+			if tc.hasActiveTime && (alice.activeTime != 1700000000500 || bob.activeTime != -1) {
+				t.Errorf("active times = %d and %d, want 1700000000500 and -1", alice.activeTime, bob.activeTime)
+			}
+		})
+	}
+}
+
+func TestDecodeRDBHashFieldExpiries(t *testing.T) {
+	snapshot := decodeFixtureRDB(t, hashMetadataRDB)
+	entries := snapshot.databases[0]
+
+	wantExpiries := map[string]map[string]int64{
+		"hmeta": {"keep": 0, "ttl": farFuture + 5000},
+		"hlpex": {"f": 0, "g": farFuture},
+	}
+	wantValues := map[string]map[string]string{
+		"hmeta": {"keep": "1", "ttl": "2"},
+		"hlpex": {"f": "v", "g": "w"},
+	}
+	for key, want := range wantValues {
+		if got := hashOf(t, entries, key); !maps.Equal(got, want) {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+
+		h := entries[key].Value.(*hashValue)
+		for field, expireAt := range wantExpiries[key] {
+			got := int64(0)
+			if expiryPtr := h.fields[field].expiryPtr; expiryPtr != nil {
+				got = expiryPtr.Timestamp.UnixMilli()
+			}
+			if got != expireAt {
+				t.Errorf("%s field %s expires at %d, want %d", key, field, got, expireAt)
+			}
+		}
+	}
+}
+
+func TestLoadRDBDatabases(t *testing.T) {
+	defer func() {
+		databases = newDatabases(16)
+		store = databases[0]
+	}()
+	databases = newDatabases(16)
+	store = databases[0]
+
+	if err := loadRDBContents(decodeFixture(t, databasesRDB)); err != nil {
+		t.Fatalf("loadRDBContents: %v", err)
+	}
+
+	want := map[int]map[string]string{
+		0:  {"a": "zero"},
+		3:  {"b": "three"},
+		15: {"c": "fifteen", "a": "other a"},
+	}
+	for _, db := range databases {
+		got := map[string]string{}
+		for key, e := range db.entries {
+			got[key] = string(e.Value.([]byte))
+		}
+		if len(got) != len(want[db.id]) || (len(got) > 0 && !maps.Equal(got, want[db.id])) {
+			t.Errorf("database %d = %v, want %v", db.id, got, want[db.id])
+		}
+	}
+
+	// a file with more databases than are configured is refused, leaving them as they were
+	databases = newDatabases(4)
+	store = databases[0]
+	store.entries["kept"] = newStringEntry([]byte("value"), nil)
+	if err := loadRDBContents(decodeFixture(t, databasesRDB)); err == nil {
+		t.Error("loading database 15 into 4 databases succeeded")
+	}
+	if _, ok := databases[0].entries["kept"]; !ok || len(databases[0].entries) != 1 {
+		t.Error("a refused file was partly loaded")
+	}
+}
+
+func TestRDBChecksum(t *testing.T) {
+	// the check value from Redis's crc64.c
+	if got := rdbChecksum([]byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("rdbChecksum = %#x, want 0xe9c6d914c4b8d9ca", got)
+	}
+
+	// the empty RDB file Redis 7.2 sends replicas, with the checksum Redis computed
+	if _, err := decodeRDB(getEmptyRDBFile()); err != nil {
+		t.Errorf("decoding Redis's empty RDB file: %v", err)
+	}
+
+	data := decodeFixture(t, databasesRDB)
+
+	// flip a bit in the last value, "other a"
+	corrupt := slices.Clone(data)
+	corrupt[len(corrupt)-12] ^= 0x01
+	if _, err := decodeRDB(corrupt); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("decoding a corrupt file returned %v, want a checksum error", err)
+	}
+
+	// a zero checksum, written when rdbchecksum is off, isn't verified
+	unchecked := slices.Clone(corrupt)
+	clear(unchecked[len(unchecked)-8:])
+	if _, err := decodeRDB(unchecked); err != nil {
+		t.Errorf("decoding a file without a checksum: %v", err)
+	}
+
+	// nor is one missing from a file older than version 5
+	old := append([]byte("REDIS0004"), data[9:len(data)-8]...)
+	if _, err := decodeRDB(old); err != nil {
+		t.Errorf("decoding a version 4 file: %v", err)
+	}
+
+	if _, err := decodeRDB(data[:len(data)-4]); err == nil {
+		t.Error("decoding a file with a truncated checksum succeeded")
+	}
+}
+
+// encodingsRDB holds a value in each RDB type and encoding Redis has written. The ziplist is
+// LZF-compressed, as Redis compresses any long string
+const encodingsRDB = `
+	524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473023634fa056374696d65
+	c200f15365fe00fb140200037374720568656c6c6f0004696e7438c0fb0005696e743136c1e8030005696e743332c2a0
+	86010000036c7a66c31040f00b68656c6c6f20776f726c6420e0db0bfc00d8c32cbb03000000086578706972696e6704
+	736f6f6efd00ca9a3b00076578706972656404676f6e65f805f90300046d657461036c727501046c697374020178c00c
+	0a077a69706c697374c34045416f046f010000682003080a0000016103412c78e0ff00e01a0001fe2f213815f806fe9c
+	03c0e80304f0a0860105d08096980006e00040004155800909ffffff0a047461696cff0e09717569636b6c6973740211
+	110000000d0000000200000161030162ff10100000000c000000020000f2020163ff120a717569636b6c697374320302
+	0c0c00000002008161020101ff0105706c61696e020a0a0000000100817a02ff020373657402026d31026d320b08696e
+	7473657431360e0200000003000000fdff05002c010b08696e747365743332100400000002000000ffffffff70110100
+	0b08696e74736574363418080000000200000002000000000000000000000000010000140b7365746c6973747061636b
+	0f0f00000003008161028162020701ff0c0b7a7365747a69706c697374181800000012000000040000016103f2020162
+	0303322e35ff110c7a7365746c6973747061636b16160000000400816102dffe0281620284332e323505ff05057a7365
+	7432020161000000000000f83f016200000000000000c003047a73657401016103302e35040468617368010166017609
+	067a69706d617010020266310200763102663202007632ff0d0b686173687a69706c6973741616000000130000000400
+	00016603017603016e03f6ff100c686173686c6973747061636b13130000000400816602817602816e02dff902fffffe
+	8a786dc9a4b4fb`
+
+// stream15RDB holds a stream as Redis 5 and 6 write it (RDB_TYPE_STREAM_LISTPACKS)
+const stream15RDB = `
+	524544495330303039fe000f0173021000000000000003e800000000000000004049490000001900020101010201846e
+	616d65058474656d7005000102010001000181610214010501030100010101816202150105010001010100010101856f
+	74686572068178020601ff1000000000000007d000000000000000051d1d0000000a00010100010101816b0200010201
+	000100018176020401ff0347d00501016743e9000100000000000003e800000000000000000068e5cf8b010000030205
+	616c696365e86be5cf8b0100000100000000000003e8000000000000000003626f62d06fe5cf8b01000000fff85511c7
+	fb2129ca`
+
+// stream19RDB holds the same stream as Redis 7.0 writes it (RDB_TYPE_STREAM_LISTPACKS_2)
+const stream19RDB = `
+	524544495330303130fe00130173021000000000000003e800000000000000004049490000001900020101010201846e
+	616d65058474656d7005000102010001000181610214010501030100010101816202150105010001010100010101856f
+	74686572068178020601ff1000000000000007d000000000000000051d1d0000000a00010100010101816b0200010201
+	000100018176020401ff0347d00543e80043e8010401016743e900020100000000000003e800000000000000000068e5
+	cf8b010000030205616c696365e86be5cf8b0100000100000000000003e8000000000000000003626f62d06fe5cf8b01
+	000000ffe01e95c8d078c0cc`
+
+// stream21RDB holds the same stream as Redis 7.2 writes it (RDB_TYPE_STREAM_LISTPACKS_3)
+const stream21RDB = `
+	524544495330303131fe00150173021000000000000003e800000000000000004049490000001900020101010201846e
+	616d65058474656d7005000102010001000181610214010501030100010101816202150105010001010100010101856f
+	74686572068178020601ff1000000000000007d000000000000000051d1d0000000a00010100010101816b0200010201
+	000100018176020401ff0347d00543e80043e8010401016743e900020100000000000003e800000000000000000068e5
+	cf8b010000030205616c696365e86be5cf8b010000f469e5cf8b0100000100000000000003e800000000000000000362
+	6f62d06fe5cf8b010000ffffffffffffffff00ff50a01ee388428d39`
+
+// databasesRDB holds keys in databases 0, 3 and 15
+const databasesRDB = `
+	524544495330303131fe00000161047a65726ffe03fb0100000162057468726565fe0f000163076669667465656e0001
+	61076f746865722061ffcf2cb34df4706fe3`
+
+// hashMetadataRDB holds hashes with field expiries as Redis 7.4 writes them
+const hashMetadataRDB = `
+	524544495330303132fe001805686d65746100d8c32cbb0300000200046b656570013153890374746c01321905686c70
+	657800d8c32cbb0300001f1f00000006008166028176020001816702817702f400d8c32cbb03000009ffff28bef88e84
+	15a957`
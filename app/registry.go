@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type commandHandler func(c *client, array []string) ([]byte, error)
+
+// commandSpec describes a command the way COMMAND INFO reports it
+type commandSpec struct {
+	Name string
+	// Arity counts the command name itself; a negative arity means "at least -Arity"
+	Arity int
+	// Flags are the Redis command flags, e.g. "write", "readonly", "admin", "fast"
+	Flags []string
+	// FirstKey, LastKey and KeyStep give the positions of key arguments
+	// (LastKey is negative when counted from the end of the arguments)
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+
+	Group   string
+	Summary string
+	Since   string
+
+	Handler     commandHandler
+	Subcommands map[string]*commandSpec
+
+	// Unlocked handlers run without executionLock, e.g. so SCRIPT KILL can interrupt the
+	// script holding it
+	Unlocked bool
+}
+
+func (spec *commandSpec) hasFlag(flag string) bool {
+	return slices.Contains(spec.Flags, flag)
+}
+
+func (spec *commandSpec) arityMatches(numArgs int) bool {
+	if spec.Arity < 0 {
+		return numArgs >= -spec.Arity
+	}
+	return numArgs == spec.Arity
+}
+
+// commandTable maps lowercase command names to their specs
+var commandTable = map[string]*commandSpec{}
+
+// executionLock serialises command execution, so that every command runs atomically
+// (commands flagged "blocking" take it themselves, around the parts that touch the keyspace)
+var executionLock sync.Mutex
+
+func registerCommands(specs ...*commandSpec) {
+	for _, spec := range specs {
+		commandTable[strings.ToLower(spec.Name)] = spec
+	}
+}
+
+// registerSubcommands attaches subcommands to a container command such as CONFIG,
+// whose specs are named "container|subcommand"
+func registerSubcommands(container *commandSpec, specs ...*commandSpec) {
+	if container.Subcommands == nil {
+		container.Subcommands = map[string]*commandSpec{}
+	}
+	for _, spec := range specs {
+		_, subcommand, _ := strings.Cut(spec.Name, "|")
+		container.Subcommands[strings.ToLower(subcommand)] = spec
+	}
+}
+
+func lookupCommand(name string) (*commandSpec, bool) {
+	spec, exists := commandTable[strings.ToLower(name)]
+	return spec, exists
+}
+
+// lookupCommandByFullName also resolves subcommands written as "container|subcommand"
+func lookupCommandByFullName(name string) (*commandSpec, bool) {
+	containerName, subcommand, isSubcommand := strings.Cut(strings.ToLower(name), "|")
+	spec, exists := lookupCommand(containerName)
+	if !exists || !isSubcommand {
+		return spec, exists
+	}
+
+	spec, exists = spec.Subcommands[subcommand]
+	return spec, exists
+}
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commandTable))
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+func (spec *commandSpec) sortedSubcommands() []*commandSpec {
+	names := make([]string, 0, len(spec.Subcommands))
+	for name := range spec.Subcommands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	subcommands := make([]*commandSpec, len(names))
+	for i, name := range names {
+		subcommands[i] = spec.Subcommands[name]
+	}
+	return subcommands
+}
+
+func (spec *commandSpec) aclCategories() []string {
+	categories := []string{}
+	if spec.hasFlag("write") {
+		categories = append(categories, "@write")
+	}
+	if spec.hasFlag("readonly") {
+		categories = append(categories, "@read")
+	}
+
+	switch spec.Group {
+	case "generic":
+		categories = append(categories, "@keyspace")
+	case "server":
+	case "transactions":
+		categories = append(categories, "@transaction")
+	default:
+		categories = append(categories, "@"+spec.Group)
+	}
+
+	if spec.hasFlag("fast") {
+		categories = append(categories, "@fast")
+	} else {
+		categories = append(categories, "@slow")
+	}
+	if spec.hasFlag("blocking") {
+		categories = append(categories, "@blocking")
+	}
+	if spec.hasFlag("admin") {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+
+	return categories
+}
+
+// encodeCommandInfo encodes a spec in the ten-element shape of COMMAND INFO
+func encodeCommandInfo(spec *commandSpec) []byte {
+	flags := [][]byte{}
+	for _, flag := range spec.Flags {
+		flags = append(flags, encodeSimpleString(flag))
+	}
+
+	categories := [][]byte{}
+	for _, category := range spec.aclCategories() {
+		categories = append(categories, encodeSimpleString(category))
+	}
+
+	subcommands := [][]byte{}
+	for _, subcommand := range spec.sortedSubcommands() {
+		subcommands = append(subcommands, encodeCommandInfo(subcommand))
+	}
+
+	return encodeArray([][]byte{
+		encodeBulkString(spec.Name),
+		encodeInteger(spec.Arity),
+		encodeArray(flags),
+		encodeInteger(spec.FirstKey),
+		encodeInteger(spec.LastKey),
+		encodeInteger(spec.KeyStep),
+		encodeArray(categories),
+		encodeArray(nil), // tips
+		encodeArray(nil), // key specifications
+		encodeArray(subcommands),
+	})
+}
+
+func encodeCommandDocs(protocol int, spec *commandSpec) []byte {
+	docs := [][]byte{
+		encodeBulkString("summary"), encodeBulkString(spec.Summary),
+		encodeBulkString("since"), encodeBulkString(spec.Since),
+		encodeBulkString("group"), encodeBulkString(spec.Group),
+	}
+
+	if len(spec.Subcommands) > 0 {
+		subcommands := [][]byte{}
+		for _, subcommand := range spec.sortedSubcommands() {
+			subcommands = append(subcommands, encodeBulkString(subcommand.Name), encodeCommandDocs(protocol, subcommand))
+		}
+		docs = append(docs, encodeBulkString("subcommands"), encodeMap(protocol, subcommands))
+	}
+
+	return encodeMap(protocol, docs)
+}
+
+func unknownCommandError(array []string) *commandError {
+	args := ""
+	for _, arg := range array[1:] {
+		args += fmt.Sprintf("'%s' ", arg)
+	}
+
+	return newCommandError("ERR", "unknown command '%s', with args beginning with: %s", array[0], args)
+}
+
+// resolveCommand finds the spec that should run for a command, descending into subcommands
+func resolveCommand(array []string) (*commandSpec, error) {
+	spec, exists := lookupCommand(array[0])
+	if !exists {
+		return nil, unknownCommandError(array)
+	}
+
+	if spec.Subcommands != nil && len(array) >= 2 {
+		subcommandSpec, exists := spec.Subcommands[strings.ToLower(array[1])]
+		if !exists {
+			return nil, newCommandError(
+				"ERR", "unknown subcommand '%s'. Try %s HELP.", array[1], strings.ToUpper(spec.Name),
+			)
+		}
+		spec = subcommandSpec
+	}
+
+	if !spec.arityMatches(len(array)) {
+		return nil, wrongArityError(spec.Name)
+	}
+
+	return spec, nil
+}
+
+// dispatchCommand runs a single command and returns the reply to send back, if any;
+// errors returned by handlers are encoded here, so every command reports them the same way
+func dispatchCommand(c *client, array []string) []byte {
+	if len(array) == 0 {
+		return nil
+	}
+
+	spec, err := resolveCommand(array)
+	if err == nil && spec.hasFlag("write") && configRepl["role"] == "slave" && !c.isMaster {
+		err = errReadOnly
+	}
+	if err == nil && (spec.hasFlag("write") || spec.Name == "ping") && !c.isMaster {
+		err = diskWriteError()
+	}
+	if err == nil {
+		err = subscribedContextError(c, spec)
+	}
+
+	if c.inMulti {
+		if output, queued := queueCommand(c, spec, array, err); queued {
+			return output
+		}
+	}
+	if err != nil {
+		return encodeCommandError(err)
+	}
+
+	output, err := executeCommand(c, spec, array)
+	if err != nil {
+		return encodeCommandError(err)
+	}
+
+	return output
+}
+
+func executeCommand(c *client, spec *commandSpec, array []string) ([]byte, error) {
+	if spec.hasFlag("blocking") || spec.Unlocked {
+		return spec.Handler(c, array)
+	}
+	if err := scriptBusyError(); err != nil && !c.isMaster {
+		return nil, err
+	}
+
+	executionLock.Lock()
+	defer executionLock.Unlock()
+
+	output, err := runCommand(c, spec, array)
+	serveBlockedClients()
+
+	return output, err
+}
+
+// runCommand runs a command under executionLock and replicates whatever it changed
+func runCommand(c *client, spec *commandSpec, array []string) ([]byte, error) {
+	selectDatabase(c)
+	dirtyBefore := dirtyCount()
+	c.propagateAs = nil
+
+	// read-only commands can look at entries shared with a snapshot without copying them
+	readOnly := readOnlyLookups
+	readOnlyLookups = spec.hasFlag("readonly") && !spec.hasFlag("may-replicate")
+	defer func() { readOnlyLookups = readOnly }()
+
+	output, err := spec.Handler(c, array)
+
+	// only writes (and reads that may update a value, like PFCOUNT) that changed the dataset are
+	// replicated, possibly rewritten by the handler into a deterministic form (e.g. relative
+	// expiries made absolute)
+	replicable := spec.hasFlag("write") || spec.hasFlag("may-replicate")
+	if err == nil && replicable && dirtyCount() != dirtyBefore {
+		if c.propagateAs == nil {
+			propagateToReplicas(array)
+		}
+		for _, command := range c.propagateAs {
+			propagateToReplicas(command)
+		}
+	}
+
+	return output, err
+}
+
+func init() {
+	configContainer := &commandSpec{
+		Name: "config", Arity: -2, Group: "server",
+		Summary: "A container for server configuration commands.", Since: "2.0.0",
+	}
+	commandContainer := &commandSpec{
+		Name: "command", Arity: -1, Flags: []string{"loading", "stale"}, Group: "server",
+		Summary: "Returns detailed information about all commands.", Since: "2.8.13",
+		Handler: handleCommand,
+	}
+
+	registerCommands(
+		&commandSpec{
+			Name: "ping", Arity: -1, Flags: []string{"fast", "stale"}, Group: "connection",
+			Summary: "Returns the server's liveliness response.", Since: "1.0.0",
+			Handler: handlePing,
+		},
+		&commandSpec{
+			Name: "quit", Arity: -1, Flags: []string{"noscript", "loading", "stale", "fast", "no_auth", "allow_busy"},
+			Group: "connection", Summary: "Closes the connection.", Since: "1.0.0",
+			Handler: handleQuit,
+		},
+		&commandSpec{
+			Name: "reset", Arity: 1, Flags: []string{"noscript", "loading", "stale", "fast", "no_auth", "allow_busy"},
+			Group: "connection", Summary: "Resets the connection.", Since: "6.2.0",
+			Handler: handleReset,
+		},
+		&commandSpec{
+			Name: "hello", Arity: -1, Flags: []string{"noscript", "loading", "stale", "fast"}, Group: "connection",
+			Summary: "Handshakes with the Redis server.", Since: "6.0.0",
+			Handler: handleHello,
+		},
+		&commandSpec{
+			Name: "select", Arity: 2, Flags: []string{"loading", "stale", "fast"}, Group: "connection",
+			Summary: "Changes the selected database.", Since: "1.0.0",
+			Handler: handleSelect,
+		},
+		&commandSpec{
+			Name: "echo", Arity: 2, Flags: []string{"fast", "loading", "stale"}, Group: "connection",
+			Summary: "Returns the given string.", Since: "1.0.0",
+			Handler: handleEcho,
+		},
+		&commandSpec{
+			Name: "keys", Arity: 2, Flags: []string{"readonly"}, Group: "generic",
+			Summary: "Returns all key names that match a pattern.", Since: "1.0.0",
+			Handler: handleKeys,
+		},
+		&commandSpec{
+			Name: "info", Arity: -1, Flags: []string{"loading", "stale"}, Group: "server",
+			Summary: "Returns information and statistics about the server.", Since: "1.0.0",
+			Handler: handleInfo,
+		},
+		&commandSpec{
+			Name: "replconf", Arity: -1, Flags: []string{"admin", "loading", "stale"}, Group: "server",
+			Summary: "An internal command for configuring the replication stream.", Since: "3.0.0",
+			Handler: handleReplconf,
+		},
+		&commandSpec{
+			Name: "psync", Arity: -3, Flags: []string{"admin", "noscript"}, Group: "server",
+			Summary: "An internal command used in replication.", Since: "2.8.0",
+			Handler: handlePsync,
+		},
+		&commandSpec{
+			Name: "wait", Arity: 3, Flags: []string{"blocking"}, Group: "generic",
+			Summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed.",
+			Since:   "3.0.0",
+			Handler: handleWait,
+		},
+		configContainer,
+		commandContainer,
+	)
+
+	registerSubcommands(configContainer,
+		&commandSpec{
+			Name: "config|get", Arity: -3, Flags: []string{"admin", "loading", "stale"}, Group: "server",
+			Summary: "Returns the effective values of configuration parameters.", Since: "2.0.0",
+			Handler: handleConfigGet,
+		},
+		&commandSpec{
+			Name: "config|set", Arity: -4, Flags: []string{"admin", "noscript", "loading", "stale"}, Group: "server",
+			Summary: "Sets configuration parameters in-flight.", Since: "2.0.0",
+			Handler: handleConfigSet,
+		},
+	)
+
+	registerSubcommands(commandContainer,
+		&commandSpec{
+			Name: "command|count", Arity: 2, Flags: []string{"loading", "stale"}, Group: "server",
+			Summary: "Returns a count of commands.", Since: "2.8.13",
+			Handler: handleCommandCount,
+		},
+		&commandSpec{
+			Name: "command|info", Arity: -2, Flags: []string{"loading", "stale"}, Group: "server",
+			Summary: "Returns information about one, multiple or all commands.", Since: "2.8.13",
+			Handler: handleCommandInfo,
+		},
+		&commandSpec{
+			Name: "command|docs", Arity: -2, Flags: []string{"loading", "stale"}, Group: "server",
+			Summary: "Returns documentary information about one, multiple or all commands.", Since: "7.0.0",
+			Handler: handleCommandDocs,
+		},
+	)
+}
@@ -5,145 +5,300 @@ import (
 	"math/rand"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func handshakeMaster(host, port string) error {
-	bytesProcessed := 0
-	receivedACk := false
+// replicaState tracks what this master knows about one of its replicas
+type replicaState struct {
+	ackOffset int
+}
+
+var replicasMu sync.Mutex
+var replicas = map[*client]*replicaState{}
+var masterReplOffset int
+
+// replicationDB is the database the replication stream last selected, or -1 to select one
+// before the next command, e.g. once a new replica has joined
+var replicationDB = -1
+
+// propagateToReplicas forwards a write command to every replica, advancing the replication offset,
+// and logs it to the append-only file. It applies to the selected database
+func propagateToReplicas(array []string) {
+	propagateInDatabase(store.id, array)
+}
+
+// propagateInDatabase propagates a command that applies to the given database, preceding
+// it with a SELECT wherever the stream last selected another one
+func propagateInDatabase(db int, array []string) {
+	if bufferingTransaction {
+		bufferedCommands = append(bufferedCommands, bufferedCommand{db, array})
+		return
+	}
+
+	// replicas log the commands they apply too
+	feedAppendOnlyFile(db, array)
+
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	if configRepl["role"] != "master" {
+		return
+	}
+
+	// queued rather than written, so a slow replica can't hold up the server; one that
+	// falls too far behind is disconnected
+	command := encodeBulkArray(array)
+	if db != replicationDB {
+		command = append(encodeBulkArray([]string{"SELECT", strconv.Itoa(db)}), command...)
+		replicationDB = db
+	}
+	for replica := range replicas {
+		if err := replica.send(command, replicaOutputLimit); err != nil {
+			fmt.Println("Problem: error thrown when writing to replica")
+		}
+	}
+
+	masterReplOffset += len(command)
+}
+
+func currentReplOffset() int {
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	return masterReplOffset
+}
+
+func removeReplica(c *client) {
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	delete(replicas, c)
+}
+
+func countAcknowledgingReplicas(offset int) int {
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
 
+	count := 0
+	for _, replica := range replicas {
+		if replica.ackOffset >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+func handleReplconf(c *client, array []string) ([]byte, error) {
+	if len(array) == 3 && strings.ToUpper(array[1]) == "ACK" {
+		ackOffset, err := strconv.Atoi(array[2])
+		if err != nil {
+			fmt.Println("Problem: could not convert replica acknowledgement bytes to an integer")
+			return nil, nil
+		}
+
+		replicasMu.Lock()
+		if replica, exists := replicas[c]; exists {
+			replica.ackOffset = ackOffset
+		}
+		replicasMu.Unlock()
+
+		// acknowledgements never get a reply
+		return nil, nil
+	}
+
+	return encodeSimpleString("OK"), nil
+}
+
+func handlePsync(c *client, array []string) ([]byte, error) {
+	resyncCommand := fmt.Sprintf(
+		"FULLRESYNC %s %d",
+		configRepl["replicationID"],
+		currentReplOffset(),
+	)
+
+	// send the current dataset, so the replica starts from the same state
+	snapshot := takeSnapshot()
+	binaryCode, err := encodeSnapshot(snapshot)
+	snapshot.release()
+	if err != nil {
+		return nil, newCommandError("ERR", "%s", err)
+	}
+
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	// queued here rather than returned, so that no propagated write can overtake the RDB file
+	if err := c.queue(encodeSimpleString(resyncCommand)); err != nil {
+		return nil, err
+	}
+	if err := c.queue(encodeRDBFile(len(binaryCode), binaryCode)); err != nil {
+		return nil, err
+	}
+
+	replicas[c] = &replicaState{}
+	// the new replica starts out in database 0, whichever the stream last selected
+	replicationDB = -1
+	return nil, nil
+}
+
+func handleWait(c *client, array []string) ([]byte, error) {
+	target, err := strconv.Atoi(array[1])
+	if err != nil {
+		return nil, errNotInteger
+	}
+	timeout, err := strconv.Atoi(array[2])
+	if err != nil {
+		return nil, newCommandError("ERR", "timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return nil, newCommandError("ERR", "timeout is negative")
+	}
+
+	offset := currentReplOffset()
+
+	// a transaction or script can't wait, so it just gets the current count
+	numAcknowledging := countAcknowledgingReplicas(offset)
+	if numAcknowledging >= target || c.denyBlocking {
+		return encodeInteger(numAcknowledging), nil
+	}
+
+	// ask every replica for its offset; their ACKs arrive on their own connections
+	executionLock.Lock()
+	propagateToReplicas([]string{"REPLCONF", "GETACK", "*"})
+	executionLock.Unlock()
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+
+	for {
+		numAcknowledging = countAcknowledgingReplicas(offset)
+		if numAcknowledging >= target || (!deadline.IsZero() && time.Now().After(deadline)) {
+			return encodeInteger(numAcknowledging), nil
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func handshakeMaster(host, port string) error {
 	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
 	if err != nil {
 		return err
 	}
-	// defer conn.Close()
 
-	readBuffer := make([]byte, 1024)
+	masterClient := newClient(conn)
+	masterClient.isMaster = true
 
 	// send PING to master
-	_, writeErr := conn.Write(encodeBulkArray([]string{"PING"}))
-	if writeErr != nil {
-		return writeErr
+	if err := masterClient.write(encodeBulkArray([]string{"PING"})); err != nil {
+		return err
 	}
-	_, readErr := conn.Read(readBuffer)
-	if readErr != nil {
-		return readErr
+	if _, err := masterClient.reader.readSimpleString(); err != nil {
+		return err
 	}
 
 	// send REPLCONF twice to the master
-	_, writeErr = conn.Write(encodeBulkArray([]string{"REPLCONF", "listening-port", configRepl["port"]}))
-	if writeErr != nil {
-		return writeErr
+	if err := masterClient.write(encodeBulkArray([]string{"REPLCONF", "listening-port", configRepl["port"]})); err != nil {
+		return err
 	}
-	_, readErr = conn.Read(readBuffer)
-	if readErr != nil {
-		return readErr
+	if _, err := masterClient.reader.readSimpleString(); err != nil {
+		return err
 	}
 
-	_, writeErr = conn.Write(encodeBulkArray([]string{"REPLCONF", "capa", "psync2"}))
-	if writeErr != nil {
-		return writeErr
+	if err := masterClient.write(encodeBulkArray([]string{"REPLCONF", "capa", "psync2"})); err != nil {
+		return err
 	}
-	_, readErr = conn.Read(readBuffer)
-	if readErr != nil {
-		return readErr
+	if _, err := masterClient.reader.readSimpleString(); err != nil {
+		return err
 	}
 
-	// send PSYNC to the master
-	_, writeErr = conn.Write(encodeBulkArray([]string{"PSYNC", "?", "-1"}))
-	if writeErr != nil {
-		return writeErr
+	// send PSYNC to the master, which replies with FULLRESYNC and its dataset
+	if err := masterClient.write(encodeBulkArray([]string{"PSYNC", "?", "-1"})); err != nil {
+		return err
 	}
-	n, readErr := conn.Read(readBuffer)
-	if readErr != nil {
-		return readErr
+	resync, err := masterClient.reader.readSimpleString()
+	if err != nil {
+		return err
+	}
+	// the stream continues from the master's offset at the time of the snapshot
+	fields := strings.Fields(resync)
+	if len(fields) != 3 || strings.ToUpper(fields[0]) != "FULLRESYNC" {
+		return fmt.Errorf("unexpected reply to PSYNC: %s", resync)
+	}
+	startOffset, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return fmt.Errorf("invalid offset in FULLRESYNC: %s", fields[2])
 	}
 
-	parsedArray, types, err := parseRESP(readBuffer[:n])
+	rdbFile, err := masterClient.reader.readRDBPayload()
 	if err != nil {
-		fmt.Println(err)
-		fmt.Println("Problem: error thrown when parsing RESP content from master")
+		fmt.Println("Problem: error thrown when reading RDB file from master")
 		return err
 	}
-
-	for i, arr := range parsedArray {
-		if len(arr) == 1 && types[i] == 0 {
-			writeRDBFile([]byte(arr[0]))
-		} else {
-			if sliceEquals(arr, []string{"REPLCONF", "GETACK", "*"}) {
-				conn.Write(encodeBulkArray([]string{"REPLCONF", "ACK", "0"}))
-				receivedACk = true
-				bytesProcessed += 37
-			}
-		}
+	executionLock.Lock()
+	err = loadRDBContents(rdbFile)
+	if err == nil {
+		err = restartAppendOnlyFile()
+	}
+	executionLock.Unlock()
+	if err != nil {
+		fmt.Println("Problem: error thrown when loading RDB file from master")
+		return err
 	}
 
-	go func() {
-		defer conn.Close()
-		masterReadBuffer := make([]byte, 1024)
-		for {
-			n, err := conn.Read(masterReadBuffer)
-			if err != nil {
-				fmt.Println(err)
-				fmt.Println("Problem: error reading from master connection")
-				return
-			}
+	go followMaster(masterClient, startOffset)
 
-			if n == 0 {
-				break
-			}
+	return nil
+}
 
-			// increment bytes processed
-			fmt.Println(string(readBuffer[:n]))
-			if receivedACk {
-				bytesProcessed += n
-			}
+// followMaster applies the replication stream, counting the bytes processed for REPLCONF ACK
+// on top of the offset the master reported with FULLRESYNC
+func followMaster(masterClient *client, startOffset int) {
+	defer masterClient.close()
 
-			masterParsedArray, types, err := parseRESP(masterReadBuffer[:n])
-			if err != nil {
-				fmt.Println("Problem: error thrown when parsing RESP content from master")
-				continue
-			}
+	masterClient.reader.bytesRead = 0
+	bytesProcessed := startOffset
 
-			for i, arr := range masterParsedArray {
-				if len(arr) == 1 && types[i] == 0 {
-					writeRDBFile([]byte(arr[0]))
-				} else {
-					if arr[0] == "SET" {
-						handleSet(arr) // no OK response back to master
-					} else if sliceEquals(arr, []string{"REPLCONF", "GETACK", "*"}) {
-						// don't count this REPLCONF command as part of the bytes processed
-						if !receivedACk {
-							receivedACk = true
-						} else {
-							bytesProcessed -= 37
-						}
-
-						bytesProcessedString := strconv.Itoa(bytesProcessed)
-
-						conn.Write(encodeBulkArray([]string{"REPLCONF", "ACK", bytesProcessedString}))
-
-						bytesProcessed += 37
-					}
-				}
+	for {
+		array, err := masterClient.reader.readCommand()
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Problem: error reading from master connection")
+			return
+		}
+
+		if len(array) == 3 && strings.ToUpper(array[0]) == "REPLCONF" && strings.ToUpper(array[1]) == "GETACK" {
+			// the offset reported excludes this REPLCONF command itself
+			ack := encodeBulkArray([]string{"REPLCONF", "ACK", strconv.Itoa(bytesProcessed)})
+			if err := masterClient.write(ack); err != nil {
+				fmt.Println("Problem: error thrown when writing to master")
+				return
 			}
+		} else {
+			// no response back to master
+			dispatchCommand(masterClient, array)
 		}
-	}()
 
-	return nil
+		bytesProcessed = startOffset + masterClient.reader.bytesRead
+	}
 }
 
-func sendReplInfo() []byte {
+func sendReplInfo() string {
 	heading := "# Replication\n"
 
 	result := fmt.Sprintf(
-		"%s\nrole:%s\nmaster_replid:%s\nmaster_repl_offset:%s",
+		"%s\nrole:%s\nmaster_replid:%s\nmaster_repl_offset:%d",
 		heading,
 		configRepl["role"],
 		configRepl["replicationID"],
-		configRepl["replicationOffset"],
+		currentReplOffset(),
 	)
 
-	return encodeBulkString(result)
+	return result
 }
 
 func randomAlphanumGenerator(length int) string {
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"unicode"
+)
+
+// maxBulkLength mirrors Redis's default proto-max-bulk-len of 512MB
+const maxBulkLength = 512 * 1024 * 1024
+
+// maxInlineLength caps inline commands and the header lines of other frames at 64KB,
+// like Redis's PROTO_INLINE_MAX_SIZE, so a peer can't make a line grow without bound
+const maxInlineLength = 64 * 1024
+
+// protocolError is returned for malformed input, after which the connection can't be trusted
+type protocolError struct {
+	reason string
+}
+
+func (e *protocolError) Error() string {
+	return "Protocol error: " + e.reason
+}
+
+func newProtocolError(format string, args ...any) error {
+	return &protocolError{reason: fmt.Sprintf(format, args...)}
+}
+
+// respValue is a single decoded RESP2 or RESP3 frame, identified by its type prefix
+type respValue struct {
+	Kind byte
+	// Str holds simple strings, errors, bulk and verbatim strings, and big numbers
+	Str string
+	// Format is the three-letter format of a verbatim string, e.g. "txt"
+	Format string
+	Int    int64
+	Double float64
+	Bool   bool
+	IsNull bool
+	// Elements holds arrays, sets and pushes, and maps as alternating keys and values
+	Elements []respValue
+	// Attributes holds any attribute frame sent ahead of this value, as alternating keys and values
+	Attributes []respValue
+}
+
+// respReader incrementally decodes RESP frames from a connection, buffering
+// partial frames until they are complete
+type respReader struct {
+	reader *bufio.Reader
+	// bytesRead counts every byte consumed so far, for replication offsets
+	bytesRead int
+}
+
+func newRESPReader(r io.Reader) *respReader {
+	return &respReader{reader: bufio.NewReaderSize(r, 16*1024)}
+}
+
+// readLine reads up to the next CRLF, returning the line without it
+func (r *respReader) readLine() ([]byte, error) {
+	line, err := r.readRawLine()
+	if err != nil {
+		return nil, err
+	}
+
+	r.bytesRead += len(line)
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, newProtocolError("expected CRLF line terminator")
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// readRawLine reads up to and including the next LF, failing once the line exceeds
+// maxInlineLength
+func (r *respReader) readRawLine() ([]byte, error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// the line is longer than the buffer, so collect it piece by piece
+		longLine := append([]byte{}, line...)
+		for err == bufio.ErrBufferFull {
+			if len(longLine) > maxInlineLength {
+				return nil, newProtocolError("too big inline request")
+			}
+			line, err = r.reader.ReadSlice('\n')
+			longLine = append(longLine, line...)
+		}
+		line = longLine
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) > maxInlineLength {
+		return nil, newProtocolError("too big inline request")
+	}
+
+	return line, nil
+}
+
+func (r *respReader) readLength() (int, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+
+	length, err := strconv.Atoi(string(line))
+	if err != nil {
+		return 0, newProtocolError("invalid length '%s'", line)
+	}
+
+	return length, nil
+}
+
+// readBulk reads a bulk payload of a known length, followed by its CRLF
+func (r *respReader) readBulk(length int) ([]byte, error) {
+	if length > maxBulkLength {
+		return nil, newProtocolError("invalid bulk length")
+	}
+
+	payload := make([]byte, length+2)
+	if _, err := io.ReadFull(r.reader, payload); err != nil {
+		return nil, err
+	}
+	r.bytesRead += len(payload)
+
+	if payload[length] != '\r' || payload[length+1] != '\n' {
+		return nil, newProtocolError("expected CRLF after bulk string")
+	}
+
+	return payload[:length], nil
+}
+
+// readCommand reads one complete command, either as an array of bulk strings or as an
+// inline command (e.g. "SET key value" typed into telnet)
+func (r *respReader) readCommand() ([]string, error) {
+	peeked, err := r.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if peeked[0] != '*' {
+		return r.readInlineCommand()
+	}
+
+	r.reader.ReadByte()
+	r.bytesRead++
+
+	numElements, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if numElements > 1024*1024 {
+		return nil, newProtocolError("invalid multibulk length")
+	}
+
+	array := make([]string, 0, max(numElements, 0))
+	for range numElements {
+		prefix, err := r.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		r.bytesRead++
+
+		if prefix != '$' {
+			return nil, newProtocolError("expected '$', got '%c'", prefix)
+		}
+
+		length, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, newProtocolError("invalid bulk length")
+		}
+
+		element, err := r.readBulk(length)
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, string(element))
+	}
+
+	return array, nil
+}
+
+func (r *respReader) readInlineCommand() ([]string, error) {
+	line, err := r.readRawLine()
+	if err != nil {
+		return nil, err
+	}
+	r.bytesRead += len(line)
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	array, err := splitInlineArgs(string(line))
+	if err != nil {
+		return nil, newProtocolError("unbalanced quotes in request")
+	}
+
+	return array, nil
+}
+
+// splitInlineArgs splits a line into arguments the way redis-cli does, honouring
+// "double quotes" (with escapes such as \n and \x41) and 'single quotes'
+func splitInlineArgs(line string) ([]string, error) {
+	args := []string{}
+	i := 0
+
+	for {
+		for i < len(line) && unicode.IsSpace(rune(line[i])) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var current []byte
+		inDoubleQuotes, inSingleQuotes := false, false
+		done := false
+
+		for !done {
+			if i == len(line) {
+				if inDoubleQuotes || inSingleQuotes {
+					return nil, errors.New("unbalanced quotes")
+				}
+				break
+			}
+
+			ch := line[i]
+			switch {
+			case inDoubleQuotes:
+				if ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					value, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(value))
+					i += 3
+				} else if ch == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				} else if ch == '"' {
+					// the closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !unicode.IsSpace(rune(line[i+1])) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				} else {
+					current = append(current, ch)
+				}
+			case inSingleQuotes:
+				if ch == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current = append(current, '\'')
+				} else if ch == '\'' {
+					if i+1 < len(line) && !unicode.IsSpace(rune(line[i+1])) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				} else {
+					current = append(current, ch)
+				}
+			default:
+				switch ch {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					current = append(current, ch)
+				}
+			}
+
+			i++
+		}
+
+		args = append(args, string(current))
+	}
+}
+
+func isHexDigit(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+// readValue reads one complete frame of any RESP2 or RESP3 type
+func (r *respReader) readValue() (respValue, error) {
+	prefix, err := r.reader.ReadByte()
+	if err != nil {
+		return respValue{}, err
+	}
+	r.bytesRead++
+
+	value := respValue{Kind: prefix}
+
+	switch prefix {
+	case '+', '-':
+		line, err := r.readLine()
+		if err != nil {
+			return value, err
+		}
+		value.Str = string(line)
+	case ':':
+		line, err := r.readLine()
+		if err != nil {
+			return value, err
+		}
+		value.Int, err = strconv.ParseInt(string(line), 10, 64)
+		if err != nil {
+			return value, newProtocolError("invalid integer '%s'", line)
+		}
+	case '$', '!', '=':
+		length, err := r.readLength()
+		if err != nil {
+			return value, err
+		}
+		if length < 0 {
+			value.IsNull = true
+			return value, nil
+		}
+
+		payload, err := r.readBulk(length)
+		if err != nil {
+			return value, err
+		}
+		value.Str = string(payload)
+
+		if prefix == '=' {
+			if len(payload) < 4 || payload[3] != ':' {
+				return value, newProtocolError("invalid verbatim string")
+			}
+			value.Format, value.Str = string(payload[:3]), string(payload[4:])
+		}
+	case '_':
+		if _, err := r.readLine(); err != nil {
+			return value, err
+		}
+		value.IsNull = true
+	case ',':
+		line, err := r.readLine()
+		if err != nil {
+			return value, err
+		}
+		value.Double, err = parseDouble(string(line))
+		if err != nil {
+			return value, newProtocolError("invalid double '%s'", line)
+		}
+	case '#':
+		line, err := r.readLine()
+		if err != nil {
+			return value, err
+		}
+		if len(line) != 1 || (line[0] != 't' && line[0] != 'f') {
+			return value, newProtocolError("invalid boolean '%s'", line)
+		}
+		value.Bool = line[0] == 't'
+	case '(':
+		line, err := r.readLine()
+		if err != nil {
+			return value, err
+		}
+		if _, ok := new(big.Int).SetString(string(line), 10); !ok {
+			return value, newProtocolError("invalid big number '%s'", line)
+		}
+		value.Str = string(line)
+	case '*', '~', '>', '%', '|':
+		length, err := r.readLength()
+		if err != nil {
+			return value, err
+		}
+		if length < 0 {
+			value.IsNull = true
+			return value, nil
+		}
+
+		numElements := length
+		if prefix == '%' || prefix == '|' {
+			numElements *= 2
+		}
+
+		value.Elements = make([]respValue, 0, numElements)
+		for range numElements {
+			element, err := r.readValue()
+			if err != nil {
+				return value, err
+			}
+			value.Elements = append(value.Elements, element)
+		}
+
+		// attributes describe the value that follows them
+		if prefix == '|' {
+			attributed, err := r.readValue()
+			if err != nil {
+				return value, err
+			}
+			attributed.Attributes = value.Elements
+			return attributed, nil
+		}
+	default:
+		return value, newProtocolError("unexpected type prefix '%c'", prefix)
+	}
+
+	return value, nil
+}
+
+// readSimpleString reads a "+..." status reply, such as those sent during the replication handshake
+func (r *respReader) readSimpleString() (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) == 0 || line[0] != '+' {
+		return "", newProtocolError("expected a simple string, got '%s'", line)
+	}
+
+	return string(line[1:]), nil
+}
+
+// readRDBPayload reads an RDB file sent during a full resync, which is framed like
+// a bulk string but without the trailing CRLF
+func (r *respReader) readRDBPayload() ([]byte, error) {
+	prefix, err := r.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	r.bytesRead++
+
+	if prefix != '$' {
+		return nil, newProtocolError("expected '$' before RDB file, got '%c'", prefix)
+	}
+
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || length > maxBulkLength {
+		return nil, newProtocolError("invalid RDB file length")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, payload); err != nil {
+		return nil, err
+	}
+	r.bytesRead += length
+
+	return payload, nil
+}
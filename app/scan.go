@@ -0,0 +1,214 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+var scanSeed = maphash.MakeSeed()
+
+const minScanBuckets = 4
+
+// scanTable indexes a set of names by hash bucket, so that they can be iterated with a
+// stateless cursor. Go maps can't be iterated incrementally, so collections that support
+// the SCAN family keep one of these alongside their map
+type scanTable struct {
+	buckets [][]string
+	count   int
+}
+
+func newScanTable() *scanTable {
+	return &scanTable{buckets: make([][]string, minScanBuckets)}
+}
+
+func (t *scanTable) bucketIndex(name string, size int) int {
+	return int(maphash.String(scanSeed, name) & uint64(size-1))
+}
+
+// add inserts a name, which the caller guarantees isn't already present
+func (t *scanTable) add(name string) {
+	i := t.bucketIndex(name, len(t.buckets))
+	t.buckets[i] = append(t.buckets[i], name)
+	t.count++
+
+	if t.count > len(t.buckets) {
+		t.resize(len(t.buckets) * 2)
+	}
+}
+
+func (t *scanTable) remove(name string) {
+	i := t.bucketIndex(name, len(t.buckets))
+	bucket := t.buckets[i]
+	for j, candidate := range bucket {
+		if candidate == name {
+			bucket[j] = bucket[len(bucket)-1]
+			t.buckets[i] = bucket[:len(bucket)-1]
+			t.count--
+			break
+		}
+	}
+
+	if len(t.buckets) > minScanBuckets && t.count*10 < len(t.buckets) {
+		t.resize(len(t.buckets) / 2)
+	}
+}
+
+func (t *scanTable) resize(size int) {
+	buckets := make([][]string, size)
+	for _, bucket := range t.buckets {
+		for _, name := range bucket {
+			i := t.bucketIndex(name, size)
+			buckets[i] = append(buckets[i], name)
+		}
+	}
+
+	t.buckets = buckets
+}
+
+// scan visits every name in the bucket addressed by cursor and returns the next cursor,
+// which is 0 once the iteration is complete. Like Redis, the cursor's bits are incremented
+// in reverse order, so buckets already visited stay visited when the table is resized
+// between calls, and every name present throughout an iteration is returned at least once
+func (t *scanTable) scan(cursor uint64, visit func(name string)) uint64 {
+	mask := uint64(len(t.buckets) - 1)
+	for _, name := range t.buckets[cursor&mask] {
+		visit(name)
+	}
+
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	cursor = bits.Reverse64(cursor)
+
+	return cursor
+}
+
+// scanBatch visits buckets from cursor onwards until at least count names are found (or ten
+// times that many buckets come up empty), returning the names and the next cursor
+func (t *scanTable) scanBatch(cursor uint64, count int) (uint64, []string) {
+	names := []string{}
+	for maxIterations := count * 10; maxIterations > 0 && len(names) < count; maxIterations-- {
+		cursor = t.scan(cursor, func(name string) {
+			names = append(names, name)
+		})
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return cursor, names
+}
+
+// each visits every name in a stable order, so separate enumerations (e.g. HKEYS and HVALS) agree
+func (t *scanTable) each(visit func(name string)) {
+	for _, bucket := range t.buckets {
+		for _, name := range bucket {
+			visit(name)
+		}
+	}
+}
+
+// scanOptions holds the options shared by SCAN, HSCAN, SSCAN and ZSCAN
+type scanOptions struct {
+	cursor   uint64
+	pattern  string
+	count    int
+	typeName string
+	noValues bool
+}
+
+// parseScanOptions parses the arguments from the cursor onwards; TYPE is only accepted by
+// SCAN, and NOVALUES only by HSCAN
+func parseScanOptions(command string, args []string) (*scanOptions, error) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, newCommandError("ERR", "invalid cursor")
+	}
+
+	options := &scanOptions{cursor: cursor, count: 10}
+	for i := 1; i < len(args); i += 2 {
+		option := strings.ToUpper(args[i])
+		if option == "NOVALUES" && strings.EqualFold(command, "hscan") {
+			options.noValues = true
+			i-- // NOVALUES takes no argument
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, errSyntax
+		}
+
+		switch option {
+		case "MATCH":
+			options.pattern = args[i+1]
+		case "COUNT":
+			count, ok := parseInteger(args[i+1])
+			if !ok {
+				return nil, errNotInteger
+			}
+			if count < 1 {
+				return nil, errSyntax
+			}
+			options.count = int(min(count, 1<<30))
+		case "TYPE":
+			if !strings.EqualFold(command, "scan") {
+				return nil, errSyntax
+			}
+			if _, ok := parseValueType(args[i+1]); !ok {
+				return nil, newCommandError("ERR", "unknown type name '%s'", args[i+1])
+			}
+			options.typeName = args[i+1]
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	return options, nil
+}
+
+// matches applies the MATCH option; a pattern of "*" matches every name, even an empty one
+func (o *scanOptions) matches(name string) bool {
+	return o.pattern == "" || o.pattern == "*" || globMatch(o.pattern, name)
+}
+
+func encodeScanReply(cursor uint64, items []string) []byte {
+	return encodeArray([][]byte{
+		encodeBulkString(strconv.FormatUint(cursor, 10)),
+		encodeBulkArray(items),
+	})
+}
+
+func handleScan(c *client, array []string) ([]byte, error) {
+	options, err := parseScanOptions(array[0], array[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, keys := store.scan(options.cursor, options.count)
+
+	results := []string{}
+	for _, key := range keys {
+		// looking the key up also evicts it if it has expired
+		e, exists := store.get(key)
+		if !exists || !options.matches(key) {
+			continue
+		}
+		if options.typeName != "" && !strings.EqualFold(e.Type.String(), options.typeName) {
+			continue
+		}
+		results = append(results, key)
+	}
+
+	return encodeScanReply(cursor, results), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "scan", Arity: -2, Flags: []string{"readonly"}, Group: "generic",
+			Summary: "Iterates over the key names in the database.", Since: "2.8.0",
+			Handler: handleScan,
+		},
+	)
+}
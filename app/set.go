@@ -0,0 +1,686 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// setMaxIntsetEntries mirrors Redis's default set-max-intset-entries
+const setMaxIntsetEntries = 512
+
+// setValue is an unordered set of distinct members. While every member is an integer (and
+// there are few enough of them) they're kept in a compact intset; otherwise in a map
+type setValue struct {
+	ints    *intset
+	members map[string]struct{}
+	// index lets SSCAN iterate over a map-encoded set
+	index *scanTable
+}
+
+func newSetValue() *setValue {
+	return &setValue{ints: newIntset()}
+}
+
+func (s *setValue) len() int {
+	if s.ints != nil {
+		return s.ints.len()
+	}
+	return len(s.members)
+}
+
+func (s *setValue) contains(member string) bool {
+	if s.ints != nil {
+		value, ok := parseInteger(member)
+		return ok && s.ints.contains(value)
+	}
+
+	_, exists := s.members[member]
+	return exists
+}
+
+// convert moves the members out of the intset, once a member that doesn't fit is added
+func (s *setValue) convert() {
+	s.members = make(map[string]struct{}, s.ints.len())
+	s.index = newScanTable()
+	for i := 0; i < s.ints.len(); i++ {
+		member := strconv.FormatInt(s.ints.get(i), 10)
+		s.members[member] = struct{}{}
+		s.index.add(member)
+	}
+	s.ints = nil
+}
+
+func (s *setValue) add(member string) bool {
+	if s.ints != nil {
+		value, ok := parseInteger(member)
+		if ok && s.ints.contains(value) {
+			return false
+		}
+		if ok && s.ints.len() < setMaxIntsetEntries {
+			return s.ints.add(value)
+		}
+		s.convert()
+	}
+
+	if _, exists := s.members[member]; exists {
+		return false
+	}
+	s.members[member] = struct{}{}
+	s.index.add(member)
+	return true
+}
+
+func (s *setValue) remove(member string) bool {
+	if s.ints != nil {
+		value, ok := parseInteger(member)
+		return ok && s.ints.remove(value)
+	}
+
+	if _, exists := s.members[member]; !exists {
+		return false
+	}
+	delete(s.members, member)
+	s.index.remove(member)
+	return true
+}
+
+// each visits the members in a stable order, which is ascending for an intset
+func (s *setValue) each(visit func(member string)) {
+	if s.ints != nil {
+		for i := 0; i < s.ints.len(); i++ {
+			visit(strconv.FormatInt(s.ints.get(i), 10))
+		}
+		return
+	}
+
+	s.index.each(visit)
+}
+
+func (s *setValue) slice() []string {
+	members := make([]string, 0, s.len())
+	s.each(func(member string) {
+		members = append(members, member)
+	})
+
+	return members
+}
+
+func (s *setValue) random() string {
+	if s.ints != nil {
+		return strconv.FormatInt(s.ints.get(rand.Intn(s.ints.len())), 10)
+	}
+
+	// map iteration order is randomised, so the first member is a random one
+	for member := range s.members {
+		return member
+	}
+	return ""
+}
+
+func (s *setValue) clone() *setValue {
+	if s.ints != nil {
+		return &setValue{ints: s.ints.clone()}
+	}
+
+	copied := &setValue{members: make(map[string]struct{}, len(s.members)), index: newScanTable()}
+	s.each(func(member string) {
+		copied.members[member] = struct{}{}
+		copied.index.add(member)
+	})
+	return copied
+}
+
+// getSet looks up a set for reading or modifying; a missing key gives a nil set
+func getSet(key string) (*setValue, error) {
+	e, err := store.getTyped(key, setType)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	return e.Value.(*setValue), nil
+}
+
+// setChanged records a modification of the set at key, deleting it once it's empty
+func setChanged(key string, s *setValue) {
+	if s.len() == 0 {
+		store.delete(key)
+	} else {
+		store.modified(key)
+	}
+}
+
+// storeSet replaces whatever is held at key with a set, or deletes the key if the set is empty
+func storeSet(key string, s *setValue) {
+	if s.len() == 0 {
+		store.delete(key)
+		return
+	}
+
+	store.set(key, &entry{Type: setType, Value: s})
+}
+
+func encodeMembers(protocol int, members []string) []byte {
+	encoded := make([][]byte, len(members))
+	for i, member := range members {
+		encoded[i] = encodeBulkString(member)
+	}
+
+	return encodeSet(protocol, encoded)
+}
+
+func handleSAdd(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	s, err := getSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	created := s == nil
+	if created {
+		s = newSetValue()
+	}
+
+	added := 0
+	for _, member := range array[2:] {
+		if s.add(member) {
+			added++
+		}
+	}
+
+	if created {
+		store.set(key, &entry{Type: setType, Value: s})
+	} else if added > 0 {
+		store.modified(key)
+	}
+
+	return encodeInteger(added), nil
+}
+
+func handleSRem(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	s, err := getSet(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return encodeInteger(0), nil
+	}
+
+	removed := 0
+	for _, member := range array[2:] {
+		if s.remove(member) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		setChanged(key, s)
+	}
+
+	return encodeInteger(removed), nil
+}
+
+func handleSIsMember(c *client, array []string) ([]byte, error) {
+	s, err := getSet(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if s != nil && s.contains(array[2]) {
+		return encodeInteger(1), nil
+	}
+	return encodeInteger(0), nil
+}
+
+func handleSMIsMember(c *client, array []string) ([]byte, error) {
+	s, err := getSet(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([][]byte, len(array)-2)
+	for i, member := range array[2:] {
+		if s != nil && s.contains(member) {
+			results[i] = encodeInteger(1)
+		} else {
+			results[i] = encodeInteger(0)
+		}
+	}
+
+	return encodeArray(results), nil
+}
+
+func handleSMembers(c *client, array []string) ([]byte, error) {
+	s, err := getSet(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return encodeSet(c.protocol, nil), nil
+	}
+
+	return encodeMembers(c.protocol, s.slice()), nil
+}
+
+func handleSCard(c *client, array []string) ([]byte, error) {
+	s, err := getSet(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return encodeInteger(0), nil
+	}
+
+	return encodeInteger(s.len()), nil
+}
+
+func handleSPop(c *client, array []string) ([]byte, error) {
+	if len(array) > 3 {
+		return nil, errSyntax
+	}
+
+	key := array[1]
+	hasCount := len(array) == 3
+
+	var count int64
+	if hasCount {
+		var ok bool
+		count, ok = parseInteger(array[2])
+		if !ok || count < 0 {
+			return nil, errNotPositive
+		}
+	}
+
+	s, err := getSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasCount {
+		if s == nil {
+			return encodeNull(c.protocol), nil
+		}
+
+		member := s.random()
+		s.remove(member)
+		setChanged(key, s)
+
+		// replicas are told which member was picked, so they remove the same one
+		c.propagateAs = [][]string{{"SREM", key, member}}
+		return encodeBulkString(member), nil
+	}
+
+	if s == nil || count == 0 {
+		return encodeSet(c.protocol, nil), nil
+	}
+
+	if count >= int64(s.len()) {
+		members := s.slice()
+		store.delete(key)
+
+		c.propagateAs = [][]string{{"DEL", key}}
+		return encodeMembers(c.protocol, members), nil
+	}
+
+	members := make([]string, 0, count)
+	for ; count > 0; count-- {
+		member := s.random()
+		s.remove(member)
+		members = append(members, member)
+	}
+	setChanged(key, s)
+
+	c.propagateAs = [][]string{append([]string{"SREM", key}, members...)}
+	return encodeMembers(c.protocol, members), nil
+}
+
+func handleSRandMember(c *client, array []string) ([]byte, error) {
+	if len(array) > 3 {
+		return nil, errSyntax
+	}
+
+	hasCount := len(array) == 3
+
+	var count int64
+	if hasCount {
+		var ok bool
+		count, ok = parseInteger(array[2])
+		if !ok {
+			return nil, errNotInteger
+		}
+		if count == math.MinInt64 {
+			return nil, newCommandError("ERR", "value is out of range")
+		}
+	}
+
+	s, err := getSet(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasCount {
+		if s == nil {
+			return encodeNull(c.protocol), nil
+		}
+		return encodeBulkString(s.random()), nil
+	}
+	if s == nil || count == 0 {
+		return encodeArray(nil), nil
+	}
+
+	// a negative count allows the same member to be returned more than once
+	members := []string{}
+	if count < 0 {
+		all := s.slice()
+		for ; count < 0; count++ {
+			members = append(members, all[rand.Intn(len(all))])
+		}
+	} else {
+		members = s.slice()
+		rand.Shuffle(len(members), func(i, j int) {
+			members[i], members[j] = members[j], members[i]
+		})
+		members = members[:min(int64(len(members)), count)]
+	}
+
+	return encodeBulkArray(members), nil
+}
+
+func handleSMove(c *client, array []string) ([]byte, error) {
+	source, destination, member := array[1], array[2], array[3]
+
+	s, err := getSet(source)
+	if err != nil {
+		return nil, err
+	}
+	target, err := getSet(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if s == nil || !s.contains(member) {
+		return encodeInteger(0), nil
+	}
+	if source == destination {
+		return encodeInteger(1), nil
+	}
+
+	s.remove(member)
+	setChanged(source, s)
+
+	if target == nil {
+		target = newSetValue()
+		target.add(member)
+		store.set(destination, &entry{Type: setType, Value: target})
+	} else if target.add(member) {
+		store.modified(destination)
+	}
+
+	return encodeInteger(1), nil
+}
+
+// getSets looks up every key for a set operation, with nil standing in for missing keys
+func getSets(keys []string) ([]*setValue, error) {
+	sets := make([]*setValue, len(keys))
+	for i, key := range keys {
+		s, err := getSet(key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = s
+	}
+
+	return sets, nil
+}
+
+// intersectSets returns the members common to every set, stopping once limit members
+// are found (zero meaning no limit)
+func intersectSets(sets []*setValue, limit int) *setValue {
+	result := newSetValue()
+	if slices.Contains(sets, nil) {
+		return result
+	}
+
+	// checking the members of the smallest set against the others does the least work
+	sets = slices.Clone(sets)
+	slices.SortFunc(sets, func(a, b *setValue) int {
+		return a.len() - b.len()
+	})
+
+	sets[0].each(func(member string) {
+		if limit > 0 && result.len() >= limit {
+			return
+		}
+		for _, other := range sets[1:] {
+			if !other.contains(member) {
+				return
+			}
+		}
+		result.add(member)
+	})
+
+	return result
+}
+
+func unionSets(sets []*setValue) *setValue {
+	result := newSetValue()
+	for _, s := range sets {
+		if s != nil {
+			s.each(func(member string) {
+				result.add(member)
+			})
+		}
+	}
+
+	return result
+}
+
+// diffSets returns the members of the first set that aren't in any of the others
+func diffSets(sets []*setValue) *setValue {
+	result := newSetValue()
+	if sets[0] == nil {
+		return result
+	}
+
+	sets[0].each(func(member string) {
+		for _, other := range sets[1:] {
+			if other != nil && other.contains(member) {
+				return
+			}
+		}
+		result.add(member)
+	})
+
+	return result
+}
+
+// handleSetOperation implements SINTER, SUNION and SDIFF, along with their STORE variants
+func handleSetOperation(c *client, array []string) ([]byte, error) {
+	command := strings.ToLower(array[0])
+	storing := strings.HasSuffix(command, "store")
+
+	keys := array[1:]
+	if storing {
+		keys = array[2:]
+	}
+
+	sets, err := getSets(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *setValue
+	switch strings.TrimSuffix(command, "store") {
+	case "sinter":
+		result = intersectSets(sets, 0)
+	case "sunion":
+		result = unionSets(sets)
+	default:
+		result = diffSets(sets)
+	}
+
+	if storing {
+		storeSet(array[1], result)
+		return encodeInteger(result.len()), nil
+	}
+	return encodeMembers(c.protocol, result.slice()), nil
+}
+
+func handleSInterCard(c *client, array []string) ([]byte, error) {
+	numKeys, ok := parseInteger(array[1])
+	if !ok || numKeys <= 0 {
+		return nil, newCommandError("ERR", "numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(array)-2) {
+		return nil, newCommandError("ERR", "Number of keys can't be greater than number of args")
+	}
+
+	var limit int64
+	rest := array[2+numKeys:]
+	for i := 0; i < len(rest); i += 2 {
+		if !strings.EqualFold(rest[i], "LIMIT") || i+1 >= len(rest) {
+			return nil, errSyntax
+		}
+		limit, ok = parseInteger(rest[i+1])
+		if !ok {
+			return nil, errNotInteger
+		}
+		if limit < 0 {
+			return nil, newCommandError("ERR", "LIMIT can't be negative")
+		}
+	}
+
+	sets, err := getSets(array[2 : 2+numKeys])
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeInteger(intersectSets(sets, int(min(limit, math.MaxInt32))).len()), nil
+}
+
+func handleSScan(c *client, array []string) ([]byte, error) {
+	options, err := parseScanOptions(array[0], array[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := getSet(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return encodeScanReply(0, nil), nil
+	}
+
+	// an intset is small enough to be returned in one go, as Redis does
+	var cursor uint64
+	var members []string
+	if s.ints != nil {
+		members = s.slice()
+	} else {
+		cursor, members = s.index.scanBatch(options.cursor, options.count)
+	}
+
+	results := []string{}
+	for _, member := range members {
+		if options.matches(member) {
+			results = append(results, member)
+		}
+	}
+
+	return encodeScanReply(cursor, results), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "sadd", Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Adds one or more members to a set. Creates the key if it doesn't exist.", Since: "1.0.0",
+			Handler: handleSAdd,
+		},
+		&commandSpec{
+			Name: "srem", Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Removes one or more members from a set. Deletes the set if the last member was removed.",
+			Since: "1.0.0", Handler: handleSRem,
+		},
+		&commandSpec{
+			Name: "sismember", Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Determines whether a member belongs to a set.", Since: "1.0.0",
+			Handler: handleSIsMember,
+		},
+		&commandSpec{
+			Name: "smismember", Arity: -3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Determines whether multiple members belong to a set.", Since: "6.2.0",
+			Handler: handleSMIsMember,
+		},
+		&commandSpec{
+			Name: "smembers", Arity: 2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Returns all members of a set.", Since: "1.0.0",
+			Handler: handleSMembers,
+		},
+		&commandSpec{
+			Name: "scard", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Returns the number of members in a set.", Since: "1.0.0",
+			Handler: handleSCard,
+		},
+		&commandSpec{
+			Name: "spop", Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Returns one or more random members from a set after removing them. Deletes the set if the last member was popped.",
+			Since: "1.0.0", Handler: handleSPop,
+		},
+		&commandSpec{
+			Name: "srandmember", Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Get one or multiple random members from a set", Since: "1.0.0",
+			Handler: handleSRandMember,
+		},
+		&commandSpec{
+			Name: "smove", Arity: 4, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "set", Summary: "Moves a member from one set to another.", Since: "1.0.0",
+			Handler: handleSMove,
+		},
+		&commandSpec{
+			Name: "sinter", Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Returns the intersect of multiple sets.", Since: "1.0.0",
+			Handler: handleSetOperation,
+		},
+		&commandSpec{
+			Name: "sintercard", Arity: -3, Flags: []string{"readonly"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "set", Summary: "Returns the number of members of the intersect of multiple sets.", Since: "7.0.0",
+			Handler: handleSInterCard,
+		},
+		&commandSpec{
+			Name: "sinterstore", Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Stores the intersect of multiple sets in a key.", Since: "1.0.0",
+			Handler: handleSetOperation,
+		},
+		&commandSpec{
+			Name: "sunion", Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Returns the union of multiple sets.", Since: "1.0.0",
+			Handler: handleSetOperation,
+		},
+		&commandSpec{
+			Name: "sunionstore", Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Stores the union of multiple sets in a key.", Since: "1.0.0",
+			Handler: handleSetOperation,
+		},
+		&commandSpec{
+			Name: "sdiff", Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Returns the difference of multiple sets.", Since: "1.0.0",
+			Handler: handleSetOperation,
+		},
+		&commandSpec{
+			Name: "sdiffstore", Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Stores the difference of multiple sets in a key.", Since: "1.0.0",
+			Handler: handleSetOperation,
+		},
+		&commandSpec{
+			Name: "sscan", Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Iterates over members of a set.", Since: "2.8.0",
+			Handler: handleSScan,
+		},
+	)
+}
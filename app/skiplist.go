@@ -0,0 +1,376 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// the skiplist follows Redis's zskiplist: nodes are ordered by score, then by member, and
+// each level records how many nodes its forward pointer skips, so ranks take O(log n)
+const (
+	skiplistMaxLevel    = 32
+	skiplistProbability = 0.25
+)
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomSkiplistLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistProbability {
+		level++
+	}
+
+	return level
+}
+
+// precedes reports whether node sorts before the given score and member
+func (node *skiplistNode) precedes(score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+// insert adds a member, which the caller guarantees isn't already present
+func (zsl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.precedes(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomSkiplistLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+
+	// levels above the new node now skip over it too
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+
+	return x
+}
+
+func (zsl *skiplist) deleteNode(x *skiplistNode, update []*skiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// findUpdates returns, for each level, the last node before the given score and member
+func (zsl *skiplist) findUpdates(score float64, member string) []*skiplistNode {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.precedes(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	return update
+}
+
+func (zsl *skiplist) delete(score float64, member string) bool {
+	update := zsl.findUpdates(score, member)
+
+	x := update[0].level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	zsl.deleteNode(x, update)
+	return true
+}
+
+// updateScore moves a member to its new score, reusing its node when its position is unchanged
+func (zsl *skiplist) updateScore(score float64, member string, newScore float64) *skiplistNode {
+	update := zsl.findUpdates(score, member)
+	x := update[0].level[0].forward
+
+	if (x.backward == nil || x.backward.score < newScore) &&
+		(x.level[0].forward == nil || x.level[0].forward.score > newScore) {
+		x.score = newScore
+		return x
+	}
+
+	zsl.deleteNode(x, update)
+	return zsl.insert(newScore, member)
+}
+
+// rank returns the 1-based rank of a member, or 0 if it isn't present
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.precedes(score, member) ||
+				(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+
+	return 0
+}
+
+// byRank returns the node at a 1-based rank
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+
+	return nil
+}
+
+// scoreRange is a range of scores, either end of which can be exclusive
+type scoreRange struct {
+	min, max                   float64
+	minExclusive, maxExclusive bool
+}
+
+func (r *scoreRange) aboveMin(score float64) bool {
+	if r.minExclusive {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r *scoreRange) belowMax(score float64) bool {
+	if r.maxExclusive {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+func (zsl *skiplist) overlapsScores(r *scoreRange) bool {
+	if r.min > r.max || (r.min == r.max && (r.minExclusive || r.maxExclusive)) {
+		return false
+	}
+	if zsl.tail == nil || !r.aboveMin(zsl.tail.score) {
+		return false
+	}
+
+	first := zsl.header.level[0].forward
+	return first != nil && r.belowMax(first.score)
+}
+
+// firstInScoreRange returns the lowest node within the range, if there is one
+func (zsl *skiplist) firstInScoreRange(r *scoreRange) *skiplistNode {
+	if !zsl.overlapsScores(r) {
+		return nil
+	}
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !r.belowMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+// lastInScoreRange returns the highest node within the range, if there is one
+func (zsl *skiplist) lastInScoreRange(r *scoreRange) *skiplistNode {
+	if !zsl.overlapsScores(r) {
+		return nil
+	}
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.belowMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == zsl.header || !r.aboveMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+// lexBound is one end of a range of members, for sorted sets whose members all share the
+// same score. "-" and "+" sort before and after every member, whichever end they're used at
+type lexBound struct {
+	value     string
+	exclusive bool
+	// infinity is -1 for "-", 1 for "+" and 0 for a bound given by value
+	infinity int
+}
+
+// compare returns -1, 0 or 1 as a member sorts before, at or after the bound
+func (b *lexBound) compare(member string) int {
+	switch {
+	case b.infinity < 0:
+		return 1
+	case b.infinity > 0:
+		return -1
+	default:
+		return strings.Compare(member, b.value)
+	}
+}
+
+type lexRange struct {
+	min, max lexBound
+}
+
+func (r *lexRange) aboveMin(member string) bool {
+	cmp := r.min.compare(member)
+	return cmp > 0 || (cmp == 0 && !r.min.exclusive)
+}
+
+func (r *lexRange) belowMax(member string) bool {
+	cmp := r.max.compare(member)
+	return cmp < 0 || (cmp == 0 && !r.max.exclusive)
+}
+
+func (r *lexRange) isEmpty() bool {
+	switch {
+	case r.min.infinity > 0 || r.max.infinity < 0:
+		return true
+	case r.min.infinity < 0 || r.max.infinity > 0:
+		return false
+	default:
+		return r.min.value > r.max.value || (r.min.value == r.max.value && (r.min.exclusive || r.max.exclusive))
+	}
+}
+
+func (zsl *skiplist) overlapsLex(r *lexRange) bool {
+	if r.isEmpty() {
+		return false
+	}
+	if zsl.tail == nil || !r.aboveMin(zsl.tail.member) {
+		return false
+	}
+
+	first := zsl.header.level[0].forward
+	return first != nil && r.belowMax(first.member)
+}
+
+func (zsl *skiplist) firstInLexRange(r *lexRange) *skiplistNode {
+	if !zsl.overlapsLex(r) {
+		return nil
+	}
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !r.belowMax(x.member) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *skiplist) lastInLexRange(r *lexRange) *skiplistNode {
+	if !zsl.overlapsLex(r) {
+		return nil
+	}
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.belowMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == zsl.header || !r.aboveMin(x.member) {
+		return nil
+	}
+	return x
+}
@@ -0,0 +1,987 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamID identifies a stream entry: a millisecond timestamp and a sequence number that
+// distinguishes entries added within the same millisecond
+type streamID struct {
+	ms, seq uint64
+}
+
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) compare(other streamID) int {
+	if c := cmp.Compare(id.ms, other.ms); c != 0 {
+		return c
+	}
+	return cmp.Compare(id.seq, other.seq)
+}
+
+func (id streamID) isZero() bool {
+	return id.ms == 0 && id.seq == 0
+}
+
+// key encodes an ID big-endian, so that keys sort the same way IDs do
+func (id streamID) key() string {
+	var key [16]byte
+	binary.BigEndian.PutUint64(key[:8], id.ms)
+	binary.BigEndian.PutUint64(key[8:], id.seq)
+
+	return string(key[:])
+}
+
+func streamIDFromKey(key string) streamID {
+	return streamID{binary.BigEndian.Uint64([]byte(key[:8])), binary.BigEndian.Uint64([]byte(key[8:]))}
+}
+
+// next returns the smallest ID after this one, failing if there isn't one
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, true
+	default:
+		return id, false
+	}
+}
+
+// prev returns the largest ID before this one, failing if there isn't one
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	default:
+		return id, false
+	}
+}
+
+var errInvalidStreamID = newCommandError("ERR", "Invalid stream ID specified as stream command argument")
+
+// parseStreamID parses an ID given as "ms-seq", or as just "ms" with missingSeq filled in
+func parseStreamID(arg string, missingSeq uint64) (streamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(arg, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	if !hasSeq {
+		return streamID{ms, missingSeq}, nil
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	return streamID{ms, seq}, nil
+}
+
+// parseIntervalID parses one end of a range of IDs, which can also be "-" or "+" for the
+// smallest and largest IDs, or be made exclusive by a leading "("
+func parseIntervalID(arg string, isStart bool) (streamID, error) {
+	switch arg {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+
+	missingSeq := uint64(0)
+	if !isStart {
+		missingSeq = math.MaxUint64
+	}
+
+	exclusive := strings.HasPrefix(arg, "(")
+	id, err := parseStreamID(strings.TrimPrefix(arg, "("), missingSeq)
+	if err != nil || !exclusive {
+		return id, err
+	}
+
+	ok := false
+	if isStart {
+		id, ok = id.next()
+		if !ok {
+			return id, newCommandError("ERR", "invalid start ID for the interval")
+		}
+	} else {
+		id, ok = id.prev()
+		if !ok {
+			return id, newCommandError("ERR", "invalid end ID for the interval")
+		}
+	}
+
+	return id, nil
+}
+
+// streamIDIndex keeps stream IDs in order, as the big-endian keys of a skiplist
+type streamIDIndex struct {
+	zsl *skiplist
+}
+
+func newStreamIDIndex() *streamIDIndex {
+	return &streamIDIndex{zsl: newSkiplist()}
+}
+
+func (ix *streamIDIndex) len() int {
+	return ix.zsl.length
+}
+
+// add inserts an ID, which the caller guarantees isn't already present
+func (ix *streamIDIndex) add(id streamID) {
+	ix.zsl.insert(0, id.key())
+}
+
+func (ix *streamIDIndex) remove(id streamID) bool {
+	return ix.zsl.delete(0, id.key())
+}
+
+func (ix *streamIDIndex) first() (streamID, bool) {
+	x := ix.zsl.header.level[0].forward
+	if x == nil {
+		return streamID{}, false
+	}
+	return streamIDFromKey(x.member), true
+}
+
+func (ix *streamIDIndex) last() (streamID, bool) {
+	if ix.zsl.tail == nil {
+		return streamID{}, false
+	}
+	return streamIDFromKey(ix.zsl.tail.member), true
+}
+
+func idRange(start, end streamID) *lexRange {
+	return &lexRange{min: lexBound{value: start.key()}, max: lexBound{value: end.key()}}
+}
+
+// ascend visits the IDs from start to end inclusive in order, until visit returns false;
+// visit may remove the ID it's given
+func (ix *streamIDIndex) ascend(start, end streamID, visit func(id streamID) bool) {
+	r := idRange(start, end)
+	for x := ix.zsl.firstInLexRange(r); x != nil && r.belowMax(x.member); {
+		next := x.level[0].forward
+		if !visit(streamIDFromKey(x.member)) {
+			return
+		}
+		x = next
+	}
+}
+
+// descend is ascend in reverse, from end down to start
+func (ix *streamIDIndex) descend(end, start streamID, visit func(id streamID) bool) {
+	r := idRange(start, end)
+	for x := ix.zsl.lastInLexRange(r); x != nil && r.aboveMin(x.member); {
+		previous := x.backward
+		if !visit(streamIDFromKey(x.member)) {
+			return
+		}
+		x = previous
+	}
+}
+
+func (ix *streamIDIndex) clone() *streamIDIndex {
+	copied := newStreamIDIndex()
+	ix.ascend(streamID{}, maxStreamID, func(id streamID) bool {
+		copied.add(id)
+		return true
+	})
+
+	return copied
+}
+
+type streamEntry struct {
+	id streamID
+	// fields alternates field names and values
+	fields []string
+}
+
+// streamValue is an append-only log of entries, ordered by ID, along with the consumer
+// groups reading from it. The stream remembers the last ID it generated even once the
+// entries are deleted, so that IDs only ever increase
+type streamValue struct {
+	ids     *streamIDIndex
+	entries map[streamID][]string
+
+	lastID streamID
+	// maxDeletedID is the largest ID removed by XDEL, and entriesAdded counts every entry
+	// ever added; together they let consumer groups work out how far behind they are
+	maxDeletedID streamID
+	entriesAdded uint64
+
+	groups map[string]*streamGroup
+}
+
+// streamNodeMaxEntries is how many entries Redis packs into each node of a stream, which
+// approximate trimming removes whole
+const streamNodeMaxEntries = 100
+
+func newStreamValue() *streamValue {
+	return &streamValue{ids: newStreamIDIndex(), entries: map[streamID][]string{}, groups: map[string]*streamGroup{}}
+}
+
+func (s *streamValue) len() int {
+	return s.ids.len()
+}
+
+// firstID is the ID of the first entry, or 0-0 if the stream is empty
+func (s *streamValue) firstID() streamID {
+	id, _ := s.ids.first()
+	return id
+}
+
+func (s *streamValue) add(id streamID, fields []string) {
+	s.ids.add(id)
+	s.entries[id] = fields
+	s.lastID = id
+	s.entriesAdded++
+}
+
+// remove deletes an entry, as XDEL does, reporting whether it existed
+func (s *streamValue) remove(id streamID) bool {
+	if !s.ids.remove(id) {
+		return false
+	}
+
+	delete(s.entries, id)
+	if id.compare(s.maxDeletedID) > 0 {
+		s.maxDeletedID = id
+	}
+	return true
+}
+
+// between returns up to count entries (all of them if count is 0) with IDs from start to
+// end inclusive, starting from end if reversed
+func (s *streamValue) between(start, end streamID, reverse bool, count int) []streamEntry {
+	entries := []streamEntry{}
+	visit := func(id streamID) bool {
+		entries = append(entries, streamEntry{id, s.entries[id]})
+		return count == 0 || len(entries) < count
+	}
+
+	if reverse {
+		s.ids.descend(end, start, visit)
+	} else {
+		s.ids.ascend(start, end, visit)
+	}
+
+	return entries
+}
+
+func (s *streamValue) lastEntry() (streamEntry, bool) {
+	id, exists := s.ids.last()
+	return streamEntry{id, s.entries[id]}, exists
+}
+
+// hasTombstones reports whether entries at or after start may have been deleted by XDEL
+func (s *streamValue) hasTombstones(start streamID) bool {
+	if s.len() == 0 || s.maxDeletedID.isZero() {
+		return false
+	}
+	return start.compare(s.maxDeletedID) <= 0
+}
+
+// entriesReadUpTo estimates how many entries had been added to the stream up to and
+// including id, returning -1 when deletions make that impossible to tell
+func (s *streamValue) entriesReadUpTo(id streamID) int64 {
+	if s.entriesAdded == 0 {
+		return 0
+	}
+	if s.len() == 0 && id.compare(s.lastID) <= 0 {
+		return int64(s.entriesAdded)
+	}
+
+	switch c := id.compare(s.lastID); {
+	case c == 0:
+		return int64(s.entriesAdded)
+	case c > 0:
+		return -1
+	}
+
+	firstID := s.firstID()
+	if s.maxDeletedID.isZero() || s.maxDeletedID.compare(firstID) < 0 {
+		switch c := id.compare(firstID); {
+		case c < 0:
+			return int64(s.entriesAdded) - int64(s.len())
+		case c == 0:
+			return int64(s.entriesAdded) - int64(s.len()) + 1
+		}
+	}
+
+	return -1
+}
+
+type streamTrimOptions struct {
+	byMinID bool
+	maxLen  int64
+	minID   streamID
+	// approximate trimming only removes whole nodes' worth of entries, at most limit of them
+	// (0 meaning no limit)
+	approximate bool
+	limit       int64
+}
+
+// trim removes entries from the start of the stream, returning how many it removed
+func (s *streamValue) trim(options *streamTrimOptions) int {
+	var excess int64
+	if options.byMinID {
+		s.ids.ascend(streamID{}, maxStreamID, func(id streamID) bool {
+			if id.compare(options.minID) >= 0 {
+				return false
+			}
+			excess++
+			return true
+		})
+	} else {
+		excess = max(int64(s.len())-options.maxLen, 0)
+	}
+
+	if options.approximate {
+		if options.limit > 0 {
+			excess = min(excess, options.limit)
+		}
+		excess -= excess % streamNodeMaxEntries
+	}
+
+	removed := 0
+	s.ids.ascend(streamID{}, maxStreamID, func(id streamID) bool {
+		if int64(removed) >= excess {
+			return false
+		}
+		s.ids.remove(id)
+		delete(s.entries, id)
+		removed++
+		return true
+	})
+
+	return removed
+}
+
+func (s *streamValue) clone() *streamValue {
+	copied := &streamValue{
+		ids:          s.ids.clone(),
+		entries:      make(map[streamID][]string, len(s.entries)),
+		lastID:       s.lastID,
+		maxDeletedID: s.maxDeletedID,
+		entriesAdded: s.entriesAdded,
+		groups:       make(map[string]*streamGroup, len(s.groups)),
+	}
+
+	// entries are never modified in place, so their fields can be shared
+	for id, fields := range s.entries {
+		copied.entries[id] = fields
+	}
+	for name, group := range s.groups {
+		copied.groups[name] = group.clone()
+	}
+
+	return copied
+}
+
+// getStream looks up a stream for reading or modifying; a missing key gives a nil stream
+func getStream(key string) (*streamValue, error) {
+	e, err := store.getTyped(key, streamType)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	return e.Value.(*streamValue), nil
+}
+
+func encodeStreamEntry(entry streamEntry) []byte {
+	return encodeArray([][]byte{encodeBulkString(entry.id.String()), encodeBulkArray(entry.fields)})
+}
+
+func encodeStreamEntries(entries []streamEntry) []byte {
+	encoded := make([][]byte, len(entries))
+	for i, entry := range entries {
+		encoded[i] = encodeStreamEntry(entry)
+	}
+
+	return encodeArray(encoded)
+}
+
+// parseTrimArgs parses the trimming options shared by XADD and XTRIM from args[i:],
+// returning nil options if there are none. For XADD it stops at the entry's ID, which
+// follows the options, and also accepts NOMKSTREAM
+func parseTrimArgs(args []string, i int, xadd bool) (options *streamTrimOptions, noMkStream bool, next int, err error) {
+	trim := &streamTrimOptions{}
+	trimming, limitGiven := false, false
+
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch {
+		case (option == "MAXLEN" || option == "MINID") && i+1 < len(args):
+			byMinID := option == "MINID"
+			if trimming && trim.byMinID != byMinID {
+				return nil, false, 0, newCommandError("ERR", "syntax error, MAXLEN and MINID options at the same time are not compatible")
+			}
+			trimming, trim.byMinID = true, byMinID
+
+			i++
+			if (args[i] == "~" || args[i] == "=") && i+1 < len(args) {
+				trim.approximate = args[i] == "~"
+				i++
+			}
+
+			if byMinID {
+				if trim.minID, err = parseStreamID(args[i], 0); err != nil {
+					return nil, false, 0, err
+				}
+			} else {
+				maxLen, ok := parseInteger(args[i])
+				if !ok {
+					return nil, false, 0, errNotInteger
+				}
+				if maxLen < 0 {
+					return nil, false, 0, newCommandError("ERR", "The MAXLEN argument must be >= 0.")
+				}
+				trim.maxLen = maxLen
+			}
+		case option == "LIMIT" && i+1 < len(args):
+			limit, ok := parseInteger(args[i+1])
+			if !ok {
+				return nil, false, 0, errNotInteger
+			}
+			if limit < 0 {
+				return nil, false, 0, newCommandError("ERR", "The LIMIT argument must be >= 0.")
+			}
+			trim.limit, limitGiven = limit, true
+			i++
+		case option == "NOMKSTREAM" && xadd:
+			noMkStream = true
+		case xadd:
+			next = i
+			i = len(args)
+		default:
+			return nil, false, 0, errSyntax
+		}
+	}
+	if !xadd {
+		next = len(args)
+	}
+
+	if limitGiven && !trim.approximate {
+		return nil, false, 0, newCommandError("ERR", "syntax error, LIMIT cannot be used without the special ~ option")
+	}
+	if trim.approximate && !limitGiven {
+		trim.limit = 100 * streamNodeMaxEntries
+	}
+	if trimming {
+		options = trim
+	}
+
+	return options, noMkStream, next, nil
+}
+
+// nextStreamID works out the ID of an entry being added to s, as given to XADD: "*" for one
+// based on the current time, "ms-*" for the next sequence number within ms, or an explicit ID
+func nextStreamID(s *streamValue, arg string) (streamID, error) {
+	errTooSmall := newCommandError("ERR", "The ID specified in XADD is equal or smaller than the target stream top item")
+
+	if s.lastID == maxStreamID {
+		return streamID{}, newCommandError("ERR", "The stream has exhausted the last possible ID, unable to add more items")
+	}
+
+	if arg == "*" {
+		now := uint64(time.Now().UnixMilli())
+		if now > s.lastID.ms {
+			return streamID{now, 0}, nil
+		}
+		id, _ := s.lastID.next()
+		return id, nil
+	}
+
+	if msPart, found := strings.CutSuffix(arg, "-*"); found {
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+		if err != nil {
+			return streamID{}, errInvalidStreamID
+		}
+
+		switch {
+		case ms > s.lastID.ms:
+			return streamID{ms, 0}, nil
+		case ms == s.lastID.ms && s.lastID.seq < math.MaxUint64:
+			return streamID{ms, s.lastID.seq + 1}, nil
+		default:
+			return streamID{}, errTooSmall
+		}
+	}
+
+	id, err := parseStreamID(arg, 0)
+	if err != nil {
+		return streamID{}, err
+	}
+	if id.isZero() {
+		return streamID{}, newCommandError("ERR", "The ID specified in XADD must be greater than 0-0")
+	}
+	if id.compare(s.lastID) <= 0 {
+		return streamID{}, errTooSmall
+	}
+
+	return id, nil
+}
+
+// propagateTrim replicates trimming as an exact XTRIM, whichever way it was asked for,
+// since approximate trimming isn't guaranteed to remove the same entries twice
+func propagateTrim(c *client, key string, s *streamValue) {
+	c.propagateAs = append(c.propagateAs, []string{"XTRIM", key, "MAXLEN", "=", strconv.Itoa(s.len())})
+}
+
+func handleXAdd(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	options, noMkStream, i, err := parseTrimArgs(array, 2, true)
+	if err != nil {
+		return nil, err
+	}
+	if i == 0 || len(array)-i-1 < 2 || (len(array)-i-1)%2 != 0 {
+		return nil, wrongArityError(array[0])
+	}
+	fields := array[i+1:]
+
+	// the ID is checked for syntax before the key is looked up
+	if array[i] != "*" && !strings.HasSuffix(array[i], "-*") {
+		if _, err := parseStreamID(array[i], 0); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	created := s == nil
+	if created {
+		if noMkStream {
+			return encodeNull(c.protocol), nil
+		}
+		s = newStreamValue()
+	}
+
+	id, err := nextStreamID(s, array[i])
+	if err != nil {
+		return nil, err
+	}
+
+	s.add(id, append([]string(nil), fields...))
+	if created {
+		store.set(key, &entry{Type: streamType, Value: s})
+	} else {
+		store.modified(key)
+	}
+
+	c.propagateAs = [][]string{append([]string{"XADD", key, id.String()}, fields...)}
+	if options != nil && s.trim(options) > 0 {
+		propagateTrim(c, key, s)
+	}
+
+	return encodeBulkString(id.String()), nil
+}
+
+func handleXTrim(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	options, _, _, err := parseTrimArgs(array, 2, false)
+	if err != nil {
+		return nil, err
+	}
+	if options == nil {
+		return nil, errSyntax
+	}
+
+	s, err := getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return encodeInteger(0), nil
+	}
+
+	removed := s.trim(options)
+	if removed > 0 {
+		store.modified(key)
+		propagateTrim(c, key, s)
+	}
+
+	return encodeInteger(removed), nil
+}
+
+func handleXDel(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	ids := make([]streamID, len(array)-2)
+	for i, arg := range array[2:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+
+	s, err := getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return encodeInteger(0), nil
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		if s.remove(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		store.modified(key)
+	}
+
+	return encodeInteger(deleted), nil
+}
+
+func handleXLen(c *client, array []string) ([]byte, error) {
+	s, err := getStream(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return encodeInteger(0), nil
+	}
+
+	return encodeInteger(s.len()), nil
+}
+
+// handleXRange implements XRANGE and XREVRANGE, which takes the end of the range first
+func handleXRange(c *client, array []string) ([]byte, error) {
+	reverse := strings.EqualFold(array[0], "xrevrange")
+	startArg, endArg := array[2], array[3]
+	if reverse {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, err := parseIntervalID(startArg, true)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseIntervalID(endArg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	count := int64(-1)
+	for i := 4; i < len(array); i += 2 {
+		if !strings.EqualFold(array[i], "COUNT") || i+1 >= len(array) {
+			return nil, errSyntax
+		}
+		var ok bool
+		if count, ok = parseInteger(array[i+1]); !ok {
+			return nil, errNotInteger
+		}
+		count = max(count, 0)
+	}
+
+	s, err := getStream(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return encodeArray(nil), nil
+	}
+	if count == 0 {
+		return encodeNullArray(c.protocol), nil
+	}
+
+	return encodeStreamEntries(s.between(start, end, reverse, int(max(count, 0)))), nil
+}
+
+// xreadOptions holds the parsed arguments of XREAD or XREADGROUP
+type xreadOptions struct {
+	count    int
+	block    bool
+	timeout  time.Duration
+	group    string
+	consumer string
+	noAck    bool
+	keys     []string
+	ids      []string
+}
+
+func parseXReadOptions(array []string) (*xreadOptions, error) {
+	command := strings.ToLower(array[0])
+	group := command == "xreadgroup"
+	options := &xreadOptions{}
+
+	for i := 1; i < len(array); i++ {
+		option := strings.ToUpper(array[i])
+		remaining := len(array) - i - 1
+
+		switch {
+		case option == "BLOCK" && remaining > 0:
+			ms, ok := parseInteger(array[i+1])
+			if !ok {
+				return nil, newCommandError("ERR", "timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return nil, newCommandError("ERR", "timeout is negative")
+			}
+			options.block, options.timeout = true, time.Duration(min(ms, math.MaxInt64/int64(time.Millisecond)))*time.Millisecond
+			i++
+		case option == "COUNT" && remaining > 0:
+			count, ok := parseInteger(array[i+1])
+			if !ok {
+				return nil, errNotInteger
+			}
+			options.count = int(min(max(count, 0), math.MaxInt32))
+			i++
+		case option == "STREAMS" && remaining > 0:
+			streams := array[i+1:]
+			if len(streams)%2 != 0 {
+				return nil, newCommandError("ERR",
+					"Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.", command)
+			}
+			options.keys, options.ids = streams[:len(streams)/2], streams[len(streams)/2:]
+			i = len(array)
+		case option == "GROUP" && remaining >= 2:
+			if !group {
+				return nil, newCommandError("ERR", "The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			options.group, options.consumer = array[i+1], array[i+2]
+			i += 2
+		case option == "NOACK":
+			if !group {
+				return nil, newCommandError("ERR", "The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			options.noAck = true
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	if options.keys == nil {
+		return nil, errSyntax
+	}
+	if group && options.group == "" {
+		return nil, newCommandError("ERR", "Missing GROUP option for XREADGROUP")
+	}
+
+	return options, nil
+}
+
+// encodeXReadReply encodes the entries read from each stream, keyed by stream name
+func encodeXReadReply(protocol int, keys []string, results [][]byte) []byte {
+	if protocol == resp3 {
+		elements := [][]byte{}
+		for i, key := range keys {
+			elements = append(elements, encodeBulkString(key), results[i])
+		}
+		return encodeMap(protocol, elements)
+	}
+
+	elements := make([][]byte, len(keys))
+	for i, key := range keys {
+		elements[i] = encodeArray([][]byte{encodeBulkString(key), results[i]})
+	}
+	return encodeArray(elements)
+}
+
+func handleXRead(c *client, array []string) ([]byte, error) {
+	options, err := parseXReadOptions(array)
+	if err != nil {
+		return nil, err
+	}
+
+	// IDs are resolved on the first attempt, so "$" means the last ID when XREAD was called
+	after := make([]streamID, len(options.keys))
+	latest := make([]bool, len(options.keys))
+	resolved := false
+
+	attempt := func() ([]byte, bool, error) {
+		streams := make([]*streamValue, len(options.keys))
+		for i, key := range options.keys {
+			s, err := getStream(key)
+			if err != nil {
+				return nil, false, err
+			}
+			streams[i] = s
+		}
+
+		if !resolved {
+			for i, arg := range options.ids {
+				switch arg {
+				case "$":
+					if streams[i] != nil {
+						after[i] = streams[i].lastID
+					}
+				case "+":
+					latest[i] = true
+				case ">":
+					return nil, false, newCommandError("ERR",
+						"The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+				default:
+					id, err := parseStreamID(arg, 0)
+					if err != nil {
+						return nil, false, err
+					}
+					after[i] = id
+				}
+			}
+			resolved = true
+		}
+
+		keys, results := []string{}, [][]byte{}
+		for i, s := range streams {
+			if s == nil {
+				continue
+			}
+
+			var entries []streamEntry
+			if latest[i] {
+				if entry, exists := s.lastEntry(); exists {
+					entries = []streamEntry{entry}
+				}
+				// once served, "+" waits for entries after the last one, as "$" does
+				latest[i], after[i] = false, s.lastID
+			} else if start, ok := after[i].next(); ok {
+				entries = s.between(start, maxStreamID, false, options.count)
+			}
+
+			if len(entries) > 0 {
+				keys = append(keys, options.keys[i])
+				results = append(results, encodeStreamEntries(entries))
+			}
+		}
+
+		if len(keys) == 0 {
+			return encodeNullArray(c.protocol), !options.block, nil
+		}
+		return encodeXReadReply(c.protocol, keys, results), true, nil
+	}
+
+	return blockOn(c, options.keys, options.timeout, encodeNullArray(c.protocol), attempt)
+}
+
+// handleXSetID implements XSETID, which sets the last ID of a stream, e.g. when its
+// entries are recreated by replaying commands
+func handleXSetID(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	lastID, err := parseStreamID(array[2], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var entriesAdded int64 = -1
+	var maxDeletedID *streamID
+	for i := 3; i < len(array); i += 2 {
+		if i+1 >= len(array) {
+			return nil, errSyntax
+		}
+
+		switch strings.ToUpper(array[i]) {
+		case "ENTRIESADDED":
+			var ok bool
+			if entriesAdded, ok = parseInteger(array[i+1]); !ok {
+				return nil, errNotInteger
+			}
+			if entriesAdded < 0 {
+				return nil, newCommandError("ERR", "entries_added must be positive")
+			}
+		case "MAXDELETEDID":
+			id, err := parseStreamID(array[i+1], 0)
+			if err != nil {
+				return nil, err
+			}
+			if lastID.compare(id) < 0 {
+				return nil, newCommandError("ERR", "The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+			}
+			maxDeletedID = &id
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	s, err := getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errNoSuchKey
+	}
+
+	if top, exists := s.ids.last(); exists && lastID.compare(top) < 0 {
+		return nil, newCommandError("ERR", "The ID specified in XSETID is smaller than the target stream top item")
+	}
+	if entriesAdded >= 0 && entriesAdded < int64(s.len()) {
+		return nil, newCommandError("ERR", "The entries_added specified in XSETID is smaller than the target stream length")
+	}
+
+	s.lastID = lastID
+	if entriesAdded >= 0 {
+		s.entriesAdded = uint64(entriesAdded)
+	}
+	if maxDeletedID != nil {
+		s.maxDeletedID = *maxDeletedID
+	}
+	store.modified(key)
+
+	return encodeSimpleString("OK"), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "xadd", Arity: -5, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Appends a new message to a stream. Creates the key if it doesn't exist.", Since: "5.0.0",
+			Handler: handleXAdd,
+		},
+		&commandSpec{
+			Name: "xtrim", Arity: -4, Flags: []string{"write"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Deletes messages from the beginning of a stream.", Since: "5.0.0",
+			Handler: handleXTrim,
+		},
+		&commandSpec{
+			Name: "xdel", Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Returns the number of messages after removing them from a stream.", Since: "5.0.0",
+			Handler: handleXDel,
+		},
+		&commandSpec{
+			Name: "xlen", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Return the number of messages in a stream.", Since: "5.0.0",
+			Handler: handleXLen,
+		},
+		&commandSpec{
+			Name: "xrange", Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Returns the messages from a stream within a range of IDs.", Since: "5.0.0",
+			Handler: handleXRange,
+		},
+		&commandSpec{
+			Name: "xrevrange", Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "Returns the messages from a stream within a range of IDs in reverse order.", Since: "5.0.0",
+			Handler: handleXRange,
+		},
+		&commandSpec{
+			Name: "xread", Arity: -4, Flags: []string{"readonly", "blocking"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "stream", Summary: "Returns messages from multiple streams with IDs greater than the ones requested. Blocks until a message is available otherwise.",
+			Since: "5.0.0", Handler: handleXRead,
+		},
+		&commandSpec{
+			Name: "xsetid", Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "stream", Summary: "An internal command for replicating stream values.", Since: "5.0.0",
+			Handler: handleXSetID,
+		},
+	)
+}
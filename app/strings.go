@@ -0,0 +1,777 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxStringLength mirrors Redis's default proto-max-bulk-len
+const maxStringLength = 512 * 1024 * 1024
+
+var errStringTooLong = newCommandError("ERR", "string exceeds maximum allowed size (proto-max-bulk-len)")
+
+// parseExpiryOption turns the argument of an EX, PX, EXAT or PXAT option into an absolute expiry
+func parseExpiryOption(command, option, value string) (*expiry, error) {
+	num, ok := parseInteger(value)
+	if !ok {
+		return nil, errNotInteger
+	}
+	if num <= 0 {
+		return nil, invalidExpireError(command)
+	}
+
+	now := time.Now().UnixMilli()
+	var unixMilli int64
+	switch strings.ToUpper(option) {
+	case "EX":
+		if num > (math.MaxInt64-now)/1000 {
+			return nil, invalidExpireError(command)
+		}
+		unixMilli = now + num*1000
+	case "PX":
+		if num > math.MaxInt64-now {
+			return nil, invalidExpireError(command)
+		}
+		unixMilli = now + num
+	case "EXAT":
+		if num > math.MaxInt64/1000 {
+			return nil, invalidExpireError(command)
+		}
+		unixMilli = num * 1000
+	case "PXAT":
+		unixMilli = num
+	default:
+		return nil, errSyntax
+	}
+
+	return &expiry{time.UnixMilli(unixMilli)}, nil
+}
+
+func isExpiryOption(option string) bool {
+	switch strings.ToUpper(option) {
+	case "EX", "PX", "EXAT", "PXAT":
+		return true
+	default:
+		return false
+	}
+}
+
+func stringValue(e *entry) []byte {
+	return e.Value.([]byte)
+}
+
+// setString stores a string value, propagating any expiry as an absolute PXAT so replicas agree on it
+func setString(c *client, key string, value []byte, expiryPtr *expiry) {
+	store.set(key, newStringEntry(value, expiryPtr))
+
+	if expiryPtr != nil {
+		c.propagateAs = append(c.propagateAs, []string{
+			"SET", key, string(value), "PXAT", strconv.FormatInt(expiryPtr.Timestamp.UnixMilli(), 10),
+		})
+	} else {
+		c.propagateAs = append(c.propagateAs, []string{"SET", key, string(value)})
+	}
+}
+
+func handleSet(c *client, array []string) ([]byte, error) {
+	key, value := array[1], []byte(array[2])
+
+	var expiryPtr *expiry
+	nx, xx, keepTTL, get := false, false, false, false
+	for i := 3; i < len(array); i++ {
+		option := strings.ToUpper(array[i])
+		switch {
+		case option == "NX" && !xx:
+			nx = true
+		case option == "XX" && !nx:
+			xx = true
+		case option == "GET":
+			get = true
+		case option == "KEEPTTL" && expiryPtr == nil:
+			keepTTL = true
+		case isExpiryOption(option) && !keepTTL && expiryPtr == nil && i+1 < len(array):
+			var err error
+			expiryPtr, err = parseExpiryOption("set", option, array[i+1])
+			if err != nil {
+				return nil, err
+			}
+			i++
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	existing, exists := store.get(key)
+	if get && exists && existing.Type != stringType {
+		return nil, errWrongType
+	}
+
+	reply := encodeSimpleString("OK")
+	if get {
+		reply = encodeNull(c.protocol)
+		if exists {
+			reply = encodeBulkString(string(stringValue(existing)))
+		}
+	}
+
+	if (nx && exists) || (xx && !exists) {
+		if get {
+			return reply, nil
+		}
+		return encodeNull(c.protocol), nil
+	}
+
+	if keepTTL && exists {
+		expiryPtr = existing.ExpiryPtr
+	}
+	setString(c, key, value, expiryPtr)
+
+	return reply, nil
+}
+
+func handleGet(c *client, array []string) ([]byte, error) {
+	e, err := store.getTyped(array[1], stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return encodeNull(c.protocol), nil
+	}
+
+	return encodeBulkString(string(stringValue(e))), nil
+}
+
+func handleGetSet(c *client, array []string) ([]byte, error) {
+	e, err := store.getTyped(array[1], stringType)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := encodeNull(c.protocol)
+	if e != nil {
+		reply = encodeBulkString(string(stringValue(e)))
+	}
+
+	store.set(array[1], newStringEntry([]byte(array[2]), nil))
+	return reply, nil
+}
+
+func handleGetDel(c *client, array []string) ([]byte, error) {
+	e, err := store.getTyped(array[1], stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return encodeNull(c.protocol), nil
+	}
+
+	store.delete(array[1])
+	return encodeBulkString(string(stringValue(e))), nil
+}
+
+func handleGetEx(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	var expiryPtr *expiry
+	persist := false
+	for i := 2; i < len(array); i++ {
+		option := strings.ToUpper(array[i])
+		switch {
+		case option == "PERSIST" && expiryPtr == nil:
+			persist = true
+		case isExpiryOption(option) && !persist && expiryPtr == nil && i+1 < len(array):
+			var err error
+			expiryPtr, err = parseExpiryOption("getex", option, array[i+1])
+			if err != nil {
+				return nil, err
+			}
+			i++
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	e, err := store.getTyped(key, stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return encodeNull(c.protocol), nil
+	}
+	reply := encodeBulkString(string(stringValue(e)))
+
+	switch {
+	case expiryPtr != nil && expiryPtr.Timestamp.Before(time.Now()):
+		store.delete(key)
+		c.propagateAs = append(c.propagateAs, []string{"GETDEL", key})
+	case expiryPtr != nil:
+		store.setExpiry(key, expiryPtr)
+		c.propagateAs = append(c.propagateAs, []string{
+			"GETEX", key, "PXAT", strconv.FormatInt(expiryPtr.Timestamp.UnixMilli(), 10),
+		})
+	case persist && e.ExpiryPtr != nil:
+		store.setExpiry(key, nil)
+	}
+
+	return reply, nil
+}
+
+func handleSetNX(c *client, array []string) ([]byte, error) {
+	if _, exists := store.get(array[1]); exists {
+		return encodeInteger(0), nil
+	}
+
+	store.set(array[1], newStringEntry([]byte(array[2]), nil))
+	return encodeInteger(1), nil
+}
+
+func handleSetEx(c *client, array []string) ([]byte, error) {
+	option := "EX"
+	if strings.EqualFold(array[0], "psetex") {
+		option = "PX"
+	}
+
+	expiryPtr, err := parseExpiryOption(array[0], option, array[2])
+	if err != nil {
+		return nil, err
+	}
+
+	setString(c, array[1], []byte(array[3]), expiryPtr)
+	return encodeSimpleString("OK"), nil
+}
+
+func handleMSet(c *client, array []string) ([]byte, error) {
+	if len(array)%2 != 1 {
+		return nil, wrongArityError(array[0])
+	}
+
+	for i := 1; i < len(array); i += 2 {
+		store.set(array[i], newStringEntry([]byte(array[i+1]), nil))
+	}
+
+	return encodeSimpleString("OK"), nil
+}
+
+func handleMSetNX(c *client, array []string) ([]byte, error) {
+	if len(array)%2 != 1 {
+		return nil, wrongArityError(array[0])
+	}
+
+	for i := 1; i < len(array); i += 2 {
+		if _, exists := store.get(array[i]); exists {
+			return encodeInteger(0), nil
+		}
+	}
+
+	for i := 1; i < len(array); i += 2 {
+		store.set(array[i], newStringEntry([]byte(array[i+1]), nil))
+	}
+
+	return encodeInteger(1), nil
+}
+
+func handleMGet(c *client, array []string) ([]byte, error) {
+	values := make([][]byte, 0, len(array)-1)
+	for _, key := range array[1:] {
+		e, exists := store.get(key)
+		if !exists || e.Type != stringType {
+			values = append(values, encodeNull(c.protocol))
+			continue
+		}
+		values = append(values, encodeBulkString(string(stringValue(e))))
+	}
+
+	return encodeArray(values), nil
+}
+
+func handleAppend(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	e, err := store.getTyped(key, stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		store.set(key, newStringEntry([]byte(array[2]), nil))
+		return encodeInteger(len(array[2])), nil
+	}
+
+	if len(stringValue(e))+len(array[2]) > maxStringLength {
+		return nil, errStringTooLong
+	}
+
+	e.Value = append(stringValue(e), array[2]...)
+	store.modified(key)
+
+	return encodeInteger(len(stringValue(e))), nil
+}
+
+func handleStrLen(c *client, array []string) ([]byte, error) {
+	e, err := store.getTyped(array[1], stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return encodeInteger(0), nil
+	}
+
+	return encodeInteger(len(stringValue(e))), nil
+}
+
+func handleGetRange(c *client, array []string) ([]byte, error) {
+	start, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+	end, ok := parseInteger(array[3])
+	if !ok {
+		return nil, errNotInteger
+	}
+
+	e, err := store.getTyped(array[1], stringType)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return encodeBulkString(""), nil
+	}
+
+	value := stringValue(e)
+	length := int64(len(value))
+
+	if start < 0 && end < 0 && start > end {
+		return encodeBulkString(""), nil
+	}
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if end < 0 {
+		end = max(length+end, 0)
+	}
+	end = min(end, length-1)
+
+	if length == 0 || start > end {
+		return encodeBulkString(""), nil
+	}
+
+	return encodeBulkString(string(value[start : end+1])), nil
+}
+
+func handleSetRange(c *client, array []string) ([]byte, error) {
+	key, value := array[1], array[3]
+
+	offset, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+	if offset < 0 {
+		return nil, newCommandError("ERR", "offset is out of range")
+	}
+
+	e, err := store.getTyped(key, stringType)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(value) == 0 {
+		if e == nil {
+			return encodeInteger(0), nil
+		}
+		return encodeInteger(len(stringValue(e))), nil
+	}
+
+	if offset+int64(len(value)) > maxStringLength {
+		return nil, errStringTooLong
+	}
+
+	var current []byte
+	if e != nil {
+		current = stringValue(e)
+	}
+
+	end := int(offset) + len(value)
+	if end > len(current) {
+		current = append(current, make([]byte, end-len(current))...)
+	}
+	copy(current[offset:], value)
+
+	if e == nil {
+		store.set(key, newStringEntry(current, nil))
+	} else {
+		e.Value = current
+		store.modified(key)
+	}
+
+	return encodeInteger(len(current)), nil
+}
+
+// incrementBy adds delta to the integer held at key, creating it from zero if needed
+func incrementBy(key string, delta int64) ([]byte, error) {
+	e, err := store.getTyped(key, stringType)
+	if err != nil {
+		return nil, err
+	}
+
+	var current int64
+	if e != nil {
+		var ok bool
+		current, ok = parseInteger(string(stringValue(e)))
+		if !ok {
+			return nil, errNotInteger
+		}
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return nil, newCommandError("ERR", "increment or decrement would overflow")
+	}
+
+	result := current + delta
+	value := []byte(strconv.FormatInt(result, 10))
+	if e == nil {
+		store.set(key, newStringEntry(value, nil))
+	} else {
+		e.Value = value
+		store.modified(key)
+	}
+
+	return encodeInteger(int(result)), nil
+}
+
+func handleIncr(c *client, array []string) ([]byte, error) {
+	return incrementBy(array[1], 1)
+}
+
+func handleDecr(c *client, array []string) ([]byte, error) {
+	return incrementBy(array[1], -1)
+}
+
+func handleIncrBy(c *client, array []string) ([]byte, error) {
+	delta, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+
+	return incrementBy(array[1], delta)
+}
+
+func handleDecrBy(c *client, array []string) ([]byte, error) {
+	delta, ok := parseInteger(array[2])
+	if !ok {
+		return nil, errNotInteger
+	}
+	if delta == math.MinInt64 {
+		return nil, newCommandError("ERR", "decrement would overflow")
+	}
+
+	return incrementBy(array[1], -delta)
+}
+
+// parseLongDouble parses a float argument with the 64-bit mantissa of the C long double
+// Redis uses for INCRBYFLOAT, so results are formatted identically
+func parseLongDouble(input string) (*big.Float, bool) {
+	if input == "" || strings.ContainsAny(input, " \t\r\n") {
+		return nil, false
+	}
+
+	num, _, err := big.ParseFloat(input, 10, 64, big.ToNearestEven)
+	if err != nil {
+		return nil, false
+	}
+	return num, true
+}
+
+// formatLongDouble formats like Redis's "%.17Lf" with trailing zeros removed
+func formatLongDouble(num *big.Float) string {
+	formatted := num.Text('f', 17)
+	if strings.Contains(formatted, ".") {
+		formatted = strings.TrimRight(formatted, "0")
+		formatted = strings.TrimSuffix(formatted, ".")
+	}
+	if formatted == "-0" {
+		formatted = "0"
+	}
+	return formatted
+}
+
+func handleIncrByFloat(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	delta, ok := parseLongDouble(array[2])
+	if !ok {
+		return nil, errNotFloat
+	}
+
+	e, err := store.getTyped(key, stringType)
+	if err != nil {
+		return nil, err
+	}
+
+	current := new(big.Float).SetPrec(64)
+	if e != nil {
+		current, ok = parseLongDouble(string(stringValue(e)))
+		if !ok {
+			return nil, errNotFloat
+		}
+	}
+
+	if current.IsInf() || delta.IsInf() {
+		return nil, newCommandError("ERR", "increment would produce NaN or Infinity")
+	}
+
+	result := new(big.Float).SetPrec(64).Add(current, delta)
+	value := []byte(formatLongDouble(result))
+
+	if e == nil {
+		store.set(key, newStringEntry(value, nil))
+	} else {
+		e.Value = value
+		store.modified(key)
+	}
+
+	// replicas receive the result, so floating point differences can't make them diverge
+	c.propagateAs = append(c.propagateAs, []string{"SET", key, string(value), "KEEPTTL"})
+
+	return encodeBulkString(string(value)), nil
+}
+
+func handleLCS(c *client, array []string) ([]byte, error) {
+	getLength, getIndexes, withMatchLength := false, false, false
+	var minMatchLength int64
+	for i := 3; i < len(array); i++ {
+		option := strings.ToUpper(array[i])
+		switch {
+		case option == "LEN":
+			getLength = true
+		case option == "IDX":
+			getIndexes = true
+		case option == "WITHMATCHLEN":
+			withMatchLength = true
+		case option == "MINMATCHLEN" && i+1 < len(array):
+			var ok bool
+			minMatchLength, ok = parseInteger(array[i+1])
+			if !ok {
+				return nil, errNotInteger
+			}
+			minMatchLength = max(minMatchLength, 0)
+			i++
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	if getLength && getIndexes {
+		return nil, newCommandError("ERR", "If you want both the length and indexes, please just use IDX.")
+	}
+
+	values := [2][]byte{}
+	for i, key := range array[1:3] {
+		e, exists := store.get(key)
+		if !exists {
+			continue
+		}
+		if e.Type != stringType {
+			return nil, newCommandError("ERR", "The specified keys must contain string values")
+		}
+		values[i] = stringValue(e)
+	}
+	a, b := values[0], values[1]
+
+	if (uint64(len(a))+1)*(uint64(len(b))+1)*4 > maxStringLength {
+		return nil, newCommandError("ERR", "Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+	}
+
+	// table[i][j] is the LCS length of the first i bytes of a and the first j bytes of b
+	width := len(b) + 1
+	table := make([]uint32, (len(a)+1)*width)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				table[i*width+j] = table[(i-1)*width+j-1] + 1
+			} else {
+				table[i*width+j] = max(table[(i-1)*width+j], table[i*width+j-1])
+			}
+		}
+	}
+
+	lcsLength := int(table[len(a)*width+len(b)])
+	if getLength {
+		return encodeInteger(lcsLength), nil
+	}
+
+	// walk back through the table, collecting the common subsequence and its matching ranges
+	result := make([]byte, lcsLength)
+	matches := [][]byte{}
+	aStart, aEnd, bStart, bEnd := len(a), 0, 0, 0
+	i, j, idx := len(a), len(b), lcsLength
+
+	for i > 0 && j > 0 {
+		emitRange := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+
+			if aStart == len(a) {
+				aStart, aEnd = i-1, i-1
+				bStart, bEnd = j-1, j-1
+			} else if aStart == i && bStart == j {
+				// the match is contiguous with the current range, so extend it backwards
+				aStart--
+				bStart--
+			} else {
+				emitRange = true
+			}
+
+			if aStart == 0 || bStart == 0 {
+				emitRange = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if table[(i-1)*width+j] > table[i*width+j-1] {
+				i--
+			} else {
+				j--
+			}
+			if aStart != len(a) {
+				emitRange = true
+			}
+		}
+
+		if emitRange {
+			matchLength := aEnd - aStart + 1
+			if minMatchLength == 0 || int64(matchLength) >= minMatchLength {
+				match := [][]byte{
+					encodeArray([][]byte{encodeInteger(aStart), encodeInteger(aEnd)}),
+					encodeArray([][]byte{encodeInteger(bStart), encodeInteger(bEnd)}),
+				}
+				if withMatchLength {
+					match = append(match, encodeInteger(matchLength))
+				}
+				matches = append(matches, encodeArray(match))
+			}
+			aStart = len(a)
+		}
+	}
+
+	if !getIndexes {
+		return encodeBulkString(string(result)), nil
+	}
+
+	return encodeMap(c.protocol, [][]byte{
+		encodeBulkString("matches"), encodeArray(matches),
+		encodeBulkString("len"), encodeInteger(lcsLength),
+	}), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "set", Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.",
+			Since: "1.0.0", Handler: handleSet,
+		},
+		&commandSpec{
+			Name: "get", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns the string value of a key.", Since: "1.0.0",
+			Handler: handleGet,
+		},
+		&commandSpec{
+			Name: "getset", Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns the previous string value of a key after setting it to a new value.",
+			Since: "1.0.0", Handler: handleGetSet,
+		},
+		&commandSpec{
+			Name: "getdel", Arity: 2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns the string value of a key after deleting the key.", Since: "6.2.0",
+			Handler: handleGetDel,
+		},
+		&commandSpec{
+			Name: "getex", Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns the string value of a key after setting its expiration time.",
+			Since: "6.2.0", Handler: handleGetEx,
+		},
+		&commandSpec{
+			Name: "setnx", Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Set the string value of a key only when the key doesn't exist.", Since: "1.0.0",
+			Handler: handleSetNX,
+		},
+		&commandSpec{
+			Name: "setex", Arity: 4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Sets the string value and expiration time of a key. Creates the key if it doesn't exist.",
+			Since: "2.0.0", Handler: handleSetEx,
+		},
+		&commandSpec{
+			Name: "psetex", Arity: 4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Sets both string value and expiration time in milliseconds of a key. The key is created if it doesn't exist.",
+			Since: "2.6.0", Handler: handleSetEx,
+		},
+		&commandSpec{
+			Name: "mset", Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, KeyStep: 2,
+			Group: "string", Summary: "Atomically creates or modifies the string values of one or more keys.",
+			Since: "1.0.1", Handler: handleMSet,
+		},
+		&commandSpec{
+			Name: "msetnx", Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, KeyStep: 2,
+			Group: "string", Summary: "Atomically modifies the string values of one or more keys only when all keys don't exist.",
+			Since: "1.0.1", Handler: handleMSetNX,
+		},
+		&commandSpec{
+			Name: "mget", Arity: -2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "string", Summary: "Atomically returns the string values of one or more keys.", Since: "1.0.0",
+			Handler: handleMGet,
+		},
+		&commandSpec{
+			Name: "append", Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Appends a string to the value of a key. Creates the key if it doesn't exist.",
+			Since: "2.0.0", Handler: handleAppend,
+		},
+		&commandSpec{
+			Name: "strlen", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns the length of a string value.", Since: "2.2.0",
+			Handler: handleStrLen,
+		},
+		&commandSpec{
+			Name: "getrange", Arity: 4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns a substring of the string stored at a key.", Since: "2.4.0",
+			Handler: handleGetRange,
+		},
+		&commandSpec{
+			Name: "setrange", Arity: 4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Overwrites a part of a string value with another by an offset. Creates the key if it doesn't exist.",
+			Since: "2.2.0", Handler: handleSetRange,
+		},
+		&commandSpec{
+			Name: "incr", Arity: 2, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.",
+			Since: "1.0.0", Handler: handleIncr,
+		},
+		&commandSpec{
+			Name: "decr", Arity: 2, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.",
+			Since: "1.0.0", Handler: handleDecr,
+		},
+		&commandSpec{
+			Name: "incrby", Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Increments the integer value of a key by a number. Uses 0 as initial value if the key doesn't exist.",
+			Since: "1.0.0", Handler: handleIncrBy,
+		},
+		&commandSpec{
+			Name: "decrby", Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Decrements a number from the integer value of a key. Uses 0 as initial value if the key doesn't exist.",
+			Since: "1.0.0", Handler: handleDecrBy,
+		},
+		&commandSpec{
+			Name: "incrbyfloat", Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist.",
+			Since: "2.6.0", Handler: handleIncrByFloat,
+		},
+		&commandSpec{
+			Name: "lcs", Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "string", Summary: "Finds the longest common substring.", Since: "7.0.0",
+			Handler: handleLCS,
+		},
+	)
+}
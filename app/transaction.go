@@ -0,0 +1,278 @@
+package main
+
+import "strings"
+
+var errExecAbort = newCommandError("EXECABORT", "Transaction discarded because of previous errors.")
+
+func noMultiError(name string) *commandError {
+	return newCommandError("ERR", "%s without MULTI", name)
+}
+
+// watchedKeys maps each watched key to the clients watching it. Like the rest of the
+// transaction state, it's guarded by executionLock
+var watchedKeys = map[databaseKey]map[*client]struct{}{}
+
+// bufferedCommand is a command to replicate, along with the database it applies to
+type bufferedCommand struct {
+	db    int
+	array []string
+}
+
+// while a transaction or script runs, whatever it replicates is buffered here, so replicas
+// get its effects wrapped in MULTI/EXEC and apply them atomically too
+var (
+	bufferingTransaction bool
+	bufferedCommands     []bufferedCommand
+)
+
+// propagateAtomically runs fn, replicating whatever it changes as a single transaction
+func propagateAtomically(fn func()) {
+	// an enclosing transaction already wraps everything
+	if bufferingTransaction {
+		fn()
+		return
+	}
+
+	bufferingTransaction = true
+	fn()
+	bufferingTransaction = false
+
+	buffered := bufferedCommands
+	bufferedCommands = nil
+	// a single command is atomic on its own
+	if len(buffered) > 1 {
+		propagateInDatabase(buffered[0].db, []string{"MULTI"})
+	}
+	for _, command := range buffered {
+		propagateInDatabase(command.db, command.array)
+	}
+	if len(buffered) > 1 {
+		propagateInDatabase(buffered[len(buffered)-1].db, []string{"EXEC"})
+	}
+}
+
+// unqueuedCommands run immediately even within MULTI, as they control the transaction itself
+var unqueuedCommands = map[string]bool{
+	"multi": true, "exec": true, "discard": true, "watch": true, "quit": true,
+}
+
+// queueCommand handles a command sent between MULTI and EXEC, reporting whether it was queued.
+// A command that can't be queued (e.g. an unknown one) makes EXEC fail instead
+func queueCommand(c *client, spec *commandSpec, array []string, err error) ([]byte, bool) {
+	if err != nil {
+		c.multiAborted = true
+		return encodeCommandError(err), true
+	}
+	if unqueuedCommands[strings.ToLower(array[0])] {
+		return nil, false
+	}
+	if spec.hasFlag("no_multi") {
+		c.multiAborted = true
+		return encodeCommandError(newCommandError("ERR", "Command not allowed inside a transaction")), true
+	}
+
+	c.queued = append(c.queued, array)
+	return encodeSimpleString("QUEUED"), true
+}
+
+// touchWatchedKey marks the transactions watching key as failed, since it was modified. A key
+// that had already expired when watched is only logically modified if it's now recreated
+func touchWatchedKey(db int, key string, removed bool) {
+	watched := databaseKey{db, key}
+	for c := range watchedKeys[watched] {
+		if c.watched[watched] && removed {
+			// from now on the key counts as missing rather than expired
+			c.watched[watched] = false
+			continue
+		}
+		c.watchDirty = true
+	}
+}
+
+// touchAllWatchedKeys fails every transaction watching a key in a database, e.g. when its
+// keys are replaced
+func touchAllWatchedKeys(db int) {
+	for watched, clients := range watchedKeys {
+		if watched.db != db {
+			continue
+		}
+		for c := range clients {
+			c.watchDirty = true
+		}
+	}
+}
+
+func watchKey(c *client, key string) {
+	watched := databaseKey{c.db, key}
+	if _, watching := c.watched[watched]; watching {
+		return
+	}
+
+	if watchedKeys[watched] == nil {
+		watchedKeys[watched] = map[*client]struct{}{}
+	}
+	watchedKeys[watched][c] = struct{}{}
+
+	if c.watched == nil {
+		c.watched = map[databaseKey]bool{}
+	}
+	c.watched[watched] = store.expiredButPresent(key)
+}
+
+func unwatchAllKeys(c *client) {
+	for key := range c.watched {
+		delete(watchedKeys[key], c)
+		if len(watchedKeys[key]) == 0 {
+			delete(watchedKeys, key)
+		}
+	}
+
+	c.watched = nil
+	c.watchDirty = false
+}
+
+// releaseWatches drops the keys watched by a client whose connection has closed
+func releaseWatches(c *client) {
+	executionLock.Lock()
+	defer executionLock.Unlock()
+
+	unwatchAllKeys(c)
+}
+
+// watchFailed reports whether a watched key changed since WATCH, including by expiring
+// since, which doesn't otherwise count as a modification until the key is evicted
+func watchFailed(c *client) bool {
+	if c.watchDirty {
+		return true
+	}
+
+	for watched, expiredAtWatch := range c.watched {
+		if !expiredAtWatch && databases[watched.db].expiredButPresent(watched.key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func discardTransaction(c *client) {
+	c.inMulti = false
+	c.queued = nil
+	c.multiAborted = false
+	unwatchAllKeys(c)
+}
+
+func handleMulti(c *client, array []string) ([]byte, error) {
+	if c.inMulti {
+		return nil, newCommandError("ERR", "MULTI calls can not be nested")
+	}
+
+	c.inMulti = true
+	return encodeSimpleString("OK"), nil
+}
+
+func handleExec(c *client, array []string) ([]byte, error) {
+	if !c.inMulti {
+		return nil, noMultiError("EXEC")
+	}
+
+	queued, aborted, failed := c.queued, c.multiAborted, watchFailed(c)
+	discardTransaction(c)
+
+	if aborted {
+		return nil, errExecAbort
+	}
+	if failed {
+		return encodeNullArray(c.protocol), nil
+	}
+
+	replies := make([][]byte, 0, len(queued))
+	propagateAtomically(func() {
+		c.denyBlocking = true
+		for _, command := range queued {
+			replies = append(replies, execQueuedCommand(c, command))
+		}
+		c.denyBlocking = false
+	})
+
+	return encodeArray(replies), nil
+}
+
+// execQueuedCommand runs a command queued by MULTI, while EXEC holds executionLock;
+// blocking commands behave as if they timed out straight away when they can't be served
+func execQueuedCommand(c *client, array []string) []byte {
+	spec, err := resolveCommand(array)
+	if err == nil {
+		var output []byte
+		if spec.hasFlag("blocking") {
+			output, err = spec.Handler(c, array)
+		} else {
+			output, err = runCommand(c, spec, array)
+		}
+		if err == nil {
+			if output == nil {
+				return encodeNull(c.protocol)
+			}
+			return output
+		}
+	}
+
+	return encodeCommandError(err)
+}
+
+func handleDiscard(c *client, array []string) ([]byte, error) {
+	if !c.inMulti {
+		return nil, noMultiError("DISCARD")
+	}
+
+	discardTransaction(c)
+	return encodeSimpleString("OK"), nil
+}
+
+func handleWatch(c *client, array []string) ([]byte, error) {
+	if c.inMulti {
+		return nil, newCommandError("ERR", "WATCH inside MULTI is not allowed")
+	}
+
+	for _, key := range array[1:] {
+		watchKey(c, key)
+	}
+
+	return encodeSimpleString("OK"), nil
+}
+
+func handleUnwatch(c *client, array []string) ([]byte, error) {
+	unwatchAllKeys(c)
+	return encodeSimpleString("OK"), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "multi", Arity: 1, Flags: []string{"noscript", "loading", "stale", "fast", "allow_busy"},
+			Group: "transactions", Summary: "Starts a transaction.", Since: "1.2.0",
+			Handler: handleMulti,
+		},
+		&commandSpec{
+			Name: "exec", Arity: 1, Flags: []string{"noscript", "loading", "stale", "skip_slowlog"},
+			Group: "transactions", Summary: "Executes all commands in a transaction.", Since: "1.2.0",
+			Handler: handleExec,
+		},
+		&commandSpec{
+			Name: "discard", Arity: 1, Flags: []string{"noscript", "loading", "stale", "fast", "allow_busy"},
+			Group: "transactions", Summary: "Discards a transaction.", Since: "2.0.0",
+			Handler: handleDiscard,
+		},
+		&commandSpec{
+			Name: "watch", Arity: -2, Flags: []string{"noscript", "loading", "stale", "fast", "allow_busy"},
+			FirstKey: 1, LastKey: -1, KeyStep: 1, Group: "transactions",
+			Summary: "Monitors changes to keys to determine the execution of a transaction.", Since: "2.2.0",
+			Handler: handleWatch,
+		},
+		&commandSpec{
+			Name: "unwatch", Arity: 1, Flags: []string{"noscript", "loading", "stale", "fast", "allow_busy"},
+			Group: "transactions", Summary: "Forgets about watched keys of a transaction.", Since: "2.2.0",
+			Handler: handleUnwatch,
+		},
+	)
+}
@@ -1,14 +1,13 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"path"
-	"reflect"
 	"strconv"
-	"unicode"
+	"strings"
 )
 
 func parseFlags() {
@@ -16,12 +15,63 @@ func parseFlags() {
 	dbFilename := flag.String("dbfilename", "", "RDB file name")
 	port := flag.String("port", "", "Redis server port")
 	master := flag.String("replicaof", "", "Master host and port")
+	databaseCount := flag.Int("databases", 16, "Number of databases")
+	save := flag.String("save", defaultSavePoints, "Save points, as pairs of seconds and changes")
+	stopWrites := flag.String("stop-writes-on-bgsave-error", "yes", "Refuse writes while saving fails")
+	rdbCompression := flag.String("rdbcompression", "yes", "Compress strings in RDB files")
+	rdbChecksum := flag.String("rdbchecksum", "yes", "Checksum RDB files")
+	appendOnly := flag.String("appendonly", "no", "Log every write to an append-only file")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "Base name of the append-only files")
+	appendDirname := flag.String("appenddirname", "appendonlydir", "Directory of the append-only files, in the RDB file's directory")
+	appendFsync := flag.String("appendfsync", aofFsyncEverysec, "When to fsync the append-only file: always, everysec or no")
+	aofLoadTruncated := flag.String("aof-load-truncated", "yes", "Load an append-only file that ends in an incomplete command")
+	aofUseRDBPreamble := flag.String("aof-use-rdb-preamble", "yes", "Rewrite the append-only file's base in RDB format")
+	autoRewritePercentage := flag.String("auto-aof-rewrite-percentage", "100", "Rewrite the append-only file once it grows by this percentage")
+	autoRewriteMinSize := flag.String("auto-aof-rewrite-min-size", "64mb", "Smallest append-only file to rewrite automatically")
 
 	flag.Parse()
 
+	persistenceConfig := map[string]string{
+		"save":                        *save,
+		"stop-writes-on-bgsave-error": *stopWrites,
+		"rdbcompression":              *rdbCompression,
+		"rdbchecksum":                 *rdbChecksum,
+		"appendonly":                  *appendOnly,
+		"appendfsync":                 *appendFsync,
+		"aof-load-truncated":          *aofLoadTruncated,
+		"aof-use-rdb-preamble":        *aofUseRDBPreamble,
+		"auto-aof-rewrite-percentage": *autoRewritePercentage,
+		"auto-aof-rewrite-min-size":   *autoRewriteMinSize,
+	}
+	for name, value := range persistenceConfig {
+		if err := setConfig(name, value); err != nil {
+			fmt.Printf("Problem: invalid value for -%s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+
 	configRDB["dir"] = *dir
 	configRDB["dbfilename"] = *dbFilename
 
+	if *databaseCount < 1 {
+		fmt.Println("Problem: databases must be at least 1")
+		os.Exit(1)
+	}
+	databases = newDatabases(*databaseCount)
+	store = databases[0]
+	configRDB["databases"] = strconv.Itoa(*databaseCount)
+
+	if strings.ContainsRune(*appendFilename, '/') {
+		fmt.Println("Problem: appendfilename can't be a path, just a filename")
+		os.Exit(1)
+	}
+	if strings.ContainsRune(*appendDirname, '/') {
+		fmt.Println("Problem: appenddirname can't be a path, just a dirname")
+		os.Exit(1)
+	}
+	configRDB["appendfilename"] = *appendFilename
+	configRDB["appenddirname"] = *appendDirname
+
 	// Set RDB config data
 	if *dir == "" || *dbFilename == "" {
 		// should choose a different home, since it isn't a temporary file
@@ -52,215 +102,248 @@ func parseFlags() {
 	configRepl["master"] = *master
 }
 
-func parseRESP(RESPContent []byte) ([][]string, []int, error) {
-	// first parameter represents the decoded text
-	// second parameter represents the purpose of text each one is
-	//   (0 for RDB file contents, 1 for command, 2 for other)
+func encodeSimpleString(output string) []byte {
+	result := fmt.Sprintf("+%s\r\n", output)
+	return []byte(result)
+}
 
-	contentLength := len(RESPContent)
-	results := [][]string{}
-	RESPTypes := []int{} // representing the type of each RESP segment (e.g. simple string, bulk string, bulk array)
-	purposes := []int{}  // representing the purpose of each text
+func encodeBulkString(output string) []byte {
+	result := fmt.Sprintf("$%d\r\n%s\r\n", len(output), output)
+	return []byte(result)
+}
 
-	i := 0
-	for i < contentLength-1 {
-		RESPType, err := categoriseRESPType(string(RESPContent[i]))
-		if err != nil {
-			return nil, nil, err
-		}
+func encodeBulkArray(output []string) []byte {
+	result := fmt.Appendf(nil, "*%d\r\n", len(output))
 
-		switch RESPType {
-		case 0:
-			j := i + 1
-			for j < len(RESPContent)-1 && RESPContent[j] != 13 && RESPContent[j+1] != 10 {
-				j++
-			}
-
-			results = append(results, []string{string(RESPContent[i+1 : j])})
-			RESPTypes = append(RESPTypes, 0)
-			purposes = append(purposes, 2)
-
-			i = j + 2
-		case 1:
-			j := i + 1
-
-			for j < len(RESPContent) && unicode.IsDigit(rune(RESPContent[j])) {
-				j++
-			}
-
-			lengthStr := string(RESPContent[i+1 : j])
-			length, err := strconv.Atoi(lengthStr)
-			if err != nil {
-				fmt.Println("Problem: error thrown when parsing Redis array (1)")
-			}
-
-			i += 3 + len(lengthStr)
-
-			results = append(results, []string{string(RESPContent[i : i+length])})
-			RESPTypes = append(RESPTypes, 1)
-			purposes = append(purposes, 0)
-
-			i += length
-			if i < len(RESPContent)-1 && RESPContent[i] == 13 && RESPContent[i+1] == 10 {
-				i += 2
-			}
-		case 2:
-			j := i + 1
-
-			for j < len(RESPContent) && unicode.IsDigit(rune(RESPContent[j])) {
-				j++
-			}
-
-			lengthStr := string(RESPContent[i+1 : j])
-			length, err := strconv.Atoi(lengthStr)
-			if err != nil {
-				fmt.Println("Problem: error thrown when parsing Redis array (1)")
-				os.Exit(1)
-			}
-
-			i += 3 + len(lengthStr)
-
-			result := []string{}
-			for range length {
-				k := i + 1
-				for k < len(RESPContent) && unicode.IsDigit(rune(RESPContent[k])) {
-					k++
-				}
-
-				wordLengthStr := string(RESPContent[i+1 : k])
-				wordLength, err := strconv.Atoi(wordLengthStr)
-				if err != nil {
-					fmt.Println("Problem: error thrown when parsing Redis array (2)")
-					os.Exit(1)
-				}
-
-				i += 3 + len(wordLengthStr)
-
-				result = append(result, string(RESPContent[i:i+wordLength]))
-
-				i += 2 + wordLength
-			}
-
-			results = append(results, result)
-			RESPTypes = append(RESPTypes, 2)
-			purposes = append(purposes, 1)
-		default:
-			return nil, nil, errors.New("first character is not a valid option")
-		}
+	for _, o := range output {
+		result = fmt.Appendf(result, "$%d\r\n%s\r\n", len(o), o)
 	}
 
-	return results, purposes, nil
+	return result
 }
 
-func categoriseRESPType(firstLetter string) (int, error) {
-	if len(firstLetter) != 1 {
-		return -1, errors.New("argument must be a single character")
+// encodeArray wraps already-encoded RESP elements in an array
+func encodeArray(elements [][]byte) []byte {
+	result := fmt.Appendf(nil, "*%d\r\n", len(elements))
+	for _, element := range elements {
+		result = append(result, element...)
 	}
 
-	switch firstLetter {
-	case "+":
-		return 0, nil
-	case "$":
-		return 1, nil
-	case "*":
-		return 2, nil
-	default:
-		fmt.Println(firstLetter)
-		return -1, errors.New("first character is not a valid option")
-	}
+	return result
 }
 
-// func parseRedisArray(RESPArray []byte) ([][]string, []int) {
-// 	// first parameter represents the decoded text
-// 	// second parameter represents the type of text each one is (0 for RDB file contents, 1 for command)
+func encodeError(message string) []byte {
+	result := fmt.Sprintf("-%s\r\n", message)
+	return []byte(result)
+}
 
-// 	segmentLength := len(RESPArray)
-// 	results := [][]string{}
-// 	types := []int{}
+func encodeInteger(num int) []byte {
+	result := fmt.Sprintf(":%d\r\n", num)
+	return []byte(result)
+}
 
-// 	i := 0 // array pointers
-// 	for i < segmentLength-1 {
-// 		j := i + 1
+func encodeRDBFile(length int, content []byte) []byte {
+	result := append(fmt.Appendf(nil, "$%d\r\n", length), content...)
+	return result
+}
 
-// 		for j < len(RESPArray) && unicode.IsDigit(rune(RESPArray[j])) {
-// 			j++
-// 		}
+func nullBulkString() []byte {
+	result := "$-1\r\n"
+	return []byte(result)
+}
 
-// 		lengthStr := string(RESPArray[i+1 : j])
-// 		length, err := strconv.Atoi(lengthStr)
-// 		if err != nil {
-// 			fmt.Println("Problem: error thrown when parsing Redis array (1)")
-// 			os.Exit(1)
-// 		}
+// The encoders below depend on the protocol version negotiated by the connection (see HELLO):
+// RESP3 has dedicated types for these replies, while RESP2 falls back to the closest RESP2 shape
 
-// 		i += 3 + len(lengthStr) // shift right from `[length]\r\n`
+const (
+	resp2 = 2
+	resp3 = 3
+)
 
-// 		result := []string{}
-// 		for range length {
-// 			k := i + 1
-// 			for k < len(RESPArray) && unicode.IsDigit(rune(RESPArray[k])) {
-// 				k++
-// 			}
+func encodeNull(protocol int) []byte {
+	if protocol == resp3 {
+		return []byte("_\r\n")
+	}
+	return nullBulkString()
+}
 
-// 			wordLengthStr := string(RESPArray[i+1 : k])
-// 			wordLength, err := strconv.Atoi(wordLengthStr)
-// 			if err != nil {
-// 				fmt.Println("Problem: error thrown when parsing Redis array (2)")
-// 				os.Exit(1)
-// 			}
+func encodeNullArray(protocol int) []byte {
+	if protocol == resp3 {
+		return []byte("_\r\n")
+	}
+	return []byte("*-1\r\n")
+}
 
-// 			i += 3 + len(wordLengthStr)
-// 			end := i + wordLength
+// encodeMap encodes alternating, already-encoded keys and values
+func encodeMap(protocol int, elements [][]byte) []byte {
+	if protocol != resp3 {
+		return encodeArray(elements)
+	}
 
-// 			element := RESPArray[i:end]
-// 			result = append(result, string(element))
+	result := fmt.Appendf(nil, "%%%d\r\n", len(elements)/2)
+	for _, element := range elements {
+		result = append(result, element...)
+	}
+	return result
+}
 
-// 			i = end + 2
-// 		}
+// encodeBulkMap encodes alternating keys and values that are all bulk strings
+func encodeBulkMap(protocol int, pairs []string) []byte {
+	elements := make([][]byte, len(pairs))
+	for i, pair := range pairs {
+		elements[i] = encodeBulkString(pair)
+	}
+	return encodeMap(protocol, elements)
+}
+
+func encodeSet(protocol int, elements [][]byte) []byte {
+	if protocol != resp3 {
+		return encodeArray(elements)
+	}
+
+	result := fmt.Appendf(nil, "~%d\r\n", len(elements))
+	for _, element := range elements {
+		result = append(result, element...)
+	}
+	return result
+}
 
-// 		results = append(results, result)
-// 	}
+func encodeBulkSet(protocol int, members []string) []byte {
+	elements := make([][]byte, len(members))
+	for i, member := range members {
+		elements[i] = encodeBulkString(member)
+	}
+	return encodeSet(protocol, elements)
+}
 
-// 	return results
-// }
+// encodePush encodes out-of-band data such as pub/sub messages
+func encodePush(protocol int, elements [][]byte) []byte {
+	if protocol != resp3 {
+		return encodeArray(elements)
+	}
 
-func sliceEquals(first, second []string) bool {
-	return reflect.DeepEqual(first, second)
+	result := fmt.Appendf(nil, ">%d\r\n", len(elements))
+	for _, element := range elements {
+		result = append(result, element...)
+	}
+	return result
 }
 
-func encodeSimpleString(output string) []byte {
-	result := fmt.Sprintf("+%s\r\n", output)
-	return []byte(result)
+// encodeAttribute prefixes a reply with auxiliary key-value data, which RESP2 has no way to carry
+func encodeAttribute(protocol int, attributes [][]byte, reply []byte) []byte {
+	if protocol != resp3 {
+		return reply
+	}
+
+	result := fmt.Appendf(nil, "|%d\r\n", len(attributes)/2)
+	for _, attribute := range attributes {
+		result = append(result, attribute...)
+	}
+	return append(result, reply...)
 }
 
-func encodeBulkString(output string) []byte {
-	result := fmt.Sprintf("$%d\r\n%s\r\n", len(output), output)
-	return []byte(result)
+// formatDouble formats a score the way Redis does: whole numbers that fit in 62 bits as
+// integers, and anything else as the shortest digits that read back the same, only switching
+// to an exponent for magnitudes far from 1 (e.g. "1e-7" or "1.5e+300")
+func formatDouble(num float64) string {
+	switch {
+	case math.IsInf(num, 1):
+		return "inf"
+	case math.IsInf(num, -1):
+		return "-inf"
+	case math.IsNaN(num):
+		return "nan"
+	case num == 0 && math.Signbit(num):
+		return "-0"
+	case num == math.Trunc(num) && math.Abs(num) <= 1<<62:
+		return strconv.FormatInt(int64(num), 10)
+	}
+
+	sign := ""
+	if num < 0 {
+		sign = "-"
+	}
+	// the digits are worth 0.d1d2d3... times ten to the power of exponent+1
+	mantissa, exponentText, _ := strings.Cut(strconv.FormatFloat(math.Abs(num), 'e', -1, 64), "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	exponent, _ := strconv.Atoi(exponentText)
+	// the power of ten of the last digit
+	last := exponent - len(digits) + 1
+
+	switch {
+	case last >= 0 && exponent < len(digits)+7:
+		return sign + digits + strings.Repeat("0", last)
+	case last < 0 && (last > -7 || (exponent > -4 && exponent < 4)):
+		if exponent < 0 {
+			return sign + "0." + strings.Repeat("0", -exponent-1) + digits
+		}
+		return sign + digits[:exponent+1] + "." + digits[exponent+1:]
+	}
+
+	formatted := sign + digits[:1]
+	if len(digits) > 1 {
+		formatted += "." + digits[1:]
+	}
+	if exponent < 0 {
+		return formatted + "e-" + strconv.Itoa(-exponent)
+	}
+	return formatted + "e+" + strconv.Itoa(exponent)
 }
 
-func encodeBulkArray(output []string) []byte {
-	result := fmt.Sprintf("*%d\r\n", len(output))
+// parseInteger parses an argument as a 64-bit integer the way Redis does, only
+// accepting its canonical form (no '+' sign, spaces or leading zeros)
+func parseInteger(input string) (int64, bool) {
+	num, err := strconv.ParseInt(input, 10, 64)
+	if err != nil || strconv.FormatInt(num, 10) != input {
+		return 0, false
+	}
+	return num, true
+}
 
-	for _, o := range output {
-		result += fmt.Sprintf("$%d\r\n%s\r\n", len(o), o)
+func parseDouble(input string) (float64, error) {
+	switch strings.ToLower(input) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
 	}
+	return strconv.ParseFloat(input, 64)
+}
 
-	return []byte(result)
+func encodeDouble(protocol int, num float64) []byte {
+	if protocol != resp3 {
+		return encodeBulkString(formatDouble(num))
+	}
+	return fmt.Appendf(nil, ",%s\r\n", formatDouble(num))
 }
 
-func encodeInteger(num int) []byte {
-	result := fmt.Sprintf(":%d\r\n", num)
-	return []byte(result)
+func encodeBoolean(protocol int, value bool) []byte {
+	if protocol != resp3 {
+		if value {
+			return encodeInteger(1)
+		}
+		return encodeInteger(0)
+	}
+
+	if value {
+		return []byte("#t\r\n")
+	}
+	return []byte("#f\r\n")
 }
 
-func encodeRDBFile(length int, content []byte) []byte {
-	result := append(fmt.Appendf(nil, "$%d\r\n", length), content...)
-	return result
+func encodeBigNumber(protocol int, num string) []byte {
+	if protocol != resp3 {
+		return encodeBulkString(num)
+	}
+	return fmt.Appendf(nil, "(%s\r\n", num)
 }
 
-func nullBulkString() []byte {
-	result := "$-1\r\n"
-	return []byte(result)
+// encodeVerbatimString encodes text along with its three-letter format, e.g. "txt" or "mkd"
+func encodeVerbatimString(protocol int, format, text string) []byte {
+	if protocol != resp3 {
+		return encodeBulkString(text)
+	}
+	return fmt.Appendf(nil, "=%d\r\n%s:%s\r\n", len(text)+4, format, text)
 }
 
 func toggleEndianBinary(input string) (string, error) {
@@ -280,17 +363,3 @@ func toggleEndianBinary(input string) (string, error) {
 
 	return output, nil
 }
-
-func toggleEndianHex(input string) (string, error) {
-	// toggles between little-endian and big-endian for hex strings
-	if len(input)%2 != 0 {
-		return "", errors.New("input HEX code must represent a whole number of bytes")
-	}
-
-	output := ""
-	for i := len(input) - 2; i >= 0; i -= 2 {
-		output += input[i : i+2]
-	}
-
-	return output, nil
-}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFormatDouble(t *testing.T) {
+	// as Redis replies with scores, through d2string and fpconv_dtoa
+	doubles := []struct {
+		num  float64
+		want string
+	}{
+		{0, "0"},
+		{math.Copysign(0, -1), "-0"},
+		{1e6, "1000000"},
+		{1.7e12, "1700000000000"},
+		{1000001000000, "1000001000000"},
+		// a 52-bit geohash, as GEOADD scores members
+		{3479099956230698, "3479099956230698"},
+		{1 << 62, "4611686018427387904"},
+		{1 << 63, "9223372036854776000"},
+		{-2.5, "-2.5"},
+		{0.1, "0.1"},
+		{123456.789, "123456.789"},
+		{1.0000001234, "1.0000001234"},
+		{0.000001, "0.000001"},
+		{1e-7, "1e-7"},
+		{3.14159e-10, "3.14159e-10"},
+		{1e20, "1e+20"},
+		{-1.5e300, "-1.5e+300"},
+		{math.Inf(1), "inf"},
+		{math.Inf(-1), "-inf"},
+	}
+	for _, double := range doubles {
+		if got := formatDouble(double.num); got != double.want {
+			t.Errorf("formatDouble(%v) = %q, want %q", double.num, got, double.want)
+		}
+	}
+}
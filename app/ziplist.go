@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// ziplists and zipmaps are the compact encodings listpacks replaced, which older RDB files
+// still hold. A ziplist has a header of its size, the offset of its last element and its
+// element count; each element records the length of the previous one (so the list can be
+// walked backwards), then its encoding and data
+const (
+	ziplistHeaderSize = 10
+	ziplistEnd        = 0xFF
+)
+
+var (
+	errCorruptZiplist = errors.New("corrupt ziplist")
+	errCorruptZipmap  = errors.New("corrupt zipmap")
+)
+
+// decodeZiplist returns every element of a ziplist, with integers written out in decimal
+func decodeZiplist(data []byte) ([]string, error) {
+	if len(data) < ziplistHeaderSize+1 || int(binary.LittleEndian.Uint32(data)) != len(data) {
+		return nil, errCorruptZiplist
+	}
+
+	elements := []string{}
+	i := ziplistHeaderSize
+	for data[i] != ziplistEnd {
+		// skip the previous element's length
+		if data[i] < 254 {
+			i++
+		} else {
+			i += 5
+		}
+		if i >= len(data) {
+			return nil, errCorruptZiplist
+		}
+
+		element, size, err := decodeZiplistElement(data[i:])
+		if err != nil {
+			return nil, err
+		}
+
+		i += size
+		if i >= len(data) {
+			return nil, errCorruptZiplist
+		}
+		elements = append(elements, element)
+	}
+
+	return elements, nil
+}
+
+// decodeZiplistElement decodes the element at the start of data, returning its value and
+// the size of its encoding and data
+func decodeZiplistElement(data []byte) (string, int, error) {
+	str := func(offset, length int) (string, int, error) {
+		if offset+length > len(data) {
+			return "", 0, errCorruptZiplist
+		}
+		return string(data[offset : offset+length]), offset + length, nil
+	}
+	integer := func(size int) (string, int, error) {
+		if 1+size > len(data) {
+			return "", 0, errCorruptZiplist
+		}
+		b := data[1 : 1+size]
+
+		var n int64
+		switch size {
+		case 1:
+			n = int64(int8(b[0]))
+		case 2:
+			n = int64(int16(binary.LittleEndian.Uint16(b)))
+		case 3:
+			n = int64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)
+		case 4:
+			n = int64(int32(binary.LittleEndian.Uint32(b)))
+		default:
+			n = int64(binary.LittleEndian.Uint64(b))
+		}
+		return strconv.FormatInt(n, 10), 1 + size, nil
+	}
+
+	b := data[0]
+	switch b >> 6 {
+	case 0:
+		return str(1, int(b&0x3F))
+	case 1:
+		if len(data) < 2 {
+			return "", 0, errCorruptZiplist
+		}
+		return str(2, int(b&0x3F)<<8|int(data[1]))
+	case 2:
+		if len(data) < 5 {
+			return "", 0, errCorruptZiplist
+		}
+		return str(5, int(binary.BigEndian.Uint32(data[1:])))
+	}
+
+	switch b {
+	case 0xC0:
+		return integer(2)
+	case 0xD0:
+		return integer(4)
+	case 0xE0:
+		return integer(8)
+	case 0xF0:
+		return integer(3)
+	case 0xFE:
+		return integer(1)
+	}
+	// small integers are held in the encoding itself
+	if b >= 0xF1 && b <= 0xFD {
+		return strconv.Itoa(int(b&0x0F) - 1), 1, nil
+	}
+
+	return "", 0, errCorruptZiplist
+}
+
+// decodeZipmap returns the fields and values of a zipmap, the encoding of small hashes
+// before ziplists, alternating. Each length is a byte, or 254 followed by four bytes, and
+// each value is followed by a byte counting the free space after it
+func decodeZipmap(data []byte) ([]string, error) {
+	if len(data) < 2 {
+		return nil, errCorruptZipmap
+	}
+
+	i := 1
+	length := func() (int, bool) {
+		switch {
+		case i >= len(data):
+			return 0, false
+		case data[i] < 254:
+			i++
+			return int(data[i-1]), true
+		case data[i] == 254 && i+5 <= len(data):
+			i += 5
+			return int(binary.LittleEndian.Uint32(data[i-4:])), true
+		default:
+			return 0, false
+		}
+	}
+
+	elements := []string{}
+	for i < len(data) && data[i] != 255 {
+		fieldLength, ok := length()
+		if !ok || i+fieldLength > len(data) {
+			return nil, errCorruptZipmap
+		}
+		field := string(data[i : i+fieldLength])
+		i += fieldLength
+
+		valueLength, ok := length()
+		if !ok || i+1+valueLength > len(data) {
+			return nil, errCorruptZipmap
+		}
+		free := int(data[i])
+		value := string(data[i+1 : i+1+valueLength])
+		i += 1 + valueLength + free
+
+		elements = append(elements, field, value)
+	}
+	if i >= len(data) {
+		return nil, errCorruptZipmap
+	}
+
+	return elements, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ziplistFixture holds an element in each of a ziplist's string and integer encodings, each
+// after the length of the one before it
+const ziplistFixture = `
+	88000000820000000e00                                              // zlbytes, zltail, zllen
+	000161                                                            // "a"
+	0340407878787878787878787878787878787878787878787878787878787878  // 64 x's
+	7878787878787878787878787878787878787878787878787878787878787878
+	787878
+	43f1                                                              // 0
+	02fd                                                              // 12
+	02fe0d                                                            // 13
+	03fe80                                                            // -128
+	03c0e803                                                          // 1000
+	04c00080                                                          // -32768
+	04f0a08601                                                        // 100000
+	05f0000080                                                        // -8388608
+	05d080969800                                                      // 10000000
+	06d000000080                                                      // -2147483648
+	06e00000000000010000                                              // 1099511627776
+	0a03656e64                                                        // "end"
+	ff                                                                // end
+`
+
+func TestDecodeZiplist(t *testing.T) {
+	data := decodeFixture(t, ziplistFixture)
+
+	elements, err := decodeZiplist(data)
+	if err != nil {
+		t.Fatalf("decodeZiplist: %v", err)
+	}
+	want := []string{"a", strings.Repeat("x", 64), "0", "12", "13", "-128", "1000", "-32768", "100000",
+		"-8388608", "10000000", "-2147483648", "1099511627776", "end"}
+	if !slices.Equal(elements, want) {
+		t.Errorf("decodeZiplist = %q, want %q", elements, want)
+	}
+
+	// the header's size must match, and the data must end where it says
+	for _, corrupt := range [][]byte{data[:len(data)-1], append(slices.Clone(data), 0xff), data[:5]} {
+		if _, err := decodeZiplist(corrupt); err == nil {
+			t.Errorf("decodeZiplist accepted %d bytes of a %d-byte ziplist", len(corrupt), len(data))
+		}
+	}
+	truncated := slices.Clone(data[:len(data)-3])
+	truncated[0] = byte(len(truncated))
+	if _, err := decodeZiplist(truncated); err == nil {
+		t.Error("decodeZiplist accepted a ziplist without its end")
+	}
+}
+
+func TestDecodeZipmap(t *testing.T) {
+	data := decodeFixture(t, `
+		02                // zmlen
+		016b              // "k"
+		0302767676 7a7a   // "vvv", with 2 free bytes after it
+		026b32            // "k2"
+		0000              // ""
+		ff                // end
+	`)
+
+	pairs, err := decodeZipmap(data)
+	if err != nil {
+		t.Fatalf("decodeZipmap: %v", err)
+	}
+	if want := []string{"k", "vvv", "k2", ""}; !slices.Equal(pairs, want) {
+		t.Errorf("decodeZipmap = %q, want %q", pairs, want)
+	}
+
+	if _, err := decodeZipmap(data[:6]); err == nil {
+		t.Error("decodeZipmap accepted a truncated zipmap")
+	}
+}
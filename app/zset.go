@@ -0,0 +1,1340 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type zsetItem struct {
+	member string
+	score  float64
+}
+
+// zsetValue is a sorted set: the skiplist orders members by score for range queries and
+// ranks, while the map gives O(1) score lookups by member
+type zsetValue struct {
+	dict map[string]float64
+	zsl  *skiplist
+	// index lets ZSCAN iterate over the members
+	index *scanTable
+}
+
+func newZsetValue() *zsetValue {
+	return &zsetValue{dict: map[string]float64{}, zsl: newSkiplist(), index: newScanTable()}
+}
+
+func (z *zsetValue) len() int {
+	return len(z.dict)
+}
+
+func (z *zsetValue) score(member string) (float64, bool) {
+	score, exists := z.dict[member]
+	return score, exists
+}
+
+// set adds a member or changes its score, reporting whether the member is new
+func (z *zsetValue) set(member string, score float64) bool {
+	if current, exists := z.dict[member]; exists {
+		if current != score {
+			z.zsl.updateScore(current, member, score)
+			z.dict[member] = score
+		}
+		return false
+	}
+
+	z.zsl.insert(score, member)
+	z.dict[member] = score
+	z.index.add(member)
+	return true
+}
+
+func (z *zsetValue) remove(member string) bool {
+	score, exists := z.dict[member]
+	if !exists {
+		return false
+	}
+
+	z.zsl.delete(score, member)
+	delete(z.dict, member)
+	z.index.remove(member)
+	return true
+}
+
+// rank returns the 0-based rank of a member, counted from the highest score when reversed
+func (z *zsetValue) rank(member string, reverse bool) (int, bool) {
+	score, exists := z.dict[member]
+	if !exists {
+		return 0, false
+	}
+
+	rank := z.zsl.rank(score, member)
+	if reverse {
+		return z.len() - rank, true
+	}
+	return rank - 1, true
+}
+
+// items returns every member in order
+func (z *zsetValue) items() []zsetItem {
+	return z.rangeByRank(0, z.len()-1, false)
+}
+
+// rangeByRank returns the members with 0-based ranks from start to stop inclusive
+func (z *zsetValue) rangeByRank(start, stop int, reverse bool) []zsetItem {
+	items := make([]zsetItem, 0, stop-start+1)
+	if stop < start {
+		return items
+	}
+
+	var x *skiplistNode
+	if reverse {
+		x = z.zsl.byRank(z.len() - start)
+	} else {
+		x = z.zsl.byRank(start + 1)
+	}
+
+	for n := start; n <= stop && x != nil; n++ {
+		items = append(items, zsetItem{x.member, x.score})
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+
+	return items
+}
+
+// rangeByScore returns the members within a range of scores, after skipping offset of them
+// and taking at most limit (negative meaning no limit)
+func (z *zsetValue) rangeByScore(r *scoreRange, reverse bool, offset, limit int) []zsetItem {
+	var x *skiplistNode
+	if reverse {
+		x = z.zsl.lastInScoreRange(r)
+	} else {
+		x = z.zsl.firstInScoreRange(r)
+	}
+
+	items := []zsetItem{}
+	for x != nil && limit != 0 {
+		if reverse && !r.aboveMin(x.score) || !reverse && !r.belowMax(x.score) {
+			break
+		}
+
+		if offset > 0 {
+			offset--
+		} else {
+			items = append(items, zsetItem{x.member, x.score})
+			limit--
+		}
+
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+
+	return items
+}
+
+// rangeByLex is rangeByScore for a range of members
+func (z *zsetValue) rangeByLex(r *lexRange, reverse bool, offset, limit int) []zsetItem {
+	var x *skiplistNode
+	if reverse {
+		x = z.zsl.lastInLexRange(r)
+	} else {
+		x = z.zsl.firstInLexRange(r)
+	}
+
+	items := []zsetItem{}
+	for x != nil && limit != 0 {
+		if reverse && !r.aboveMin(x.member) || !reverse && !r.belowMax(x.member) {
+			break
+		}
+
+		if offset > 0 {
+			offset--
+		} else {
+			items = append(items, zsetItem{x.member, x.score})
+			limit--
+		}
+
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+
+	return items
+}
+
+// countBetween counts the members from first to last inclusive, using their ranks
+func (z *zsetValue) countBetween(first, last *skiplistNode) int {
+	if first == nil || last == nil {
+		return 0
+	}
+
+	return z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1
+}
+
+func (z *zsetValue) clone() *zsetValue {
+	copied := newZsetValue()
+	for _, item := range z.items() {
+		copied.set(item.member, item.score)
+	}
+
+	return copied
+}
+
+// getZset looks up a sorted set for reading or modifying; a missing key gives a nil set
+func getZset(key string) (*zsetValue, error) {
+	e, err := store.getTyped(key, zsetType)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	return e.Value.(*zsetValue), nil
+}
+
+// zsetChanged records a modification of the sorted set at key, deleting it once it's empty
+func zsetChanged(key string, z *zsetValue) {
+	if z.len() == 0 {
+		store.delete(key)
+	} else {
+		store.modified(key)
+	}
+}
+
+// storeZset replaces whatever is held at key with a sorted set, or deletes the key if it's empty
+func storeZset(key string, z *zsetValue) {
+	if z.len() == 0 {
+		store.delete(key)
+		return
+	}
+
+	store.set(key, &entry{Type: zsetType, Value: z})
+}
+
+// parseScore parses a score the way Redis does, accepting "inf" but not "nan"
+func parseScore(arg string) (float64, bool) {
+	score, err := parseDouble(arg)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+
+	return score, true
+}
+
+func parseScoreRange(minArg, maxArg string) (*scoreRange, error) {
+	r := &scoreRange{}
+	for _, bound := range []struct {
+		arg       string
+		value     *float64
+		exclusive *bool
+	}{{minArg, &r.min, &r.minExclusive}, {maxArg, &r.max, &r.maxExclusive}} {
+		arg := bound.arg
+		if strings.HasPrefix(arg, "(") {
+			*bound.exclusive = true
+			arg = arg[1:]
+		}
+
+		value, ok := parseScore(arg)
+		if !ok {
+			return nil, newCommandError("ERR", "min or max is not a float")
+		}
+		*bound.value = value
+	}
+
+	return r, nil
+}
+
+func parseLexBound(arg string) (lexBound, bool) {
+	switch {
+	case arg == "-":
+		return lexBound{exclusive: true, infinity: -1}, true
+	case arg == "+":
+		return lexBound{exclusive: true, infinity: 1}, true
+	case strings.HasPrefix(arg, "("):
+		return lexBound{value: arg[1:], exclusive: true}, true
+	case strings.HasPrefix(arg, "["):
+		return lexBound{value: arg[1:]}, true
+	default:
+		return lexBound{}, false
+	}
+}
+
+func parseLexRange(minArg, maxArg string) (*lexRange, error) {
+	min, minOK := parseLexBound(minArg)
+	max, maxOK := parseLexBound(maxArg)
+	if !minOK || !maxOK {
+		return nil, newCommandError("ERR", "min or max not valid string range item")
+	}
+
+	return &lexRange{min: min, max: max}, nil
+}
+
+// encodeZsetItems encodes members, optionally with their scores, which RESP3 pairs up
+func encodeZsetItems(protocol int, items []zsetItem, withScores bool) []byte {
+	elements := make([][]byte, 0, len(items))
+	for _, item := range items {
+		switch {
+		case !withScores:
+			elements = append(elements, encodeBulkString(item.member))
+		case protocol == resp3:
+			elements = append(elements, encodeArray([][]byte{
+				encodeBulkString(item.member), encodeDouble(protocol, item.score),
+			}))
+		default:
+			elements = append(elements, encodeBulkString(item.member), encodeDouble(protocol, item.score))
+		}
+	}
+
+	return encodeArray(elements)
+}
+
+// handleZAdd implements ZADD and ZINCRBY, which behaves like ZADD with the INCR option
+func handleZAdd(c *client, array []string) ([]byte, error) {
+	key := array[1]
+	nx, xx, gt, lt, ch, incr := false, false, false, false, false, false
+
+	i := 2
+	if strings.EqualFold(array[0], "zincrby") {
+		incr = true
+	} else {
+	options:
+		for ; i < len(array); i++ {
+			switch strings.ToUpper(array[i]) {
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			case "GT":
+				gt = true
+			case "LT":
+				lt = true
+			case "CH":
+				ch = true
+			case "INCR":
+				incr = true
+			default:
+				break options
+			}
+		}
+	}
+
+	pairs := array[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, errSyntax
+	}
+	if nx && xx {
+		return nil, newCommandError("ERR", "XX and NX options at the same time are not compatible")
+	}
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		return nil, newCommandError("ERR", "GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) > 2 {
+		return nil, newCommandError("ERR", "INCR option supports a single increment-element pair")
+	}
+
+	// every score is checked before anything is changed
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, ok := parseScore(pairs[2*j])
+		if !ok {
+			return nil, errNotFloat
+		}
+		scores[j] = score
+	}
+
+	z, err := getZset(key)
+	if err != nil {
+		return nil, err
+	}
+
+	created := z == nil
+	if created {
+		if xx {
+			if incr {
+				return encodeNull(c.protocol), nil
+			}
+			return encodeInteger(0), nil
+		}
+		z = newZsetValue()
+	}
+
+	added, changed := 0, 0
+	var result float64
+	aborted := false
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		current, exists := z.score(member)
+
+		if exists && nx || !exists && xx {
+			aborted = true
+			continue
+		}
+
+		newScore := score
+		if incr && exists {
+			newScore = current + score
+			if math.IsNaN(newScore) {
+				return nil, newCommandError("ERR", "resulting score is not a number (NaN)")
+			}
+		}
+
+		if exists && (gt && newScore <= current || lt && newScore >= current) {
+			aborted = true
+			continue
+		}
+
+		if z.set(member, newScore) {
+			added++
+		} else if newScore != current {
+			changed++
+		}
+		result = newScore
+	}
+
+	if created && z.len() > 0 {
+		store.set(key, &entry{Type: zsetType, Value: z})
+	} else if added+changed > 0 {
+		store.modified(key)
+	}
+
+	switch {
+	case incr && aborted:
+		return encodeNull(c.protocol), nil
+	case incr:
+		return encodeDouble(c.protocol, result), nil
+	case ch:
+		return encodeInteger(added + changed), nil
+	default:
+		return encodeInteger(added), nil
+	}
+}
+
+func handleZRem(c *client, array []string) ([]byte, error) {
+	key := array[1]
+
+	z, err := getZset(key)
+	if err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return encodeInteger(0), nil
+	}
+
+	removed := 0
+	for _, member := range array[2:] {
+		if z.remove(member) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		zsetChanged(key, z)
+	}
+
+	return encodeInteger(removed), nil
+}
+
+func handleZScore(c *client, array []string) ([]byte, error) {
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return encodeNull(c.protocol), nil
+	}
+
+	score, exists := z.score(array[2])
+	if !exists {
+		return encodeNull(c.protocol), nil
+	}
+
+	return encodeDouble(c.protocol, score), nil
+}
+
+func handleZMScore(c *client, array []string) ([]byte, error) {
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([][]byte, len(array)-2)
+	for i, member := range array[2:] {
+		score, exists := 0.0, false
+		if z != nil {
+			score, exists = z.score(member)
+		}
+
+		if exists {
+			results[i] = encodeDouble(c.protocol, score)
+		} else {
+			results[i] = encodeNull(c.protocol)
+		}
+	}
+
+	return encodeArray(results), nil
+}
+
+func handleZCard(c *client, array []string) ([]byte, error) {
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return encodeInteger(0), nil
+	}
+
+	return encodeInteger(z.len()), nil
+}
+
+// handleZCount implements ZCOUNT and ZLEXCOUNT
+func handleZCount(c *client, array []string) ([]byte, error) {
+	byLex := strings.EqualFold(array[0], "zlexcount")
+
+	var scores *scoreRange
+	var lex *lexRange
+	var err error
+	if byLex {
+		lex, err = parseLexRange(array[2], array[3])
+	} else {
+		scores, err = parseScoreRange(array[2], array[3])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return encodeInteger(0), nil
+	}
+
+	if byLex {
+		return encodeInteger(z.countBetween(z.zsl.firstInLexRange(lex), z.zsl.lastInLexRange(lex))), nil
+	}
+	return encodeInteger(z.countBetween(z.zsl.firstInScoreRange(scores), z.zsl.lastInScoreRange(scores))), nil
+}
+
+// handleZRank implements ZRANK and ZREVRANK
+func handleZRank(c *client, array []string) ([]byte, error) {
+	if len(array) > 4 || (len(array) == 4 && !strings.EqualFold(array[3], "WITHSCORE")) {
+		return nil, errSyntax
+	}
+	withScore := len(array) == 4
+
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	rank, exists := 0, false
+	if z != nil {
+		rank, exists = z.rank(array[2], strings.EqualFold(array[0], "zrevrank"))
+	}
+
+	switch {
+	case !exists && withScore:
+		return encodeNullArray(c.protocol), nil
+	case !exists:
+		return encodeNull(c.protocol), nil
+	case withScore:
+		score, _ := z.score(array[2])
+		return encodeArray([][]byte{encodeInteger(rank), encodeDouble(c.protocol, score)}), nil
+	default:
+		return encodeInteger(rank), nil
+	}
+}
+
+type zrangeKind int
+
+const (
+	zrangeByRank zrangeKind = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+// zrangeRequest holds the parsed arguments of any of the commands ZRANGE generalises
+type zrangeRequest struct {
+	key, destination string
+	kind             zrangeKind
+	reverse          bool
+	start, stop      string
+	offset, limit    int64
+	withScores       bool
+	hasLimit         bool
+}
+
+// parseZRange parses ZRANGE, ZRANGESTORE and the older ZREVRANGE, ZRANGEBYSCORE,
+// ZREVRANGEBYSCORE, ZRANGEBYLEX and ZREVRANGEBYLEX into a single form
+func parseZRange(array []string) (*zrangeRequest, error) {
+	command := strings.ToLower(array[0])
+	request := &zrangeRequest{limit: -1}
+
+	args := array[1:]
+	if command == "zrangestore" {
+		request.destination = args[0]
+		args = args[1:]
+	}
+	request.key, request.start, request.stop = args[0], args[1], args[2]
+
+	switch command {
+	case "zrevrange":
+		request.reverse = true
+	case "zrangebyscore":
+		request.kind = zrangeByScore
+	case "zrevrangebyscore":
+		request.kind, request.reverse = zrangeByScore, true
+	case "zrangebylex":
+		request.kind = zrangeByLex
+	case "zrevrangebylex":
+		request.kind, request.reverse = zrangeByLex, true
+	}
+
+	modern := command == "zrange" || command == "zrangestore"
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch {
+		case option == "WITHSCORES" && command != "zrangestore":
+			request.withScores = true
+		case option == "LIMIT" && i+2 < len(args):
+			offset, ok := parseInteger(args[i+1])
+			if !ok {
+				return nil, errNotInteger
+			}
+			limit, ok := parseInteger(args[i+2])
+			if !ok {
+				return nil, errNotInteger
+			}
+			request.offset, request.limit, request.hasLimit = offset, limit, true
+			i += 2
+		case option == "BYSCORE" && modern:
+			request.kind = zrangeByScore
+		case option == "BYLEX" && modern:
+			request.kind = zrangeByLex
+		case option == "REV" && modern:
+			request.reverse = true
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	if request.hasLimit && request.kind == zrangeByRank {
+		return nil, newCommandError("ERR", "syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if request.withScores && request.kind == zrangeByLex {
+		return nil, newCommandError("ERR", "syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	// the older reversed commands, and REV with BYSCORE or BYLEX, take the maximum first
+	if request.reverse && request.kind != zrangeByRank {
+		request.start, request.stop = request.stop, request.start
+	}
+
+	return request, nil
+}
+
+func (request *zrangeRequest) run(z *zsetValue) ([]zsetItem, error) {
+	switch request.kind {
+	case zrangeByScore:
+		r, err := parseScoreRange(request.start, request.stop)
+		if err != nil || z == nil || request.offset < 0 {
+			return nil, err
+		}
+		return z.rangeByScore(r, request.reverse, int(request.offset), int(request.limit)), nil
+	case zrangeByLex:
+		r, err := parseLexRange(request.start, request.stop)
+		if err != nil || z == nil || request.offset < 0 {
+			return nil, err
+		}
+		return z.rangeByLex(r, request.reverse, int(request.offset), int(request.limit)), nil
+	default:
+		start, ok := parseInteger(request.start)
+		if !ok {
+			return nil, errNotInteger
+		}
+		stop, ok := parseInteger(request.stop)
+		if !ok {
+			return nil, errNotInteger
+		}
+		if z == nil {
+			return nil, nil
+		}
+
+		first, last, nonEmpty := normaliseRange(start, stop, z.len())
+		if !nonEmpty {
+			return nil, nil
+		}
+		return z.rangeByRank(first, last, request.reverse), nil
+	}
+}
+
+// handleZRange implements ZRANGE, ZRANGESTORE and the older range commands
+func handleZRange(c *client, array []string) ([]byte, error) {
+	request, err := parseZRange(array)
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := getZset(request.key)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := request.run(z)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.destination != "" {
+		result := newZsetValue()
+		for _, item := range items {
+			result.set(item.member, item.score)
+		}
+		storeZset(request.destination, result)
+
+		return encodeInteger(result.len()), nil
+	}
+
+	return encodeZsetItems(c.protocol, items, request.withScores), nil
+}
+
+// handleZRemRange implements ZREMRANGEBYRANK, ZREMRANGEBYSCORE and ZREMRANGEBYLEX
+func handleZRemRange(c *client, array []string) ([]byte, error) {
+	key := array[1]
+	request := &zrangeRequest{key: key, start: array[2], stop: array[3], limit: -1}
+	switch strings.ToLower(array[0]) {
+	case "zremrangebyscore":
+		request.kind = zrangeByScore
+	case "zremrangebylex":
+		request.kind = zrangeByLex
+	}
+
+	z, err := getZset(key)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := request.run(z)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		z.remove(item.member)
+	}
+	if len(items) > 0 {
+		zsetChanged(key, z)
+	}
+
+	return encodeInteger(len(items)), nil
+}
+
+// popFromZset removes up to count of the lowest (or highest) scoring members
+func popFromZset(key string, z *zsetValue, max bool, count int) []zsetItem {
+	items := z.rangeByRank(0, min(count, z.len())-1, max)
+	for _, item := range items {
+		z.remove(item.member)
+	}
+	zsetChanged(key, z)
+
+	return items
+}
+
+// handleZPop implements ZPOPMIN and ZPOPMAX
+func handleZPop(c *client, array []string) ([]byte, error) {
+	if len(array) > 3 {
+		return nil, errSyntax
+	}
+
+	key := array[1]
+	max := strings.EqualFold(array[0], "zpopmax")
+
+	count, hasCount := int64(1), len(array) == 3
+	if hasCount {
+		var ok bool
+		count, ok = parseInteger(array[2])
+		if !ok || count < 0 {
+			return nil, errNotPositive
+		}
+	}
+
+	z, err := getZset(key)
+	if err != nil {
+		return nil, err
+	}
+	if z == nil || count == 0 {
+		return encodeArray(nil), nil
+	}
+
+	items := popFromZset(key, z, max, int(min(count, math.MaxInt32)))
+
+	// without a count, RESP3 still gets a flat member and score, as Redis does
+	if !hasCount {
+		return encodeArray([][]byte{
+			encodeBulkString(items[0].member), encodeDouble(c.protocol, items[0].score),
+		}), nil
+	}
+	return encodeZsetItems(c.protocol, items, true), nil
+}
+
+func parseZsetDirection(arg string) (bool, error) {
+	switch strings.ToUpper(arg) {
+	case "MIN":
+		return false, nil
+	case "MAX":
+		return true, nil
+	default:
+		return false, errSyntax
+	}
+}
+
+// popFromFirstZset pops from the first non-empty sorted set among keys, returning the key
+// popped from, or "" if they're all empty
+func popFromFirstZset(keys []string, max bool, count int) (string, []zsetItem, error) {
+	for _, key := range keys {
+		z, err := getZset(key)
+		if err != nil {
+			return "", nil, err
+		}
+		if z != nil {
+			return key, popFromZset(key, z, max, count), nil
+		}
+	}
+
+	return "", nil, nil
+}
+
+func encodeZMPopReply(protocol int, key string, items []zsetItem) []byte {
+	pairs := make([][]byte, len(items))
+	for i, item := range items {
+		pairs[i] = encodeArray([][]byte{encodeBulkString(item.member), encodeDouble(protocol, item.score)})
+	}
+
+	return encodeArray([][]byte{encodeBulkString(key), encodeArray(pairs)})
+}
+
+func handleZMPop(c *client, array []string) ([]byte, error) {
+	keys, max, count, err := parseMultiPopArgs(array[1:], parseZsetDirection)
+	if err != nil {
+		return nil, err
+	}
+
+	key, items, err := popFromFirstZset(keys, max, count)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return encodeNullArray(c.protocol), nil
+	}
+
+	return encodeZMPopReply(c.protocol, key, items), nil
+}
+
+// handleBlockingZPop implements BZPOPMIN and BZPOPMAX
+func handleBlockingZPop(c *client, array []string) ([]byte, error) {
+	command := strings.ToUpper(array[0])
+	keys := array[1 : len(array)-1]
+	max := command == "BZPOPMAX"
+
+	timeout, err := parseTimeout(array[len(array)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	return blockOn(c, keys, timeout, encodeNullArray(c.protocol), func() ([]byte, bool, error) {
+		key, items, err := popFromFirstZset(keys, max, 1)
+		if err != nil || key == "" {
+			return nil, false, err
+		}
+
+		c.propagateAs = [][]string{{command[1:], key}}
+		return encodeArray([][]byte{
+			encodeBulkString(key), encodeBulkString(items[0].member), encodeDouble(c.protocol, items[0].score),
+		}), true, nil
+	})
+}
+
+func handleBlockingZMPop(c *client, array []string) ([]byte, error) {
+	timeout, err := parseTimeout(array[1])
+	if err != nil {
+		return nil, err
+	}
+	keys, max, count, err := parseMultiPopArgs(array[2:], parseZsetDirection)
+	if err != nil {
+		return nil, err
+	}
+
+	return blockOn(c, keys, timeout, encodeNullArray(c.protocol), func() ([]byte, bool, error) {
+		key, items, err := popFromFirstZset(keys, max, count)
+		if err != nil || key == "" {
+			return nil, false, err
+		}
+
+		popCommand := "ZPOPMIN"
+		if max {
+			popCommand = "ZPOPMAX"
+		}
+		c.propagateAs = [][]string{{popCommand, key, strconv.Itoa(len(items))}}
+		return encodeZMPopReply(c.protocol, key, items), true, nil
+	})
+}
+
+// zsetInput is a sorted set or a plain set used as input to ZUNION, ZINTER or ZDIFF,
+// where set members count as having a score of 1
+type zsetInput struct {
+	z *zsetValue
+	s *setValue
+}
+
+func (in *zsetInput) len() int {
+	switch {
+	case in.z != nil:
+		return in.z.len()
+	case in.s != nil:
+		return in.s.len()
+	default:
+		return 0
+	}
+}
+
+func (in *zsetInput) score(member string) (float64, bool) {
+	switch {
+	case in.z != nil:
+		return in.z.score(member)
+	case in.s != nil:
+		return 1, in.s.contains(member)
+	default:
+		return 0, false
+	}
+}
+
+func (in *zsetInput) each(visit func(member string, score float64)) {
+	switch {
+	case in.z != nil:
+		for _, item := range in.z.items() {
+			visit(item.member, item.score)
+		}
+	case in.s != nil:
+		in.s.each(func(member string) {
+			visit(member, 1)
+		})
+	}
+}
+
+func getZsetInput(key string) (*zsetInput, error) {
+	e, exists := store.get(key)
+	if !exists {
+		return &zsetInput{}, nil
+	}
+
+	switch e.Type {
+	case zsetType:
+		return &zsetInput{z: e.Value.(*zsetValue)}, nil
+	case setType:
+		return &zsetInput{s: e.Value.(*setValue)}, nil
+	default:
+		return nil, errWrongType
+	}
+}
+
+// aggregateScores combines the scores a member has in different inputs
+func aggregateScores(aggregate string, current, score float64) float64 {
+	switch aggregate {
+	case "MIN":
+		return min(current, score)
+	case "MAX":
+		return max(current, score)
+	default:
+		// inf + -inf is treated as 0, as in Redis
+		if sum := current + score; !math.IsNaN(sum) {
+			return sum
+		}
+		return 0
+	}
+}
+
+// weightScore multiplies a score by its input's weight, treating 0 * inf as 0
+func weightScore(score, weight float64) float64 {
+	if weighted := score * weight; !math.IsNaN(weighted) {
+		return weighted
+	}
+	return 0
+}
+
+// handleZSetOperation implements ZUNION, ZINTER and ZDIFF, along with their STORE variants
+func handleZSetOperation(c *client, array []string) ([]byte, error) {
+	command := strings.ToLower(array[0])
+	operation := strings.TrimSuffix(command, "store")
+	storing := operation != command
+
+	args := array[1:]
+	destination := ""
+	if storing {
+		destination, args = args[0], args[1:]
+	}
+
+	numKeys, ok := parseInteger(args[0])
+	if !ok {
+		return nil, errNotInteger
+	}
+	if numKeys < 1 {
+		return nil, newCommandError("ERR", "at least 1 input key is needed for '%s' command", command)
+	}
+	if numKeys > int64(len(args)-1) {
+		return nil, errSyntax
+	}
+
+	keys := args[1 : 1+numKeys]
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate, withScores := "SUM", false
+
+	rest := args[1+numKeys:]
+	for i := 0; i < len(rest); i++ {
+		option := strings.ToUpper(rest[i])
+		switch {
+		case option == "WEIGHTS" && operation != "zdiff" && len(rest)-i-1 >= len(weights):
+			for j := range weights {
+				weight, ok := parseScore(rest[i+1+j])
+				if !ok {
+					return nil, newCommandError("ERR", "weight value is not a float")
+				}
+				weights[j] = weight
+			}
+			i += len(weights)
+		case option == "AGGREGATE" && operation != "zdiff" && i+1 < len(rest):
+			aggregate = strings.ToUpper(rest[i+1])
+			if aggregate != "SUM" && aggregate != "MIN" && aggregate != "MAX" {
+				return nil, errSyntax
+			}
+			i++
+		case option == "WITHSCORES" && !storing:
+			withScores = true
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	inputs := make([]*zsetInput, len(keys))
+	for i, key := range keys {
+		input, err := getZsetInput(key)
+		if err != nil {
+			return nil, err
+		}
+		inputs[i] = input
+	}
+
+	result := newZsetValue()
+	switch operation {
+	case "zunion":
+		for i, input := range inputs {
+			input.each(func(member string, score float64) {
+				score = weightScore(score, weights[i])
+				if current, exists := result.score(member); exists {
+					score = aggregateScores(aggregate, current, score)
+				}
+				result.set(member, score)
+			})
+		}
+	case "zinter":
+		// checking the members of the smallest input against the others does the least work
+		order := make([]int, len(inputs))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(a, b int) int {
+			return inputs[a].len() - inputs[b].len()
+		})
+
+		inputs[order[0]].each(func(member string, score float64) {
+			score = weightScore(score, weights[order[0]])
+			for _, i := range order[1:] {
+				other, exists := inputs[i].score(member)
+				if !exists {
+					return
+				}
+				score = aggregateScores(aggregate, score, weightScore(other, weights[i]))
+			}
+			result.set(member, score)
+		})
+	default:
+		inputs[0].each(func(member string, score float64) {
+			for _, other := range inputs[1:] {
+				if _, exists := other.score(member); exists {
+					return
+				}
+			}
+			result.set(member, score)
+		})
+	}
+
+	if storing {
+		storeZset(destination, result)
+		return encodeInteger(result.len()), nil
+	}
+	return encodeZsetItems(c.protocol, result.items(), withScores), nil
+}
+
+func handleZInterCard(c *client, array []string) ([]byte, error) {
+	numKeys, ok := parseInteger(array[1])
+	if !ok || numKeys <= 0 {
+		return nil, newCommandError("ERR", "numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(array)-2) {
+		return nil, newCommandError("ERR", "Number of keys can't be greater than number of args")
+	}
+
+	var limit int64
+	rest := array[2+numKeys:]
+	for i := 0; i < len(rest); i += 2 {
+		if !strings.EqualFold(rest[i], "LIMIT") || i+1 >= len(rest) {
+			return nil, errSyntax
+		}
+		limit, ok = parseInteger(rest[i+1])
+		if !ok {
+			return nil, errNotInteger
+		}
+		if limit < 0 {
+			return nil, newCommandError("ERR", "LIMIT can't be negative")
+		}
+	}
+
+	inputs := []*zsetInput{}
+	for _, key := range array[2 : 2+numKeys] {
+		input, err := getZsetInput(key)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, input)
+	}
+	slices.SortStableFunc(inputs, func(a, b *zsetInput) int {
+		return a.len() - b.len()
+	})
+
+	count := int64(0)
+	inputs[0].each(func(member string, score float64) {
+		if limit > 0 && count >= limit {
+			return
+		}
+		for _, other := range inputs[1:] {
+			if _, exists := other.score(member); !exists {
+				return
+			}
+		}
+		count++
+	})
+
+	return encodeInteger(int(count)), nil
+}
+
+func handleZScan(c *client, array []string) ([]byte, error) {
+	options, err := parseScanOptions(array[0], array[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := getZset(array[1])
+	if err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return encodeScanReply(0, nil), nil
+	}
+
+	cursor, members := z.index.scanBatch(options.cursor, options.count)
+
+	results := []string{}
+	for _, member := range members {
+		if options.matches(member) {
+			score, _ := z.score(member)
+			results = append(results, member, formatDouble(score))
+		}
+	}
+
+	return encodeScanReply(cursor, results), nil
+}
+
+func init() {
+	registerCommands(
+		&commandSpec{
+			Name: "zadd", Arity: -4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist.",
+			Since: "1.2.0", Handler: handleZAdd,
+		},
+		&commandSpec{
+			Name: "zincrby", Arity: 4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Increments the score of a member in a sorted set.", Since: "1.2.0",
+			Handler: handleZAdd,
+		},
+		&commandSpec{
+			Name: "zrem", Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Removes one or more members from a sorted set. Deletes the sorted set if all members were removed.",
+			Since: "1.2.0", Handler: handleZRem,
+		},
+		&commandSpec{
+			Name: "zscore", Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns the score of a member in a sorted set.", Since: "1.2.0",
+			Handler: handleZScore,
+		},
+		&commandSpec{
+			Name: "zmscore", Arity: -3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns the score of one or more members in a sorted set.", Since: "6.2.0",
+			Handler: handleZMScore,
+		},
+		&commandSpec{
+			Name: "zcard", Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns the number of members in a sorted set.", Since: "1.2.0",
+			Handler: handleZCard,
+		},
+		&commandSpec{
+			Name: "zcount", Arity: 4, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns the count of members in a sorted set that have scores within a range.", Since: "2.0.0",
+			Handler: handleZCount,
+		},
+		&commandSpec{
+			Name: "zlexcount", Arity: 4, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns the number of members in a sorted set within a lexicographical range.", Since: "2.8.9",
+			Handler: handleZCount,
+		},
+		&commandSpec{
+			Name: "zrank", Arity: -3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns the index of a member in a sorted set ordered by ascending scores.", Since: "2.0.0",
+			Handler: handleZRank,
+		},
+		&commandSpec{
+			Name: "zrevrank", Arity: -3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns the index of a member in a sorted set ordered by descending scores.", Since: "2.0.0",
+			Handler: handleZRank,
+		},
+		&commandSpec{
+			Name: "zrange", Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns members in a sorted set within a range of indexes.", Since: "1.2.0",
+			Handler: handleZRange,
+		},
+		&commandSpec{
+			Name: "zrangestore", Arity: -5, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "sorted_set", Summary: "Stores a range of members from sorted set in a key.", Since: "6.2.0",
+			Handler: handleZRange,
+		},
+		&commandSpec{
+			Name: "zrevrange", Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns members in a sorted set within a range of indexes in reverse order.", Since: "1.2.0",
+			Handler: handleZRange,
+		},
+		&commandSpec{
+			Name: "zrangebyscore", Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns members in a sorted set within a range of scores.", Since: "1.0.5",
+			Handler: handleZRange,
+		},
+		&commandSpec{
+			Name: "zrevrangebyscore", Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns members in a sorted set within a range of scores in reverse order.", Since: "2.2.0",
+			Handler: handleZRange,
+		},
+		&commandSpec{
+			Name: "zrangebylex", Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns members in a sorted set within a lexicographical range.", Since: "2.8.9",
+			Handler: handleZRange,
+		},
+		&commandSpec{
+			Name: "zrevrangebylex", Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns members in a sorted set within a lexicographical range in reverse order.", Since: "2.8.9",
+			Handler: handleZRange,
+		},
+		&commandSpec{
+			Name: "zremrangebyrank", Arity: 4, Flags: []string{"write"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Removes members in a sorted set within a range of indexes. Deletes the sorted set if all members were removed.",
+			Since: "2.0.0", Handler: handleZRemRange,
+		},
+		&commandSpec{
+			Name: "zremrangebyscore", Arity: 4, Flags: []string{"write"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Removes members in a sorted set within a range of scores. Deletes the sorted set if all members were removed.",
+			Since: "1.2.0", Handler: handleZRemRange,
+		},
+		&commandSpec{
+			Name: "zremrangebylex", Arity: 4, Flags: []string{"write"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Removes members in a sorted set within a lexicographical range. Deletes the sorted set if all members were removed.",
+			Since: "2.8.9", Handler: handleZRemRange,
+		},
+		&commandSpec{
+			Name: "zpopmin", Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns the lowest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.",
+			Since: "5.0.0", Handler: handleZPop,
+		},
+		&commandSpec{
+			Name: "zpopmax", Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Returns the highest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.",
+			Since: "5.0.0", Handler: handleZPop,
+		},
+		&commandSpec{
+			Name: "zmpop", Arity: -4, Flags: []string{"write"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "sorted_set", Summary: "Returns the highest- or lowest-scoring members from one or more sorted sets after removing them. Deletes the sorted set if the last member was popped.",
+			Since: "7.0.0", Handler: handleZMPop,
+		},
+		&commandSpec{
+			Name: "bzpopmin", Arity: -3, Flags: []string{"write", "fast", "blocking"}, FirstKey: 1, LastKey: -2, KeyStep: 1,
+			Group: "sorted_set", Summary: "Removes and returns the member with the lowest score from one or more sorted sets. Blocks until a member is available otherwise. Deletes the sorted set if the last element was popped.",
+			Since: "5.0.0", Handler: handleBlockingZPop,
+		},
+		&commandSpec{
+			Name: "bzpopmax", Arity: -3, Flags: []string{"write", "fast", "blocking"}, FirstKey: 1, LastKey: -2, KeyStep: 1,
+			Group: "sorted_set", Summary: "Removes and returns the member with the highest score from one or more sorted sets. Blocks until a member available otherwise.  Deletes the sorted set if the last element was popped.",
+			Since: "5.0.0", Handler: handleBlockingZPop,
+		},
+		&commandSpec{
+			Name: "bzmpop", Arity: -5, Flags: []string{"write", "blocking"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "sorted_set", Summary: "Removes and returns a member by score from one or more sorted sets. Blocks until a member is available otherwise. Deletes the sorted set if the last element was popped.",
+			Since: "7.0.0", Handler: handleBlockingZMPop,
+		},
+		&commandSpec{
+			Name: "zunion", Arity: -3, Flags: []string{"readonly"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "sorted_set", Summary: "Returns the union of multiple sorted sets.", Since: "6.2.0",
+			Handler: handleZSetOperation,
+		},
+		&commandSpec{
+			Name: "zunionstore", Arity: -4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Stores the union of multiple sorted sets in a key.", Since: "2.0.0",
+			Handler: handleZSetOperation,
+		},
+		&commandSpec{
+			Name: "zinter", Arity: -3, Flags: []string{"readonly"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "sorted_set", Summary: "Returns the intersect of multiple sorted sets.", Since: "6.2.0",
+			Handler: handleZSetOperation,
+		},
+		&commandSpec{
+			Name: "zinterstore", Arity: -4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Stores the intersect of multiple sorted sets in a key.", Since: "2.0.0",
+			Handler: handleZSetOperation,
+		},
+		&commandSpec{
+			Name: "zintercard", Arity: -3, Flags: []string{"readonly"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "sorted_set", Summary: "Returns the number of members of the intersect of multiple sorted sets.", Since: "7.0.0",
+			Handler: handleZInterCard,
+		},
+		&commandSpec{
+			Name: "zdiff", Arity: -3, Flags: []string{"readonly"}, FirstKey: 0, LastKey: 0, KeyStep: 0,
+			Group: "sorted_set", Summary: "Returns the difference between multiple sorted sets.", Since: "6.2.0",
+			Handler: handleZSetOperation,
+		},
+		&commandSpec{
+			Name: "zdiffstore", Arity: -4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Stores the difference of multiple sorted sets in a key.", Since: "6.2.0",
+			Handler: handleZSetOperation,
+		},
+		&commandSpec{
+			Name: "zscan", Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted_set", Summary: "Iterates over members and scores of a sorted set.", Since: "2.8.0",
+			Handler: handleZScan,
+		},
+	)
+}